@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+	"heckel.io/ntfy/v2/server"
+)
+
+func init() {
+	commands = append(commands, cmdAttachmentKey)
+}
+
+var flagsAttachmentKeyRotate = append(
+	append([]cli.Flag{}, flagsDefault...),
+	&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"NTFY_CONFIG_FILE"}, Value: server.DefaultConfigFile, Usage: "config file"},
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-cache-dir", Aliases: []string{"attachment_cache_dir"}, EnvVars: []string{"NTFY_ATTACHMENT_CACHE_DIR"}, Usage: "cache directory for attached files"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-encryption-key", Aliases: []string{"attachment_encryption_key"}, EnvVars: []string{"NTFY_ATTACHMENT_ENCRYPTION_KEY"}, Usage: "current (old) attachment encryption key"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-encryption-key-file", Aliases: []string{"attachment_encryption_key_file"}, EnvVars: []string{"NTFY_ATTACHMENT_ENCRYPTION_KEY_FILE"}, Usage: "file containing the current (old) attachment encryption key"}),
+	&cli.StringFlag{Name: "new-key", Usage: "new attachment encryption key"},
+	&cli.StringFlag{Name: "new-key-file", Usage: "file containing the new attachment encryption key"},
+)
+
+var cmdAttachmentKey = &cli.Command{
+	Name:     "attachment-key",
+	Usage:    "Generate or rotate the attachment encryption key",
+	Category: categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "generate",
+			Usage:     "Generate a new attachment encryption key",
+			UsageText: "coop attachment-key generate",
+			Action:    execAttachmentKeyGenerate,
+			Description: `Generate a random key to encrypt attachments and avatars at rest.
+
+Store the key in a file (readable only by the server user), and point to it via
+attachment-encryption-key-file in the server.yml file. Losing the key means losing
+all encrypted attachments and avatars.
+
+Example:
+  coop attachment-key generate > /etc/ntfy/attachment.key`,
+		},
+		{
+			Name:      "rotate",
+			Usage:     "Re-wrap all attachment data keys with a new key",
+			UsageText: "coop attachment-key rotate --new-key-file FILE",
+			Action:    execAttachmentKeyRotate,
+			Flags:     flagsAttachmentKeyRotate,
+			Before:    initConfigFileInputSourceFunc("config", flagsAttachmentKeyRotate, initLogFunc),
+			Description: `Re-wrap the data keys of all encrypted attachments and avatars with a new master key.
+
+The current key and attachment cache directory are read from the server.yml file (or the
+given flags). Only file headers are rewritten, not the file contents. Files that already
+use the new key are skipped, so the command can safely be run again if interrupted.
+After the rotation, configure the new key and restart the server.
+
+Rotation only works for the attachment cache directory. Files stored in S3 (attachment-s3-url)
+cannot be rotated with this command yet.
+
+Example:
+  coop attachment-key generate > /etc/ntfy/attachment.key.new
+  coop attachment-key rotate --new-key-file /etc/ntfy/attachment.key.new`,
+		},
+	},
+}
+
+func execAttachmentKeyGenerate(c *cli.Context) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
+func execAttachmentKeyRotate(c *cli.Context) error {
+	cacheDir := c.String("attachment-cache-dir")
+	if cacheDir == "" {
+		return errors.New("attachment-cache-dir must be set")
+	}
+	oldKey, err := readAttachmentEncryptionKey(c.String("attachment-encryption-key"), c.String("attachment-encryption-key-file"))
+	if err != nil {
+		return err
+	} else if oldKey == nil {
+		return errors.New("attachment-encryption-key or attachment-encryption-key-file must be set")
+	}
+	newKey, err := readAttachmentEncryptionKey(c.String("new-key"), c.String("new-key-file"))
+	if err != nil {
+		return err
+	} else if newKey == nil {
+		return errors.New("new-key or new-key-file must be set")
+	}
+	rotated, err := server.RotateAttachmentEncryptionKey(cacheDir, oldKey, newKey)
+	if err != nil {
+		return fmt.Errorf("rotation failed after %d file(s): %w", rotated, err)
+	}
+	fmt.Fprintf(c.App.ErrWriter, "re-wrapped data keys of %d file(s)\n", rotated)
+	return nil
+}
+
+// readAttachmentEncryptionKey decodes a base64-encoded attachment encryption key, either given directly, or read
+// from a file. It returns nil if neither is set.
+func readAttachmentEncryptionKey(key, keyFile string) ([]byte, error) {
+	if key != "" && keyFile != "" {
+		return nil, errors.New("either the attachment encryption key or the key file can be set, not both")
+	} else if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read attachment encryption key file: %w", err)
+		}
+		key = strings.TrimSpace(string(b))
+	}
+	if key == "" {
+		return nil, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return nil, errors.New("invalid attachment encryption key, must be 32 bytes, base64-encoded (see 'coop attachment-key generate')")
+	}
+	return decoded, nil
+}
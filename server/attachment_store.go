@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io"
+	"path/filepath"
+	"time"
+
+	"heckel.io/ntfy/v2/util"
+)
+
+// attachmentStore stores attachments and avatars. The file system implementation (fileCache) is the default;
+// s3Store stores files in an S3-compatible object store. Files are encrypted at rest if a cipher is configured.
+type attachmentStore interface {
+	// Write stores a file, and returns its (plaintext) size. Writing fails if any of the limiters is exceeded.
+	Write(id string, in io.Reader, limiters ...util.Limiter) (int64, error)
+
+	// Read reads length bytes of a file, starting at offset. A negative length reads until the end of the file.
+	Read(id string, offset, length int64) (io.ReadCloser, error)
+
+	// Stat returns the (plaintext) size of a file, or an error wrapping fs.ErrNotExist if it does not exist
+	Stat(id string) (int64, error)
+
+	// Rename moves a file to a new ID. A file with the new ID is replaced.
+	Rename(id, newID string) error
+
+	// Remove deletes the given files. Files that do not exist are ignored.
+	Remove(ids ...string) error
+
+	// Size returns the total size of all stored files
+	Size() int64
+
+	// Remaining returns the number of bytes that can still be stored before the total size limit is reached
+	Remaining() int64
+}
+
+// attachmentPresigner is implemented by stores that can hand out time-limited URLs, so that clients can
+// download files directly from the store instead of through the server
+type attachmentPresigner interface {
+	PresignedURL(id, filename, contentType string, expiry time.Duration) (string, error)
+}
+
+// newAttachmentStores creates the stores for attachments and avatars. Files are stored in S3 if an S3 URL is
+// configured, or in the attachment cache directory otherwise. If neither is configured, both stores are nil.
+func newAttachmentStores(conf *Config, cipher *fileCipher) (attachments attachmentStore, avatars attachmentStore, err error) {
+	if conf.AttachmentS3URL != "" {
+		s3Config, err := parseS3URL(conf.AttachmentS3URL)
+		if err != nil {
+			return nil, nil, err
+		}
+		attachmentStore, err := newS3AttachmentStore(s3Config, conf.AttachmentTotalSizeLimit, cipher)
+		if err != nil {
+			return nil, nil, err
+		}
+		avatarStore, err := newS3Store(s3Config, avatarDirName+"/", avatarIDRegex, avatarTotalSizeLimit, cipher)
+		if err != nil {
+			return nil, nil, err
+		}
+		return attachmentStore, avatarStore, nil
+	} else if conf.AttachmentCacheDir != "" {
+		fileCache, err := newFileCache(conf.AttachmentCacheDir, conf.AttachmentTotalSizeLimit, cipher)
+		if err != nil {
+			return nil, nil, err
+		}
+		avatarStore, err := newFileStore(filepath.Join(conf.AttachmentCacheDir, avatarDirName), avatarIDRegex, avatarTotalSizeLimit, cipher)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileCache, avatarStore, nil
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+// s3Store is an attachmentStore that keeps files in an S3-compatible object store. Files are streamed to the
+// store (using multipart uploads for large files), and read with ranged GET requests.
+type s3Store struct {
+	client           *s3Client
+	prefix           string         // Key prefix, including the prefix of the S3 URL
+	idRegex          *regexp.Regexp // Valid file IDs
+	cipher           *fileCipher    // Encrypts files at rest, may be nil
+	metrics          bool           // Report the total size as attachment metric
+	totalSizeCurrent int64
+	totalSizeLimit   int64
+	mu               sync.Mutex
+}
+
+var (
+	_ attachmentStore     = (*s3Store)(nil)
+	_ attachmentPresigner = (*s3Store)(nil)
+)
+
+func newS3AttachmentStore(config *s3Config, totalSizeLimit int64, cipher *fileCipher) (*s3Store, error) {
+	s, err := newS3Store(config, "", fileIDRegex, totalSizeLimit, cipher)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics = true
+	return s, nil
+}
+
+// newS3Store creates a store for files with IDs matching idRegex, below the given prefix of the bucket. The
+// current total size is determined by listing the existing objects.
+func newS3Store(config *s3Config, prefix string, idRegex *regexp.Regexp, totalSizeLimit int64, cipher *fileCipher) (*s3Store, error) {
+	client := newS3Client(config)
+	prefix = config.Prefix + prefix
+	size, err := client.ListSize(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{
+		client:           client,
+		prefix:           prefix,
+		idRegex:          idRegex,
+		cipher:           cipher,
+		totalSizeCurrent: size,
+		totalSizeLimit:   totalSizeLimit,
+	}, nil
+}
+
+func (s *s3Store) Write(id string, in io.Reader, limiters ...util.Limiter) (int64, error) {
+	if !s.idRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	log.Tag(tagFileCache).Field("message_id", id).Debug("Writing attachment to S3")
+	if _, err := s.client.HeadObject(s.key(id)); err == nil {
+		return 0, errFileExists
+	}
+	limiters = append(limiters, util.NewFixedLimiter(s.Remaining()))
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var size int64
+	var writeErr error
+	go func() {
+		defer close(done)
+		size, writeErr = s.encrypt(pw, in, limiters...)
+		pw.CloseWithError(writeErr) // Fails the upload if writeErr is not nil
+	}()
+	stored, err := s.client.Upload(s.key(id), pr)
+	pr.CloseWithError(err) // Unblocks the writer if the upload failed
+	<-done
+	if writeErr != nil {
+		return 0, writeErr // More relevant than the upload error, e.g. util.ErrLimitReached
+	} else if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.totalSizeCurrent += stored
+	if s.metrics {
+		mset(metricAttachmentsTotalSize, s.totalSizeCurrent)
+	}
+	s.mu.Unlock()
+	return size, nil
+}
+
+// encrypt copies the plaintext from in to w, encrypting it if a cipher is configured, and returns the plaintext size
+func (s *s3Store) encrypt(w io.Writer, in io.Reader, limiters ...util.Limiter) (int64, error) {
+	var f io.WriteCloser = &nopWriteCloser{Writer: w}
+	if s.cipher != nil {
+		var err error
+		if f, err = s.cipher.Writer(w); err != nil {
+			return 0, err
+		}
+	}
+	size, err := io.Copy(util.NewLimitWriter(f, limiters...), in)
+	if err != nil {
+		return 0, err
+	}
+	return size, f.Close()
+}
+
+func (s *s3Store) Read(id string, offset, length int64) (io.ReadCloser, error) {
+	if !s.idRegex.MatchString(id) {
+		return nil, errInvalidFileID
+	}
+	return readAtRest(s.cipher, s.rangeOpener(id), offset, length)
+}
+
+func (s *s3Store) Stat(id string) (int64, error) {
+	if !s.idRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	f, size, err := s.client.GetObject(s.key(id), 0, int64(fileCipherHeaderSize))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header, err := readHeaderAtRest(func(int64, int64) (io.ReadCloser, error) { return f, nil })
+	if err != nil {
+		return 0, err
+	}
+	return sizeAtRest(header, size), nil
+}
+
+func (s *s3Store) Rename(id, newID string) error {
+	if !s.idRegex.MatchString(id) || !s.idRegex.MatchString(newID) {
+		return errInvalidFileID
+	}
+	log.Tag(tagFileCache).Field("message_id", id).Debug("Renaming attachment in S3 to %s", newID)
+	if err := s.client.CopyObject(s.key(id), s.key(newID)); err != nil {
+		return err
+	}
+	return s.client.DeleteObject(s.key(id))
+}
+
+func (s *s3Store) Remove(ids ...string) error {
+	for _, id := range ids {
+		if !s.idRegex.MatchString(id) {
+			return errInvalidFileID
+		}
+		log.Tag(tagFileCache).Field("message_id", id).Debug("Deleting attachment from S3")
+		size, err := s.client.HeadObject(s.key(id))
+		if err != nil {
+			log.Tag(tagFileCache).Field("message_id", id).Err(err).Debug("Error deleting attachment")
+			continue
+		}
+		if err := s.client.DeleteObject(s.key(id)); err != nil {
+			log.Tag(tagFileCache).Field("message_id", id).Err(err).Debug("Error deleting attachment")
+			continue
+		}
+		s.mu.Lock()
+		s.totalSizeCurrent = max(s.totalSizeCurrent-size, 0)
+		s.mu.Unlock()
+	}
+	if s.metrics {
+		mset(metricAttachmentsTotalSize, s.Size())
+	}
+	return nil
+}
+
+func (s *s3Store) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalSizeCurrent
+}
+
+func (s *s3Store) Remaining() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remaining := s.totalSizeLimit - s.totalSizeCurrent
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// PresignedURL returns a URL to download a file directly from the object store. Encrypted files must be
+// decrypted by the server, so this must only be used if no cipher is configured.
+func (s *s3Store) PresignedURL(id, filename, contentType string, expiry time.Duration) (string, error) {
+	if !s.idRegex.MatchString(id) {
+		return "", errInvalidFileID
+	}
+	query := url.Values{}
+	if filename != "" {
+		query.Set("response-content-disposition", "attachment; filename="+strconv.Quote(filename))
+	}
+	if contentType != "" {
+		query.Set("response-content-type", contentType)
+	}
+	return s.client.PresignedURL(s.key(id), query, expiry), nil
+}
+
+func (s *s3Store) key(id string) string {
+	return s.prefix + id
+}
+
+func (s *s3Store) rangeOpener(id string) rangeOpener {
+	return func(offset, length int64) (io.ReadCloser, error) {
+		f, _, err := s.client.GetObject(s.key(id), offset, length)
+		return f, err
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (w *nopWriteCloser) Close() error {
+	return nil
+}
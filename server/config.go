@@ -41,18 +41,64 @@ const (
 	DefaultWebPushExpiryDuration        = 60 * 24 * time.Hour
 )
 
+// Defines default OpenID Connect (single sign-on) settings
+const (
+	DefaultAuthOIDCUsernameClaim = "preferred_username"
+	DefaultAuthOIDCGroupsClaim   = "groups"
+)
+
+// Defines default security response header settings. In the Content-Security-Policy, "{nonce}"
+// is replaced with a random nonce for every request, which is also added to the web app's script tags.
+const (
+	DefaultContentSecurityPolicy         = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob: https:; media-src 'self' data: blob: https:; connect-src 'self' https: wss:; worker-src 'self'; manifest-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'"
+	DefaultStrictTransportSecurityMaxAge = 365 * 24 * time.Hour
+	DefaultXFrameOptions                 = "DENY"
+	DefaultReferrerPolicy                = "strict-origin-when-cross-origin"
+	DefaultPermissionsPolicy             = "camera=(), microphone=(), geolocation=(), payment=(), usb=()"
+)
+
+// Attachments with the same contents are stored only once. These policies define how they are counted
+// towards the attachment total size limit of a user (or visitor):
+// - upload: every upload counts, even if the contents were uploaded before (default)
+// - unique: attachments with the same contents count only once per user
+const (
+	AttachmentQuotaPolicyUpload = "upload"
+	AttachmentQuotaPolicyUnique = "unique"
+)
+
+// DefaultAuthOIDCScopes are the scopes requested from the OpenID provider
+var DefaultAuthOIDCScopes = []string{"openid", "profile", "email"}
+
 // Defines all global and per-visitor limits
 // - message size limit: the max number of bytes for a message
 // - total topic limit: max number of topics overall
 // - various attachment limits
 const (
-	DefaultMessageSizeLimit         = 4096 // Bytes; note that FCM/APNS have a limit of ~4 KB for the entire message
+	DefaultMessageSizeLimit         = 4096       // Bytes; note that FCM/APNS have a limit of ~4 KB for the entire message
+	DefaultEnvelopeSizeLimit        = 256 * 1024 // Bytes; encrypted message envelopes contain one ciphertext per recipient device
 	DefaultTotalTopicLimit          = 15000
 	DefaultAttachmentTotalSizeLimit = int64(5 * 1024 * 1024 * 1024) // 5 GB
 	DefaultAttachmentFileSizeLimit  = int64(15 * 1024 * 1024)       // 15 MB
+	DefaultKeyBackupSizeLimit       = int64(1024 * 1024)            // 1 MB; encrypted E2E key backup blobs
 	DefaultAttachmentExpiryDuration = 0 // Coop: Attachments are persistent by default
+	DefaultAttachmentURLExpiry      = time.Hour
 )
 
+// DefaultAttachmentBlobGracePeriod is how long an attachment blob is kept after it was last used, even if no
+// message references it anymore
+const DefaultAttachmentBlobGracePeriod = 10 * time.Minute
+
+// DefaultAttachmentUploadExpiry is how long an incomplete resumable upload is kept after its last chunk
+const DefaultAttachmentUploadExpiry = 24 * time.Hour
+
+// DefaultDMRequestMessageLimit is how many messages a user can send in a DM with a non-contact (a message request),
+// before the recipient accepted the request
+const DefaultDMRequestMessageLimit = 3
+
+// DefaultContactLimit is how many contact lookups (by username or phone number) and contact requests a user can
+// make per day, via POST /v1/coop/contacts and the vCard import
+const DefaultContactLimit = 200
+
 // Defines all per-visitor limits
 // - per visitor subscription limit: max number of subscriptions (active HTTP connections) per per-visitor/IP
 // - per visitor request limit: max number of PUT/GET/.. requests (here: 60 requests bucket, replenished at a rate of one per 5 seconds)
@@ -109,11 +155,44 @@ type Config struct {
 	AuthTokens                           map[string][]*user.Token
 	AuthBcryptCost                       int
 	AuthStatsQueueWriterInterval         time.Duration
+	AuthLoginFailureLimit                int
+	AuthLoginLockDuration                time.Duration
+	AuthLoginLockMaxDuration             time.Duration
+	AuthPasswordMinLength                int
+	AuthPasswordMinClasses               int
+	AuthPasswordDisallowUsername         bool
+	AuthPasswordBreachedDir              string
+	AuthOIDCIssuer                       string
+	AuthOIDCClientID                     string
+	AuthOIDCClientSecret                 string
+	AuthOIDCScopes                       []string
+	AuthOIDCUsernameClaim                string
+	AuthOIDCGroupsClaim                  string
+	AuthOIDCAdminGroups                  []string
+	AuthOIDCTierGroups                   []user.TierGroup // IdP group -> tier code, in order of precedence
+	AuthLDAPURL                          string
+	AuthLDAPStartTLS                     bool
+	AuthLDAPBindDN                       string
+	AuthLDAPBindPassword                 string
+	AuthLDAPBaseDN                       string
+	AuthLDAPUserFilter                   string
+	AuthLDAPGroupAttribute               string
+	AuthLDAPDisplayNameAttribute         string
+	AuthLDAPAvatarAttribute              string
+	AuthLDAPAdminGroups                  []string
+	AuthLDAPTierGroups                   []user.TierGroup // LDAP group (name or DN) -> tier code, in order of precedence
 	AttachmentCacheDir                   string
+	AttachmentEncryptionKey              []byte // 32 byte master key to encrypt attachments and avatars at rest (optional)
+	AttachmentS3URL                      string // Store attachments and avatars in an S3 bucket instead of AttachmentCacheDir (optional)
 	AttachmentTotalSizeLimit             int64
 	AttachmentFileSizeLimit              int64
 	AttachmentExpiryDuration             time.Duration
-	TemplateDir                          string // Directory to load named templates from
+	AttachmentURLSecret                  string        // Key for signed attachment URLs (random per process if empty)
+	AttachmentURLExpiry                  time.Duration // Validity of signed attachment URLs
+	AttachmentQuotaPolicy                string        // How deduplicated attachments count towards the quota, see AttachmentQuotaPolicyUpload
+	AttachmentBlobGracePeriod            time.Duration // Messages reference a blob before they are written to the cache, see CacheBatchTimeout
+	AttachmentUploadExpiry               time.Duration // Incomplete resumable uploads are deleted after this duration without a chunk
+	TemplateDir                          string        // Directory to load named templates from
 	KeepaliveInterval                    time.Duration
 	ManagerInterval                      time.Duration
 	DisallowedTopics                     []string
@@ -144,6 +223,10 @@ type Config struct {
 	MessageDelayMin                      time.Duration
 	MessageDelayMax                      time.Duration
 	MessageSizeLimit                     int
+	EnvelopeSizeLimit                    int
+	KeyBackupSizeLimit                   int64
+	DMRequestMessageLimit                int // Messages a non-contact can send in a DM before the recipient accepts
+	ContactLimit                         int // Contact lookups and contact requests per user and day
 	TotalTopicLimit                      int
 	TotalAttachmentSizeLimit             int64
 	VisitorSubscriptionLimit             int
@@ -175,7 +258,13 @@ type Config struct {
 	RequireLogin                         bool
 	EnableReservations                   bool // Allow users with role "user" to own/reserve topics
 	EnableMetrics                        bool
-	AccessControlAllowOrigin             string // CORS header field to restrict access from web clients
+	AccessControlAllowOrigins            []string      // CORS: origins allowed to access the API from web clients, "*" allows all origins
+	AccessControlAllowCredentials        bool          // CORS: allow cross-origin requests with credentials (cookies), requires explicit origins
+	ContentSecurityPolicy                string        // Content-Security-Policy header, "{nonce}" is replaced with a per-request nonce (empty to disable)
+	StrictTransportSecurityMaxAge        time.Duration // Strict-Transport-Security max-age, only sent if HTTPS is used (zero to disable)
+	XFrameOptions                        string        // X-Frame-Options header (empty to disable)
+	ReferrerPolicy                       string        // Referrer-Policy header (empty to disable)
+	PermissionsPolicy                    string        // Permissions-Policy header (empty to disable)
 	WebPushPrivateKey                    string
 	WebPushPublicKey                     string
 	WebPushFile                          string
@@ -210,10 +299,42 @@ func NewConfig() *Config {
 		AuthDefault:                          user.PermissionReadWrite,
 		AuthBcryptCost:                       user.DefaultUserPasswordBcryptCost,
 		AuthStatsQueueWriterInterval:         user.DefaultUserStatsQueueWriterInterval,
+		AuthLoginFailureLimit:                user.DefaultLoginFailureLimit,
+		AuthLoginLockDuration:                user.DefaultLoginLockDuration,
+		AuthLoginLockMaxDuration:             user.DefaultLoginLockMaxDuration,
+		AuthPasswordMinLength:                user.DefaultPasswordMinLength,
+		AuthPasswordMinClasses:               0,
+		AuthPasswordDisallowUsername:         true,
+		AuthPasswordBreachedDir:              "",
+		AuthOIDCIssuer:                       "",
+		AuthOIDCClientID:                     "",
+		AuthOIDCClientSecret:                 "",
+		AuthOIDCScopes:                       DefaultAuthOIDCScopes,
+		AuthOIDCUsernameClaim:                DefaultAuthOIDCUsernameClaim,
+		AuthOIDCGroupsClaim:                  DefaultAuthOIDCGroupsClaim,
+		AuthOIDCAdminGroups:                  nil,
+		AuthOIDCTierGroups:                   nil,
+		AuthLDAPURL:                          "",
+		AuthLDAPStartTLS:                     false,
+		AuthLDAPBindDN:                       "",
+		AuthLDAPBindPassword:                 "",
+		AuthLDAPBaseDN:                       "",
+		AuthLDAPUserFilter:                   user.DefaultLDAPUserFilter,
+		AuthLDAPGroupAttribute:               user.DefaultLDAPGroupAttribute,
+		AuthLDAPDisplayNameAttribute:         user.DefaultLDAPDisplayNameAttribute,
+		AuthLDAPAvatarAttribute:              user.DefaultLDAPAvatarAttribute,
+		AuthLDAPAdminGroups:                  nil,
+		AuthLDAPTierGroups:                   nil,
 		AttachmentCacheDir:                   "",
+		AttachmentS3URL:                      "",
 		AttachmentTotalSizeLimit:             DefaultAttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:              DefaultAttachmentFileSizeLimit,
 		AttachmentExpiryDuration:             DefaultAttachmentExpiryDuration,
+		AttachmentURLSecret:                  "",
+		AttachmentURLExpiry:                  DefaultAttachmentURLExpiry,
+		AttachmentQuotaPolicy:                AttachmentQuotaPolicyUpload,
+		AttachmentBlobGracePeriod:            DefaultAttachmentBlobGracePeriod,
+		AttachmentUploadExpiry:               DefaultAttachmentUploadExpiry,
 		TemplateDir:                          DefaultTemplateDir,
 		KeepaliveInterval:                    DefaultKeepaliveInterval,
 		ManagerInterval:                      DefaultManagerInterval,
@@ -240,6 +361,10 @@ func NewConfig() *Config {
 		TwilioVerifyService:                  "",
 		TwilioCallFormat:                     nil,
 		MessageSizeLimit:                     DefaultMessageSizeLimit,
+		EnvelopeSizeLimit:                    DefaultEnvelopeSizeLimit,
+		KeyBackupSizeLimit:                   DefaultKeyBackupSizeLimit,
+		DMRequestMessageLimit:                DefaultDMRequestMessageLimit,
+		ContactLimit:                         DefaultContactLimit,
 		MessageDelayMin:                      DefaultMessageDelayMin,
 		MessageDelayMax:                      DefaultMessageDelayMax,
 		TotalTopicLimit:                      DefaultTotalTopicLimit,
@@ -271,7 +396,13 @@ func NewConfig() *Config {
 		EnableLogin:                          false,
 		EnableReservations:                   false,
 		RequireLogin:                         false,
-		AccessControlAllowOrigin:             "*",
+		AccessControlAllowOrigins:            []string{"*"},
+		AccessControlAllowCredentials:        false,
+		ContentSecurityPolicy:                DefaultContentSecurityPolicy,
+		StrictTransportSecurityMaxAge:        DefaultStrictTransportSecurityMaxAge,
+		XFrameOptions:                        DefaultXFrameOptions,
+		ReferrerPolicy:                       DefaultReferrerPolicy,
+		PermissionsPolicy:                    DefaultPermissionsPolicy,
 		WebPushPrivateKey:                    "",
 		WebPushPublicKey:                     "",
 		WebPushFile:                          "",
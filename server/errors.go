@@ -142,9 +142,27 @@ var (
 	errHTTPBadRequestTemplateFileNotFound            = &errHTTP{40047, http.StatusBadRequest, "invalid request: template file not found", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestTemplateFileInvalid             = &errHTTP{40048, http.StatusBadRequest, "invalid request: template file invalid", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestSequenceIDInvalid               = &errHTTP{40049, http.StatusBadRequest, "invalid request: sequence ID invalid", "https://ntfy.sh/docs/publish/#updating-deleting-notifications", nil}
+	errHTTPBadRequestPasswordTooShort                = &errHTTP{40054, http.StatusBadRequest, "invalid request: password too short", "", nil}
+	errHTTPBadRequestPasswordTooSimple               = &errHTTP{40055, http.StatusBadRequest, "invalid request: password must contain more character classes (lowercase, uppercase, digits, symbols)", "", nil}
+	errHTTPBadRequestPasswordContainsUsername        = &errHTTP{40056, http.StatusBadRequest, "invalid request: password must not contain the username", "", nil}
+	errHTTPBadRequestPasswordBreached                = &errHTTP{40057, http.StatusBadRequest, "invalid request: password appears in a list of breached passwords", "", nil}
+	errHTTPBadRequestDeviceKeysInvalid               = &errHTTP{40058, http.StatusBadRequest, "invalid request: device keys invalid", "", nil}
+	errHTTPBadRequestEnvelopeInvalid                 = &errHTTP{40059, http.StatusBadRequest, "invalid request: encrypted message envelope invalid", "", nil}
+	errHTTPBadRequestKeyBackupInvalid                = &errHTTP{40060, http.StatusBadRequest, "invalid request: key backup invalid", "", nil}
+	errHTTPBadRequestAttachmentSizeInvalid           = &errHTTP{40061, http.StatusBadRequest, "invalid request: size parameter must be original, preview or thumb", "", nil}
+	errHTTPBadRequestAvatarSizeInvalid               = &errHTTP{40062, http.StatusBadRequest, "invalid request: size parameter must be 64 or 256", "", nil}
+	errHTTPBadRequestAvatarInvalid                   = &errHTTP{40063, http.StatusBadRequest, "invalid request: avatar must be a jpeg, png, webp or gif image", "", nil}
+	errHTTPBadRequestUploadInvalid                   = &errHTTP{40064, http.StatusBadRequest, "invalid request: upload filename or size invalid", "", nil}
+	errHTTPBadRequestUploadOffsetInvalid             = &errHTTP{40065, http.StatusBadRequest, "invalid request: Upload-Offset header missing or invalid", "", nil}
+	errHTTPBadRequestImageInvalid                    = &errHTTP{40066, http.StatusBadRequest, "invalid request: image is corrupt, its metadata cannot be removed", "", nil}
 	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", "", nil}
+	errHTTPNotFoundUpload                            = &errHTTP{40402, http.StatusNotFound, "upload not found or expired", "", nil}
 	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication", nil}
 	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication", nil}
+	errHTTPForbiddenKeyBackupVerifier                = &errHTTP{40302, http.StatusForbidden, "forbidden: incorrect key backup verifier", "", nil}
+	errHTTPForbiddenDMBlocked                        = &errHTTP{40303, http.StatusForbidden, "forbidden: conversation is read-only", "", nil}
+	errHTTPForbiddenDMRequestLimit                   = &errHTTP{40304, http.StatusForbidden, "forbidden: message request not accepted yet", "", nil}
+	errHTTPForbiddenUserSuspended                    = &errHTTP{40305, http.StatusForbidden, "forbidden: account suspended", "", nil}
 	errHTTPConflict                                  = &errHTTP{40900, http.StatusConflict, "conflict", "", nil}
 	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "conflict: user already exists", "", nil}
 	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "conflict: access control entry for topic or topic pattern already exists", "", nil}
@@ -152,10 +170,19 @@ var (
 	errHTTPConflictPhoneNumberExists                 = &errHTTP{40904, http.StatusConflict, "conflict: phone number already exists", "", nil}
 	errHTTPConflictProvisionedUserChange             = &errHTTP{40905, http.StatusConflict, "conflict: cannot change or delete provisioned user", "", nil}
 	errHTTPConflictProvisionedTokenChange            = &errHTTP{40906, http.StatusConflict, "conflict: cannot change or delete provisioned token", "", nil}
+	errHTTPConflictFingerprintMismatch               = &errHTTP{40907, http.StatusConflict, "conflict: fingerprint does not match the current identity key", "", nil}
+	errHTTPConflictUploadOffsetMismatch              = &errHTTP{40908, http.StatusConflict, "conflict: upload offset does not match the bytes received so far", "", nil}
+	errHTTPConflictUploadInProgress                  = &errHTTP{40909, http.StatusConflict, "conflict: another chunk of this upload is being received", "", nil}
+	errHTTPConflictUploadIncomplete                  = &errHTTP{40910, http.StatusConflict, "conflict: upload is not complete", "", nil}
+	errHTTPConflictOIDCSubjectLinked                 = &errHTTP{40911, http.StatusConflict, "conflict: single sign-on identity is already linked to another user", "", nil}
 	errHTTPGonePhoneVerificationExpired              = &errHTTP{41001, http.StatusGone, "phone number verification expired or does not exist", "", nil}
 	errHTTPEntityTooLargeAttachment                  = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPEntityTooLargeMatrixRequest               = &errHTTP{41302, http.StatusRequestEntityTooLarge, "Matrix request is larger than the max allowed length", "", nil}
 	errHTTPEntityTooLargeJSONBody                    = &errHTTP{41303, http.StatusRequestEntityTooLarge, "JSON body too large", "", nil}
+	errHTTPEntityTooLargeEnvelope                    = &errHTTP{41304, http.StatusRequestEntityTooLarge, "encrypted message envelope too large", "", nil}
+	errHTTPEntityTooLargeKeyBackup                   = &errHTTP{41305, http.StatusRequestEntityTooLarge, "key backup too large", "", nil}
+	errHTTPEntityTooLargeContactImport               = &errHTTP{41306, http.StatusRequestEntityTooLarge, "contact import too large", "", nil}
+	errHTTPRangeNotSatisfiable                       = &errHTTP{41601, http.StatusRequestedRangeNotSatisfiable, "requested range not satisfiable", "", nil}
 	errHTTPTooManyRequests                           = &errHTTP{42900, http.StatusTooManyRequests, "too many requests", "", nil}
 	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails", "https://ntfy.sh/docs/publish/#limitations", nil}
@@ -167,6 +194,14 @@ var (
 	errHTTPTooManyRequestsLimitMessages              = &errHTTP{42908, http.StatusTooManyRequests, "limit reached: daily message quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitAuthFailure           = &errHTTP{42909, http.StatusTooManyRequests, "limit reached: too many auth failures", "https://ntfy.sh/docs/publish/#limitations", nil} // FIXME document limit
 	errHTTPTooManyRequestsLimitCalls                 = &errHTTP{42910, http.StatusTooManyRequests, "limit reached: daily phone call quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
+	errHTTPTooManyRequestsLimitDevices               = &errHTTP{42912, http.StatusTooManyRequests, "limit reached: too many devices in the key directory", "", nil}
+	errHTTPTooManyRequestsLimitPrekeys               = &errHTTP{42913, http.StatusTooManyRequests, "limit reached: too many one-time prekeys for this device", "", nil}
+	errHTTPTooManyRequestsLimitKeyBackup             = &errHTTP{42914, http.StatusTooManyRequests, "limit reached: key backup temporarily locked due to too many failed attempts", "", nil}
+	errHTTPTooManyRequestsLimitUploads               = &errHTTP{42915, http.StatusTooManyRequests, "limit reached: too many incomplete uploads", "", nil}
+	errHTTPTooManyRequestsLimitContactInvites        = &errHTTP{42916, http.StatusTooManyRequests, "limit reached: too many contact invites", "", nil}
+	errHTTPTooManyRequestsLimitReports               = &errHTTP{42917, http.StatusTooManyRequests, "limit reached: too many open reports", "", nil}
+	errHTTPTooManyRequestsLimitContacts              = &errHTTP{42918, http.StatusTooManyRequests, "limit reached: daily contact lookup and request quota reached", "", nil}
+	errHTTPTooManyRequestsLimitLogins                = &errHTTP{42919, http.StatusTooManyRequests, "limit reached: too many pending single sign-on logins, please try again later", "", nil}
 	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", "", nil}
 	errHTTPInternalErrorInvalidPath                  = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid path", "", nil}
 	errHTTPInternalErrorMissingBaseURL               = &errHTTP{50003, http.StatusInternalServerError, "internal server error: base-url must be be configured for this feature", "https://ntfy.sh/docs/config/", nil}
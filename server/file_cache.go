@@ -13,19 +13,35 @@ import (
 )
 
 var (
-	fileIDRegex      = regexp.MustCompile(fmt.Sprintf(`^[-_A-Za-z0-9]{%d}$`, messageIDLength))
+	fileIDRegex      = regexp.MustCompile(fmt.Sprintf(`^([-_A-Za-z0-9]{%d}|[0-9a-f]{64})(_[a-z0-9]+)?$`, messageIDLength)) // Message/upload ID or SHA-256 (blob), optional suffix for thumbnails and upload chunks
 	errInvalidFileID = errors.New("invalid file ID")
 	errFileExists    = errors.New("file exists")
 )
 
+// fileCache is the file system based attachmentStore
 type fileCache struct {
 	dir              string
+	idRegex          *regexp.Regexp // Valid file IDs, to prevent path traversal
+	cipher           *fileCipher    // Encrypts files at rest, may be nil
+	metrics          bool           // Report the total size as attachment metric
 	totalSizeCurrent int64
 	totalSizeLimit   int64
 	mu               sync.Mutex
 }
 
-func newFileCache(dir string, totalSizeLimit int64) (*fileCache, error) {
+var _ attachmentStore = (*fileCache)(nil)
+
+func newFileCache(dir string, totalSizeLimit int64, cipher *fileCipher) (*fileCache, error) {
+	c, err := newFileStore(dir, fileIDRegex, totalSizeLimit, cipher)
+	if err != nil {
+		return nil, err
+	}
+	c.metrics = true
+	return c, nil
+}
+
+// newFileStore creates a file system based store for files with IDs matching idRegex
+func newFileStore(dir string, idRegex *regexp.Regexp, totalSizeLimit int64, cipher *fileCipher) (*fileCache, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -35,13 +51,15 @@ func newFileCache(dir string, totalSizeLimit int64) (*fileCache, error) {
 	}
 	return &fileCache{
 		dir:              dir,
+		idRegex:          idRegex,
+		cipher:           cipher,
 		totalSizeCurrent: size,
 		totalSizeLimit:   totalSizeLimit,
 	}, nil
 }
 
 func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (int64, error) {
-	if !fileIDRegex.MatchString(id) {
+	if !c.idRegex.MatchString(id) {
 		return 0, errInvalidFileID
 	}
 	log.Tag(tagFileCache).Field("message_id", id).Debug("Writing attachment")
@@ -49,7 +67,7 @@ func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (in
 	if _, err := os.Stat(file); err == nil {
 		return 0, errFileExists
 	}
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	f, err := createAtRest(c.cipher, file)
 	if err != nil {
 		return 0, err
 	}
@@ -65,16 +83,53 @@ func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (in
 		os.Remove(file)
 		return 0, err
 	}
+	stored := size
+	if c.cipher != nil {
+		stored = fileCipherEncryptedSize(size)
+	}
 	c.mu.Lock()
-	c.totalSizeCurrent += size
-	mset(metricAttachmentsTotalSize, c.totalSizeCurrent)
+	c.totalSizeCurrent += stored
+	if c.metrics {
+		mset(metricAttachmentsTotalSize, c.totalSizeCurrent)
+	}
 	c.mu.Unlock()
 	return size, nil
 }
 
+func (c *fileCache) Read(id string, offset, length int64) (io.ReadCloser, error) {
+	if !c.idRegex.MatchString(id) {
+		return nil, errInvalidFileID
+	}
+	return readAtRest(c.cipher, fileRangeOpener(filepath.Join(c.dir, id)), offset, length)
+}
+
+func (c *fileCache) Stat(id string) (int64, error) {
+	if !c.idRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	file := filepath.Join(c.dir, id)
+	stat, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+	header, err := readHeaderAtRest(fileRangeOpener(file))
+	if err != nil {
+		return 0, err
+	}
+	return sizeAtRest(header, stat.Size()), nil
+}
+
+func (c *fileCache) Rename(id, newID string) error {
+	if !c.idRegex.MatchString(id) || !c.idRegex.MatchString(newID) {
+		return errInvalidFileID
+	}
+	log.Tag(tagFileCache).Field("message_id", id).Debug("Renaming attachment to %s", newID)
+	return os.Rename(filepath.Join(c.dir, id), filepath.Join(c.dir, newID))
+}
+
 func (c *fileCache) Remove(ids ...string) error {
 	for _, id := range ids {
-		if !fileIDRegex.MatchString(id) {
+		if !c.idRegex.MatchString(id) {
 			return errInvalidFileID
 		}
 		log.Tag(tagFileCache).Field("message_id", id).Debug("Deleting attachment")
@@ -90,7 +145,9 @@ func (c *fileCache) Remove(ids ...string) error {
 	c.mu.Lock()
 	c.totalSizeCurrent = size
 	c.mu.Unlock()
-	mset(metricAttachmentsTotalSize, size)
+	if c.metrics {
+		mset(metricAttachmentsTotalSize, size)
+	}
 	return nil
 }
 
@@ -110,6 +167,26 @@ func (c *fileCache) Remaining() int64 {
 	return remaining
 }
 
+// fileRangeOpener returns a rangeOpener for the given file
+func fileRangeOpener(filename string) rangeOpener {
+	return func(offset, length int64) (io.ReadCloser, error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		if length < 0 {
+			return f, nil
+		}
+		return &atRestReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+	}
+}
+
 func dirSize(dir string) (int64, error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
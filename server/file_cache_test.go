@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/util"
+	"io"
 	"os"
 	"strings"
 	"testing"
@@ -62,9 +63,35 @@ func TestFileCache_Write_FailedAdditionalLimiter(t *testing.T) {
 	require.NoFileExists(t, dir+"/abcdefghijkl")
 }
 
+func TestFileCache_Write_Encrypted(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newFileCache(dir, 10*1024, newTestFileCipher(t, 1))
+	require.Nil(t, err)
+	size, err := c.Write("abcdefghijkl", strings.NewReader("secret file"), util.NewFixedLimiter(999))
+	require.Nil(t, err)
+	require.Equal(t, int64(11), size)
+	require.NotContains(t, readFile(t, dir+"/abcdefghijkl"), "secret file")
+	require.Equal(t, fileCipherEncryptedSize(11), c.Size())
+
+	size, err = c.Stat("abcdefghijkl")
+	require.Nil(t, err)
+	require.Equal(t, int64(11), size)
+	f, err := c.Read("abcdefghijkl", 0, -1)
+	require.Nil(t, err)
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	require.Nil(t, err)
+	require.Equal(t, "secret file", string(b))
+
+	// Limits still apply to the plaintext
+	_, err = c.Write("abcdefghijkm", bytes.NewReader(make([]byte, 1001)), util.NewFixedLimiter(1000))
+	require.Equal(t, util.ErrLimitReached, err)
+	require.NoFileExists(t, dir+"/abcdefghijkm")
+}
+
 func newTestFileCache(t *testing.T) (dir string, cache *fileCache) {
 	dir = t.TempDir()
-	cache, err := newFileCache(dir, 10*1024)
+	cache, err := newFileCache(dir, 10*1024, nil)
 	require.Nil(t, err)
 	return dir, cache
 }
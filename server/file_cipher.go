@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+// Attachments and avatars can optionally be encrypted at rest (envelope encryption). Every file gets a random
+// data key, which is wrapped with the master key (AES-256-GCM) and stored in a fixed-size header. The contents
+// are encrypted with the data key in chunks (AES-256-GCM), so that files can be encrypted and decrypted as a
+// stream. Rotating the master key only rewrites the header, never the (potentially large) file contents.
+//
+// File format:
+//
+//	magic (8) | master key ID (8) | wrap nonce (12) | wrapped data key (32+16) | chunk 0 | chunk 1 | ... | final chunk
+//
+// Each chunk holds up to fileCipherChunkSize bytes of plaintext plus the GCM tag. The nonce of a chunk is its index,
+// with the last byte set for the final chunk, so that truncated or reordered files fail to decrypt. Files without
+// the magic prefix are plaintext files written before encryption was enabled, and are read as is.
+
+const (
+	fileCipherMagic      = "COOPENC1"
+	fileCipherKeyLength  = 32 // AES-256
+	fileCipherKeyIDLen   = 8
+	fileCipherNonceLen   = 12
+	fileCipherTagLen     = 16
+	fileCipherChunkSize  = 64 * 1024
+	fileCipherHeaderSize = len(fileCipherMagic) + fileCipherKeyIDLen + fileCipherNonceLen + fileCipherKeyLength + fileCipherTagLen
+)
+
+var (
+	errFileCipherInvalidKey = errors.New("invalid encryption key, must be 32 bytes")
+	errFileCipherWrongKey   = errors.New("file is encrypted with a different master key")
+	errFileCipherNoKey      = errors.New("file is encrypted, but no encryption key is configured")
+	errFileCipherCorrupt    = errors.New("encrypted file is corrupt or truncated")
+)
+
+// fileCipher encrypts and decrypts files with data keys wrapped by a master key
+type fileCipher struct {
+	keyID []byte
+	aead  cipher.AEAD
+}
+
+func newFileCipher(key []byte) (*fileCipher, error) {
+	if len(key) != fileCipherKeyLength {
+		return nil, errFileCipherInvalidKey
+	}
+	aead, err := newFileCipherAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(key)
+	return &fileCipher{
+		keyID: hash[:fileCipherKeyIDLen],
+		aead:  aead,
+	}, nil
+}
+
+// Writer returns a writer that encrypts everything written to it with a new data key, and writes it to w.
+// Close must be called to write the final chunk; it does not close w.
+func (c *fileCipher) Writer(w io.Writer) (io.WriteCloser, error) {
+	dataKey := make([]byte, fileCipherKeyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	header, err := c.header(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newFileCipherAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &fileCipherWriter{w: w, aead: aead, buf: make([]byte, 0, fileCipherChunkSize)}, nil
+}
+
+// Reader returns a reader that decrypts the encrypted file read from r
+func (c *fileCipher) Reader(r io.Reader) (io.Reader, error) {
+	header := make([]byte, fileCipherHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errFileCipherCorrupt
+	}
+	return c.reader(header, r, 0)
+}
+
+// reader returns a reader that decrypts the chunks read from r, starting with the given chunk index
+func (c *fileCipher) reader(header []byte, r io.Reader, counter uint64) (io.Reader, error) {
+	dataKey, err := c.unwrap(header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newFileCipherAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCipherReader{r: bufio.NewReaderSize(r, fileCipherChunkSize+fileCipherTagLen), aead: aead, counter: counter}, nil
+}
+
+// header wraps the data key with the master key, and returns the file header
+func (c *fileCipher) header(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, fileCipherNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, fileCipherHeaderSize)
+	header = append(header, fileCipherMagic...)
+	header = append(header, c.keyID...)
+	header = append(header, nonce...)
+	return c.aead.Seal(header, nonce, dataKey, []byte(fileCipherMagic)), nil
+}
+
+// unwrap returns the data key from the file header
+func (c *fileCipher) unwrap(header []byte) ([]byte, error) {
+	if len(header) != fileCipherHeaderSize || !bytes.HasPrefix(header, []byte(fileCipherMagic)) {
+		return nil, errFileCipherCorrupt
+	}
+	keyID := header[len(fileCipherMagic) : len(fileCipherMagic)+fileCipherKeyIDLen]
+	if !bytes.Equal(keyID, c.keyID) {
+		return nil, errFileCipherWrongKey
+	}
+	nonce := header[len(fileCipherMagic)+fileCipherKeyIDLen : len(fileCipherMagic)+fileCipherKeyIDLen+fileCipherNonceLen]
+	wrapped := header[len(fileCipherMagic)+fileCipherKeyIDLen+fileCipherNonceLen:]
+	dataKey, err := c.aead.Open(nil, nonce, wrapped, []byte(fileCipherMagic))
+	if err != nil {
+		return nil, errFileCipherCorrupt
+	}
+	return dataKey, nil
+}
+
+// rewrap re-wraps the data key of the given file with the master key of another cipher, by rewriting the
+// file header in place. It returns false if the file is not encrypted, or already uses the new master key.
+func (c *fileCipher) rewrap(filename string, to *fileCipher) (bool, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, fileCipherHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.HasPrefix(header, []byte(fileCipherMagic)) {
+		return false, nil // Plaintext file
+	} else if bytes.Equal(header[len(fileCipherMagic):len(fileCipherMagic)+fileCipherKeyIDLen], to.keyID) {
+		return false, nil // Already rotated
+	}
+	dataKey, err := c.unwrap(header)
+	if err != nil {
+		return false, err
+	}
+	newHeader, err := to.header(dataKey)
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.WriteAt(newHeader, 0); err != nil {
+		return false, err
+	}
+	return true, f.Sync()
+}
+
+type fileCipherWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (w *fileCipherWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), fileCipherChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		if len(p) > 0 { // Only seal a full chunk once more data follows, so that the last chunk can be marked as final
+			if err := w.seal(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *fileCipherWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+func (w *fileCipherWriter) seal(final bool) error {
+	ciphertext := w.aead.Seal(nil, fileCipherChunkNonce(w.counter, final), w.buf, nil)
+	if _, err := w.w.Write(ciphertext); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.counter++
+	return nil
+}
+
+type fileCipherReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	chunk   []byte
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+func (r *fileCipherReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *fileCipherReader) open() error {
+	if r.chunk == nil {
+		r.chunk = make([]byte, fileCipherChunkSize+fileCipherTagLen)
+	}
+	n, err := io.ReadFull(r.r, r.chunk)
+	if errors.Is(err, io.EOF) {
+		return errFileCipherCorrupt // Final chunk missing
+	} else if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	final := err != nil
+	if !final {
+		if _, err := r.r.Peek(1); errors.Is(err, io.EOF) {
+			final = true
+		}
+	}
+	plaintext, err := r.aead.Open(r.chunk[:0], fileCipherChunkNonce(r.counter, final), r.chunk[:n], nil)
+	if err != nil {
+		return errFileCipherCorrupt
+	}
+	r.buf = plaintext
+	r.counter++
+	r.done = final
+	return nil
+}
+
+func newFileCipherAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func fileCipherChunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, fileCipherNonceLen)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if final {
+		nonce[fileCipherNonceLen-1] = 1
+	}
+	return nonce
+}
+
+// fileCipherEncryptedSize returns the size of an encrypted file for the given plaintext size
+func fileCipherEncryptedSize(size int64) int64 {
+	chunks := max((size+fileCipherChunkSize-1)/fileCipherChunkSize, 1)
+	return int64(fileCipherHeaderSize) + size + chunks*fileCipherTagLen
+}
+
+// fileCipherPlaintextSize returns the plaintext size of an encrypted file of the given size
+func fileCipherPlaintextSize(size int64) int64 {
+	body := size - int64(fileCipherHeaderSize)
+	chunks := max((body+fileCipherChunkSize+fileCipherTagLen-1)/(fileCipherChunkSize+fileCipherTagLen), 1)
+	return max(body-chunks*fileCipherTagLen, 0)
+}
+
+// createAtRest creates a file that is encrypted with the given cipher, or a plaintext file if the cipher is nil
+func createAtRest(c *fileCipher, filename string) (io.WriteCloser, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return f, nil
+	}
+	w, err := c.Writer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &atRestWriteCloser{WriteCloser: w, file: f}, nil
+}
+
+// rangeOpener opens length bytes of a stored file, starting at offset. A negative length reads until the end.
+type rangeOpener func(offset, length int64) (io.ReadCloser, error)
+
+// readAtRest reads length bytes of a file's plaintext, starting at offset, and decrypts it if it is encrypted.
+// A negative length reads until the end. Encrypted files are read from the start of the chunk containing the
+// offset, so ranged reads of large files do not have to decrypt everything before the range.
+func readAtRest(c *fileCipher, open rangeOpener, offset, length int64) (io.ReadCloser, error) {
+	header, err := readHeaderAtRest(open)
+	if err != nil {
+		return nil, err
+	} else if !bytes.HasPrefix(header, []byte(fileCipherMagic)) {
+		return open(offset, length)
+	} else if c == nil {
+		return nil, errFileCipherNoKey
+	}
+	chunk := offset / fileCipherChunkSize
+	f, err := open(int64(fileCipherHeaderSize)+chunk*(fileCipherChunkSize+fileCipherTagLen), -1)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.reader(header, f, uint64(chunk))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, offset%fileCipherChunkSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+	return &atRestReadCloser{Reader: r, Closer: f}, nil
+}
+
+// readHeaderAtRest reads the header of a stored file. The header is shorter than fileCipherHeaderSize
+// for small plaintext files.
+func readHeaderAtRest(open rangeOpener) ([]byte, error) {
+	f, err := open(0, int64(fileCipherHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, fileCipherHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// sizeAtRest returns the plaintext size of a stored file, given its header and its stored size
+func sizeAtRest(header []byte, size int64) int64 {
+	if bytes.HasPrefix(header, []byte(fileCipherMagic)) {
+		return fileCipherPlaintextSize(size)
+	}
+	return size
+}
+
+type atRestWriteCloser struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func (w *atRestWriteCloser) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+type atRestReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// RotateAttachmentEncryptionKey re-wraps the data keys of all encrypted files in the attachment cache directory
+// (including avatars) with a new master key. File contents are not rewritten. Files that are not encrypted,
+// or that already use the new key, are skipped, so an interrupted rotation can safely be run again.
+func RotateAttachmentEncryptionKey(dir string, oldKey, newKey []byte) (rotated int, err error) {
+	from, err := newFileCipher(oldKey)
+	if err != nil {
+		return 0, err
+	}
+	to, err := newFileCipher(newKey)
+	if err != nil {
+		return 0, err
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+		ok, err := from.rewrap(path, to)
+		if err != nil {
+			return err
+		} else if ok {
+			rotated++
+			log.Tag(tagFileCache).Field("file", path).Debug("Re-wrapped data key")
+		}
+		return nil
+	})
+	return rotated, err
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileCipher_WriteRead(t *testing.T) {
+	c := newTestFileCipher(t, 1)
+	for _, size := range []int{0, 1, fileCipherChunkSize - 1, fileCipherChunkSize, fileCipherChunkSize + 1, 3*fileCipherChunkSize + 5} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		var buf bytes.Buffer
+		w, err := c.Writer(&buf)
+		require.Nil(t, err)
+		_, err = w.Write(plaintext)
+		require.Nil(t, err)
+		require.Nil(t, w.Close())
+		require.Equal(t, fileCipherEncryptedSize(int64(size)), int64(buf.Len()))
+		require.Equal(t, int64(size), fileCipherPlaintextSize(int64(buf.Len())))
+
+		r, err := c.Reader(bytes.NewReader(buf.Bytes()))
+		require.Nil(t, err)
+		decrypted, err := io.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, plaintext, decrypted)
+	}
+}
+
+func TestFileCipher_Tampered(t *testing.T) {
+	c := newTestFileCipher(t, 1)
+	var buf bytes.Buffer
+	w, err := c.Writer(&buf)
+	require.Nil(t, err)
+	_, err = w.Write(bytes.Repeat([]byte("x"), 2*fileCipherChunkSize+10))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	encrypted := buf.Bytes()
+
+	// Missing final chunk
+	r, err := c.Reader(bytes.NewReader(encrypted[:fileCipherHeaderSize+2*(fileCipherChunkSize+fileCipherTagLen)]))
+	require.Nil(t, err)
+	_, err = io.ReadAll(r)
+	require.Equal(t, errFileCipherCorrupt, err)
+
+	// Modified contents
+	modified := bytes.Clone(encrypted)
+	modified[fileCipherHeaderSize+5] ^= 1
+	r, err = c.Reader(bytes.NewReader(modified))
+	require.Nil(t, err)
+	_, err = io.ReadAll(r)
+	require.Equal(t, errFileCipherCorrupt, err)
+
+	// Different master key
+	_, err = newTestFileCipher(t, 2).Reader(bytes.NewReader(encrypted))
+	require.Equal(t, errFileCipherWrongKey, err)
+}
+
+func TestFileCipher_ReadAtRest_Plaintext(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "plain")
+	require.Nil(t, os.WriteFile(filename, []byte("written before encryption was enabled"), 0600))
+	header, err := readHeaderAtRest(fileRangeOpener(filename))
+	require.Nil(t, err)
+	require.Equal(t, int64(37), sizeAtRest(header, 37))
+	f, err := readAtRest(newTestFileCipher(t, 1), fileRangeOpener(filename), 0, -1)
+	require.Nil(t, err)
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	require.Nil(t, err)
+	require.Equal(t, "written before encryption was enabled", string(b))
+}
+
+func TestFileCipher_ReadAtRest_Range(t *testing.T) {
+	c := newTestFileCipher(t, 1)
+	filename := filepath.Join(t.TempDir(), "encrypted")
+	plaintext := make([]byte, 3*fileCipherChunkSize+123)
+	_, err := rand.Read(plaintext)
+	require.Nil(t, err)
+	w, err := createAtRest(c, filename)
+	require.Nil(t, err)
+	_, err = w.Write(plaintext)
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+
+	ranges := []struct {
+		offset, length int64
+	}{
+		{0, -1},
+		{0, 10},
+		{fileCipherChunkSize - 5, 10}, // Spans two chunks
+		{fileCipherChunkSize, fileCipherChunkSize},         // Exactly one chunk
+		{2*fileCipherChunkSize + 7, -1},                    // Until the end
+		{int64(len(plaintext)) - 1, 1},                     // Last byte
+		{fileCipherChunkSize + 1, 2 * fileCipherChunkSize}, // Three chunks
+	}
+	for _, r := range ranges {
+		f, err := readAtRest(c, fileRangeOpener(filename), r.offset, r.length)
+		require.Nil(t, err)
+		b, err := io.ReadAll(f)
+		require.Nil(t, err)
+		f.Close()
+		end := int64(len(plaintext))
+		if r.length >= 0 {
+			end = r.offset + r.length
+		}
+		require.Equal(t, plaintext[r.offset:end], b, "offset %d, length %d", r.offset, r.length)
+	}
+}
+
+func TestFileCipher_RotateKey(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	oldCipher, newCipher := newTestFileCipher(t, 1), newTestFileCipher(t, 2)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, avatarDirName), 0700))
+	files := []string{filepath.Join(dir, "abcdefghijkl"), filepath.Join(dir, avatarDirName, "av_123.png")}
+	for _, filename := range files {
+		w, err := createAtRest(oldCipher, filename)
+		require.Nil(t, err)
+		_, err = w.Write([]byte("secret " + filepath.Base(filename)))
+		require.Nil(t, err)
+		require.Nil(t, w.Close())
+	}
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "plaintext123"), []byte("plain"), 0600))
+	before, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+
+	rotated, err := RotateAttachmentEncryptionKey(dir, oldKey, newKey)
+	require.Nil(t, err)
+	require.Equal(t, 2, rotated)
+
+	// Contents are unchanged, only the header is rewritten
+	after, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+	require.Equal(t, before[fileCipherHeaderSize:], after[fileCipherHeaderSize:])
+	require.NotEqual(t, before[:fileCipherHeaderSize], after[:fileCipherHeaderSize])
+	for _, filename := range files {
+		_, err := readAtRest(oldCipher, fileRangeOpener(filename), 0, -1)
+		require.Equal(t, errFileCipherWrongKey, err)
+		f, err := readAtRest(newCipher, fileRangeOpener(filename), 0, -1)
+		require.Nil(t, err)
+		b, err := io.ReadAll(f)
+		require.Nil(t, err)
+		require.Equal(t, "secret "+filepath.Base(filename), string(b))
+		f.Close()
+	}
+
+	// Running it again is a no-op
+	rotated, err = RotateAttachmentEncryptionKey(dir, oldKey, newKey)
+	require.Nil(t, err)
+	require.Equal(t, 0, rotated)
+}
+
+func newTestFileCipher(t *testing.T, b byte) *fileCipher {
+	c, err := newFileCipher(bytes.Repeat([]byte{b}, 32))
+	require.Nil(t, err)
+	return c
+}
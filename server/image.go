@@ -0,0 +1,633 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // Register GIF decoder
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Register WebP decoder
+)
+
+// Images attached to messages are processed before they are stored: metadata (EXIF, XMP, IPTC, comments) is
+// stripped without re-encoding the image, so that photos do not leak e.g. the GPS location. The dimensions and a
+// blurhash placeholder are stored with the attachment, and thumbnails are stored next to it (see handleFile).
+//
+// JPEGs with an EXIF orientation other than "normal" keep a minimal EXIF segment with only the orientation, so
+// that they are displayed correctly without being re-encoded. Thumbnails are rotated after scaling them down.
+
+const (
+	imageMaxPixels           = 50 * 1000 * 1000 // Decompression bomb protection, larger images are only stripped
+	imageDecodeMaxConcurrent = 4                // Decoding a large image takes a few hundred MB, see imageDecodeSlots
+	imageThumbnailQuality    = 80
+	imageBlurHashSize        = 32 // Images are scaled down to this size before computing the blurhash
+	imageBlurHashComponentsX = 4
+	imageBlurHashComponentsY = 3
+)
+
+// imageThumbnailSizes are the thumbnail sizes (longest edge in pixels), ordered from largest to smallest.
+// Thumbnails are only generated if the image is larger than the thumbnail.
+var imageThumbnailSizes = []struct {
+	name string
+	size int
+}{
+	{"preview", 1280},
+	{"thumb", 320},
+}
+
+var (
+	errImageInvalid = errors.New("invalid or unsupported image")
+	pngSignature    = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader      = []byte("Exif\x00\x00")
+
+	// imageDecodeSlots limits the number of images that are decoded at the same time. Stripping metadata is
+	// cheap and not limited; decoding, scaling and encoding thumbnails waits for a free slot.
+	imageDecodeSlots = make(chan struct{}, imageDecodeMaxConcurrent)
+)
+
+// processedImage is the result of processImage
+type processedImage struct {
+	data       []byte            // Image without metadata
+	width      int               // Zero if the image could not be decoded
+	height     int               // Zero if the image could not be decoded
+	blurHash   string            // Empty if the image could not be decoded
+	thumbnails map[string][]byte // Thumbnail name (see imageThumbnailSizes) -> encoded thumbnail
+}
+
+// isProcessableImage returns true if processImage supports the given content type
+func isProcessableImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// processImage strips the metadata of an image, and computes its dimensions, blurhash and thumbnails. It
+// fails only if the metadata cannot be stripped. Images that cannot be decoded are only stripped.
+func processImage(data []byte, contentType string) (*processedImage, error) {
+	stripped, orientation, err := stripImageMetadata(data, contentType)
+	if err != nil {
+		return nil, err
+	}
+	result := &processedImage{
+		data:       stripped,
+		thumbnails: make(map[string][]byte),
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		return result, nil
+	}
+	result.width, result.height = config.Width, config.Height
+	if orientation >= 5 { // Rotated by 90°, the image is displayed with width and height swapped
+		result.width, result.height = config.Height, config.Width
+	}
+	if config.Width*config.Height > imageMaxPixels {
+		return result, nil
+	}
+	imageDecodeSlots <- struct{}{}
+	defer func() { <-imageDecodeSlots }()
+	img, _, err := image.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		result.width, result.height = 0, 0
+		return result, nil
+	}
+	source, opaque := img, imageOpaque(img)
+	for _, t := range imageThumbnailSizes {
+		if max(config.Width, config.Height) <= t.size {
+			continue
+		}
+		scaled := scaleImage(source, t.size, draw.CatmullRom) // Scale down from the previous (larger) thumbnail
+		thumbnail, err := encodeThumbnail(orientImage(scaled, orientation), opaque)
+		if err != nil {
+			return nil, err
+		}
+		result.thumbnails[t.name] = thumbnail
+		source = scaled
+	}
+	result.blurHash = blurHash(orientImage(scaleImage(source, imageBlurHashSize, draw.ApproxBiLinear), orientation), imageBlurHashComponentsX, imageBlurHashComponentsY)
+	return result, nil
+}
+
+// processedAvatar is the result of processAvatar
+type processedAvatar struct {
+	ext      string         // File extension of all variants, .jpg or .png (if the image has transparency)
+	variants map[int][]byte // Size -> encoded image
+}
+
+// processAvatar decodes an image, crops it to a centered square, and re-encodes it in the given sizes (in
+// pixels). The type is detected from the contents rather than trusting the client. Re-encoding drops all
+// metadata, as well as anything else hidden in the file (e.g. polyglot payloads). Animated GIFs lose
+// their animation. Images smaller than a size are not scaled up.
+func processAvatar(data []byte, sizes []int) (*processedAvatar, error) {
+	contentType := mimetype.Detect(data).String()
+	if !isProcessableImage(contentType) {
+		return nil, errImageInvalid
+	}
+	orientation := 1
+	if contentType == "image/jpeg" {
+		if _, o, err := stripJPEGMetadata(data); err == nil {
+			orientation = o
+		}
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width*config.Height > imageMaxPixels {
+		return nil, errImageInvalid
+	}
+	imageDecodeSlots <- struct{}{}
+	defer func() { <-imageDecodeSlots }()
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errImageInvalid
+	}
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side).Add(b.Min).Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+	opaque := imageOpaque(img)
+	result := &processedAvatar{
+		ext:      ".png",
+		variants: make(map[int][]byte),
+	}
+	if opaque {
+		result.ext = ".jpg"
+	}
+	for _, size := range sizes {
+		dst := image.NewRGBA(image.Rect(0, 0, min(size, side), min(size, side)))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+		encoded, err := encodeThumbnail(orientImage(dst, orientation), opaque) // A centered square crop is the same after rotating
+		if err != nil {
+			return nil, err
+		}
+		result.variants[size] = encoded
+	}
+	return result, nil
+}
+
+// stripImageMetadata removes metadata from an image without re-encoding it, and returns the EXIF orientation
+// (1-8, 1 being "normal") of JPEG images
+func stripImageMetadata(data []byte, contentType string) ([]byte, int, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		stripped, err := stripPNGMetadata(data)
+		return stripped, 1, err
+	case "image/gif":
+		stripped, err := stripGIFMetadata(data)
+		return stripped, 1, err
+	case "image/webp":
+		stripped, err := stripWebPMetadata(data)
+		return stripped, 1, err
+	}
+	return nil, 0, errImageInvalid
+}
+
+// stripJPEGMetadata removes all APPn segments (EXIF, XMP, IPTC, ...) and comments, except for JFIF (APP0),
+// ICC color profiles (APP2) and Adobe color transforms (APP14), which are needed to display the image correctly.
+// If the image has an EXIF orientation other than "normal", a minimal EXIF segment with only the orientation is
+// added (see exifOrientationSegment). Anything after the end of the image (e.g. appended files) is dropped.
+func stripJPEGMetadata(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errImageInvalid
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	orientation := 1
+	withOrientation := func(out []byte) ([]byte, int, error) {
+		if orientation > 1 {
+			pos := 2 // After SOI, or after JFIF (APP0) if present
+			if len(out) >= 6 && out[2] == 0xFF && out[3] == 0xE0 {
+				pos = 4 + int(binary.BigEndian.Uint16(out[4:]))
+			}
+			out = append(out[:pos:pos], append(exifOrientationSegment(orientation), out[pos:]...)...)
+		}
+		return out, orientation, nil
+	}
+	for i := 2; ; {
+		if i >= len(data) || data[i] != 0xFF {
+			return nil, 0, errImageInvalid
+		}
+		for i < len(data) && data[i] == 0xFF { // Skip fill bytes
+			i++
+		}
+		if i >= len(data) {
+			return nil, 0, errImageInvalid
+		}
+		marker := data[i]
+		i++
+		if marker == 0xD9 { // End of image
+			return withOrientation(append(out, 0xFF, 0xD9))
+		} else if (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 { // Markers without length
+			out = append(out, 0xFF, marker)
+			continue
+		}
+		if i+2 > len(data) {
+			return nil, 0, errImageInvalid
+		}
+		length := int(binary.BigEndian.Uint16(data[i:]))
+		if length < 2 || i+length > len(data) {
+			return nil, 0, errImageInvalid
+		}
+		segment := data[i+2 : i+length]
+		if marker == 0xDA { // Start of scan, followed by entropy-coded data up to the next marker
+			end := jpegScanEnd(data, i+length)
+			out = append(out, 0xFF, marker)
+			out = append(out, data[i:end]...)
+			if end == len(data) { // End of image missing, which decoders tolerate
+				return withOrientation(append(out, 0xFF, 0xD9))
+			}
+			i = end
+			continue
+		}
+		keep := true
+		switch {
+		case marker == 0xE1:
+			if bytes.HasPrefix(segment, exifHeader) {
+				orientation = exifOrientation(segment[len(exifHeader):])
+			}
+			keep = false
+		case marker == 0xE2:
+			keep = bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00"))
+		case (marker >= 0xE3 && marker <= 0xED) || marker == 0xEF || marker == 0xFE:
+			keep = false
+		}
+		if keep {
+			out = append(out, 0xFF, marker)
+			out = append(out, data[i:i+length]...)
+		}
+		i += length
+	}
+}
+
+// jpegScanEnd returns the position of the first marker after the entropy-coded data starting at i, or len(data)
+// if there is none. Stuffed bytes (0xFF00) and restart markers are part of the entropy-coded data.
+func jpegScanEnd(data []byte, i int) int {
+	for ; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+		next := data[i+1]
+		if next != 0x00 && next != 0xFF && (next < 0xD0 || next > 0xD7) {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// exifOrientationSegment returns an APP1 segment with EXIF data that only contains the given orientation
+func exifOrientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, // Big endian TIFF header, first IFD at offset 8
+		0x00, 0x01, // One entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, byte(orientation >> 8), byte(orientation), 0x00, 0x00, // Orientation, SHORT, 1 value
+		0x00, 0x00, 0x00, 0x00, // No next IFD
+	}
+	segment := []byte{0xFF, 0xE1, 0x00, 0x00}
+	segment = append(segment, exifHeader...)
+	segment = append(segment, tiff...)
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+	return segment
+}
+
+// exifOrientation returns the orientation tag (0x0112) from the first IFD of the given EXIF (TIFF) data,
+// or 1 ("normal") if there is none
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return 1
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// stripPNGMetadata removes text chunks, EXIF data and the modification time from a PNG image
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errImageInvalid
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	for i := len(pngSignature); i+12 <= len(data); {
+		length := int64(binary.BigEndian.Uint32(data[i:]))
+		end := int64(i) + 12 + length // Length, type, data, CRC
+		if end > int64(len(data)) {
+			return nil, errImageInvalid
+		}
+		chunkType := string(data[i+4 : i+8])
+		switch chunkType {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		if chunkType == "IEND" {
+			return out, nil
+		}
+		i = int(end)
+	}
+	return nil, errImageInvalid
+}
+
+// stripGIFMetadata removes comments and application extensions (e.g. XMP) from a GIF image, except for the
+// extensions that control looping of animated GIFs
+func stripGIFMetadata(data []byte) ([]byte, error) {
+	if len(data) < 13 || (!bytes.HasPrefix(data, []byte("GIF87a")) && !bytes.HasPrefix(data, []byte("GIF89a"))) {
+		return nil, errImageInvalid
+	}
+	i := 13 // Header and logical screen descriptor
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1) // Global color table
+	}
+	if i > len(data) {
+		return nil, errImageInvalid
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:i]...)
+	for i < len(data) {
+		switch data[i] {
+		case 0x3B: // Trailer
+			return append(out, 0x3B), nil
+		case 0x21: // Extension
+			if i+2 > len(data) {
+				return nil, errImageInvalid
+			}
+			end, err := gifSkipSubBlocks(data, i+2)
+			if err != nil {
+				return nil, err
+			}
+			label := data[i+1]
+			keep := label != 0xFE // Comment
+			if label == 0xFF {    // Application extension
+				keep = i+14 <= len(data) && data[i+2] == 11 && (string(data[i+3:i+14]) == "NETSCAPE2.0" || string(data[i+3:i+14]) == "ANIMEXTS1.0")
+			}
+			if keep {
+				out = append(out, data[i:end]...)
+			}
+			i = end
+		case 0x2C: // Image descriptor
+			if i+10 > len(data) {
+				return nil, errImageInvalid
+			}
+			start := i + 10
+			if data[i+9]&0x80 != 0 {
+				start += 3 << (data[i+9]&0x07 + 1) // Local color table
+			}
+			end, err := gifSkipSubBlocks(data, start+1) // After LZW minimum code size
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, data[i:end]...)
+			i = end
+		default:
+			return nil, errImageInvalid
+		}
+	}
+	return append(out, 0x3B), nil // Trailer missing, which browsers tolerate
+}
+
+func gifSkipSubBlocks(data []byte, i int) (int, error) {
+	for {
+		if i >= len(data) {
+			return 0, errImageInvalid
+		}
+		n := int(data[i])
+		i++
+		if n == 0 {
+			return i, nil
+		}
+		i += n
+	}
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks from a WebP image, and clears the corresponding
+// flags in the extended header (VP8X)
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errImageInvalid
+	}
+	if riffEnd := 8 + int64(binary.LittleEndian.Uint32(data[4:8])); riffEnd < int64(len(data)) {
+		data = data[:riffEnd] // Ignore trailing data
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errImageInvalid
+		}
+		size := int64(binary.LittleEndian.Uint32(data[i+4:]))
+		end := int64(i) + 8 + size + size%2 // Chunks are padded to an even size
+		if end > int64(len(data)) {
+			if int64(i)+8+size != int64(len(data)) {
+				return nil, errImageInvalid
+			}
+			end = int64(len(data)) // Padding of the last chunk missing
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, data[i:end]...)
+			if size > 0 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP flags
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = int(end)
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}
+
+// orientImage applies an EXIF orientation (1-8) to an image. The image is returned as is for orientation 1.
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // Transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			offset := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[offset:offset+4])
+		}
+	}
+	return dst
+}
+
+// scaleImage scales an image down so that its longest edge is size pixels
+func scaleImage(img image.Image, size int, scaler draw.Scaler) *image.RGBA {
+	b := img.Bounds()
+	w, h := size, max(b.Dy()*size/b.Dx(), 1)
+	if b.Dy() > b.Dx() {
+		w, h = max(b.Dx()*size/b.Dy(), 1), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	scaler.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// encodeThumbnail encodes opaque thumbnails as JPEG, and thumbnails with transparency as PNG
+func encodeThumbnail(img image.Image, opaque bool) ([]byte, error) {
+	var buf bytes.Buffer
+	if opaque {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: imageThumbnailQuality}); err != nil {
+			return nil, err
+		}
+	} else if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func imageOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// blurHash encodes an image as a blurhash with the given number of components, see https://github.com/woltapp/blurhash
+func blurHash(img image.Image, componentsX, componentsY int) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	pixels := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			pixels[y*w+x] = [3]float64{sRGBToLinear(c.R), sRGBToLinear(c.G), sRGBToLinear(c.B)}
+		}
+	}
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			var factor [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					for k := 0; k < 3; k++ {
+						factor[k] += basis * pixels[y*w+x][k]
+					}
+				}
+			}
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+			for k := 0; k < 3; k++ {
+				factor[k] *= normalisation / float64(w*h)
+			}
+			factors = append(factors, factor)
+		}
+	}
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		var actualMaximumValue float64
+		for _, factor := range factors[1:] {
+			for k := 0; k < 3; k++ {
+				actualMaximumValue = math.Max(actualMaximumValue, math.Abs(factor[k]))
+			}
+		}
+		quantisedMaximumValue := int(math.Max(0, math.Min(82, math.Floor(actualMaximumValue*166-0.5))))
+		maximumValue = float64(quantisedMaximumValue+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximumValue, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, factor := range factors[1:] {
+		var value int
+		for k := 0; k < 3; k++ {
+			quantised := int(math.Max(0, math.Min(18, math.Floor(signPow(factor[k]/maximumValue, 0.5)*9+9.5))))
+			value = value*19 + quantised
+		}
+		hash.WriteString(encodeBase83(value, 2))
+	}
+	return hash.String()
+}
+
+const base83Characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(value, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Characters[value%83]
+		value /= 83
+	}
+	return string(b)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessImage_JPEG_Orientation(t *testing.T) {
+	// Left half red, right half blue; rotated 90° clockwise, red is on top
+	data := newTestJPEG(t, 400, 200, 6, "GPS 48.2082N 16.3738E")
+	img, err := processImage(data, "image/jpeg")
+	require.Nil(t, err)
+	require.NotContains(t, string(img.data), "GPS 48.2082N")
+	require.Equal(t, 200, img.width)
+	require.Equal(t, 400, img.height)
+	require.Len(t, img.blurHash, 28)
+	require.Contains(t, img.thumbnails, "thumb")
+	require.NotContains(t, img.thumbnails, "preview") // Smaller than the preview size
+
+	// The image is not re-encoded, but keeps an EXIF segment with only the orientation
+	require.Equal(t, newTestJPEG(t, 400, 200, 6, ""), img.data)
+	_, orientation, err := stripJPEGMetadata(img.data)
+	require.Nil(t, err)
+	require.Equal(t, 6, orientation)
+
+	// Thumbnails are rotated
+	thumbnail, err := jpeg.Decode(bytes.NewReader(img.thumbnails["thumb"]))
+	require.Nil(t, err)
+	require.Equal(t, image.Rect(0, 0, 160, 320), thumbnail.Bounds())
+	r, _, b, _ := thumbnail.At(80, 40).RGBA()
+	require.Greater(t, r, b)
+	r, _, b, _ = thumbnail.At(80, 280).RGBA()
+	require.Greater(t, b, r)
+}
+
+func TestProcessImage_JPEG_TrailingData(t *testing.T) {
+	// Data after the end of the image (e.g. an appended ZIP file) is dropped
+	data := append(newTestJPEG(t, 64, 48, 1, ""), []byte("PK\x03\x04hidden payload")...)
+	img, err := processImage(data, "image/jpeg")
+	require.Nil(t, err)
+	require.NotContains(t, string(img.data), "hidden payload")
+	require.Equal(t, newTestJPEG(t, 64, 48, 0, ""), img.data)
+	require.Equal(t, 64, img.width)
+}
+
+func TestProcessImage_JPEG_NoOrientationIsNotReencoded(t *testing.T) {
+	data := newTestJPEG(t, 64, 48, 1, "Camera serial 1234")
+	img, err := processImage(data, "image/jpeg")
+	require.Nil(t, err)
+	require.NotContains(t, string(img.data), "Camera serial")
+	require.Equal(t, 64, img.width)
+	require.Equal(t, 48, img.height)
+	require.Empty(t, img.thumbnails)
+
+	// Only the EXIF segment is removed, the image data is unchanged
+	original := newTestJPEG(t, 64, 48, 0, "")
+	require.Equal(t, original, img.data)
+}
+
+func TestProcessImage_PNG(t *testing.T) {
+	data := newTestPNG(t, 500, 100)
+	// Insert a text chunk after the IHDR chunk (8 byte signature + 25 byte IHDR)
+	text := newTestPNGChunk("tEXt", []byte("Comment\x00taken at home"))
+	data = append(append(append([]byte{}, data[:33]...), text...), data[33:]...)
+	_, err := png.Decode(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	img, err := processImage(data, "image/png")
+	require.Nil(t, err)
+	require.NotContains(t, string(img.data), "taken at home")
+	require.Equal(t, 500, img.width)
+	require.Equal(t, 100, img.height)
+	require.Len(t, img.blurHash, 28)
+	thumbnail, err := jpeg.Decode(bytes.NewReader(img.thumbnails["thumb"])) // Opaque, so JPEG
+	require.Nil(t, err)
+	require.Equal(t, image.Rect(0, 0, 320, 64), thumbnail.Bounds())
+}
+
+func TestProcessImage_Invalid(t *testing.T) {
+	_, err := processImage([]byte("not an image"), "image/jpeg")
+	require.Equal(t, errImageInvalid, err)
+	_, err = processImage([]byte("\xFF\xD8\xFF\xE1\xFF\xFF"), "image/jpeg") // Truncated segment
+	require.Equal(t, errImageInvalid, err)
+	_, err = processImage(pngSignature, "image/png") // No IEND
+	require.Equal(t, errImageInvalid, err)
+}
+
+func TestProcessAvatar(t *testing.T) {
+	// Wide image is cropped to the center square, the left half of which is red
+	data := append(newTestJPEG(t, 600, 300, 1, "GPS 48.2082N 16.3738E"), []byte("<script>alert(1)</script>")...)
+	avatar, err := processAvatar(data, []int{256, 64})
+	require.Nil(t, err)
+	require.Equal(t, ".jpg", avatar.ext)
+	require.Len(t, avatar.variants, 2)
+	for size, variant := range avatar.variants {
+		require.NotContains(t, string(variant), "GPS 48.2082N")
+		require.NotContains(t, string(variant), "<script>")
+		img, err := jpeg.Decode(bytes.NewReader(variant))
+		require.Nil(t, err)
+		require.Equal(t, image.Rect(0, 0, size, size), img.Bounds())
+		r, _, b, _ := img.At(size/4, size/2).RGBA()
+		require.Greater(t, r, b)
+		r, _, b, _ = img.At(size*3/4, size/2).RGBA()
+		require.Greater(t, b, r)
+	}
+}
+
+func TestProcessAvatar_SmallAndTransparent(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 100, 120)))) // Fully transparent
+	avatar, err := processAvatar(buf.Bytes(), []int{256, 64})
+	require.Nil(t, err)
+	require.Equal(t, ".png", avatar.ext)
+	img, err := png.Decode(bytes.NewReader(avatar.variants[256]))
+	require.Nil(t, err)
+	require.Equal(t, image.Rect(0, 0, 100, 100), img.Bounds()) // Not scaled up
+	img, err = png.Decode(bytes.NewReader(avatar.variants[64]))
+	require.Nil(t, err)
+	require.Equal(t, image.Rect(0, 0, 64, 64), img.Bounds())
+}
+
+func TestProcessAvatar_Invalid(t *testing.T) {
+	_, err := processAvatar([]byte("<html><body>not an image</body></html>"), []int{256})
+	require.Equal(t, errImageInvalid, err)
+	_, err = processAvatar([]byte("\x89PNG\r\n\x1a\nfake image data"), []int{256})
+	require.Equal(t, errImageInvalid, err)
+}
+
+func TestStripGIFMetadata(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{LoopCount: 0}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 10, 10), palette)
+		frame.SetColorIndex(i, i, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	require.Nil(t, gif.EncodeAll(&buf, anim))
+	data := buf.Bytes()
+	comment := []byte("\x21\xFE\x0Dsecret note 1\x00")
+	xmp := []byte("\x21\xFF\x0BXMP DataXMP\x05<xmp>\x00")
+	data = append(append(append(append([]byte{}, data[:len(data)-1]...), comment...), xmp...), 0x3B)
+
+	stripped, err := stripGIFMetadata(data)
+	require.Nil(t, err)
+	require.NotContains(t, string(stripped), "secret note")
+	require.NotContains(t, string(stripped), "<xmp>")
+	require.Contains(t, string(stripped), "NETSCAPE2.0") // Looping is kept
+	decoded, err := gif.DecodeAll(bytes.NewReader(stripped))
+	require.Nil(t, err)
+	require.Len(t, decoded.Image, 3)
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	chunk := func(fourCC string, data []byte) []byte {
+		b := append([]byte(fourCC), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+		b = append(b, data...)
+		if len(data)%2 == 1 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	vp8x := chunk("VP8X", []byte{0x2C, 0, 0, 0, 9, 0, 0, 9, 0, 0}) // ICC, EXIF and XMP flags
+	icc := chunk("ICCP", []byte("icc profile"))
+	image := chunk("VP8L", []byte("image data"))
+	exif := chunk("EXIF", []byte("MM gps location"))
+	xmp := chunk("XMP ", []byte("<xmp/>"))
+	body := bytes.Join([][]byte{[]byte("WEBP"), vp8x, icc, image, exif, xmp}, nil)
+	data := append([]byte("RIFF\x00\x00\x00\x00"), body...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(body)))
+
+	stripped, err := stripWebPMetadata(data)
+	require.Nil(t, err)
+	require.NotContains(t, string(stripped), "gps location")
+	require.NotContains(t, string(stripped), "<xmp/>")
+	require.Contains(t, string(stripped), "icc profile")
+	require.Contains(t, string(stripped), "image data")
+	require.Equal(t, byte(0x20), stripped[20]) // Only the ICC flag is left
+	require.Equal(t, uint32(len(stripped)-8), binary.LittleEndian.Uint32(stripped[4:]))
+}
+
+func TestBlurHash(t *testing.T) {
+	solid := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for i := 0; i < len(solid.Pix); i += 4 {
+		copy(solid.Pix[i:], []byte{255, 0, 0, 255})
+	}
+	hash := blurHash(solid, 4, 3)
+	require.Len(t, hash, 28)
+	require.Equal(t, "L", hash[:1])     // 4x3 components
+	require.Equal(t, "TI:j", hash[2:6]) // Average color #ff0000
+	require.Equal(t, hash, blurHash(solid, 4, 3))
+	require.NotEqual(t, hash, blurHash(newTestImage(32, 32), 4, 3))
+	require.Len(t, blurHash(solid, 1, 1), 6)
+}
+
+func TestEncodeBase83(t *testing.T) {
+	require.Equal(t, "00", encodeBase83(0, 2))
+	require.Equal(t, "~", encodeBase83(82, 1))
+	require.Equal(t, "TI:j", encodeBase83(0xFF0000, 4))
+}
+
+// newTestImage returns an image that is red on the left half, and blue on the right half
+func newTestImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+// newTestPNG returns a PNG of newTestImage
+func newTestPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, newTestImage(width, height)))
+	return buf.Bytes()
+}
+
+// newTestJPEG returns a JPEG of newTestImage, with an EXIF segment containing the given orientation and text
+// (no EXIF segment if orientation is 0)
+func newTestJPEG(t *testing.T, width, height, orientation int, text string) []byte {
+	var buf bytes.Buffer
+	require.Nil(t, jpeg.Encode(&buf, newTestImage(width, height), &jpeg.Options{Quality: 90}))
+	data := buf.Bytes()
+	if orientation == 0 {
+		return data
+	}
+	tiff := []byte("MM\x00\x2A\x00\x00\x00\x08")
+	tiff = append(tiff, 0, 1)                         // One IFD entry
+	tiff = append(tiff, 0x01, 0x12, 0, 3, 0, 0, 0, 1) // Orientation, SHORT, count 1
+	tiff = append(tiff, 0, byte(orientation), 0, 0)   // Value
+	tiff = append(tiff, 0, 0, 0, 0)                   // No next IFD
+	tiff = append(tiff, text...)                      // Other data, e.g. GPS
+	segment := append(append([]byte{}, exifHeader...), tiff...)
+	app1 := []byte{0xFF, 0xE1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	return append(append(append([]byte{0xFF, 0xD8}, app1...), segment...), data[2:]...)
+}
+
+func newTestPNGChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
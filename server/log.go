@@ -24,6 +24,7 @@ const (
 	tagEmail        = "email" // Send email
 	tagTwilio       = "twilio"
 	tagFileCache    = "file_cache"
+	tagImage        = "image"
 	tagMessageCache = "message_cache"
 	tagStripe       = "stripe"
 	tagAccount      = "account"
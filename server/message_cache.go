@@ -19,6 +19,7 @@ import (
 var (
 	errUnexpectedMessageType = errors.New("unexpected message type")
 	errMessageNotFound       = errors.New("message not found")
+	errUploadNotFound        = errors.New("upload not found")
 	errNoRows                = errors.New("no rows found")
 )
 
@@ -54,7 +55,13 @@ const (
 			encoding TEXT NOT NULL,
 			published INT NOT NULL,
 			reply_to TEXT NOT NULL DEFAULT '',
-			reply_to_text TEXT NOT NULL DEFAULT ''
+			reply_to_text TEXT NOT NULL DEFAULT '',
+			html TEXT NOT NULL DEFAULT '',
+			envelope TEXT NOT NULL DEFAULT '',
+			attachment_width INT NOT NULL DEFAULT 0,
+			attachment_height INT NOT NULL DEFAULT 0,
+			attachment_blurhash TEXT NOT NULL DEFAULT '',
+			attachment_hash TEXT NOT NULL DEFAULT ''
 		);
 		CREATE INDEX IF NOT EXISTS idx_mid ON messages (mid);
 		CREATE INDEX IF NOT EXISTS idx_sequence_id ON messages (sequence_id);
@@ -64,6 +71,23 @@ const (
 		CREATE INDEX IF NOT EXISTS idx_sender ON messages (sender);
 		CREATE INDEX IF NOT EXISTS idx_user ON messages (user);
 		CREATE INDEX IF NOT EXISTS idx_attachment_expires ON messages (attachment_expires);
+		CREATE INDEX IF NOT EXISTS idx_attachment_hash ON messages (attachment_hash);
+		CREATE TABLE IF NOT EXISTS attachment_blobs (
+			hash TEXT PRIMARY KEY,
+			size INT NOT NULL,
+			last_used INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS attachment_uploads (
+			id TEXT PRIMARY KEY,
+			user TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			size INT NOT NULL,
+			received INT NOT NULL DEFAULT 0,
+			chunks INT NOT NULL DEFAULT 0,
+			expires INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_attachment_uploads_user ON attachment_uploads (user);
+		CREATE INDEX IF NOT EXISTS idx_attachment_uploads_expires ON attachment_uploads (expires);
 		CREATE TABLE IF NOT EXISTS stats (
 			key TEXT PRIMARY KEY,
 			value INT
@@ -102,8 +126,8 @@ const (
 		COMMIT;
 	`
 	insertMessageQuery = `
-		INSERT INTO messages (mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_deleted, sender, sender_name, user, content_type, encoding, published, reply_to, reply_to_text)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_deleted, sender, sender_name, user, content_type, encoding, published, reply_to, reply_to_text, html, envelope, attachment_width, attachment_height, attachment_blurhash, attachment_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	deleteMessageQuery                    = `DELETE FROM messages WHERE mid = ?`
 	selectScheduledMessageIDsBySeqIDQuery = `SELECT mid FROM messages WHERE topic = ? AND sequence_id = ? AND published = 0`
@@ -111,43 +135,43 @@ const (
 	updateMessagesForTopicExpiryQuery     = `UPDATE messages SET expires = ? WHERE topic = ?`
 	selectRowIDFromMessageID              = `SELECT id FROM messages WHERE mid = ?` // Do not include topic, see #336 and TestServer_PollSinceID_MultipleTopics
 	selectMessagesByIDQuery               = `
-		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text
+		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text, html, envelope, attachment_width, attachment_height, attachment_blurhash, attachment_hash
 		FROM messages
 		WHERE mid = ?
 	`
 	selectMessagesSinceTimeQuery = `
-		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text
+		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text, html, envelope, attachment_width, attachment_height, attachment_blurhash, attachment_hash
 		FROM messages
 		WHERE topic = ? AND time >= ? AND published = 1
 		ORDER BY time, id
 	`
 	selectMessagesSinceTimeIncludeScheduledQuery = `
-		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text
+		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text, html, envelope, attachment_width, attachment_height, attachment_blurhash, attachment_hash
 		FROM messages
 		WHERE topic = ? AND time >= ?
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDQuery = `
-		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text
+		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text, html, envelope, attachment_width, attachment_height, attachment_blurhash, attachment_hash
 		FROM messages
 		WHERE topic = ? AND id > ? AND published = 1
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDIncludeScheduledQuery = `
-		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text
+		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text, html, envelope, attachment_width, attachment_height, attachment_blurhash, attachment_hash
 		FROM messages
 		WHERE topic = ? AND (id > ? OR published = 0)
 		ORDER BY time, id
 	`
 	selectMessagesLatestQuery = `
-		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text
+		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text, html, envelope, attachment_width, attachment_height, attachment_blurhash, attachment_hash
 		FROM messages
 		WHERE topic = ? AND published = 1
 		ORDER BY time DESC, id DESC
 		LIMIT 1
 	`
 	selectMessagesDueQuery = `
-		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text
+		SELECT mid, sequence_id, time, event, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, sender_name, user, content_type, encoding, reply_to, reply_to_text, html, envelope, attachment_width, attachment_height, attachment_blurhash, attachment_hash
 		FROM messages
 		WHERE time <= ? AND published = 0
 		ORDER BY time, id
@@ -166,13 +190,48 @@ const (
 	selectAttachmentsSizeBySenderQuery = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = '' AND sender = ? AND attachment_expires >= ?`
 	selectAttachmentsSizeByUserIDQuery = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = ? AND attachment_expires >= ?`
 
+	// Attachments with the same contents are stored once (as blob), and counted once per user (or sender)
+	selectUniqueAttachmentsSizeBySenderQuery = `
+		SELECT IFNULL(SUM(size), 0) FROM (
+			SELECT MAX(attachment_size) AS size
+			FROM messages
+			WHERE user = '' AND sender = ? AND attachment_expires >= ?
+			GROUP BY CASE WHEN attachment_hash = '' THEN mid ELSE attachment_hash END
+		)
+	`
+	selectUniqueAttachmentsSizeByUserIDQuery = `
+		SELECT IFNULL(SUM(size), 0) FROM (
+			SELECT MAX(attachment_size) AS size
+			FROM messages
+			WHERE user = ? AND attachment_expires >= ?
+			GROUP BY CASE WHEN attachment_hash = '' THEN mid ELSE attachment_hash END
+		)
+	`
+	touchAttachmentBlobQuery               = `UPDATE attachment_blobs SET last_used = ? WHERE hash = ?`
+	insertAttachmentBlobQuery              = `INSERT INTO attachment_blobs (hash, size, last_used) VALUES (?, ?, ?)`
+	deleteAttachmentBlobQuery              = `DELETE FROM attachment_blobs WHERE hash = ?`
+	selectAttachmentBlobRefsQuery          = `SELECT COUNT(*) FROM messages WHERE attachment_hash = ? AND attachment_deleted = 0`
+	selectAttachmentBlobsUnreferencedQuery = `
+		SELECT hash
+		FROM attachment_blobs
+		WHERE last_used <= ? AND NOT EXISTS (
+			SELECT 1 FROM messages WHERE attachment_hash = attachment_blobs.hash AND attachment_deleted = 0
+		)
+	`
+	insertAttachmentUploadQuery         = `INSERT INTO attachment_uploads (id, user, filename, size, received, chunks, expires) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	updateAttachmentUploadQuery         = `UPDATE attachment_uploads SET received = ?, chunks = ?, expires = ? WHERE id = ?`
+	deleteAttachmentUploadQuery         = `DELETE FROM attachment_uploads WHERE id = ?`
+	selectAttachmentUploadQuery         = `SELECT id, user, filename, size, received, chunks, expires FROM attachment_uploads WHERE id = ? AND expires > ?`
+	selectAttachmentUploadsByUserQuery  = `SELECT id, user, filename, size, received, chunks, expires FROM attachment_uploads WHERE user = ? AND expires > ?`
+	selectAttachmentUploadsExpiredQuery = `SELECT id, user, filename, size, received, chunks, expires FROM attachment_uploads WHERE expires <= ?`
+
 	selectStatsQuery = `SELECT value FROM stats WHERE key = 'messages'`
 	updateStatsQuery = `UPDATE stats SET value = ? WHERE key = 'messages'`
 )
 
 // Schema management queries
 const (
-	currentSchemaVersion          = 17
+	currentSchemaVersion          = 22
 	createSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -355,6 +414,49 @@ const (
 		CREATE INDEX IF NOT EXISTS idx_reactions_message ON reactions(message_id);
 		CREATE INDEX IF NOT EXISTS idx_join_requests_status ON join_requests (status);
 	`
+
+	// 17 -> 18 (Coop: Sanitized HTML rendering of chat messages)
+	migrate17To18AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN html TEXT NOT NULL DEFAULT('');
+	`
+
+	// 18 -> 19 (Coop: Encrypted message envelopes)
+	migrate18To19AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN envelope TEXT NOT NULL DEFAULT('');
+	`
+
+	// 19 -> 20 (Coop: Image dimensions and blurhash of attachments)
+	migrate19To20AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_width INT NOT NULL DEFAULT('0');
+		ALTER TABLE messages ADD COLUMN attachment_height INT NOT NULL DEFAULT('0');
+		ALTER TABLE messages ADD COLUMN attachment_blurhash TEXT NOT NULL DEFAULT('');
+	`
+
+	// 20 -> 21
+	migrate20To21AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_hash TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_attachment_hash ON messages (attachment_hash);
+		CREATE TABLE IF NOT EXISTS attachment_blobs (
+			hash TEXT PRIMARY KEY,
+			size INT NOT NULL,
+			last_used INT NOT NULL
+		);
+	`
+
+	// 21 -> 22 (Coop: Resumable attachment uploads)
+	migrate21To22CreateAttachmentUploadsTableQuery = `
+		CREATE TABLE IF NOT EXISTS attachment_uploads (
+			id TEXT PRIMARY KEY,
+			user TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			size INT NOT NULL,
+			received INT NOT NULL DEFAULT 0,
+			chunks INT NOT NULL DEFAULT 0,
+			expires INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_attachment_uploads_user ON attachment_uploads (user);
+		CREATE INDEX IF NOT EXISTS idx_attachment_uploads_expires ON attachment_uploads (expires);
+	`
 )
 
 var (
@@ -376,6 +478,11 @@ var (
 		14: migrateFrom14,
 		15: migrateFrom15,
 		16: migrateFrom16,
+		17: migrateFrom17,
+		18: migrateFrom18,
+		19: migrateFrom19,
+		20: migrateFrom20,
+		21: migrateFrom21,
 	}
 )
 
@@ -468,19 +575,24 @@ func (c *messageCache) addMessages(ms []*message) error {
 	}
 	defer stmt.Close()
 	for _, m := range ms {
-		if m.Event != messageEvent && m.Event != messageDeleteEvent && m.Event != messageClearEvent && m.Event != coopNudgeEvent {
+		if m.Event != messageEvent && m.Event != messageDeleteEvent && m.Event != messageClearEvent && m.Event != coopNudgeEvent && m.Event != coopKeyChangeEvent && m.Event != coopContactCardEvent {
 			return errUnexpectedMessageType
 		}
 		published := m.Time <= time.Now().Unix()
 		tags := strings.Join(m.Tags, ",")
-		var attachmentName, attachmentType, attachmentURL string
+		var attachmentName, attachmentType, attachmentURL, attachmentBlurHash, attachmentHash string
 		var attachmentSize, attachmentExpires, attachmentDeleted int64
+		var attachmentWidth, attachmentHeight int
 		if m.Attachment != nil {
 			attachmentName = m.Attachment.Name
 			attachmentType = m.Attachment.Type
 			attachmentSize = m.Attachment.Size
 			attachmentExpires = m.Attachment.Expires
 			attachmentURL = m.Attachment.URL
+			attachmentWidth = m.Attachment.Width
+			attachmentHeight = m.Attachment.Height
+			attachmentBlurHash = m.Attachment.BlurHash
+			attachmentHash = m.Attachment.Hash
 		}
 		var actionsStr string
 		if len(m.Actions) > 0 {
@@ -490,6 +602,14 @@ func (c *messageCache) addMessages(ms []*message) error {
 			}
 			actionsStr = string(actionsBytes)
 		}
+		var envelopeStr string
+		if m.Envelope != nil {
+			envelopeBytes, err := json.Marshal(m.Envelope)
+			if err != nil {
+				return err
+			}
+			envelopeStr = string(envelopeBytes)
+		}
 		var sender string
 		if m.Sender.IsValid() {
 			sender = m.Sender.String()
@@ -522,6 +642,12 @@ func (c *messageCache) addMessages(ms []*message) error {
 			published,
 			m.ReplyTo,
 			m.ReplyToText,
+			m.HTML,
+			envelopeStr,
+			attachmentWidth,
+			attachmentHeight,
+			attachmentBlurHash,
+			attachmentHash,
 		)
 		if err != nil {
 			return err
@@ -869,6 +995,26 @@ func (c *messageCache) AttachmentBytesUsedByUser(userID string) (int64, error) {
 	return c.readAttachmentBytesUsed(rows)
 }
 
+// UniqueAttachmentBytesUsedBySender is like AttachmentBytesUsedBySender, but counts attachments with the same
+// contents only once
+func (c *messageCache) UniqueAttachmentBytesUsedBySender(sender string) (int64, error) {
+	rows, err := c.db.Query(selectUniqueAttachmentsSizeBySenderQuery, sender, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return c.readAttachmentBytesUsed(rows)
+}
+
+// UniqueAttachmentBytesUsedByUser is like AttachmentBytesUsedByUser, but counts attachments with the same
+// contents only once
+func (c *messageCache) UniqueAttachmentBytesUsedByUser(userID string) (int64, error) {
+	rows, err := c.db.Query(selectUniqueAttachmentsSizeByUserIDQuery, userID, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return c.readAttachmentBytesUsed(rows)
+}
+
 func (c *messageCache) readAttachmentBytesUsed(rows *sql.Rows) (int64, error) {
 	defer rows.Close()
 	var size int64
@@ -883,6 +1029,152 @@ func (c *messageCache) readAttachmentBytesUsed(rows *sql.Rows) (int64, error) {
 	return size, nil
 }
 
+// TouchAttachmentBlob marks an attachment blob as used, so that it is not pruned before a new message referencing
+// it is written to the database. It returns false if the blob does not exist.
+func (c *messageCache) TouchAttachmentBlob(hash string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, err := c.db.Exec(touchAttachmentBlobQuery, time.Now().Unix(), hash)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// AddAttachmentBlob registers a newly stored attachment blob
+func (c *messageCache) AddAttachmentBlob(hash string, size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.db.Exec(insertAttachmentBlobQuery, hash, size, time.Now().Unix())
+	return err
+}
+
+// AttachmentBlobRefs returns the number of messages referencing an attachment blob
+func (c *messageCache) AttachmentBlobRefs(hash string) (int, error) {
+	var refs int
+	if err := c.db.QueryRow(selectAttachmentBlobRefsQuery, hash).Scan(&refs); err != nil {
+		return 0, err
+	}
+	return refs, nil
+}
+
+// AttachmentBlobsUnreferenced returns the hashes of attachment blobs that are not referenced by any message
+// (with a non-deleted attachment), and were last used at or before the given time
+func (c *messageCache) AttachmentBlobsUnreferenced(usedBefore time.Time) ([]string, error) {
+	rows, err := c.db.Query(selectAttachmentBlobsUnreferencedQuery, usedBefore.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := make([]string, 0)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// DeleteAttachmentBlobs removes attachment blobs from the database
+func (c *messageCache) DeleteAttachmentBlobs(hashes ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, hash := range hashes {
+		if _, err := tx.Exec(deleteAttachmentBlobQuery, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddAttachmentUpload registers a new resumable upload
+func (c *messageCache) AddAttachmentUpload(u *attachmentUpload) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.db.Exec(insertAttachmentUploadQuery, u.ID, u.User, u.Filename, u.Size, u.Received, u.Chunks, u.Expires)
+	return err
+}
+
+// UpdateAttachmentUpload stores the progress of a resumable upload after a chunk was received
+func (c *messageCache) UpdateAttachmentUpload(u *attachmentUpload) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.db.Exec(updateAttachmentUploadQuery, u.Received, u.Chunks, u.Expires, u.ID)
+	return err
+}
+
+// DeleteAttachmentUpload removes a resumable upload from the database
+func (c *messageCache) DeleteAttachmentUpload(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.db.Exec(deleteAttachmentUploadQuery, id)
+	return err
+}
+
+// AttachmentUpload returns the resumable upload with the given ID, or errUploadNotFound if it does not
+// exist or has expired
+func (c *messageCache) AttachmentUpload(id string) (*attachmentUpload, error) {
+	rows, err := c.db.Query(selectAttachmentUploadQuery, id, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := readAttachmentUploads(rows)
+	if err != nil {
+		return nil, err
+	} else if len(uploads) == 0 {
+		return nil, errUploadNotFound
+	}
+	return uploads[0], nil
+}
+
+// AttachmentUploadsByUser returns the resumable uploads of a user that have not expired
+func (c *messageCache) AttachmentUploadsByUser(userID string) ([]*attachmentUpload, error) {
+	rows, err := c.db.Query(selectAttachmentUploadsByUserQuery, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return readAttachmentUploads(rows)
+}
+
+// AttachmentUploadsExpired returns the resumable uploads that have expired, but were not deleted yet
+func (c *messageCache) AttachmentUploadsExpired() ([]*attachmentUpload, error) {
+	rows, err := c.db.Query(selectAttachmentUploadsExpiredQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return readAttachmentUploads(rows)
+}
+
+func readAttachmentUploads(rows *sql.Rows) ([]*attachmentUpload, error) {
+	defer rows.Close()
+	uploads := make([]*attachmentUpload, 0)
+	for rows.Next() {
+		var u attachmentUpload
+		if err := rows.Scan(&u.ID, &u.User, &u.Filename, &u.Size, &u.Received, &u.Chunks, &u.Expires); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, &u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
 func (c *messageCache) processMessageBatches() {
 	if c.queue == nil {
 		return
@@ -912,8 +1204,8 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 
 func readMessage(rows *sql.Rows) (*message, error) {
 	var timestamp, expires, attachmentSize, attachmentExpires int64
-	var priority int
-	var id, sequenceID, event, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, sender, senderName, user, contentType, encoding, replyTo, replyToText string
+	var priority, attachmentWidth, attachmentHeight int
+	var id, sequenceID, event, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, sender, senderName, user, contentType, encoding, replyTo, replyToText, html, envelopeStr, attachmentBlurHash, attachmentHash string
 	err := rows.Scan(
 		&id,
 		&sequenceID,
@@ -940,6 +1232,12 @@ func readMessage(rows *sql.Rows) (*message, error) {
 		&encoding,
 		&replyTo,
 		&replyToText,
+		&html,
+		&envelopeStr,
+		&attachmentWidth,
+		&attachmentHeight,
+		&attachmentBlurHash,
+		&attachmentHash,
 	)
 	if err != nil {
 		return nil, err
@@ -958,14 +1256,24 @@ func readMessage(rows *sql.Rows) (*message, error) {
 	if err != nil {
 		senderIP = netip.Addr{} // if no IP stored in database, return invalid address
 	}
+	var env *envelope
+	if envelopeStr != "" {
+		if err := json.Unmarshal([]byte(envelopeStr), &env); err != nil {
+			return nil, err
+		}
+	}
 	var att *attachment
 	if attachmentName != "" && attachmentURL != "" {
 		att = &attachment{
-			Name:    attachmentName,
-			Type:    attachmentType,
-			Size:    attachmentSize,
-			Expires: attachmentExpires,
-			URL:     attachmentURL,
+			Name:     attachmentName,
+			Type:     attachmentType,
+			Size:     attachmentSize,
+			Expires:  attachmentExpires,
+			URL:      attachmentURL,
+			Width:    attachmentWidth,
+			Height:   attachmentHeight,
+			BlurHash: attachmentBlurHash,
+			Hash:     attachmentHash,
 		}
 	}
 	return &message{
@@ -986,6 +1294,8 @@ func readMessage(rows *sql.Rows) (*message, error) {
 		SenderName:  senderName,
 		ReplyTo:     replyTo,
 		ReplyToText: replyToText,
+		HTML:        html,
+		Envelope:    env,
 		Sender:      senderIP, // Must parse assuming database must be correct
 		User:        user,
 		ContentType: contentType,
@@ -1321,3 +1631,83 @@ func migrateFrom16(db *sql.DB, _ time.Duration) error {
 	}
 	return tx.Commit()
 }
+
+func migrateFrom17(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 17 to 18")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate17To18AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 18); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom18(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 18 to 19")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate18To19AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 19); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom19(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 19 to 20")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate19To20AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 20); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom20(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 20 to 21")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate20To21AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 21); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom21(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 21 to 22")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate21To22CreateAttachmentUploadsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 22); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"net/netip"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -451,6 +452,72 @@ func testCacheAttachmentsExpired(t *testing.T, c *messageCache) {
 	require.Equal(t, "m4", ids[0])
 }
 
+func TestSqliteCache_AttachmentBlobs(t *testing.T) {
+	testCacheAttachmentBlobs(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentBlobs(t *testing.T) {
+	testCacheAttachmentBlobs(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentBlobs(t *testing.T, c *messageCache) {
+	hash := strings.Repeat("ab", 32)
+	exists, err := c.TouchAttachmentBlob(hash)
+	require.Nil(t, err)
+	require.False(t, exists)
+	require.Nil(t, c.AddAttachmentBlob(hash, 5000))
+	exists, err = c.TouchAttachmentBlob(hash)
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	for _, id := range []string{"m1", "m2"} {
+		m := newDefaultMessage("mytopic", "flower for you")
+		m.ID = id
+		m.SequenceID = id
+		m.User = "u_1234"
+		m.Attachment = &attachment{
+			Name:    "flower.jpg",
+			Type:    "image/jpeg",
+			Size:    5000,
+			Expires: time.Now().Add(time.Hour).Unix(),
+			URL:     "https://ntfy.sh/file/" + id + ".jpg",
+			Hash:    hash,
+		}
+		require.Nil(t, c.AddMessage(m))
+	}
+	refs, err := c.AttachmentBlobRefs(hash)
+	require.Nil(t, err)
+	require.Equal(t, 2, refs)
+	m, err := c.Message("m1")
+	require.Nil(t, err)
+	require.Equal(t, hash, m.Attachment.Hash)
+
+	// Both messages count towards the upload quota, but only once towards the unique quota
+	size, err := c.AttachmentBytesUsedByUser("u_1234")
+	require.Nil(t, err)
+	require.Equal(t, int64(10000), size)
+	size, err = c.UniqueAttachmentBytesUsedByUser("u_1234")
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), size)
+
+	// Blob is only unreferenced once all messages are gone
+	require.Nil(t, c.MarkAttachmentsDeleted("m1"))
+	hashes, err := c.AttachmentBlobsUnreferenced(time.Now())
+	require.Nil(t, err)
+	require.Empty(t, hashes)
+	require.Nil(t, c.DeleteMessages("m2"))
+	hashes, err = c.AttachmentBlobsUnreferenced(time.Now().Add(-time.Minute)) // Used too recently
+	require.Nil(t, err)
+	require.Empty(t, hashes)
+	hashes, err = c.AttachmentBlobsUnreferenced(time.Now())
+	require.Nil(t, err)
+	require.Equal(t, []string{hash}, hashes)
+	require.Nil(t, c.DeleteAttachmentBlobs(hashes...))
+	exists, err = c.TouchAttachmentBlob(hash)
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
 func TestSqliteCache_Migration_From0(t *testing.T) {
 	filename := newSqliteTestCacheFile(t)
 	db, err := sql.Open("sqlite3", filename)
@@ -0,0 +1,505 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal client for S3-compatible object stores (AWS S3, MinIO, Garage, ...). It only supports
+// the operations needed to store attachments. Requests use path-style addressing, and are signed with AWS
+// Signature Version 4.
+
+const (
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3Service       = "s3"
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+	s3DefaultRegion = "us-east-1"
+	s3PartSize      = 5 * 1024 * 1024 // Minimum size of all but the last part of a multipart upload
+	s3Timeout       = 5 * time.Minute
+)
+
+var (
+	errS3InvalidURL = errors.New("invalid S3 URL, must be http(s)://ACCESS_KEY:SECRET_KEY@HOST/BUCKET[/PREFIX][?region=REGION]")
+)
+
+// s3Config holds the connection details of an S3 bucket
+type s3Config struct {
+	Endpoint  string // Scheme and host, e.g. https://s3.eu-central-1.amazonaws.com
+	Bucket    string
+	Prefix    string // Object key prefix, empty or ending with a slash
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// parseS3URL parses an S3 URL of the form http(s)://ACCESS_KEY:SECRET_KEY@HOST/BUCKET[/PREFIX][?region=REGION]
+func parseS3URL(rawURL string) (*s3Config, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User == nil {
+		return nil, errS3InvalidURL
+	}
+	secretKey, ok := u.User.Password()
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if !ok || u.User.Username() == "" || secretKey == "" || bucket == "" {
+		return nil, errS3InvalidURL
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	return &s3Config{
+		Endpoint:  u.Scheme + "://" + u.Host,
+		Bucket:    bucket,
+		Prefix:    prefix,
+		Region:    region,
+		AccessKey: u.User.Username(),
+		SecretKey: secretKey,
+	}, nil
+}
+
+type s3Client struct {
+	config *s3Config
+	client *http.Client
+}
+
+func newS3Client(config *s3Config) *s3Client {
+	return &s3Client{
+		config: config,
+		client: &http.Client{Timeout: s3Timeout},
+	}
+}
+
+// s3Error is an error response returned by the object store
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s (status code %d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// Is makes errors.Is(err, fs.ErrNotExist) work for missing objects
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Upload stores an object, using a single PUT request for small objects and a multipart upload for large ones,
+// so that objects never have to be buffered completely in memory. It returns the number of bytes written.
+func (c *s3Client) Upload(key string, r io.Reader) (int64, error) {
+	part, err := s3ReadPart(r)
+	if err != nil {
+		return 0, err
+	} else if len(part) < s3PartSize {
+		return int64(len(part)), c.PutObject(key, part)
+	}
+	uploadID, err := c.CreateMultipartUpload(key)
+	if err != nil {
+		return 0, err
+	}
+	size, err := c.uploadParts(key, uploadID, r, part)
+	if err != nil {
+		_ = c.AbortMultipartUpload(key, uploadID) // Best effort, the original error is more relevant
+		return 0, err
+	}
+	return size, nil
+}
+
+func (c *s3Client) uploadParts(key, uploadID string, r io.Reader, part []byte) (int64, error) {
+	var size int64
+	parts := make([]s3CompletePart, 0)
+	for len(part) > 0 {
+		etag, err := c.UploadPart(key, uploadID, len(parts)+1, part)
+		if err != nil {
+			return 0, err
+		}
+		parts = append(parts, s3CompletePart{PartNumber: len(parts) + 1, ETag: etag})
+		size += int64(len(part))
+		if part, err = s3ReadPart(r); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.CompleteMultipartUpload(key, uploadID, parts); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// PutObject stores an object with a single request
+func (c *s3Client) PutObject(key string, body []byte) error {
+	resp, err := c.do(http.MethodPut, key, nil, nil, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CreateMultipartUpload starts a multipart upload, and returns its upload ID
+func (c *s3Client) CreateMultipartUpload(key string) (string, error) {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result s3InitiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	} else if result.UploadID == "" {
+		return "", errors.New("s3: missing upload ID")
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart uploads a part of a multipart upload, and returns its ETag
+func (c *s3Client) UploadPart(key, uploadID string, partNumber int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+	resp, err := c.do(http.MethodPut, key, query, nil, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// CompleteMultipartUpload assembles the uploaded parts into the final object
+func (c *s3Client) CompleteMultipartUpload(key, uploadID string, parts []s3CompletePart) error {
+	body, err := xml.Marshal(&s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/xml"}}
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The response status is 200 even if the upload failed after the response was started
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	} else if bytes.Contains(b, []byte("<Error>")) {
+		return s3ErrorFromBody(resp.StatusCode, b)
+	}
+	return nil
+}
+
+// AbortMultipartUpload aborts a multipart upload, and deletes the parts uploaded so far
+func (c *s3Client) AbortMultipartUpload(key, uploadID string) error {
+	resp, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// GetObject reads length bytes of an object, starting at offset (a negative length reads until the end),
+// and returns the total size of the object
+func (c *s3Client) GetObject(key string, offset, length int64) (io.ReadCloser, int64, error) {
+	var header http.Header
+	if length >= 0 {
+		if length == 0 {
+			return io.NopCloser(bytes.NewReader(nil)), 0, nil
+		}
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	} else if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := c.do(http.MethodGet, key, nil, header, nil)
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return io.NopCloser(bytes.NewReader(nil)), 0, nil // Object is empty, or offset is beyond its end
+	} else if err != nil {
+		return nil, 0, err
+	}
+	size := resp.ContentLength
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+			if total, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+				size = total
+			}
+		}
+	}
+	return resp.Body, size, nil
+}
+
+// HeadObject returns the size of an object
+func (c *s3Client) HeadObject(key string) (int64, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// DeleteObject deletes an object. Deleting an object that does not exist is not an error.
+func (c *s3Client) DeleteObject(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CopyObject copies an object within the bucket. Objects larger than 5 GB cannot be copied this way.
+func (c *s3Client) CopyObject(key, newKey string) error {
+	header := http.Header{"X-Amz-Copy-Source": {c.objectURL(key).EscapedPath()}}
+	resp, err := c.do(http.MethodPut, newKey, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The copy may fail after the response status was sent, in which case the body contains the error
+	b, err := io.ReadAll(io.LimitReader(resp.Body, jsonBodyBytesLimit))
+	if err != nil {
+		return err
+	} else if bytes.Contains(b, []byte("<Error>")) {
+		return s3ErrorFromBody(http.StatusInternalServerError, b)
+	}
+	return nil
+}
+
+// ListSize returns the total size of all objects directly below the given prefix
+func (c *s3Client) ListSize(prefix string) (int64, error) {
+	var size int64
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+		for _, object := range result.Contents {
+			size += object.Size
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return size, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// PresignedURL returns a URL that allows downloading an object without credentials until the expiry.
+// Additional query parameters (e.g. response-content-disposition) are included in the signature.
+func (c *s3Client) PresignedURL(key string, query url.Values, expiry time.Duration) string {
+	return c.presign(c.objectURL(key), query, expiry, time.Now())
+}
+
+func (c *s3Client) presign(u *url.URL, query url.Values, expiry time.Duration, now time.Time) string {
+	now = now.UTC()
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("X-Amz-Algorithm", s3Algorithm)
+	q.Set("X-Amz-Credential", c.config.AccessKey+"/"+c.scope(now))
+	q.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		s3URIEncode(u.Path, false),
+		s3CanonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	q.Set("X-Amz-Signature", c.signature(now, canonicalRequest))
+	presigned := *u
+	presigned.RawQuery = s3CanonicalQuery(q)
+	return presigned.String()
+}
+
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := c.objectURL(key)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	hash := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(hash[:]), time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, jsonBodyBytesLimit))
+		return nil, s3ErrorFromBody(resp.StatusCode, b)
+	}
+	return resp, nil
+}
+
+// objectURL returns the path-style URL of an object, or of the bucket if the key is empty
+func (c *s3Client) objectURL(key string) *url.URL {
+	u, _ := url.Parse(c.config.Endpoint) // Validated in parseS3URL
+	u.Path = "/" + c.config.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3URIEncode(u.Path, false)
+	return u
+}
+
+// sign adds the AWS Signature Version 4 authorization header to the request
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders, canonicalHeaders := s3CanonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, c.config.AccessKey, c.scope(now), signedHeaders, c.signature(now, canonicalRequest)))
+}
+
+func (c *s3Client) scope(now time.Time) string {
+	return strings.Join([]string{now.Format(s3DateFormat), c.config.Region, s3Service, "aws4_request"}, "/")
+}
+
+func (c *s3Client) signature(now time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3TimeFormat), c.scope(now), hex.EncodeToString(hash[:])}, "\n")
+	key := s3HMAC([]byte("AWS4"+c.config.SecretKey), now.Format(s3DateFormat))
+	key = s3HMAC(key, c.config.Region)
+	key = s3HMAC(key, s3Service)
+	key = s3HMAC(key, "aws4_request")
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+// s3CanonicalHeaders returns the signed headers and the canonical headers of a request. Only the host,
+// the range, the content type, and the x-amz-* headers are signed.
+func s3CanonicalHeaders(req *http.Request) (signedHeaders string, canonicalHeaders string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "range" || name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(query))
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// s3URIEncode encodes a string as required by Signature Version 4: everything but unreserved characters
+// (and slashes in paths) is percent-encoded
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3ReadPart reads up to s3PartSize bytes; the buffer only grows as needed, so small files stay small
+func s3ReadPart(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, s3PartSize); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func s3ErrorFromBody(statusCode int, body []byte) error {
+	e := &s3Error{StatusCode: statusCode}
+	_ = xml.Unmarshal(body, e) // Body may be empty (e.g. for HEAD requests)
+	return e
+}
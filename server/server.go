@@ -6,10 +6,12 @@ import (
 	"crypto/sha256"
 	"embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -58,11 +60,21 @@ type Server struct {
 	userManager       *user.Manager                       // Might be nil!
 	messageCache      *messageCache                       // Database that stores the messages
 	webPush           *webPushStore                       // Database that stores web push subscriptions
-	fileCache         *fileCache                          // File system based cache that stores attachments
+	fileCache         attachmentStore                     // Stores attachments (file system or S3), may be nil
+	avatarStore       attachmentStore                     // Stores avatars (file system or S3), may be nil
 	stripe            stripeAPI                           // Stripe API, can be replaced with a mock
 	priceCache        *util.LookupCache[map[string]int64] // Stripe price ID -> price as cents (USD implied!)
 	metricsHandler    http.Handler                        // Handles /metrics if enable-metrics set, and listen-metrics-http not set
 	socialRateLimiter *socialRateLimiter                  // Rate limiter for typing/nudge events
+	passwordPolicy    *user.PasswordPolicy                // Requirements for new passwords
+	oidcProvider      *oidcProvider                       // OpenID Connect single sign-on, may be nil
+	ldapAuther        *user.LDAPAuther                    // LDAP authentication (falls back to userManager), may be nil
+	attachmentURLKey  []byte                              // Key to sign attachment URLs, see withSignedAttachmentURL
+	fileCipher        *fileCipher                         // Encrypts attachments and avatars at rest, may be nil
+	attachmentBlobsMu sync.Mutex                          // Serializes storing and pruning attachment blobs
+	uploadsActive     map[string]bool                     // Resumable uploads that are currently being written, see lockUpload
+	uploadsMu         sync.Mutex                          // Protects uploadsActive
+	unknownUserAudits *auditSampler                       // Limits audit entries for failed logins of unknown users
 	closeChan         chan bool
 	mu                sync.RWMutex
 }
@@ -193,25 +205,36 @@ func New(conf *Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	var fileCache *fileCache
-	if conf.AttachmentCacheDir != "" {
-		fileCache, err = newFileCache(conf.AttachmentCacheDir, conf.AttachmentTotalSizeLimit)
+	var fileCipher *fileCipher
+	if len(conf.AttachmentEncryptionKey) > 0 {
+		fileCipher, err = newFileCipher(conf.AttachmentEncryptionKey)
 		if err != nil {
 			return nil, err
 		}
 	}
+	fileCache, avatarStore, err := newAttachmentStores(conf, fileCipher)
+	if err != nil {
+		return nil, err
+	}
+	attachmentURLKey, err := newAttachmentURLKey(conf.AttachmentURLSecret)
+	if err != nil {
+		return nil, err
+	}
 	var userManager *user.Manager
 	if conf.AuthFile != "" {
 		authConfig := &user.Config{
-			Filename:            conf.AuthFile,
-			StartupQueries:      conf.AuthStartupQueries,
-			DefaultAccess:       conf.AuthDefault,
-			ProvisionEnabled:    true, // Enable provisioning of users and access
-			Users:               conf.AuthUsers,
-			Access:              conf.AuthAccess,
-			Tokens:              conf.AuthTokens,
-			BcryptCost:          conf.AuthBcryptCost,
-			QueueWriterInterval: conf.AuthStatsQueueWriterInterval,
+			Filename:             conf.AuthFile,
+			StartupQueries:       conf.AuthStartupQueries,
+			DefaultAccess:        conf.AuthDefault,
+			ProvisionEnabled:     true, // Enable provisioning of users and access
+			Users:                conf.AuthUsers,
+			Access:               conf.AuthAccess,
+			Tokens:               conf.AuthTokens,
+			BcryptCost:           conf.AuthBcryptCost,
+			QueueWriterInterval:  conf.AuthStatsQueueWriterInterval,
+			LoginFailureLimit:    conf.AuthLoginFailureLimit,
+			LoginLockDuration:    conf.AuthLoginLockDuration,
+			LoginLockMaxDuration: conf.AuthLoginLockMaxDuration,
 		}
 		userManager, err = user.NewManager(authConfig)
 		if err != nil {
@@ -237,6 +260,7 @@ func New(conf *Config) (*Server, error) {
 		messageCache:    messageCache,
 		webPush:         webPush,
 		fileCache:       fileCache,
+		avatarStore:     avatarStore,
 		firebaseClient:  firebaseClient,
 		smtpSender:      mailer,
 		topics:          topics,
@@ -246,6 +270,38 @@ func New(conf *Config) (*Server, error) {
 		visitors:          make(map[string]*visitor),
 		stripe:            stripe,
 		socialRateLimiter: newSocialRateLimiter(),
+		attachmentURLKey:  attachmentURLKey,
+		fileCipher:        fileCipher,
+		uploadsActive:     make(map[string]bool),
+		unknownUserAudits: newAuditSampler(auditUnknownUserLimitReplenish, auditUnknownUserLimitBurst),
+		passwordPolicy: &user.PasswordPolicy{
+			MinLength:        conf.AuthPasswordMinLength,
+			MinClasses:       conf.AuthPasswordMinClasses,
+			DisallowUsername: conf.AuthPasswordDisallowUsername,
+			BreachedDir:      conf.AuthPasswordBreachedDir,
+		},
+	}
+	for _, t := range topics {
+		t.SetBlockers(s.blockerIDs)
+	}
+	if conf.AuthOIDCIssuer != "" {
+		s.oidcProvider = newOIDCProvider(conf)
+	}
+	if conf.AuthLDAPURL != "" && userManager != nil {
+		s.ldapAuther = user.NewLDAPAuther(userManager, &user.LDAPConfig{
+			URL:                  conf.AuthLDAPURL,
+			StartTLS:             conf.AuthLDAPStartTLS,
+			BindDN:               conf.AuthLDAPBindDN,
+			BindPassword:         conf.AuthLDAPBindPassword,
+			BaseDN:               conf.AuthLDAPBaseDN,
+			UserFilter:           conf.AuthLDAPUserFilter,
+			GroupAttribute:       conf.AuthLDAPGroupAttribute,
+			DisplayNameAttribute: conf.AuthLDAPDisplayNameAttribute,
+			AvatarAttribute:      conf.AuthLDAPAvatarAttribute,
+			AdminGroups:          conf.AuthLDAPAdminGroups,
+			TierGroups:           conf.AuthLDAPTierGroups,
+			SyncAvatar:           s.syncAvatar,
+		})
 	}
 	s.priceCache = util.NewLookupCache(s.fetchStripePrices, conf.StripePriceCacheDuration)
 	return s, nil
@@ -399,6 +455,11 @@ func (s *Server) closeDatabases() {
 
 // handle is the main entry point for all HTTP requests
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.withSecurityHeaders(s.handleRequest)(w, r)
+}
+
+// handleRequest authenticates the visitor and dispatches the request, see handleInternal
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	v, err := s.maybeAuthenticate(r) // Note: Always returns v, even when error is returned
 	if err != nil {
 		s.handleError(w, r, v, err)
@@ -466,7 +527,6 @@ func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor,
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
 	w.WriteHeader(httpErr.HTTPCode)
 	io.WriteString(w, httpErr.JSON()+"\n")
 }
@@ -498,6 +558,10 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureAdmin(s.handleAccessAllow)(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiUsersAccessPath {
 		return s.ensureAdmin(s.handleAccessReset)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAuthOIDCLoginPath {
+		return s.ensureOIDCEnabled(s.limitRequests(s.handleOIDCLogin))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAuthOIDCCallbackPath {
+		return s.ensureOIDCEnabled(s.limitRequests(s.handleOIDCCallback))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPath {
 		return s.ensureUserManager(s.handleAccountCreate)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountPath {
@@ -550,10 +614,28 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureAdmin(s.handleAdminUsersGet)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAdminUsersPath {
 		return s.ensureAdmin(s.handleAdminUserCreate)(w, r, v)
+	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, apiAdminUsersPath+"/") && strings.HasSuffix(r.URL.Path, adminUserSuspensionSuffix) {
+		return s.ensureAdmin(s.handleAdminUserSuspend)(w, r, v)
+	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, apiAdminUsersPath+"/") && strings.HasSuffix(r.URL.Path, adminUserSuspensionSuffix) {
+		return s.ensureAdmin(s.handleAdminUserUnsuspend)(w, r, v)
+	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, apiAdminUsersPath+"/") && strings.HasSuffix(r.URL.Path, adminUserOIDCSuffix) {
+		return s.ensureOIDCEnabled(s.ensureAdmin(s.handleAdminUserOIDCLink))(w, r, v)
+	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, apiAdminUsersPath+"/") && strings.HasSuffix(r.URL.Path, adminUserOIDCSuffix) {
+		return s.ensureOIDCEnabled(s.ensureAdmin(s.handleAdminUserOIDCUnlink))(w, r, v)
 	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, apiAdminUsersPath+"/") {
 		return s.ensureAdmin(s.handleAdminUserUpdate)(w, r, v)
+	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, apiAdminUsersPath+"/") && strings.HasSuffix(r.URL.Path, "/lock") {
+		return s.ensureAdmin(s.handleAdminUserUnlock)(w, r, v)
 	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, apiAdminUsersPath+"/") {
 		return s.ensureAdmin(s.handleAdminUserDelete)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminReportsPath {
+		return s.ensureAdmin(s.handleAdminReportsGet)(w, r, v)
+	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, apiAdminReportsPrefix) {
+		return s.ensureAdmin(s.handleAdminReportUpdate)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminAuditPath {
+		return s.ensureAdmin(s.handleAdminAuditGet)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminAuditExportPath {
+		return s.ensureAdmin(s.handleAdminAuditExport)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == "/v1/admin/topics/stats" {
 		return s.ensureAdmin(s.handleAdminTopicStatsList)(w, r, v)
 	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/admin/topics/") {
@@ -596,21 +678,55 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureUser(s.handleReactionList)(w, r, v)
 	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/coop/messages/") && strings.Contains(r.URL.Path, "/reactions/") {
 		return s.ensureUser(s.handleReactionDelete)(w, r, v)
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/coop/messages/") && strings.HasSuffix(r.URL.Path, "/html") {
+		return s.ensureUser(s.handleMessageHTML)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == "/v1/coop/reactions" {
 		return s.ensureUser(s.handleReactionsByTopic)(w, r, v)
+	// Coop: Reports
+	} else if r.Method == http.MethodPost && r.URL.Path == apiReportsPath {
+		return s.ensureUser(s.limitRequests(s.handleReportCreate))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiReportsPath {
+		return s.ensureUser(s.handleReportList)(w, r, v)
 	// Coop: Contacts
 	} else if r.Method == http.MethodGet && r.URL.Path == "/v1/coop/contacts" {
 		return s.ensureUser(s.handleContactList)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiContactsExportPath {
+		return s.ensureUser(s.handleContactsExport)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiContactsImportPath {
+		return s.ensureUser(s.limitRequests(s.handleContactsImport))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiContactCardPath {
+		return s.ensureUser(s.limitRequests(s.limitMessages(s.handleContactCardShare)))(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == "/v1/coop/contacts/requests" {
 		return s.ensureUser(s.handleContactRequests)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == "/v1/coop/contacts" {
 		return s.ensureUser(s.handleContactAdd)(w, r, v)
 	} else if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v1/coop/contacts/") && strings.HasSuffix(r.URL.Path, "/block") {
 		return s.ensureUser(s.handleContactBlock)(w, r, v)
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/coop/contacts/") && strings.HasSuffix(r.URL.Path, apiContactVerificationSuffix) {
+		return s.ensureUser(s.handleContactVerificationGet)(w, r, v)
+	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/coop/contacts/") && strings.HasSuffix(r.URL.Path, apiContactVerificationSuffix) {
+		return s.ensureUser(s.handleContactVerify)(w, r, v)
+	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/coop/contacts/") && strings.HasSuffix(r.URL.Path, apiContactVerificationSuffix) {
+		return s.ensureUser(s.handleContactUnverify)(w, r, v)
+	} else if r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/v1/coop/contacts/") {
+		return s.ensureUser(s.handleContactPatch)(w, r, v)
 	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/coop/contacts/") {
 		return s.ensureUser(s.handleContactUpdate)(w, r, v)
 	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/coop/contacts/") {
 		return s.ensureUser(s.handleContactDelete)(w, r, v)
+	// Coop: Contact invites
+	} else if r.Method == http.MethodPost && r.URL.Path == apiContactInvitesPath {
+		return s.ensureUser(s.limitRequests(s.handleContactInviteCreate))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiContactInvitesPath {
+		return s.ensureUser(s.handleContactInviteList)(w, r, v)
+	} else if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, apiContactInvitesPrefix) && strings.HasSuffix(r.URL.Path, contactInviteRedeemSuffix) {
+		return s.ensureUser(s.limitRequests(s.handleContactInviteRedeem))(w, r, v)
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, apiContactInvitesPrefix) && (strings.HasSuffix(r.URL.Path, contactInviteQRSuffixPNG) || strings.HasSuffix(r.URL.Path, contactInviteQRSuffixSVG)) {
+		return s.limitRequests(s.handleContactInviteQR)(w, r, v)
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, apiContactInvitesPrefix) {
+		return s.limitRequests(s.handleContactInviteInfo)(w, r, v)
+	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, apiContactInvitesPrefix) {
+		return s.ensureUser(s.handleContactInviteDelete)(w, r, v)
 	// Coop: User Search
 	} else if r.Method == http.MethodGet && r.URL.Path == "/v1/coop/users/search" {
 		return s.ensureUser(s.handleUserSearch)(w, r, v)
@@ -619,6 +735,36 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureUser(s.handleDMCreate)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == "/v1/coop/dm" {
 		return s.ensureUser(s.handleDMList)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiDMRequestsPath {
+		return s.ensureUser(s.handleDMRequestList)(w, r, v)
+	} else if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, apiDMRequestsPrefix) && strings.HasSuffix(r.URL.Path, dmRequestAcceptSuffix) {
+		return s.ensureUser(s.handleDMRequestAccept)(w, r, v)
+	} else if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, apiDMRequestsPrefix) && strings.HasSuffix(r.URL.Path, dmRequestDeclineSuffix) {
+		return s.ensureUser(s.handleDMRequestDecline)(w, r, v)
+	// Coop: Resumable uploads
+	} else if r.Method == http.MethodPost && r.URL.Path == apiUploadsPath {
+		return s.ensureUser(s.limitRequests(s.handleUploadCreate))(w, r, v)
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, apiUploadsPrefix) {
+		return s.ensureUser(s.handleUploadGet)(w, r, v)
+	} else if r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, apiUploadsPrefix) {
+		return s.ensureUser(s.limitRequests(s.handleUploadChunk))(w, r, v)
+	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, apiUploadsPrefix) {
+		return s.ensureUser(s.handleUploadDelete)(w, r, v)
+	// Coop: E2E Key Directory
+	} else if r.Method == http.MethodPut && r.URL.Path == apiKeysBackupPath {
+		return s.ensureUser(s.handleKeyBackupPut)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiKeysBackupPath {
+		return s.ensureUser(s.limitRequests(s.handleKeyBackupGet))(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiKeysBackupPath {
+		return s.ensureUser(s.handleKeyBackupDelete)(w, r, v)
+	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, apiKeysDevicesPrefix) {
+		return s.ensureUser(s.handleKeysPublish)(w, r, v)
+	} else if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, apiKeysDevicesPrefix) {
+		return s.ensureUser(s.handleKeysDelete)(w, r, v)
+	} else if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, apiKeysUsersPrefix) && strings.HasSuffix(r.URL.Path, apiKeysBundlesSuffix) {
+		return s.ensureUser(s.limitRequests(s.handleKeysBundles))(w, r, v)
+	} else if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, apiKeysUsersPrefix) {
+		return s.ensureUser(s.handleKeysDevices)(w, r, v)
 	// Coop: Groups / Topic Meta
 	} else if r.Method == http.MethodPost && r.URL.Path == "/v1/coop/groups" {
 		return s.ensureUser(s.handleGroupCreate)(w, r, v)
@@ -639,7 +785,7 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureAdmin(s.handleJoinRequestList)(w, r, v)
 	} else if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/join-requests/") {
 		return s.ensureAdmin(s.handleJoinRequestResolve)(w, r, v)
-	} else if r.Method == http.MethodGet && invitePageRegex.MatchString(r.URL.Path) {
+	} else if r.Method == http.MethodGet && (invitePageRegex.MatchString(r.URL.Path) || contactInvitePageRegex.MatchString(r.URL.Path)) {
 		return s.ensureWebEnabled(s.handleRoot)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiStatsPath {
 		return s.handleStats(w, r, v)
@@ -653,7 +799,7 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureWebEnabled(s.handleStatic)(w, r, v)
 	} else if r.Method == http.MethodGet && docsRegex.MatchString(r.URL.Path) {
 		return s.ensureWebEnabled(s.handleDocs)(w, r, v)
-	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && s.config.AttachmentCacheDir != "" {
+	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && s.fileCache != nil {
 		return s.limitRequests(s.handleFile)(w, r, v)
 	} else if r.Method == http.MethodOptions {
 		return s.limitRequests(s.handleOptions)(w, r, v) // Should work even if the web app is not enabled, see #598
@@ -694,7 +840,6 @@ func (s *Server) handleTopic(w http.ResponseWriter, r *http.Request, v *visitor)
 	unifiedpush := readBoolParam(r, false, "x-unifiedpush", "unifiedpush", "up") // see PUT/POST too!
 	if unifiedpush {
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
 		_, err := io.WriteString(w, `{"unifiedpush":{"version":1}}`+"\n")
 		return err
 	}
@@ -740,6 +885,7 @@ func (s *Server) configResponse() *apiConfigResponse {
 		EnableLogin:        s.config.EnableLogin,
 		RequireLogin:       s.config.RequireLogin,
 		EnableSignup:       s.config.EnableSignup,
+		EnableOIDC:         s.oidcProvider != nil,
 		EnablePayments:     s.config.StripeSecretKey != "",
 		EnableCalls:        s.config.TwilioAccount != "",
 		EnableEmails:       s.config.SMTPSenderFrom != "",
@@ -779,12 +925,33 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request, _ *visito
 }
 
 // handleStatic returns all static resources (excluding the docs), including the web app
-func (s *Server) handleStatic(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+func (s *Server) handleStatic(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if r.URL.Path == webAppIndex {
+		return s.handleWebAppIndex(w, r, v)
+	}
 	r.URL.Path = webSiteDir + r.URL.Path
 	util.Gzip(http.FileServer(http.FS(webFsCached))).ServeHTTP(w, r)
 	return nil
 }
 
+// handleWebAppIndex returns the web app's index page. If the Content-Security-Policy uses a nonce, it is
+// added to all script tags. Since the nonce changes with every request, the page is never served from cache.
+func (s *Server) handleWebAppIndex(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	index, err := fs.ReadFile(webFs, strings.TrimPrefix(webSiteDir+webAppIndex, "/"))
+	if err != nil {
+		return err
+	}
+	if nonce, err := fromContext[string](r, contextCSPNonce); err == nil {
+		index = addCSPNonce(index, nonce)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	util.Gzip(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(index)
+	})).ServeHTTP(w, r)
+	return nil
+}
+
 // handleDocs returns static resources related to the docs
 func (s *Server) handleDocs(w http.ResponseWriter, r *http.Request, _ *visitor) error {
 	util.Gzip(http.FileServer(http.FS(docsStaticCached))).ServeHTTP(w, r)
@@ -810,7 +977,7 @@ func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request, _ *visitor)
 // Before streaming the file to a client, it locates uploader (m.Sender or m.User) in the message cache, so it
 // can associate the download bandwidth with the uploader.
 func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	if s.config.AttachmentCacheDir == "" {
+	if s.fileCache == nil {
 		return errHTTPInternalError
 	}
 	matches := fileRegex.FindStringSubmatch(r.URL.Path)
@@ -818,20 +985,11 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 		return errHTTPInternalErrorInvalidPath
 	}
 	messageID := matches[1]
-	file := filepath.Join(s.config.AttachmentCacheDir, messageID)
-	stat, err := os.Stat(file)
+	thumbnail, err := attachmentThumbnailName(r.URL.Query().Get("size"))
 	if err != nil {
-		return errHTTPNotFound.Fields(log.Context{
-			"message_id":    messageID,
-			"error_context": "filesystem",
-		})
-	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	if r.Method == http.MethodHead {
-		return nil
+		return err
 	}
-	// Find message in database, and associate bandwidth to the uploader user
+	// Find message in database, check if the visitor may read it, and associate bandwidth to the uploader user
 	// This is an easy way to
 	//   - avoid abuse (e.g. 1 uploader, 1k downloaders)
 	//   - and also uses the higher bandwidth limits of a paying user
@@ -853,6 +1011,41 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	} else if err != nil {
 		return err
 	}
+	if err := s.authorizeFileRead(r, v, m); err != nil {
+		return err
+	}
+	originalID := attachmentFileID(m)
+	size, err := s.fileCache.Stat(originalID)
+	if err != nil {
+		return errHTTPNotFound.Fields(log.Context{
+			"message_id":    messageID,
+			"error_context": "attachment_store",
+		})
+	}
+	fileID, rangeHeader := originalID, r.Header.Get("Range")
+	if thumbnail != "" {
+		// Images smaller than the thumbnail size have no thumbnail, so the original is served instead.
+		// Thumbnails are small, so ranges are not supported for them.
+		if thumbnailSize, err := s.fileCache.Stat(attachmentThumbnailID(originalID, thumbnail)); err == nil {
+			fileID, size, rangeHeader = attachmentThumbnailID(originalID, thumbnail), thumbnailSize, ""
+		}
+	}
+	offset, length, partial, err := parseFileRange(rangeHeader, size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return err
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	}
+	if r.Method == http.MethodHead {
+		if partial {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		return nil
+	}
 	bandwidthVisitor := v
 	if s.userManager != nil && m.User != "" {
 		u, err := s.userManager.UserByID(m.User)
@@ -863,18 +1056,36 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	} else if m.Sender.IsValid() {
 		bandwidthVisitor = s.visitor(m.Sender, nil)
 	}
-	if !bandwidthVisitor.BandwidthAllowed(stat.Size()) {
+	if !bandwidthVisitor.BandwidthAllowed(length) {
 		return errHTTPTooManyRequestsLimitAttachmentBandwidth.With(m)
 	}
+	// Let the client download directly from the store, if it supports it. Encrypted files must be decrypted here.
+	if presigner, ok := s.fileCache.(attachmentPresigner); ok && s.fileCipher == nil && fileID == originalID {
+		presignedURL, err := presigner.PresignedURL(originalID, m.Attachment.Name, attachmentContentType(m), attachmentPresignExpiry)
+		if err != nil {
+			return err
+		}
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Range")
+		http.Redirect(w, r, presignedURL, http.StatusFound)
+		return nil
+	}
 	// Actually send file
-	f, err := os.Open(file)
+	f, err := s.fileCache.Read(fileID, offset, length)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if m.Attachment.Name != "" {
+	if m.Attachment.Name != "" && fileID == originalID {
 		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(m.Attachment.Name))
 	}
+	if partial {
+		// Sniffing the content type only works on the start of the file
+		w.Header().Set("Content-Type", attachmentContentType(m))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err = io.Copy(w, f)
+		return err
+	}
 	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f)
 	return err
 }
@@ -896,6 +1107,11 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	if err != nil {
 		return nil, err
 	}
+	if blocked, err := s.dmBlocked(v.User(), t.ID); err != nil {
+		return nil, err
+	} else if blocked {
+		return nil, errHTTPForbiddenDMBlocked.With(t)
+	}
 	body, err := util.Peek(r.Body, s.config.MessageSizeLimit)
 	if err != nil {
 		return nil, err
@@ -924,6 +1140,16 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 			return nil, errHTTPTooManyRequestsLimitCalls.With(t)
 		}
 	}
+	dmRequest, err := s.reserveDMRequestMessage(v.User(), t.ID)
+	if err != nil {
+		return nil, err
+	}
+	published := false
+	defer func() {
+		if !published {
+			s.releaseDMRequestMessage(v.User(), dmRequest)
+		}
+	}()
 	if m.PollID != "" {
 		m = newPollRequestMessage(t.ID, m.PollID)
 	}
@@ -932,9 +1158,9 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	if u := v.User(); u != nil {
 		m.SenderName = u.Name
 	}
-	// Coop: Resolve reply_to text preview
-	if m.ReplyTo != "" {
-		if origMsg, err := s.messageCache.Message(m.ReplyTo); err == nil && origMsg != nil {
+	// Coop: Resolve reply_to text preview (not for encrypted messages, clients resolve those themselves)
+	if m.ReplyTo != "" && m.ContentType != envelopeContentType {
+		if origMsg, err := s.messageCache.Message(m.ReplyTo); err == nil && origMsg != nil && origMsg.Envelope == nil {
 			preview := origMsg.Message
 			if len(preview) > 100 {
 				preview = preview[:100]
@@ -951,6 +1177,10 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	if m.Message == "" {
 		m.Message = emptyMessageBody
 	}
+	if s.isCoopTopic(t.ID) {
+		m.Coop = true
+		m.HTML = renderMessageHTML(m) // Coop: Render once, so all consumers share the same sanitized HTML
+	}
 	delayed := m.Time > time.Now().Unix()
 	ev := logvrm(v, r, m).
 		Tag(tagPublish).
@@ -971,7 +1201,7 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 		if err := t.Publish(v, m); err != nil {
 			return nil, err
 		}
-		if s.firebaseClient != nil && firebase {
+		if s.firebaseClient != nil && firebase && dmRequest == nil {
 			go s.sendToFirebase(v, m)
 		}
 		if s.smtpSender != nil && email != "" {
@@ -983,7 +1213,7 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 		if s.config.UpstreamBaseURL != "" && !unifiedpush { // UP messages are not sent to upstream
 			go s.forwardPollRequest(v, m)
 		}
-		if s.config.WebPushPublicKey != "" {
+		if s.config.WebPushPublicKey != "" && dmRequest == nil {
 			go s.publishToWebPushEndpoints(v, m)
 		}
 	} else {
@@ -997,7 +1227,7 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 		}
 		// Delete attachment files for deleted scheduled messages
 		if s.fileCache != nil && len(deletedIDs) > 0 {
-			if err := s.fileCache.Remove(deletedIDs...); err != nil {
+			if err := s.fileCache.Remove(attachmentFileIDs(deletedIDs)...); err != nil {
 				logvrm(v, r, m).Tag(tagPublish).Err(err).Warn("Error removing attachments for deleted scheduled messages")
 			}
 		}
@@ -1005,7 +1235,12 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 		if err := s.messageCache.AddMessage(m); err != nil {
 			return nil, err
 		}
+		// Delete attachment blobs no longer referenced by any message (after adding this message, which may share one)
+		if s.fileCache != nil && len(deletedIDs) > 0 {
+			s.pruneAttachmentBlobs()
+		}
 	}
+	published = true
 	u := v.User()
 	if s.userManager != nil && u != nil && u.Tier != nil {
 		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
@@ -1027,7 +1262,7 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 		return err
 	}
 	minc(metricMessagesPublishedSuccess)
-	return s.writeJSON(w, m.forJSON())
+	return s.writeJSON(w, s.withSignedAttachmentURL(m.forDevice(v.User(), readDeviceParam(r)), v.User()).forJSON())
 }
 
 func (s *Server) handlePublishMatrix(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -1072,6 +1307,11 @@ func (s *Server) handleActionMessage(w http.ResponseWriter, r *http.Request, v *
 	if err != nil {
 		return err
 	}
+	if blocked, err := s.dmBlocked(v.User(), t.ID); err != nil {
+		return err
+	} else if blocked {
+		return errHTTPForbiddenDMBlocked.With(t)
+	}
 	if !util.ContainsIP(s.config.VisitorRequestExemptPrefixes, v.ip) && !vrate.MessageAllowed() {
 		return errHTTPTooManyRequestsLimitMessages.With(t)
 	}
@@ -1084,16 +1324,21 @@ func (s *Server) handleActionMessage(w http.ResponseWriter, r *http.Request, v *
 	m.Sender = v.IP()
 	m.User = v.MaybeUserID()
 	m.Expires = time.Unix(m.Time, 0).Add(v.Limits().MessageExpiryDuration).Unix()
+	// No push notifications for pending message requests
+	dmRequest, err := s.dmRequest(t.ID)
+	if err != nil {
+		return err
+	}
 	// Publish to subscribers
 	if err := t.Publish(v, m); err != nil {
 		return err
 	}
 	// Send to Firebase for Android clients
-	if s.firebaseClient != nil {
+	if s.firebaseClient != nil && dmRequest == nil {
 		go s.sendToFirebase(v, m)
 	}
 	// Send to web push endpoints
-	if s.config.WebPushPublicKey != "" {
+	if s.config.WebPushPublicKey != "" && dmRequest == nil {
 		go s.publishToWebPushEndpoints(v, m)
 	}
 	if event == messageDeleteEvent {
@@ -1104,9 +1349,10 @@ func (s *Server) handleActionMessage(w http.ResponseWriter, r *http.Request, v *
 		}
 		// Delete attachment files for deleted scheduled messages
 		if s.fileCache != nil && len(deletedIDs) > 0 {
-			if err := s.fileCache.Remove(deletedIDs...); err != nil {
+			if err := s.fileCache.Remove(attachmentFileIDs(deletedIDs)...); err != nil {
 				logvrm(v, r, m).Tag(tagPublish).Err(err).Warn("Error removing attachments for deleted scheduled messages")
 			}
+			s.pruneAttachmentBlobs()
 		}
 	}
 	// Add to message cache
@@ -1136,7 +1382,7 @@ func (s *Server) sendToFirebase(v *visitor, m *message) {
 
 func (s *Server) sendEmail(v *visitor, m *message, email string) {
 	logvm(v, m).Tag(tagEmail).Field("email", email).Debug("Sending email to %s", email)
-	if err := s.smtpSender.Send(v, m, email); err != nil {
+	if err := s.smtpSender.Send(v, s.withEmailAttachmentURL(m), email); err != nil {
 		logvm(v, m).Tag(tagEmail).Field("email", email).Err(err).Warn("Unable to send email to %s: %v", email, err.Error())
 		minc(metricEmailsPublishedFailure)
 		return
@@ -1292,7 +1538,9 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 	}
 	contentType, markdown := readParam(r, "content-type", "content_type"), readBoolParam(r, false, "x-markdown", "markdown", "md")
 	if markdown || strings.ToLower(contentType) == "text/markdown" {
-		m.ContentType = "text/markdown"
+		m.ContentType = markdownContentType
+	} else if parseEnvelopeContentType(contentType) {
+		m.ContentType = envelopeContentType
 	}
 	unifiedpush = readBoolParam(r, false, "x-unifiedpush", "unifiedpush", "up") // see GET too!
 	contentEncoding := readParam(r, "content-encoding")
@@ -1315,6 +1563,10 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 //     If a message is flagged as poll request, the body does not matter and is discarded
 //  2. curl -T somebinarydata.bin "ntfy.sh/mytopic?up=1"
 //     If UnifiedPush is enabled, encode as base64 if body is binary, and do not trim
+//     Coop: curl -H "Content-Type: application/vnd.coop.envelope+json" -d @envelope.json ntfy.sh/mytopic
+//     Encrypted messages are read as an envelope (up to the envelope size limit), see handleBodyAsEnvelope
+//     Coop: curl -H "Upload: 4Vq8dPmXzT2b" -d "Holiday video" ntfy.sh/mytopic
+//     Body must be a message, the completed resumable upload is attached, see handleBodyAsUpload
 //  3. curl -H "Attach: http://example.com/file.jpg" ntfy.sh/mytopic
 //     Body must be a message, because we attached an external URL
 //  4. curl -T short.txt -H "Filename: short.txt" ntfy.sh/mytopic
@@ -1330,6 +1582,10 @@ func (s *Server) handlePublishBody(r *http.Request, v *visitor, m *message, body
 		return s.handleBodyDiscard(body)
 	} else if unifiedpush {
 		return s.handleBodyAsMessageAutoDetect(m, body) // Case 2
+	} else if m.ContentType == envelopeContentType {
+		return s.handleBodyAsEnvelope(v, m, body) // Coop: Encrypted message
+	} else if uploadID := readParam(r, "x-upload", "upload"); uploadID != "" {
+		return s.handleBodyAsUpload(v, m, body, uploadID) // Coop: Resumable upload
 	} else if m.Attachment != nil && m.Attachment.URL != "" {
 		return s.handleBodyAsTextMessage(m, body) // Case 3
 	} else if m.Attachment != nil && m.Attachment.Name != "" {
@@ -1480,7 +1736,7 @@ func (s *Server) renderTemplate(name, tpl, source string) (string, error) {
 }
 
 func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser) error {
-	if s.fileCache == nil || s.config.BaseURL == "" || s.config.AttachmentCacheDir == "" {
+	if s.fileCache == nil || s.config.BaseURL == "" {
 		return errHTTPBadRequestAttachmentsDisallowed.With(m)
 	}
 	vinfo, err := v.Info()
@@ -1520,13 +1776,45 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 		util.NewFixedLimiter(vinfo.Limits.AttachmentFileSizeLimit),
 		util.NewFixedLimiter(vinfo.Stats.AttachmentTotalSizeRemaining),
 	}
-	m.Attachment.Size, err = s.fileCache.Write(m.ID, body, limiters...)
+	return s.writeAttachment(v, m, body, vinfo.Limits.AttachmentFileSizeLimit, limiters...)
+}
+
+// writeAttachment stores the attachment of a message: images are processed (see processImage), and the file
+// is stored as a content-addressed blob, see storeAttachmentBlob. Writing fails if any of the limiters is exceeded,
+// or if the metadata of an image cannot be stripped. Images are read through the limiters before they are processed,
+// so that the limits apply to the upload itself.
+func (s *Server) writeAttachment(v *visitor, m *message, in io.Reader, fileSizeLimit int64, limiters ...util.Limiter) error {
+	var thumbnails map[string][]byte
+	if isProcessableImage(m.Attachment.Type) {
+		var buf bytes.Buffer
+		if _, err := io.Copy(util.NewLimitWriter(&buf, limiters...), io.LimitReader(in, fileSizeLimit+1)); errors.Is(err, util.ErrLimitReached) {
+			return errHTTPEntityTooLargeAttachment.With(m)
+		} else if err != nil {
+			return err
+		} else if int64(buf.Len()) > fileSizeLimit {
+			return errHTTPEntityTooLargeAttachment.With(m)
+		}
+		img, err := processImage(buf.Bytes(), m.Attachment.Type)
+		if err != nil {
+			// Fail closed: images are only stored once their metadata (EXIF, GPS, ...) is stripped
+			logvm(v, m).Tag(tagImage).Err(err).Debug("Cannot strip image metadata, rejecting attachment")
+			return errHTTPBadRequestImageInvalid.With(m)
+		}
+		in = bytes.NewReader(img.data)
+		m.Attachment.Width, m.Attachment.Height, m.Attachment.BlurHash = img.width, img.height, img.blurHash
+		thumbnails = img.thumbnails
+		limiters = nil // Already applied to the upload; processed images are not larger, except for an added GIF trailer
+	}
+	// The file is written under the message ID first, and then moved to its content-addressed blob
+	hash := sha256.New()
+	size, err := s.fileCache.Write(m.ID, io.TeeReader(in, hash), limiters...)
 	if errors.Is(err, util.ErrLimitReached) {
 		return errHTTPEntityTooLargeAttachment.With(m)
 	} else if err != nil {
 		return err
 	}
-	return nil
+	m.Attachment.Size = size
+	return s.storeAttachmentBlob(v, m, hex.EncodeToString(hash.Sum(nil)), thumbnails)
 }
 
 func (s *Server) handleSubscribeJSON(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -1591,11 +1879,12 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 		closed = true
 		wlock.Unlock()
 	}()
+	viewer, device := v.User(), readDeviceParam(r)
 	sub := func(v *visitor, msg *message) error {
 		if !filters.Pass(msg) {
 			return nil
 		}
-		m, err := encoder(msg)
+		m, err := encoder(s.withSignedAttachmentURL(msg.forDevice(viewer, device), viewer))
 		if err != nil {
 			return err
 		}
@@ -1615,8 +1904,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
 		return err
 	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Content-Type", contentType+"; charset=utf-8")                    // Android/Volley client needs charset!
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8") // Android/Volley client needs charset!
 	if poll {
 		for _, t := range topics {
 			t.Keepalive()
@@ -1753,6 +2041,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			}
 		}
 	})
+	viewer, device := v.User(), readDeviceParam(r)
 	sub := func(v *visitor, msg *message) error {
 		if !filters.Pass(msg) {
 			return nil
@@ -1762,12 +2051,11 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 		if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
 			return err
 		}
-		return conn.WriteJSON(msg)
+		return conn.WriteJSON(s.withSignedAttachmentURL(msg.forDevice(viewer, device), viewer))
 	}
 	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
 		return err
 	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
 	if poll {
 		for _, t := range topics {
 			t.Keepalive()
@@ -1891,12 +2179,29 @@ func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled b
 		if err != nil {
 			return err
 		}
+		if len(topicMessages) > 0 && s.isCoopTopic(t.ID) {
+			for _, m := range topicMessages {
+				m.Coop = true
+			}
+		}
 		messages = append(messages, topicMessages...)
 	}
 	sort.Slice(messages, func(i, j int) bool {
 		return messages[i].Time < messages[j].Time
 	})
+	// Coop: Like the live fan-out, skip group messages of users the subscriber blocked. DM history
+	// is kept as is, since blocking only makes the conversation read-only.
+	var blocked map[string]bool
+	if userID := v.MaybeUserID(); userID != "" && s.userManager != nil {
+		var err error
+		if blocked, err = s.userManager.BlockedIDs(userID); err != nil {
+			return err
+		}
+	}
 	for _, m := range messages {
+		if m.User != "" && blocked[m.User] && !isDMTopic(m.Topic) {
+			continue
+		}
 		if err := sub(v, m); err != nil {
 			return err
 		}
@@ -1936,10 +2241,14 @@ func parseSince(r *http.Request, poll bool) (sinceMarker, error) {
 	return sinceNoMessages, errHTTPBadRequestSinceInvalid
 }
 
-func (s *Server) handleOptions(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+func (s *Server) handleOptions(w http.ResponseWriter, r *http.Request, _ *visitor) error {
 	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, PATCH, DELETE")
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Access-Control-Allow-Headers", "*")                              // CORS, allow auth via JS // FIXME is this terrible?
+	if requestHeaders := r.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" && !util.Contains(s.config.AccessControlAllowOrigins, "*") {
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Headers", requestHeaders) // The wildcard is not honored for requests with credentials
+	} else {
+		w.Header().Set("Access-Control-Allow-Headers", "*") // CORS, allow auth via JS
+	}
 	return nil
 }
 
@@ -1989,6 +2298,7 @@ func (s *Server) topicsFromIDs(ids ...string) ([]*topic, error) {
 				return nil, errHTTPTooManyRequestsLimitTotalTopics
 			}
 			s.topics[id] = newTopic(id)
+			s.topics[id].SetBlockers(s.blockerIDs)
 		}
 		topics = append(topics, s.topics[id])
 	}
@@ -2141,6 +2451,7 @@ func (s *Server) sendDelayedMessages() error {
 
 func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 	logvm(v, m).Debug("Sending delayed message")
+	m.Coop = s.isCoopTopic(m.Topic) // Not stored in the cache, see publish
 	s.mu.RLock()
 	t, ok := s.topics[m.Topic] // If no subscribers, just mark message as published
 	s.mu.RUnlock()
@@ -2152,13 +2463,19 @@ func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 			}
 		}()
 	}
-	if s.firebaseClient != nil { // Firebase subscribers may not show up in topics map
+	dmRequest, err := s.dmRequest(m.Topic)
+	if err != nil {
+		logvm(v, m).Err(err).Warn("Unable to check for message request")
+	}
+	// No push notifications for pending message requests
+	push := err == nil && dmRequest == nil
+	if s.firebaseClient != nil && push { // Firebase subscribers may not show up in topics map
 		go s.sendToFirebase(v, m)
 	}
 	if s.config.UpstreamBaseURL != "" {
 		go s.forwardPollRequest(v, m)
 	}
-	if s.config.WebPushPublicKey != "" {
+	if s.config.WebPushPublicKey != "" && push {
 		go s.publishToWebPushEndpoints(v, m)
 	}
 	if err := s.messageCache.MarkPublished(m); err != nil {
@@ -2235,6 +2552,9 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if m.ReplyTo != "" {
 			r.Header.Set("X-Reply-To", m.ReplyTo)
 		}
+		if m.Upload != "" {
+			r.Header.Set("X-Upload", m.Upload)
+		}
 		return next(w, r, v)
 	}
 }
@@ -2314,7 +2634,12 @@ func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
 		return vip, errHTTPTooManyRequestsLimitAuthFailure // Always return visitor, even when error occurs!
 	}
 	u, err := s.authenticate(r, header)
-	if err != nil {
+	if errors.Is(err, user.ErrUserSuspended) {
+		logr(r).Err(err).Debug("Authentication failed, user is suspended")
+		return vip, errHTTPForbiddenUserSuspended // Always return visitor, even when error occurs!
+	} else if err != nil {
+		// Locked users get the same response as unknown users and wrong passwords, so that the lockout
+		// cannot be used to find out which usernames exist. The owner is notified via the sync topic.
 		vip.AuthFailed()
 		logr(r).Err(err).Debug("Authentication failed")
 		return vip, errHTTPUnauthorized // Always return visitor, even when error occurs!
@@ -2357,7 +2682,7 @@ func supportedAuthHeader(value string) bool {
 	return strings.HasPrefix(value, "basic ") || strings.HasPrefix(value, "bearer ")
 }
 
-func (s *Server) authenticateBasicAuth(r *http.Request, value string) (user *user.User, err error) {
+func (s *Server) authenticateBasicAuth(r *http.Request, value string) (*user.User, error) {
 	r.Header.Set("Authorization", value)
 	username, password, ok := r.BasicAuth()
 	if !ok {
@@ -2365,9 +2690,66 @@ func (s *Server) authenticateBasicAuth(r *http.Request, value string) (user *use
 	} else if username == "" {
 		return s.authenticateBearerAuth(r, password) // Treat password as token
 	}
+	u, err := s.authenticateUser(username, password)
+	if errors.Is(err, user.ErrUnauthenticated) {
+		s.authFailed(r, username)
+	}
+	return u, err
+}
+
+// authenticateUser checks username and password against the LDAP directory (if configured), or
+// the local user database
+func (s *Server) authenticateUser(username, password string) (*user.User, error) {
+	if s.ldapAuther != nil {
+		return s.ldapAuther.Authenticate(username, password)
+	}
 	return s.userManager.Authenticate(username, password)
 }
 
+// authFailed writes a failed login attempt for the given username to the audit log, and notifies the owner
+// of the account via their sync topic if the account was locked as a result. The attempt itself has already
+// been recorded by the Auther (see user.Manager.AuthFailed).
+func (s *Server) authFailed(r *http.Request, username string) {
+	minc(metricLoginFailures)
+	u, err := s.userManager.User(username)
+	if err != nil {
+		if ok, suppressed := s.unknownUserAudits.Allow(); ok {
+			detail := map[string]any{"reason": "unknown user"}
+			if suppressed > 0 {
+				detail["suppressed"] = suppressed // Failed logins of unknown users since the last entry
+			}
+			s.auditAs(r, "", auditActionLoginFailure, username, detail)
+		}
+		return // User does not exist, nothing else to record
+	}
+	failure, err := s.userManager.LoginFailure(u.ID)
+	if err != nil {
+		logr(r).Err(err).Warn("Cannot read failed login attempts")
+		return
+	}
+	s.auditAs(r, "", auditActionLoginFailure, username, map[string]any{"failures": failure.Failures})
+	if !failure.Locked() {
+		return
+	}
+	minc(metricLoginLockouts)
+	s.auditAs(r, "", auditActionLoginLocked, username, map[string]any{"locked_until": failure.LockedUntil.Unix()})
+	ip := extractIPAddress(r, s.config.BehindProxy, s.config.ProxyForwardedHeader, s.config.ProxyTrustedPrefixes)
+	v := s.visitor(ip, nil)
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"user_name":    u.Name,
+			"failures":     failure.Failures,
+			"locked_until": failure.LockedUntil.Unix(),
+		}).
+		Info("User %s temporarily locked after %d failed login attempts", u.Name, failure.Failures)
+	go func() {
+		if err := s.publishAccountLockedEvent(v, u, failure.LockedUntil); err != nil {
+			logv(v).Err(err).Trace("Error publishing to user's sync topic")
+		}
+	}()
+}
+
 func (s *Server) authenticateBearerAuth(r *http.Request, token string) (*user.User, error) {
 	u, err := s.userManager.AuthenticateToken(token)
 	if err != nil {
@@ -2401,7 +2783,6 @@ func (s *Server) writeJSON(w http.ResponseWriter, v any) error {
 
 func (s *Server) writeJSONWithContentType(w http.ResponseWriter, v any, contentType string) error {
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
 	if err := json.NewEncoder(w).Encode(v); err != nil {
 		return err
 	}
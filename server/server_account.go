@@ -13,8 +13,11 @@ import (
 )
 
 const (
-	syncTopicAccountSyncEvent = "sync"
-	tokenExpiryDuration       = 72 * time.Hour // Extend tokens by this much
+	syncTopicAccountSyncEvent    = "sync"
+	syncTopicAccountLockedEvent  = "account_locked"
+	syncTopicAccountWarningEvent = "account_warning"
+	syncTopicReportStatusEvent   = "report_status"
+	tokenExpiryDuration          = 72 * time.Hour // Extend tokens by this much
 )
 
 func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -36,6 +39,9 @@ func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *
 	if existingUser, _ := s.userManager.User(newAccount.Username); existingUser != nil {
 		return errHTTPConflictUserExists
 	}
+	if err := s.validatePassword(newAccount.Username, newAccount.Password); err != nil {
+		return err
+	}
 	logvr(v, r).Tag(tagAccount).Field("user_name", newAccount.Username).Info("Creating user %s", newAccount.Username)
 	if err := s.userManager.AddUser(newAccount.Username, newAccount.Password, user.RoleUser, false); err != nil {
 		if errors.Is(err, user.ErrInvalidArgument) {
@@ -44,9 +50,30 @@ func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *
 		return err
 	}
 	v.AccountCreated()
+	s.audit(r, v, auditActionAccountCreate, newAccount.Username, nil)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// validatePassword checks a new password against the configured password policy, and
+// translates policy violations into HTTP errors that the web app can display
+func (s *Server) validatePassword(username, password string) error {
+	err := s.passwordPolicy.Validate(username, password)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, user.ErrPasswordTooShort):
+		return errHTTPBadRequestPasswordTooShort.Fields(log.Context{"password_min_length": s.config.AuthPasswordMinLength})
+	case errors.Is(err, user.ErrPasswordTooSimple):
+		return errHTTPBadRequestPasswordTooSimple.Fields(log.Context{"password_min_classes": s.config.AuthPasswordMinClasses})
+	case errors.Is(err, user.ErrPasswordContainsUsername):
+		return errHTTPBadRequestPasswordContainsUsername
+	case errors.Is(err, user.ErrPasswordBreached):
+		return errHTTPBadRequestPasswordBreached
+	}
+	log.Tag(tagAccount).Err(err).Warn("Cannot check password against breached password list")
+	return nil // Fail open: a broken breach list should not lock out all users
+}
+
 func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	info, err := v.Info()
 	if err != nil {
@@ -173,7 +200,7 @@ func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *
 		return errHTTPBadRequest
 	}
 	u := v.User()
-	if _, err := s.userManager.Authenticate(u.Name, req.Password); err != nil {
+	if _, err := s.authenticateUser(u.Name, req.Password); err != nil {
 		return errHTTPBadRequestIncorrectPasswordConfirmation
 	}
 	if err := s.userManager.CanChangeUser(u.Name); err != nil {
@@ -200,6 +227,7 @@ func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *
 	if err := s.userManager.MarkUserRemoved(u); err != nil {
 		return err
 	}
+	s.audit(r, v, auditActionAccountDelete, u.Name, nil)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -211,9 +239,12 @@ func (s *Server) handleAccountPasswordChange(w http.ResponseWriter, r *http.Requ
 		return errHTTPBadRequest
 	}
 	u := v.User()
-	if _, err := s.userManager.Authenticate(u.Name, req.Password); err != nil {
+	if _, err := s.authenticateUser(u.Name, req.Password); err != nil {
 		return errHTTPBadRequestIncorrectPasswordConfirmation
 	}
+	if err := s.validatePassword(u.Name, req.NewPassword); err != nil {
+		return err
+	}
 	logvr(v, r).Tag(tagAccount).Debug("Changing password for user %s", u.Name)
 	if err := s.userManager.ChangePassword(u.Name, req.NewPassword, false); err != nil {
 		if errors.Is(err, user.ErrProvisionedUserChange) {
@@ -221,6 +252,7 @@ func (s *Server) handleAccountPasswordChange(w http.ResponseWriter, r *http.Requ
 		}
 		return err
 	}
+	s.audit(r, v, auditActionPasswordChange, u.Name, nil)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -249,6 +281,11 @@ func (s *Server) handleAccountTokenCreate(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		return err
 	}
+	action := auditActionTokenCreate
+	if u.Token == "" {
+		action = auditActionLogin // Tokens created with username/password are logins (e.g. in the web app)
+	}
+	s.audit(r, v, action, auditToken(token.Value), map[string]any{"label": token.Label, "expires": token.Expires.Unix()})
 	response := &apiAccountTokenResponse{
 		Token:      token.Value,
 		Label:      token.Label,
@@ -290,6 +327,9 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 		}
 		return err
 	}
+	if req.Label != nil || req.Expires != nil { // Regular token extensions are not audited
+		s.audit(r, v, auditActionTokenUpdate, auditToken(token.Value), map[string]any{"label": token.Label, "expires": token.Expires.Unix()})
+	}
 	response := &apiAccountTokenResponse{
 		Token:      token.Value,
 		Label:      token.Label,
@@ -315,6 +355,11 @@ func (s *Server) handleAccountTokenDelete(w http.ResponseWriter, r *http.Request
 		}
 		return err
 	}
+	action := auditActionTokenDelete
+	if token == u.Token {
+		action = auditActionLogout
+	}
+	s.audit(r, v, action, auditToken(token), nil)
 	logvr(v, r).
 		Tag(tagAccount).
 		Field("token", token).
@@ -628,16 +673,47 @@ func (s *Server) publishSyncEventAsync(v *visitor) {
 
 // publishSyncEvent publishes a sync message to the user's sync topic
 func (s *Server) publishSyncEvent(v *visitor) error {
-	u := v.User()
+	return s.publishSyncTopicEvent(v, v.User(), &apiAccountSyncTopicResponse{Event: syncTopicAccountSyncEvent})
+}
+
+// publishAccountLockedEvent notifies the owner of an account via their sync topic that the account
+// was temporarily locked due to too many failed login attempts. The visitor v is the one that caused
+// the lock, which is not necessarily the owner of the account.
+func (s *Server) publishAccountLockedEvent(v *visitor, u *user.User, lockedUntil time.Time) error {
+	return s.publishSyncTopicEvent(v, u, &apiAccountSyncTopicResponse{
+		Event:       syncTopicAccountLockedEvent,
+		LockedUntil: lockedUntil.Unix(),
+	})
+}
+
+// publishAccountWarningEvent notifies the owner of an account via their sync topic that an admin warned
+// them after a report about their content or behavior
+func (s *Server) publishAccountWarningEvent(v *visitor, u *user.User, reason string) error {
+	return s.publishSyncTopicEvent(v, u, &apiAccountSyncTopicResponse{
+		Event:  syncTopicAccountWarningEvent,
+		Reason: reason,
+	})
+}
+
+// publishReportStatusEvent notifies a reporter via their sync topic that the status of their report changed
+func (s *Server) publishReportStatusEvent(v *visitor, u *user.User, report *user.Report) error {
+	return s.publishSyncTopicEvent(v, u, &apiAccountSyncTopicResponse{
+		Event:        syncTopicReportStatusEvent,
+		ReportID:     report.ID,
+		ReportStatus: string(report.Status),
+	})
+}
+
+func (s *Server) publishSyncTopicEvent(v *visitor, u *user.User, event *apiAccountSyncTopicResponse) error {
 	if u == nil || u.SyncTopic == "" {
 		return nil
 	}
-	logv(v).Field("sync_topic", u.SyncTopic).Trace("Publishing sync event to user's sync topic")
+	logv(v).Field("sync_topic", u.SyncTopic).Trace("Publishing %s event to user's sync topic", event.Event)
 	syncTopic, err := s.topicFromID(u.SyncTopic)
 	if err != nil {
 		return err
 	}
-	messageBytes, err := json.Marshal(&apiAccountSyncTopicResponse{Event: syncTopicAccountSyncEvent})
+	messageBytes, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
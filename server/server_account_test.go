@@ -2,12 +2,15 @@ package server
 
 import (
 	"fmt"
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
 	"io"
 	"net/netip"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -301,6 +304,60 @@ func TestAccount_ChangePassword_NoAccount(t *testing.T) {
 	require.Equal(t, 401, rr.Code)
 }
 
+func TestAccount_Signup_PasswordPolicy(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.EnableSignup = true
+	conf.AuthPasswordMinLength = 8
+	conf.AuthPasswordMinClasses = 2
+	conf.AuthPasswordDisallowUsername = true
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	rr := request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"short"}`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40054, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"onlylowercase"}`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40055, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"Phil12345"}`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40056, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"correct horse 42"}`, nil)
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestAccount_ChangePassword_PasswordPolicy(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthPasswordMinLength = 8
+	conf.AuthPasswordBreachedDir = t.TempDir()
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	// SHA-1("password1") = E38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D
+	require.Nil(t, os.WriteFile(filepath.Join(conf.AuthPasswordBreachedDir, "E38AD.txt"), []byte("214943DAAD1D64C102FAEC29DE4AFE9DA3D:2427158\r\n"), 0600))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+
+	rr := request(t, s, "POST", "/v1/account/password", `{"password": "phil", "new_password": "pass"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40054, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account/password", `{"password": "phil", "new_password": "password1"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40057, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account/password", `{"password": "phil", "new_password": "not breached yet"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
 func TestAccount_ExtendToken(t *testing.T) {
 	t.Parallel()
 	s := newTestServer(t, newTestConfigWithAuthFile(t))
@@ -664,25 +721,27 @@ func TestAccount_Reservation_Delete_Messages_And_Attachments(t *testing.T) {
 	})
 	require.Equal(t, 200, rr.Code)
 	m1 := toMessage(t, rr.Body.String())
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m1.ID))
+	m1File := filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, m1.ID))
+	require.FileExists(t, m1File)
 
-	rr = request(t, s, "POST", "/mytopic2?f=attach.txt", `Howdy`, map[string]string{
+	rr = request(t, s, "POST", "/mytopic2?f=attach.txt", `Howdy again`, map[string]string{
 		"Authorization": util.BasicAuth("phil", "mypass"),
 	})
 	require.Equal(t, 200, rr.Code)
 	m2 := toMessage(t, rr.Body.String())
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m2.ID))
+	m2File := filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, m2.ID))
+	require.FileExists(t, m2File)
 
 	// Pre-verify message count and file
 	ms, err := s.messageCache.Messages("mytopic1", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(ms))
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m1.ID))
+	require.FileExists(t, m1File)
 
 	ms, err = s.messageCache.Messages("mytopic2", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(ms))
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m2.ID))
+	require.FileExists(t, m2File)
 
 	// Delete reservation
 	rr = request(t, s, "DELETE", "/v1/account/reservation/mytopic1", ``, map[string]string{
@@ -702,19 +761,19 @@ func TestAccount_Reservation_Delete_Messages_And_Attachments(t *testing.T) {
 	waitFor(t, func() bool {
 		ms, err := s.messageCache.Messages("mytopic1", sinceAllMessages, false)
 		require.Nil(t, err)
-		return len(ms) == 0 && !util.FileExists(filepath.Join(s.config.AttachmentCacheDir, m1.ID))
+		return len(ms) == 0 && !util.FileExists(m1File)
 	})
 
 	ms, err = s.messageCache.Messages("mytopic1", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 0, len(ms))
-	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, m1.ID))
+	require.NoFileExists(t, m1File)
 
 	ms, err = s.messageCache.Messages("mytopic2", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(ms))
 	require.Equal(t, m2.ID, ms[0].ID)
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m2.ID))
+	require.FileExists(t, m2File)
 }
 
 /*func TestAccount_Persist_UserStats_After_Tier_Change(t *testing.T) {
@@ -779,3 +838,59 @@ func TestAccount_Reservation_Delete_Messages_And_Attachments(t *testing.T) {
 	account, _ = util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
 	require.Equal(t, int64(2), account.Stats.Messages) // Is not reset!
 }*/
+
+func TestAccount_LDAPLogin_SyncsProfile(t *testing.T) {
+	d := testdirectory.Start(t, testdirectory.WithNoTLS(t))
+	d.SetUsers(gldap.NewEntry("cn=alice,"+testdirectory.DefaultUserDN, map[string][]string{
+		"password":    {"alice-pass"},
+		"displayName": {"Alice Liddell"},
+		"memberOf":    {"cn=coop-admins," + testdirectory.DefaultGroupDN},
+		"jpegPhoto":   {string(newTestJPEG(t, 96, 96, 0, ""))},
+	}))
+	conf := newTestConfigWithAuthFile(t)
+	conf.AttachmentCacheDir = t.TempDir()
+	conf.AuthLDAPURL = fmt.Sprintf("ldap://%s:%d", d.Host(), d.Port())
+	conf.AuthLDAPBaseDN = testdirectory.DefaultUserDN
+	conf.AuthLDAPUserFilter = "(cn=%s)"
+	conf.AuthLDAPAdminGroups = []string{"coop-admins"}
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil-pass", user.RoleAdmin, false))
+
+	// Directory user is created on first login
+	rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("alice", "alice-pass"),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](rr.Result().Body)
+	require.Equal(t, "alice", account.Username)
+	require.Equal(t, "admin", account.Role)
+
+	alice, err := s.userManager.User("alice")
+	require.Nil(t, err)
+	avatarID, err := s.userManager.ProfileAvatarID(alice.ID)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(avatarID, "av_"))
+	require.FileExists(t, filepath.Join(conf.AttachmentCacheDir, "avatars", avatarID))
+
+	// Same avatar on next login, nothing changes
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("alice", "alice-pass"),
+	})
+	require.Equal(t, 200, rr.Code)
+	newAvatarID, err := s.userManager.ProfileAvatarID(alice.ID)
+	require.Nil(t, err)
+	require.Equal(t, avatarID, newAvatarID)
+
+	// Wrong password
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("alice", "wrong-pass"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Local user still works
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil-pass"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
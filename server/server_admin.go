@@ -7,6 +7,7 @@ import (
 	"heckel.io/ntfy/v2/user"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Admin API path constants
@@ -15,6 +16,12 @@ const (
 	apiAdminTopicsPath = "/api/admin/topics"
 )
 
+const (
+	adminUserSuspensionSuffix = "/suspension"
+	adminUserOIDCSuffix       = "/oidc"
+	suspensionReasonLengthMax = 500
+)
+
 // Request/Response structs for admin user management
 type apiAdminUserCreateRequest struct {
 	Username string `json:"username"`
@@ -27,9 +34,27 @@ type apiAdminUserUpdateRequest struct {
 	Role     *string `json:"role,omitempty"`
 }
 
+type apiAdminUserSuspendRequest struct {
+	Reason string `json:"reason"`
+	Until  int64  `json:"until,omitempty"` // Unix timestamp, or zero to suspend indefinitely
+}
+
+type apiAdminUserOIDCLinkRequest struct {
+	Subject string `json:"subject"` // Subject ("sub" claim) of the user at the configured identity provider
+}
+
+type apiAdminUserSuspension struct {
+	Reason      string `json:"reason"`
+	SuspendedBy string `json:"suspended_by"`
+	SuspendedAt int64  `json:"suspended_at"`
+	Until       int64  `json:"until,omitempty"`
+}
+
 type apiAdminUserResponse struct {
-	Username string `json:"username"`
-	Role     string `json:"role"`
+	Username    string                  `json:"username"`
+	Role        string                  `json:"role"`
+	LockedUntil int64                   `json:"locked_until,omitempty"`
+	Suspension  *apiAdminUserSuspension `json:"suspension,omitempty"`
 }
 
 type apiAdminUsersResponse struct {
@@ -92,10 +117,17 @@ func (s *Server) handleAdminUsersGet(w http.ResponseWriter, r *http.Request, v *
 	}
 
 	for _, u := range users {
-		response.Users = append(response.Users, apiAdminUserResponse{
+		userResponse := apiAdminUserResponse{
 			Username: u.Name,
 			Role:     string(u.Role),
-		})
+		}
+		if failure, err := s.userManager.LoginFailure(u.ID); err == nil && failure.Locked() {
+			userResponse.LockedUntil = failure.LockedUntil.Unix()
+		}
+		if u.Suspended() {
+			userResponse.Suspension = newAPIAdminUserSuspension(u.Suspension)
+		}
+		response.Users = append(response.Users, userResponse)
 	}
 
 	return s.writeJSON(w, response)
@@ -125,11 +157,16 @@ func (s *Server) handleAdminUserCreate(w http.ResponseWriter, r *http.Request, v
 		return errHTTPBadRequest.Wrap("invalid role")
 	}
 
+	if err := s.validatePassword(req.Username, req.Password); err != nil {
+		return err
+	}
+
 	// Create user (password not hashed yet)
 	if err := s.userManager.AddUser(req.Username, req.Password, role, false); err != nil {
 		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to create user %s", req.Username)
 		return errHTTPInternalError
 	}
+	s.audit(r, v, auditActionAdminUserCreate, req.Username, map[string]any{"role": string(role)})
 
 	response := &apiAdminUserResponse{
 		Username: req.Username,
@@ -158,6 +195,258 @@ func (s *Server) handleAdminUserDelete(w http.ResponseWriter, r *http.Request, v
 		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to delete user %s", username)
 		return errHTTPInternalError
 	}
+	s.audit(r, v, auditActionAdminUserDelete, username, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleAdminUserUnlock resets the failed login attempts of a user, lifting a temporary lock (Admin endpoint)
+func (s *Server) handleAdminUserUnlock(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	// Extract username from path: /api/admin/users/{username}/lock
+	username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiAdminUsersPath+"/"), "/lock")
+	if username == "" || strings.Contains(username, "/") {
+		return errHTTPNotFound
+	}
+
+	logvr(v, r).Tag(tagAdmin).Info("admin: unlocking user %s", username)
+
+	if s.userManager == nil {
+		return errHTTPInternalError
+	}
+
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to get user %s", username)
+		return errHTTPInternalError
+	}
+
+	if err := s.userManager.ResetLoginFailures(u.ID); err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to unlock user %s", username)
+		return errHTTPInternalError
+	}
+	s.audit(r, v, auditActionAdminUserUnlock, username, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleAdminUserSuspend suspends a user until the given time, or indefinitely (Admin endpoint). The user's
+// tokens are deleted and their live subscriptions are cancelled, and they cannot log in until the suspension
+// is lifted by an admin, or expires.
+func (s *Server) handleAdminUserSuspend(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	// Extract username from path: /api/admin/users/{username}/suspension
+	username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiAdminUsersPath+"/"), adminUserSuspensionSuffix)
+	if username == "" || strings.Contains(username, "/") {
+		return errHTTPNotFound
+	}
+
+	req, err := readJSONWithLimit[apiAdminUserSuspendRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		return errHTTPBadRequest.Wrap("reason is required")
+	} else if len(req.Reason) > suspensionReasonLengthMax {
+		return errHTTPBadRequest.Wrap("reason too long (max %d)", suspensionReasonLengthMax)
+	}
+	until, err := parseSuspensionUntil(req.Until)
+	if err != nil {
+		return err
+	}
+
+	logvr(v, r).Tag(tagAdmin).Info("admin: suspending user %s", username)
+
+	if s.userManager == nil {
+		return errHTTPInternalError
+	}
+
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) || (err == nil && u.Name == user.Everyone) {
+		return errHTTPNotFound
+	} else if err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to get user %s", username)
+		return errHTTPInternalError
+	} else if u.ID == v.User().ID {
+		return errHTTPBadRequest.Wrap("cannot suspend yourself")
+	}
+
+	if err := s.suspendUser(r, v, u, req.Reason, until, nil); err != nil {
+		return err
+	}
+
+	// Get updated user info
+	u, err = s.userManager.User(username)
+	if err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to get user %s after suspension", username)
+		return errHTTPInternalError
+	}
+
+	response := &apiAdminUserResponse{
+		Username:   u.Name,
+		Role:       string(u.Role),
+		Suspension: newAPIAdminUserSuspension(u.Suspension),
+	}
+
+	return s.writeJSON(w, response)
+}
+
+// suspendUser suspends a user on behalf of the admin visitor v, revokes their live subscriptions, and
+// writes the suspension to the audit log, along with the given extra detail (may be nil)
+func (s *Server) suspendUser(r *http.Request, v *visitor, u *user.User, reason string, until time.Time, detail map[string]any) error {
+	if err := s.userManager.SuspendUser(u.ID, reason, v.User().Name, until); err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to suspend user %s", u.Name)
+		return errHTTPInternalError
+	}
+	if s.webPush != nil {
+		if err := s.webPush.RemoveSubscriptionsByUserID(u.ID); err != nil {
+			logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to remove web push subscriptions for %s", u.Name)
+		}
+	}
+	if detail == nil {
+		detail = make(map[string]any)
+	}
+	detail["reason"] = reason
+	if !until.IsZero() {
+		detail["until"] = until.Unix()
+	}
+	s.audit(r, v, auditActionAdminUserSuspend, u.Name, detail)
+	return s.killUserSubscriber(u, "*")
+}
+
+// parseSuspensionUntil converts the until field of a suspension request to a time, which is zero
+// if the suspension does not expire
+func parseSuspensionUntil(until int64) (time.Time, error) {
+	if until <= 0 {
+		return time.Time{}, nil
+	} else if t := time.Unix(until, 0); t.After(time.Now()) {
+		return t, nil
+	}
+	return time.Time{}, errHTTPBadRequest.Wrap("until must be in the future")
+}
+
+// handleAdminUserUnsuspend lifts the suspension of a user (Admin endpoint)
+func (s *Server) handleAdminUserUnsuspend(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	// Extract username from path: /api/admin/users/{username}/suspension
+	username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiAdminUsersPath+"/"), adminUserSuspensionSuffix)
+	if username == "" || strings.Contains(username, "/") {
+		return errHTTPNotFound
+	}
+
+	logvr(v, r).Tag(tagAdmin).Info("admin: lifting suspension of user %s", username)
+
+	if s.userManager == nil {
+		return errHTTPInternalError
+	}
+
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to get user %s", username)
+		return errHTTPInternalError
+	}
+
+	if err := s.userManager.UnsuspendUser(u.ID); err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to lift suspension of user %s", username)
+		return errHTTPInternalError
+	}
+	s.audit(r, v, auditActionAdminUserUnsuspend, username, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func newAPIAdminUserSuspension(suspension *user.Suspension) *apiAdminUserSuspension {
+	if suspension == nil {
+		return nil
+	}
+	response := &apiAdminUserSuspension{
+		Reason:      suspension.Reason,
+		SuspendedBy: suspension.SuspendedBy,
+		SuspendedAt: suspension.SuspendedAt.Unix(),
+	}
+	if !suspension.Until.IsZero() {
+		response.Until = suspension.Until.Unix()
+	}
+	return response
+}
+
+// handleAdminUserOIDCLink links an existing user to a subject at the configured identity provider, so that
+// single sign-on logins with that identity log in as this user (Admin endpoint). Without such a link, existing
+// users are never taken over by single sign-on logins, even if the username matches.
+func (s *Server) handleAdminUserOIDCLink(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	// Extract username from path: /api/admin/users/{username}/oidc
+	username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiAdminUsersPath+"/"), adminUserOIDCSuffix)
+	if username == "" || strings.Contains(username, "/") {
+		return errHTTPNotFound
+	}
+
+	req, err := readJSONWithLimit[apiAdminUserOIDCLinkRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	req.Subject = strings.TrimSpace(req.Subject)
+	if req.Subject == "" {
+		return errHTTPBadRequest.Wrap("subject is required")
+	}
+
+	logvr(v, r).Tag(tagAdmin).Info("admin: linking user %s to single sign-on subject %s", username, req.Subject)
+
+	if s.userManager == nil {
+		return errHTTPInternalError
+	}
+
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) || (err == nil && u.Name == user.Everyone) {
+		return errHTTPNotFound
+	} else if err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to get user %s", username)
+		return errHTTPInternalError
+	}
+
+	if err := s.userManager.LinkOIDCSubject(u.ID, s.config.AuthOIDCIssuer, req.Subject); errors.Is(err, user.ErrOIDCSubjectLinked) {
+		return errHTTPConflictOIDCSubjectLinked
+	} else if err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to link user %s to single sign-on", username)
+		return errHTTPInternalError
+	}
+	s.audit(r, v, auditActionAdminUserOIDCLink, username, map[string]any{"issuer": s.config.AuthOIDCIssuer, "subject": req.Subject})
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleAdminUserOIDCUnlink removes the single sign-on link of a user (Admin endpoint)
+func (s *Server) handleAdminUserOIDCUnlink(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	// Extract username from path: /api/admin/users/{username}/oidc
+	username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiAdminUsersPath+"/"), adminUserOIDCSuffix)
+	if username == "" || strings.Contains(username, "/") {
+		return errHTTPNotFound
+	}
+
+	logvr(v, r).Tag(tagAdmin).Info("admin: unlinking user %s from single sign-on", username)
+
+	if s.userManager == nil {
+		return errHTTPInternalError
+	}
+
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to get user %s", username)
+		return errHTTPInternalError
+	}
+
+	if err := s.userManager.UnlinkOIDCSubject(u.ID); err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to unlink user %s from single sign-on", username)
+		return errHTTPInternalError
+	}
+	s.audit(r, v, auditActionAdminUserOIDCUnlink, username, nil)
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
@@ -187,11 +476,16 @@ func (s *Server) handleAdminUserUpdate(w http.ResponseWriter, r *http.Request, v
 	}
 
 	// Update password if provided
+	detail := make(map[string]any)
 	if req.Password != nil {
+		if err := s.validatePassword(username, *req.Password); err != nil {
+			return err
+		}
 		if err := s.userManager.ChangePassword(username, *req.Password, false); err != nil {
 			logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to change password for user %s", username)
 			return errHTTPInternalError
 		}
+		detail["password"] = "changed"
 	}
 
 	// Update role if provided
@@ -206,7 +500,9 @@ func (s *Server) handleAdminUserUpdate(w http.ResponseWriter, r *http.Request, v
 			logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to change role for user %s", username)
 			return errHTTPInternalError
 		}
+		detail["role"] = string(role)
 	}
+	s.audit(r, v, auditActionAdminUserUpdate, username, detail)
 
 	// Get updated user info
 	u, err := s.userManager.User(username)
@@ -297,6 +593,7 @@ func (s *Server) handleAdminTopicAccessGrant(w http.ResponseWriter, r *http.Requ
 		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to grant access for user %s", req.Username)
 		return errHTTPInternalError
 	}
+	s.audit(r, v, auditActionAdminAccessGrant, req.Username, map[string]any{"topic": req.TopicPattern, "permission": permission.String()})
 
 	// Add subscription so the topic appears in the user's sidebar
 	if err := s.addSubscriptionsForUser(req.Username, []string{req.TopicPattern}); err != nil {
@@ -329,6 +626,7 @@ func (s *Server) handleAdminTopicAccessRevoke(w http.ResponseWriter, r *http.Req
 		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to revoke access for user %s", req.Username)
 		return errHTTPInternalError
 	}
+	s.audit(r, v, auditActionAdminAccessRevoke, req.Username, map[string]any{"topic": req.TopicPattern})
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
@@ -372,12 +670,14 @@ func (s *Server) handleAdminTopicDelete(w http.ResponseWriter, r *http.Request,
 		logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to delete messages for topic %s", topic)
 		return errHTTPInternalError
 	}
+	s.audit(r, v, auditActionAdminTopicDelete, topic, map[string]any{"messages": len(ids)})
 
 	// Clean up attachments if file cache exists
 	if s.fileCache != nil && len(ids) > 0 {
-		if err := s.fileCache.Remove(ids...); err != nil {
+		if err := s.fileCache.Remove(attachmentFileIDs(ids)...); err != nil {
 			logvr(v, r).Tag(tagAdmin).Err(err).Warn("admin: failed to remove attachments for topic %s", topic)
 		}
+		s.pruneAttachmentBlobs()
 	}
 
 	logvr(v, r).Tag(tagAdmin).Info("admin: deleted %d messages for topic %s", len(ids), topic)
@@ -462,6 +762,11 @@ func (s *Server) handleUsersAdd(w http.ResponseWriter, r *http.Request, v *visit
 			return err
 		}
 	}
+	detail := map[string]any{"role": string(user.RoleUser)}
+	if tier != nil {
+		detail["tier"] = tier.Code
+	}
+	s.audit(r, v, auditActionAdminUserCreate, req.Username, detail)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -509,6 +814,14 @@ func (s *Server) handleUsersUpdate(w http.ResponseWriter, r *http.Request, v *vi
 			return err
 		}
 	}
+	detail := make(map[string]any)
+	if req.Tier != "" {
+		detail["tier"] = req.Tier
+	}
+	if req.Password != "" || req.Hash != "" {
+		detail["password"] = "changed"
+	}
+	s.audit(r, v, auditActionAdminUserUpdate, req.Username, detail)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -528,6 +841,7 @@ func (s *Server) handleUsersDelete(w http.ResponseWriter, r *http.Request, v *vi
 	if err := s.userManager.RemoveUser(req.Username); err != nil {
 		return err
 	}
+	s.audit(r, v, auditActionAdminUserDelete, req.Username, nil)
 	if err := s.killUserSubscriber(u, "*"); err != nil { // FIXME super inefficient
 		return err
 	}
@@ -552,6 +866,7 @@ func (s *Server) handleAccessAllow(w http.ResponseWriter, r *http.Request, v *vi
 	if err := s.userManager.AllowAccess(req.Username, req.Topic, permission); err != nil {
 		return err
 	}
+	s.audit(r, v, auditActionAdminAccessGrant, req.Username, map[string]any{"topic": req.Topic, "permission": permission.String()})
 	// Add subscription so the topic appears in the user's sidebar
 	if err := s.addSubscriptionsForUser(req.Username, []string{req.Topic}); err != nil {
 		log.Tag(tagAdmin).Warn("Failed to add subscription for user %s: %v", req.Username, err)
@@ -571,6 +886,7 @@ func (s *Server) handleAccessReset(w http.ResponseWriter, r *http.Request, v *vi
 	if err := s.userManager.ResetAccess(req.Username, req.Topic); err != nil {
 		return err
 	}
+	s.audit(r, v, auditActionAdminAccessRevoke, req.Username, map[string]any{"topic": req.Topic})
 	if err := s.killUserSubscriber(u, req.Topic); err != nil { // This may be a pattern
 		return err
 	}
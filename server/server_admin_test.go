@@ -1,10 +1,14 @@
 package server
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"io"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -435,3 +439,320 @@ func TestAccess_AllowReset_KillConnection(t *testing.T) {
 		return timeTaken.Load() >= 500
 	})
 }
+
+func TestUser_LoginLockout_AdminUnlock(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthLoginFailureLimit = 3
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+
+	// Fail to log in until the account is locked
+	for i := 0; i < 3; i++ {
+		rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "wrong"),
+		})
+		require.Equal(t, 401, rr.Code)
+	}
+
+	// Correct password is rejected while locked, with the same response as for an unknown user
+	rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+	lockedBody := rr.Body.String()
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("nobody", "nobody"),
+	})
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, lockedBody, rr.Body.String())
+
+	// Admin sees the lock
+	rr = request(t, s, "GET", "/api/admin/users", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	var users apiAdminUsersResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&users))
+	var lockedUntil int64
+	for _, u := range users.Users {
+		if u.Username == "ben" {
+			lockedUntil = u.LockedUntil
+		}
+	}
+	require.Greater(t, lockedUntil, time.Now().Unix())
+
+	// Admin unlocks the user, who can then log in again
+	rr = request(t, s, "DELETE", "/api/admin/users/ben/lock", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 204, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Non-admins cannot unlock
+	rr = request(t, s, "DELETE", "/api/admin/users/phil/lock", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+}
+
+func TestUser_AdminSuspend(t *testing.T) {
+	s := newTestServer(t, configureAuth(t, newTestConfigWithWebPush(t)))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("ben", "mytopic", user.PermissionReadWrite))
+	rr := request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+
+	// Ben has a live subscription
+	ben, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	topic, err := s.topicFromID("mytopic")
+	require.Nil(t, err)
+	canceled := atomic.Bool{}
+	topic.Subscribe(func(v *visitor, msg *message) error { return nil }, ben.ID, func() { canceled.Store(true) })
+	rr = request(t, s, "POST", "/v1/webpush", payloadForTopics(t, []string{"mytopic"}, testWebPushEndpoint), map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	requireSubscriptionCount(t, s, "mytopic", 1)
+
+	// Invalid requests
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	rr = request(t, s, "PUT", "/api/admin/users/ben/suspension", `{}`, admin)
+	require.Equal(t, 400, rr.Code)
+	rr = request(t, s, "PUT", "/api/admin/users/ben/suspension", `{"reason":"spam","until":1}`, admin)
+	require.Equal(t, 400, rr.Code)
+	rr = request(t, s, "PUT", "/api/admin/users/phil/suspension", `{"reason":"spam"}`, admin)
+	require.Equal(t, 400, rr.Code)
+	rr = request(t, s, "PUT", "/api/admin/users/nobody/suspension", `{"reason":"spam"}`, admin)
+	require.Equal(t, 404, rr.Code)
+	rr = request(t, s, "PUT", "/api/admin/users/phil/suspension", `{"reason":"spam"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Suspend ben, which cancels the subscriptions and rejects logins and tokens
+	until := time.Now().Add(time.Hour).Unix()
+	rr = request(t, s, "PUT", "/api/admin/users/ben/suspension", fmt.Sprintf(`{"reason":"spam","until":%d}`, until), admin)
+	require.Equal(t, 200, rr.Code)
+	response, err := util.UnmarshalJSON[apiAdminUserResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "ben", response.Username)
+	require.Equal(t, "spam", response.Suspension.Reason)
+	require.Equal(t, "phil", response.Suspension.SuspendedBy)
+	require.Equal(t, until, response.Suspension.Until)
+	require.True(t, canceled.Load())
+	requireSubscriptionCount(t, s, "mytopic", 0)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40305, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Admin sees the suspension, and the profile shows as deactivated
+	rr = request(t, s, "GET", "/api/admin/users", "", admin)
+	require.Equal(t, 200, rr.Code)
+	users, err := util.UnmarshalJSON[apiAdminUsersResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	var suspension *apiAdminUserSuspension
+	for _, u := range users.Users {
+		if u.Username == "ben" {
+			suspension = u.Suspension
+		} else {
+			require.Nil(t, u.Suspension)
+		}
+	}
+	require.NotNil(t, suspension)
+	require.Equal(t, "spam", suspension.Reason)
+
+	rr = request(t, s, "GET", "/v1/coop/profile/ben", "", admin)
+	require.Equal(t, 200, rr.Code)
+	profile, err := util.UnmarshalJSON[user.Profile](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.True(t, profile.Deactivated)
+
+	// Lifting the suspension allows ben to log in again
+	rr = request(t, s, "DELETE", "/api/admin/users/ben/suspension", "", admin)
+	require.Equal(t, 204, rr.Code)
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	entries, err := s.userManager.AuditEntries(&user.AuditFilter{Action: "admin.user"})
+	require.Nil(t, err)
+	actions := make([]string, 0)
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	require.Contains(t, actions, auditActionAdminUserSuspend)
+	require.Contains(t, actions, auditActionAdminUserUnsuspend)
+}
+
+func TestUser_AdminCreate_PasswordPolicy(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthPasswordMinLength = 8
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+
+	rr := request(t, s, "POST", "/api/admin/users", `{"username":"ben", "password":"ben", "role":"user"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40054, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/api/admin/users", `{"username":"ben", "password":"long enough", "role":"user"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 201, rr.Code)
+
+	rr = request(t, s, "PUT", "/api/admin/users/ben", `{"password":"short"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40054, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestAdmin_AuditLog(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+
+	// Failed login, login, admin actions
+	rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "wrong"),
+	})
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/api/admin/users", `{"username":"emma","password":"emma-pass","role":"user"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"User-Agent":    "=HYPERLINK(\"http://evil\")",
+	})
+	require.Equal(t, 201, rr.Code)
+	rr = request(t, s, "POST", "/api/admin/topics", `{"username":"emma","topic_pattern":"announcements","permission":"read-only"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 201, rr.Code)
+	rr = request(t, s, "DELETE", "/api/admin/users/emma", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 204, rr.Code)
+
+	// Non-admins cannot read the audit log
+	rr = request(t, s, "GET", "/v1/admin/audit", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// All entries, newest first
+	rr = request(t, s, "GET", "/v1/admin/audit", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	audit, _ := util.UnmarshalJSON[apiAdminAuditResponse](rr.Result().Body)
+	require.Equal(t, 5, len(audit.Entries))
+	require.Equal(t, "admin.user.delete", audit.Entries[0].Action)
+	require.Equal(t, "phil", audit.Entries[0].Actor)
+	require.Equal(t, "emma", audit.Entries[0].Target)
+	require.Equal(t, "admin.access.grant", audit.Entries[1].Action)
+	require.Equal(t, "announcements", audit.Entries[1].Detail["topic"])
+	require.Equal(t, "admin.user.create", audit.Entries[2].Action)
+	require.Equal(t, "login", audit.Entries[3].Action)
+	require.Equal(t, "ben", audit.Entries[3].Actor)
+	require.Equal(t, "login.failure", audit.Entries[4].Action)
+	require.Equal(t, "", audit.Entries[4].Actor)
+	require.Equal(t, "ben", audit.Entries[4].Target)
+	require.Equal(t, "9.9.9.9", audit.Entries[4].IP)
+	require.Zero(t, audit.NextBefore)
+
+	// Filter and paginate
+	rr = request(t, s, "GET", "/v1/admin/audit?action=admin&limit=2", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	audit, _ = util.UnmarshalJSON[apiAdminAuditResponse](rr.Result().Body)
+	require.Equal(t, 2, len(audit.Entries))
+	require.NotZero(t, audit.NextBefore)
+	rr = request(t, s, "GET", fmt.Sprintf("/v1/admin/audit?action=admin&limit=2&before=%d", audit.NextBefore), "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	audit, _ = util.UnmarshalJSON[apiAdminAuditResponse](rr.Result().Body)
+	require.Equal(t, 1, len(audit.Entries))
+	require.Equal(t, "admin.user.create", audit.Entries[0].Action)
+
+	rr = request(t, s, "GET", "/v1/admin/audit?limit=100000", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+
+	// CSV export, with formulas neutralized
+	rr = request(t, s, "GET", "/v1/admin/audit.csv?actor=phil", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	require.Nil(t, err)
+	require.Equal(t, 4, len(records))
+	require.Equal(t, []string{"id", "time", "actor", "action", "target", "ip", "user_agent", "detail"}, records[0])
+	require.Equal(t, "admin.user.create", records[3][3])
+	require.Equal(t, "'=HYPERLINK(\"http://evil\")", records[3][6])
+	require.Equal(t, `{"role":"user"}`, records[3][7])
+}
+
+func TestAdmin_AuditLog_UnknownUsersSampled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	s.unknownUserAudits = newAuditSampler(time.Hour, 2)
+
+	// Only the first two failed logins of unknown users are written, the rest are counted
+	for i := 0; i < 5; i++ {
+		rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BasicAuth(fmt.Sprintf("nobody%d", i), "wrong"),
+		})
+		require.Equal(t, 401, rr.Code)
+	}
+	entries, err := s.userManager.AuditEntries(&user.AuditFilter{Action: auditActionLoginFailure})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, "nobody1", entries[0].Target)
+	require.Nil(t, entries[0].Detail["suppressed"])
+
+	// Next written entry carries the number of suppressed entries
+	s.unknownUserAudits.limiter.SetLimit(rate.Inf)
+	rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("nobody5", "wrong"),
+	})
+	require.Equal(t, 401, rr.Code)
+	entries, err = s.userManager.AuditEntries(&user.AuditFilter{Action: auditActionLoginFailure})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(entries))
+	require.Equal(t, "nobody5", entries[0].Target)
+	require.Equal(t, float64(3), entries[0].Detail["suppressed"])
+}
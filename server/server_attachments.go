@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// Query parameters of signed attachment URLs, e.g. /file/abcd1234.jpg?u=phil&exp=1700000000&sig=...
+const (
+	attachmentURLUserParam      = "u"
+	attachmentURLExpiresParam   = "exp"
+	attachmentURLSignatureParam = "sig"
+	attachmentURLSecretLength   = 32
+)
+
+// newAttachmentURLKey returns the key used to sign attachment URLs. If no secret is configured, a
+// random key is used, which means that signed URLs do not survive a restart.
+func newAttachmentURLKey(secret string) ([]byte, error) {
+	if secret != "" {
+		key := sha256.Sum256([]byte(secret))
+		return key[:], nil
+	}
+	key := make([]byte, attachmentURLSecretLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// authorizeFileRead checks if the visitor may download the attachment of the given message. Attachments
+// in Coop chat topics require read permission on the topic, either via the visitor's own credentials,
+// via a signed URL issued to a user that (still) has read permission, or via a signed URL that is scoped
+// to this message only (see withEmailAttachmentURL).
+func (s *Server) authorizeFileRead(r *http.Request, v *visitor, m *message) error {
+	if !s.isCoopTopic(m.Topic) {
+		return nil
+	}
+	if err := s.userManager.Authorize(v.User(), m.Topic, user.PermissionRead); err == nil {
+		return nil
+	}
+	if username, ok := s.verifyAttachmentURL(r.URL.Query(), m.ID); ok {
+		if username == "" {
+			return nil
+		}
+		u, err := s.userManager.User(username)
+		if err == nil && s.userManager.Authorize(u, m.Topic, user.PermissionRead) == nil {
+			return nil
+		}
+	}
+	return errHTTPForbidden.Fields(log.Context{
+		"message_id": m.ID,
+		"topic":      m.Topic,
+	})
+}
+
+// withSignedAttachmentURL returns a copy of the message in which the attachment URL is signed for the
+// given viewer, so that it can be embedded (e.g. in <img> tags) without sending an Authorization header.
+// The original message is returned if the attachment is not stored on this server, or not in a Coop topic.
+func (s *Server) withSignedAttachmentURL(m *message, u *user.User) *message {
+	if u == nil {
+		return m
+	}
+	return s.withAttachmentURLSignedFor(m, u.Name)
+}
+
+// withEmailAttachmentURL returns a copy of the message in which the attachment URL is signed for this
+// message only, without a user. Email recipients are not (necessarily) users, and signing the URL for
+// the publisher would let anyone with the email act as the publisher until the URL expires.
+func (s *Server) withEmailAttachmentURL(m *message) *message {
+	return s.withAttachmentURLSignedFor(m, "")
+}
+
+func (s *Server) withAttachmentURLSignedFor(m *message, username string) *message {
+	if !m.Coop || m.Attachment == nil || !strings.HasPrefix(m.Attachment.URL, s.config.BaseURL+"/file/") {
+		return m
+	}
+	expires := time.Now().Add(s.config.AttachmentURLExpiry).Unix()
+	query := url.Values{}
+	if username != "" {
+		query.Set(attachmentURLUserParam, username)
+	}
+	query.Set(attachmentURLExpiresParam, strconv.FormatInt(expires, 10))
+	query.Set(attachmentURLSignatureParam, s.attachmentURLSignature(m.ID, username, expires))
+	clone, attachment := *m, *m.Attachment
+	attachment.URL = strings.SplitN(attachment.URL, "?", 2)[0] + "?" + query.Encode()
+	clone.Attachment = &attachment
+	return &clone
+}
+
+// verifyAttachmentURL checks the signature and expiry of a signed attachment URL, and returns the
+// user the URL was issued to, or an empty username if the URL is scoped to the message only
+func (s *Server) verifyAttachmentURL(query url.Values, messageID string) (username string, ok bool) {
+	username = query.Get(attachmentURLUserParam)
+	signature := query.Get(attachmentURLSignatureParam)
+	expires, err := strconv.ParseInt(query.Get(attachmentURLExpiresParam), 10, 64)
+	if signature == "" || err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	expected := s.attachmentURLSignature(messageID, username, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", false
+	}
+	return username, true
+}
+
+func (s *Server) attachmentURLSignature(messageID, username string, expires int64) string {
+	mac := hmac.New(sha256.New, s.attachmentURLKey)
+	mac.Write([]byte(messageID + "\n" + username + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// attachmentPresignExpiry is the validity of presigned URLs that handleFile redirects to. It only needs to
+// cover the redirect itself, since every download goes through handleFile first.
+const attachmentPresignExpiry = 5 * time.Minute
+
+// parseFileRange parses a single-range "Range: bytes=..." header for a file of the given size, and returns the
+// offset and length of the requested range. Multiple ranges and malformed headers are ignored, i.e. the whole
+// file is returned, which RFC 9110 permits. If the range cannot be satisfied, errHTTPRangeNotSatisfiable is returned.
+func parseFileRange(header string, size int64) (offset, length int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, false, nil
+	}
+	if startStr == "" { // Suffix range, e.g. bytes=-500
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, size, false, nil
+		} else if suffix == 0 || size == 0 {
+			return 0, 0, false, errHTTPRangeNotSatisfiable
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true, nil
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	} else if start >= size {
+		return 0, 0, false, errHTTPRangeNotSatisfiable
+	}
+	end := size - 1
+	if endStr != "" {
+		if end, err = strconv.ParseInt(endStr, 10, 64); err != nil || end < start {
+			return 0, size, false, nil
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, nil
+}
+
+// attachmentContentType returns the content type to serve an attachment with. HTML is never served as such,
+// see util.ContentTypeWriter.
+func attachmentContentType(m *message) string {
+	if m.Attachment == nil || m.Attachment.Type == "" {
+		return "application/octet-stream"
+	}
+	return strings.ReplaceAll(m.Attachment.Type, "text/html", "text/plain")
+}
+
+// attachmentFileID returns the ID of the stored file of a message's attachment: the SHA-256 of its contents
+// (the blob), or the message ID for attachments stored before attachments were deduplicated
+func attachmentFileID(m *message) string {
+	if m.Attachment != nil && m.Attachment.Hash != "" {
+		return m.Attachment.Hash
+	}
+	return m.ID
+}
+
+// attachmentThumbnailID returns the file ID of a thumbnail (see imageThumbnailSizes) of an attachment
+func attachmentThumbnailID(fileID, name string) string {
+	return fileID + "_" + name
+}
+
+// attachmentFileIDs returns the IDs of all files of the given attachments (message IDs or blob hashes), i.e. the
+// attachments themselves and their thumbnails. Thumbnails that do not exist are ignored when removing files.
+func attachmentFileIDs(fileIDs []string) []string {
+	ids := make([]string, 0, len(fileIDs)*(len(imageThumbnailSizes)+1))
+	for _, id := range fileIDs {
+		ids = append(ids, id)
+		for _, t := range imageThumbnailSizes {
+			ids = append(ids, attachmentThumbnailID(id, t.name))
+		}
+	}
+	return ids
+}
+
+// attachmentThumbnailName returns the thumbnail name for the "size" query parameter of a file download,
+// or an empty string for the original
+func attachmentThumbnailName(size string) (string, error) {
+	if size == "" || size == "original" {
+		return "", nil
+	}
+	for _, t := range imageThumbnailSizes {
+		if t.name == size {
+			return size, nil
+		}
+	}
+	return "", errHTTPBadRequestAttachmentSizeInvalid
+}
+
+// storeAttachmentBlob moves an uploaded attachment (written under the message ID) to its content-addressed
+// blob, or removes it if a blob with the same contents already exists. Thumbnails are only stored for new blobs.
+func (s *Server) storeAttachmentBlob(v *visitor, m *message, hash string, thumbnails map[string][]byte) error {
+	s.attachmentBlobsMu.Lock()
+	defer s.attachmentBlobsMu.Unlock()
+	exists, err := s.messageCache.TouchAttachmentBlob(hash)
+	if err != nil {
+		s.fileCache.Remove(m.ID)
+		return err
+	} else if exists {
+		logvm(v, m).Tag(tagPublish).Field("attachment_hash", hash).Debug("Attachment already stored, referencing existing file")
+		m.Attachment.Hash = hash
+		return s.fileCache.Remove(m.ID)
+	}
+	if err := s.fileCache.Rename(m.ID, hash); err != nil {
+		s.fileCache.Remove(m.ID)
+		return err
+	}
+	if err := s.messageCache.AddAttachmentBlob(hash, m.Attachment.Size); err != nil {
+		s.fileCache.Remove(hash)
+		return err
+	}
+	for name, thumbnail := range thumbnails {
+		if _, err := s.fileCache.Write(attachmentThumbnailID(hash, name), bytes.NewReader(thumbnail)); err != nil {
+			logvm(v, m).Tag(tagImage).Err(err).Warn("Cannot store %s thumbnail", name)
+		}
+	}
+	m.Attachment.Hash = hash
+	return nil
+}
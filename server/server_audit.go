@@ -0,0 +1,283 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	apiAdminAuditPath       = "/v1/admin/audit"
+	apiAdminAuditExportPath = "/v1/admin/audit.csv"
+	auditDefaultLimit       = 100
+	auditMaxLimit           = 1000
+	auditExportLimit        = 100000
+	auditTokenPrefixLength  = 6 // Only this many characters of tokens are written to the audit log
+
+	// Failed logins for unknown usernames are not tied to an account and can be sent from any number
+	// of IPs, so only this many are written to the audit log; the rest are counted (see auditSampler)
+	auditUnknownUserLimitBurst     = 30
+	auditUnknownUserLimitReplenish = 10 * time.Second
+)
+
+// Audit log actions. Actions are hierarchical, so filtering by "admin" returns all admin actions.
+const (
+	auditActionLogin               = "login"
+	auditActionLoginFailure        = "login.failure"
+	auditActionLoginLocked         = "login.locked"
+	auditActionLogout              = "logout"
+	auditActionTokenCreate         = "token.create"
+	auditActionTokenUpdate         = "token.update"
+	auditActionTokenDelete         = "token.delete"
+	auditActionAccountCreate       = "account.create"
+	auditActionAccountDelete       = "account.delete"
+	auditActionPasswordChange      = "password.change"
+	auditActionAdminUserCreate     = "admin.user.create"
+	auditActionAdminUserUpdate     = "admin.user.update"
+	auditActionAdminUserDelete     = "admin.user.delete"
+	auditActionAdminUserUnlock     = "admin.user.unlock"
+	auditActionAdminUserSuspend    = "admin.user.suspend"
+	auditActionAdminUserUnsuspend  = "admin.user.unsuspend"
+	auditActionAdminUserOIDCLink   = "admin.user.oidc_link"
+	auditActionAdminUserOIDCUnlink = "admin.user.oidc_unlink"
+	auditActionAdminAccessGrant    = "admin.access.grant"
+	auditActionAdminAccessRevoke   = "admin.access.revoke"
+	auditActionAdminTopicDelete    = "admin.topic.delete"
+	auditActionAdminReportAction   = "admin.report.action"
+	auditActionInviteCreate        = "invite.create"
+	auditActionInviteDelete        = "invite.delete"
+	auditActionInviteRedeem        = "invite.redeem"
+	auditActionInviteJoin          = "invite.join"
+	auditActionJoinRequestCreate   = "join_request.create"
+	auditActionJoinRequestResolve  = "join_request.resolve"
+	auditActionKeysPublish         = "keys.publish"
+	auditActionKeysDelete          = "keys.delete"
+	auditActionKeyBackupUpdate     = "keys.backup.update"
+	auditActionKeyBackupDelete     = "keys.backup.delete"
+	auditActionKeyBackupFetch      = "keys.backup.fetch"
+	auditActionKeyBackupFailure    = "keys.backup.failure"
+	auditActionKeyBackupLocked     = "keys.backup.locked"
+	auditActionContactVerify       = "contact.verify"
+	auditActionContactUnverify     = "contact.unverify"
+	auditActionContactInviteCreate = "contact.invite.create"
+	auditActionContactInviteDelete = "contact.invite.delete"
+	auditActionContactInviteRedeem = "contact.invite.redeem"
+	auditActionContactImport       = "contact.import"
+	auditActionReportCreate        = "report.create"
+)
+
+// apiAdminAuditEntry is a single audit log entry in the admin API
+type apiAdminAuditEntry struct {
+	ID        int64          `json:"id"`
+	Time      int64          `json:"time"`
+	Actor     string         `json:"actor"`
+	Action    string         `json:"action"`
+	Target    string         `json:"target"`
+	IP        string         `json:"ip"`
+	UserAgent string         `json:"user_agent"`
+	Detail    map[string]any `json:"detail,omitempty"`
+}
+
+// apiAdminAuditResponse is the response for GET /v1/admin/audit. If there are more entries,
+// next_before can be passed as the before parameter to fetch the next page.
+type apiAdminAuditResponse struct {
+	Entries    []*apiAdminAuditEntry `json:"entries"`
+	NextBefore int64                 `json:"next_before,omitempty"`
+}
+
+// audit writes an entry to the audit log, with the visitor's user as actor. Errors are logged, but
+// do not fail the request, since the action itself has already been performed.
+func (s *Server) audit(r *http.Request, v *visitor, action, target string, detail map[string]any) {
+	actor := ""
+	if u := v.User(); u != nil {
+		actor = u.Name
+	}
+	s.auditAs(r, actor, action, target, detail)
+}
+
+// auditAs writes an entry to the audit log with the given actor, e.g. for logins, where the request
+// is not (yet) authenticated
+func (s *Server) auditAs(r *http.Request, actor, action, target string, detail map[string]any) {
+	if s.userManager == nil {
+		return
+	}
+	entry := &user.AuditEntry{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		IP:        extractIPAddress(r, s.config.BehindProxy, s.config.ProxyForwardedHeader, s.config.ProxyTrustedPrefixes),
+		UserAgent: r.UserAgent(),
+		Detail:    detail,
+	}
+	if err := s.userManager.AddAuditEntry(entry); err != nil {
+		logr(r).Tag(tagAdmin).Err(err).Warn("Cannot write %s entry to audit log", action)
+	}
+}
+
+// auditSampler limits how many entries of a kind are written to the audit log. Entries beyond the
+// limit are not written, but counted, and the count is attached to the next entry that is written.
+type auditSampler struct {
+	limiter    *rate.Limiter
+	suppressed int
+	mu         sync.Mutex
+}
+
+func newAuditSampler(replenish time.Duration, burst int) *auditSampler {
+	return &auditSampler{
+		limiter: rate.NewLimiter(rate.Every(replenish), burst),
+	}
+}
+
+// Allow returns true if an entry may be written, along with the number of entries that were
+// suppressed since the last one was written
+func (a *auditSampler) Allow() (bool, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.limiter.Allow() {
+		a.suppressed++
+		return false, 0
+	}
+	suppressed := a.suppressed
+	a.suppressed = 0
+	return true, suppressed
+}
+
+// auditToken shortens a token, so that it can be identified in the audit log without being usable
+func auditToken(token string) string {
+	if len(token) <= auditTokenPrefixLength {
+		return token
+	}
+	return token[:auditTokenPrefixLength] + "..."
+}
+
+// handleAdminAuditGet returns the audit log, newest first, filtered by the actor, action, target,
+// since and until query parameters, and paginated via limit and before (Admin endpoint)
+func (s *Server) handleAdminAuditGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	filter, err := parseAuditFilter(r, auditDefaultLimit, auditMaxLimit)
+	if err != nil {
+		return err
+	}
+	entries, err := s.userManager.AuditEntries(filter)
+	if err != nil {
+		return err
+	}
+	response := &apiAdminAuditResponse{
+		Entries: make([]*apiAdminAuditEntry, 0, len(entries)),
+	}
+	for _, e := range entries {
+		response.Entries = append(response.Entries, &apiAdminAuditEntry{
+			ID:        e.ID,
+			Time:      e.Time.Unix(),
+			Actor:     e.Actor,
+			Action:    e.Action,
+			Target:    e.Target,
+			IP:        auditIP(e),
+			UserAgent: e.UserAgent,
+			Detail:    e.Detail,
+		})
+	}
+	if len(entries) == filter.Limit {
+		response.NextBefore = entries[len(entries)-1].ID
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAdminAuditExport returns the audit log as CSV, using the same filters as handleAdminAuditGet (Admin endpoint).
+// Entries are streamed from the database to the response, so that large exports are not held in memory.
+func (s *Server) handleAdminAuditExport(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	filter, err := parseAuditFilter(r, auditExportLimit, auditExportLimit)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"id", "time", "actor", "action", "target", "ip", "user_agent", "detail"}); err != nil {
+		return err
+	}
+	if err := s.userManager.ForEachAuditEntry(filter, func(e *user.AuditEntry) error {
+		detail := ""
+		if len(e.Detail) > 0 {
+			b, err := json.Marshal(e.Detail)
+			if err != nil {
+				return err
+			}
+			detail = string(b)
+		}
+		return writer.Write([]string{
+			strconv.FormatInt(e.ID, 10),
+			e.Time.UTC().Format(time.RFC3339),
+			csvSafe(e.Actor),
+			csvSafe(e.Action),
+			csvSafe(e.Target),
+			auditIP(e),
+			csvSafe(e.UserAgent),
+			csvSafe(detail),
+		})
+	}); err != nil {
+		logvr(v, r).Tag(tagAdmin).Err(err).Warn("Cannot export audit log")
+		return nil // Parts of the response may have been written already, cannot send an error anymore
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func parseAuditFilter(r *http.Request, defaultLimit, maxLimit int) (*user.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := &user.AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+		Limit:  defaultLimit,
+	}
+	var err error
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxLimit {
+			return nil, errHTTPBadRequest.Wrap("invalid limit, must be between 1 and %d", maxLimit)
+		}
+	}
+	if before := query.Get("before"); before != "" {
+		filter.Before, err = strconv.ParseInt(before, 10, 64)
+		if err != nil || filter.Before <= 0 {
+			return nil, errHTTPBadRequest.Wrap("invalid before, must be an entry ID")
+		}
+	}
+	if since := query.Get("since"); since != "" {
+		timestamp, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			return nil, errHTTPBadRequest.Wrap("invalid since, must be a Unix timestamp")
+		}
+		filter.Since = time.Unix(timestamp, 0)
+	}
+	if until := query.Get("until"); until != "" {
+		timestamp, err := strconv.ParseInt(until, 10, 64)
+		if err != nil {
+			return nil, errHTTPBadRequest.Wrap("invalid until, must be a Unix timestamp")
+		}
+		filter.Until = time.Unix(timestamp, 0)
+	}
+	return filter, nil
+}
+
+func auditIP(e *user.AuditEntry) string {
+	if !e.IP.IsValid() {
+		return ""
+	}
+	return e.IP.String()
+}
+
+// csvSafe prevents values from being interpreted as formulas when the CSV file is opened in a spreadsheet
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
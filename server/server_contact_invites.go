@@ -0,0 +1,287 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	apiContactInvitesPath       = "/v1/coop/contact-invites"
+	apiContactInvitesPrefix     = apiContactInvitesPath + "/"
+	contactInviteDefaultExpiry  = 7 * 24 * time.Hour
+	contactInviteMaxUsesLimit   = 100
+	contactInviteQRSizeDefault  = 256
+	contactInviteQRSizeMax      = 1024
+	contactInviteQRSuffixPNG    = "/qr.png"
+	contactInviteQRSuffixSVG    = "/qr.svg"
+	contactInviteRedeemSuffix   = "/redeem"
+	contactInvitePagePathPrefix = "/contact/"
+)
+
+var (
+	contactInvitePageRegex = regexp.MustCompile(`^/contact/ci_[A-Za-z0-9]+$`)
+)
+
+// apiContactInviteCreateRequest is the request for POST /v1/coop/contact-invites. Expires is a Unix timestamp;
+// if it is zero, the invite expires after seven days.
+type apiContactInviteCreateRequest struct {
+	MaxUses int   `json:"max_uses"`
+	Expires int64 `json:"expires"`
+}
+
+// apiContactInviteResponse is the response for creating and listing contact invites
+type apiContactInviteResponse struct {
+	Token     string `json:"token"`
+	MaxUses   int    `json:"max_uses"`
+	UsedCount int    `json:"used_count"`
+	Expires   int64  `json:"expires,omitempty"`
+	Created   int64  `json:"created"`
+	URL       string `json:"url"`
+}
+
+// apiContactInviteInfoResponse is the public response for GET /v1/coop/contact-invites/{token}
+type apiContactInviteInfoResponse struct {
+	Token       string `json:"token"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	Expires     int64  `json:"expires,omitempty"`
+	Available   bool   `json:"available"`
+}
+
+// apiContactInviteRedeemRequest is the request for POST /v1/coop/contact-invites/{token}/redeem. If DM is set,
+// a DM with the invite owner is opened right away.
+type apiContactInviteRedeemRequest struct {
+	DM bool `json:"dm"`
+}
+
+// apiContactInviteRedeemResponse is the response for redeeming a contact invite
+type apiContactInviteRedeemResponse struct {
+	Username string `json:"username"`
+	Topic    string `json:"topic,omitempty"` // DM topic, if requested
+}
+
+// handleContactInviteCreate handles POST /v1/coop/contact-invites - creates a personal contact invite
+func (s *Server) handleContactInviteCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiContactInviteCreateRequest](r.Body, jsonBodyBytesLimit, true)
+	if err != nil {
+		return err
+	}
+	maxUses := req.MaxUses
+	if maxUses <= 0 {
+		maxUses = 1
+	} else if maxUses > contactInviteMaxUsesLimit {
+		return errHTTPBadRequest.Wrap("max_uses must be at most %d", contactInviteMaxUsesLimit)
+	}
+	expires := time.Now().Add(contactInviteDefaultExpiry)
+	if req.Expires > 0 {
+		expires = time.Unix(req.Expires, 0)
+		if expires.Before(time.Now()) {
+			return errHTTPBadRequest.Wrap("expires must be in the future")
+		}
+	}
+	invite, err := s.userManager.AddContactInvite(u.ID, maxUses, expires)
+	if errors.Is(err, user.ErrTooManyContactInvites) {
+		return errHTTPTooManyRequestsLimitContactInvites
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionContactInviteCreate, auditToken(invite.Token), map[string]any{"max_uses": maxUses, "expires": expires.Unix()})
+	return s.writeJSON(w, s.newContactInviteResponse(invite))
+}
+
+// handleContactInviteList handles GET /v1/coop/contact-invites - lists the user's unexpired contact invites
+func (s *Server) handleContactInviteList(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	invites, err := s.userManager.ContactInvites(v.User().ID)
+	if err != nil {
+		return err
+	}
+	response := make([]*apiContactInviteResponse, 0, len(invites))
+	for _, invite := range invites {
+		response = append(response, s.newContactInviteResponse(invite))
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleContactInviteDelete handles DELETE /v1/coop/contact-invites/{token} - revokes a contact invite
+func (s *Server) handleContactInviteDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	token := strings.TrimPrefix(r.URL.Path, apiContactInvitesPrefix)
+	if token == "" || strings.Contains(token, "/") {
+		return errHTTPBadRequestInviteInvalid
+	}
+	if err := s.userManager.RemoveContactInvite(v.User().ID, token); errors.Is(err, user.ErrContactInviteNotFound) {
+		return errHTTPBadRequestInviteNotFound
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionContactInviteDelete, auditToken(token), nil)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleContactInviteInfo handles GET /v1/coop/contact-invites/{token} - returns who the invite is from (public)
+func (s *Server) handleContactInviteInfo(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	invite, err := s.contactInviteFromPath(r.URL.Path, "")
+	if err != nil {
+		return err
+	}
+	response := &apiContactInviteInfoResponse{
+		Token:     invite.Token,
+		Username:  invite.Username,
+		Available: invite.Available(),
+	}
+	if !invite.Expires.IsZero() {
+		response.Expires = invite.Expires.Unix()
+	}
+	if profile, err := s.userManager.Profile(invite.Username); err == nil {
+		response.DisplayName = profile.DisplayName
+		response.AvatarURL = profile.AvatarURL
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleContactInviteQR handles GET /v1/coop/contact-invites/{token}/qr.png and .../qr.svg - renders the
+// invite URL as a QR code, so that it can be scanned in person. The optional size parameter sets the
+// width of the PNG in pixels.
+func (s *Server) handleContactInviteQR(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	svg := strings.HasSuffix(r.URL.Path, contactInviteQRSuffixSVG)
+	suffix := contactInviteQRSuffixPNG
+	if svg {
+		suffix = contactInviteQRSuffixSVG
+	}
+	invite, err := s.contactInviteFromPath(r.URL.Path, suffix)
+	if err != nil {
+		return err
+	} else if invite.Expired() {
+		return errHTTPBadRequestInviteExpired
+	} else if !invite.Available() {
+		return errHTTPBadRequestInviteMaxUsed
+	}
+	qr, err := qrcode.New(s.contactInviteURL(invite.Token), qrcode.Medium)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if svg {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, err := w.Write(qrCodeSVG(qr.Bitmap()))
+		return err
+	}
+	size := contactInviteQRSizeDefault
+	if sizeStr := readQueryParam(r, "size"); sizeStr != "" {
+		size, err = strconv.Atoi(sizeStr)
+		if err != nil || size <= 0 || size > contactInviteQRSizeMax {
+			return errHTTPBadRequest.Wrap("size must be between 1 and %d", contactInviteQRSizeMax)
+		}
+	}
+	png, err := qr.PNG(size)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_, err = w.Write(png)
+	return err
+}
+
+// handleContactInviteRedeem handles POST /v1/coop/contact-invites/{token}/redeem - makes the user a contact
+// of the invite owner, bypassing the owner's privacy setting, and optionally opens a DM
+func (s *Server) handleContactInviteRedeem(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiContactInviteRedeemRequest](r.Body, jsonBodyBytesLimit, true)
+	if err != nil {
+		return err
+	}
+	invite, err := s.contactInviteFromPath(r.URL.Path, contactInviteRedeemSuffix)
+	if err != nil {
+		return err
+	} else if invite.Username == u.Name {
+		return errHTTPBadRequest.Wrap("cannot redeem own invite")
+	}
+	blocked, err := s.userManager.IsBlocked(u.Name, invite.Username)
+	if err != nil {
+		return err
+	} else if blocked {
+		return errHTTPForbidden.Wrap("blocked")
+	}
+	invite, err = s.userManager.RedeemContactInvite(invite.Token, u.Name)
+	if errors.Is(err, user.ErrContactInviteNotFound) {
+		return errHTTPBadRequestInviteNotFound
+	} else if errors.Is(err, user.ErrContactInviteExpired) {
+		return errHTTPBadRequestInviteExpired
+	} else if errors.Is(err, user.ErrContactInviteMaxUsed) {
+		return errHTTPBadRequestInviteMaxUsed
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionContactInviteRedeem, auditToken(invite.Token), map[string]any{"owner": invite.Username})
+	log.Tag(tagContacts).Info("Contact invite redeemed: %s <-> %s", u.Name, invite.Username)
+	response := &apiContactInviteRedeemResponse{Username: invite.Username}
+	if req.DM {
+		if response.Topic, err = s.openDM(u.Name, invite.Username, false); err != nil {
+			return err
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// contactInviteFromPath returns the contact invite identified by the token in the request path,
+// e.g. /v1/coop/contact-invites/{token}/redeem for the suffix "/redeem"
+func (s *Server) contactInviteFromPath(path, suffix string) (*user.ContactInvite, error) {
+	token := strings.TrimSuffix(strings.TrimPrefix(path, apiContactInvitesPrefix), suffix)
+	if token == "" || strings.Contains(token, "/") {
+		return nil, errHTTPBadRequestInviteInvalid
+	}
+	invite, err := s.userManager.ContactInvite(token)
+	if errors.Is(err, user.ErrContactInviteNotFound) {
+		return nil, errHTTPBadRequestInviteNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// contactInviteURL returns the web app URL of a contact invite, which is also what the QR code encodes
+func (s *Server) contactInviteURL(token string) string {
+	return s.config.BaseURL + contactInvitePagePathPrefix + token
+}
+
+func (s *Server) newContactInviteResponse(invite *user.ContactInvite) *apiContactInviteResponse {
+	response := &apiContactInviteResponse{
+		Token:     invite.Token,
+		MaxUses:   invite.MaxUses,
+		UsedCount: invite.UsedCount,
+		Created:   invite.Created.Unix(),
+		URL:       s.contactInviteURL(invite.Token),
+	}
+	if !invite.Expires.IsZero() {
+		response.Expires = invite.Expires.Unix()
+	}
+	return response
+}
+
+// qrCodeSVG renders a QR code bitmap (including its quiet zone) as an SVG image, with one path
+// segment per dark module. The image scales to any size, so no size parameter is needed.
+func qrCodeSVG(bitmap [][]bool) []byte {
+	var b strings.Builder
+	size := len(bitmap)
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return []byte(b.String())
+}
@@ -2,22 +2,39 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 )
 
-const tagContacts = "contacts"
+const (
+	tagContacts                  = "contacts"
+	apiContactVerificationSuffix = "/verification"
+	contactNicknameLengthMax     = 50
+	contactLabelLengthMax        = 32
+	contactLabelsMax             = 20
+	apiContactCardPath           = "/v1/coop/contacts/card"
+	coopContactCardEvent         = "coop_contact_card"
+)
 
-// handleContactList handles GET /v1/coop/contacts - returns accepted contacts
+// handleContactList handles GET /v1/coop/contacts - returns accepted contacts, optionally only
+// those with the given label (?label=Work)
 func (s *Server) handleContactList(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	u := v.User()
 	contacts, err := s.userManager.Contacts(u.Name, user.ContactStatusAccepted)
 	if err != nil {
 		return err
 	}
+	if label := readQueryParam(r, "label"); label != "" {
+		contacts = slices.DeleteFunc(contacts, func(c *user.Contact) bool {
+			return !slices.Contains(c.Labels, label)
+		})
+	}
 	return s.writeJSON(w, contacts)
 }
 
@@ -45,61 +62,72 @@ func (s *Server) handleContactAdd(w http.ResponseWriter, r *http.Request, v *vis
 	var req apiContactAddRequest
 	if err := json.Unmarshal(body, &req); err != nil {
 		return errHTTPBadRequest.Wrap("invalid request body")
+	} else if !v.ContactAllowed() {
+		return errHTTPTooManyRequestsLimitContacts
 	}
-	if req.Username == "" || req.Username == u.Name {
-		return errHTTPBadRequest.Wrap("invalid username")
+	if _, err := s.addContact(u, req.Username); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// addContact sends a contact request from the user to the given user, applying the target's privacy
+// setting: open profiles accept right away, invite-only profiles refuse. It returns the resulting status.
+func (s *Server) addContact(u *user.User, username string) (string, error) {
+	if username == "" || username == u.Name {
+		return "", errHTTPBadRequest.Wrap("invalid username")
 	}
 
 	// Check if target user exists
-	if _, err := s.userManager.User(req.Username); err != nil {
-		return errHTTPBadRequest.Wrap("user not found")
+	if _, err := s.userManager.User(username); err != nil {
+		return "", errHTTPBadRequest.Wrap("user not found")
 	}
 
 	// Check if blocked
-	blocked, err := s.userManager.IsBlocked(u.Name, req.Username)
+	blocked, err := s.userManager.IsBlocked(u.Name, username)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if blocked {
-		return errHTTPForbidden.Wrap("blocked")
+		return "", errHTTPForbidden.Wrap("blocked")
 	}
 
 	// Check existing relationship
-	existingStatus, err := s.userManager.ContactStatus(u.Name, req.Username)
+	existingStatus, err := s.userManager.ContactStatus(u.Name, username)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if existingStatus != "" {
-		return errHTTPConflict.Wrap("contact relationship already exists")
+		return "", errHTTPConflict.Wrap("contact relationship already exists")
 	}
 
 	// Check target's privacy setting
-	privacy, err := s.userManager.ProfilePrivacy(req.Username)
+	privacy, err := s.userManager.ProfilePrivacy(username)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	switch privacy {
 	case user.PrivacyInviteOnly:
-		return errHTTPForbidden.Wrap("user only accepts contacts via invite")
+		return "", errHTTPForbidden.Wrap("user only accepts contacts via invite")
 	case user.PrivacyOpen:
 		// Auto-accept: create both directions as accepted
-		if err := s.userManager.AddContact(u.Name, req.Username, user.ContactStatusAccepted); err != nil {
-			return err
+		if err := s.userManager.AddContact(u.Name, username, user.ContactStatusAccepted); err != nil {
+			return "", err
 		}
-		if err := s.userManager.AddContact(req.Username, u.Name, user.ContactStatusAccepted); err != nil {
-			return err
+		if err := s.userManager.AddContact(username, u.Name, user.ContactStatusAccepted); err != nil {
+			return "", err
 		}
-		log.Tag(tagContacts).Info("Contact auto-accepted: %s <-> %s (privacy=open)", u.Name, req.Username)
+		log.Tag(tagContacts).Info("Contact auto-accepted: %s <-> %s (privacy=open)", u.Name, username)
+		return user.ContactStatusAccepted, nil
 	default: // PrivacyRequest
 		// Create pending request
-		if err := s.userManager.AddContact(u.Name, req.Username, user.ContactStatusPending); err != nil {
-			return err
+		if err := s.userManager.AddContact(u.Name, username, user.ContactStatusPending); err != nil {
+			return "", err
 		}
-		log.Tag(tagContacts).Info("Contact request sent: %s -> %s", u.Name, req.Username)
+		log.Tag(tagContacts).Info("Contact request sent: %s -> %s", u.Name, username)
+		return user.ContactStatusPending, nil
 	}
-
-	return s.writeJSON(w, newSuccessResponse())
 }
 
 type apiContactUpdateRequest struct {
@@ -148,6 +176,157 @@ func (s *Server) handleContactUpdate(w http.ResponseWriter, r *http.Request, v *
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// apiContactPatchRequest is the request for PATCH /v1/coop/contacts/{username}. Fields that are not set are
+// left unchanged; labels replace the existing labels.
+type apiContactPatchRequest struct {
+	Nickname *string   `json:"nickname"`
+	Favorite *bool     `json:"favorite"`
+	Labels   *[]string `json:"labels"`
+}
+
+// handleContactPatch handles PATCH /v1/coop/contacts/{username} - set nickname, favorite flag and labels
+func (s *Server) handleContactPatch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	targetUsername := strings.TrimPrefix(r.URL.Path, "/v1/coop/contacts/")
+	if targetUsername == "" || strings.Contains(targetUsername, "/") {
+		return errHTTPBadRequest.Wrap("missing username")
+	}
+	req, err := readJSONWithLimit[apiContactPatchRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	contact, err := s.userManager.Contact(u.Name, targetUsername)
+	if errors.Is(err, user.ErrContactNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return err
+	} else if contact.Status == user.ContactStatusBlocked {
+		return errHTTPBadRequest.Wrap("contact is blocked")
+	}
+	if req.Nickname != nil {
+		contact.Nickname = strings.TrimSpace(*req.Nickname)
+		if len(contact.Nickname) > contactNicknameLengthMax {
+			return errHTTPBadRequest.Wrap("nickname too long (max %d)", contactNicknameLengthMax)
+		}
+	}
+	if req.Favorite != nil {
+		contact.Favorite = *req.Favorite
+	}
+	if req.Labels != nil {
+		if contact.Labels, err = normalizeContactLabels(*req.Labels); err != nil {
+			return err
+		}
+	}
+	if err := s.userManager.UpdateContact(u.Name, targetUsername, contact.Nickname, contact.Favorite, contact.Labels); err != nil {
+		return err
+	}
+	log.Tag(tagContacts).Debug("Contact updated: %s updated %s", u.Name, targetUsername)
+	updated, err := s.userManager.Contact(u.Name, targetUsername)
+	if err != nil {
+		return err
+	}
+	return s.writeJSON(w, updated)
+}
+
+// normalizeContactLabels trims and deduplicates contact labels, and checks their number and length
+func normalizeContactLabels(labels []string) ([]string, error) {
+	normalized := make([]string, 0, len(labels))
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || slices.Contains(normalized, label) {
+			continue
+		} else if len(label) > contactLabelLengthMax {
+			return nil, errHTTPBadRequest.Wrap("label too long (max %d)", contactLabelLengthMax)
+		}
+		normalized = append(normalized, label)
+	}
+	if len(normalized) > contactLabelsMax {
+		return nil, errHTTPBadRequest.Wrap("too many labels (max %d)", contactLabelsMax)
+	}
+	return normalized, nil
+}
+
+// apiContactCardRequest is the request for POST /v1/coop/contacts/card
+type apiContactCardRequest struct {
+	Topic    string `json:"topic"`
+	Username string `json:"username"`
+}
+
+// apiContactCard is the body of a coop_contact_card message. Clients render it as a profile card, whose
+// "add contact" button sends a regular contact request (POST /v1/coop/contacts) for the username.
+type apiContactCard struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// handleContactCardShare handles POST /v1/coop/contacts/card - shares a user's profile card in a chat.
+// The card is stored, streamed and counted like a regular message, see limitMessages.
+func (s *Server) handleContactCardShare(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiContactCardRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if req.Topic == "" {
+		return errHTTPBadRequest.Wrap("topic required")
+	}
+	if err := s.userManager.Authorize(u, req.Topic, user.PermissionWrite); err != nil {
+		return errHTTPForbidden
+	}
+	if blocked, err := s.dmBlocked(u, req.Topic); err != nil {
+		return err
+	} else if blocked {
+		return errHTTPForbiddenDMBlocked
+	}
+	if meta, err := s.dmRequest(req.Topic); err != nil {
+		return err
+	} else if meta != nil && meta.DMRequestTo != u.Name {
+		return errHTTPForbiddenDMRequestLimit
+	}
+	if _, err := s.userManager.User(req.Username); err != nil {
+		return errHTTPBadRequest.Wrap("user not found")
+	}
+	if blocked, err := s.userManager.IsBlocked(u.Name, req.Username); err != nil {
+		return err
+	} else if blocked {
+		return errHTTPForbidden.Wrap("blocked")
+	}
+	card := &apiContactCard{Username: req.Username}
+	if profile, err := s.userManager.Profile(req.Username); err == nil && profile != nil {
+		card.DisplayName = profile.DisplayName
+		card.AvatarURL = profile.AvatarURL
+	}
+	body, err := json.Marshal(card)
+	if err != nil {
+		return err
+	}
+	t, err := s.topicFromID(req.Topic)
+	if err != nil {
+		return err
+	}
+	m := newMessage(coopContactCardEvent, req.Topic, string(body))
+	m.SenderName = u.Name
+	m.Sender = v.IP()
+	m.User = v.MaybeUserID()
+	m.Expires = time.Unix(m.Time, 0).Add(v.Limits().MessageExpiryDuration).Unix()
+	if err := t.Publish(v, m); err != nil {
+		return err
+	}
+	if err := s.messageCache.AddMessage(m); err != nil {
+		return err
+	}
+	if u.Tier != nil {
+		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
+	}
+	s.mu.Lock()
+	s.messages++
+	s.mu.Unlock()
+	minc(metricMessagesPublishedSuccess)
+	log.Tag(tagContacts).Info("Contact card of %s shared by %s in topic %s", req.Username, u.Name, req.Topic)
+	return s.writeJSON(w, m.forJSON())
+}
+
 // handleContactDelete handles DELETE /v1/coop/contacts/{username} - remove a contact
 func (s *Server) handleContactDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	u := v.User()
@@ -180,6 +359,146 @@ func (s *Server) handleContactBlock(w http.ResponseWriter, r *http.Request, v *v
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// blockerIDs returns the IDs of the users that have blocked the given user. It is used by the topic
+// fan-out and by web push to skip subscribers that blocked the publisher of a message.
+func (s *Server) blockerIDs(userID string) (map[string]bool, error) {
+	if s.userManager == nil {
+		return nil, nil
+	}
+	return s.userManager.BlockerIDs(userID)
+}
+
+// dmBlocked returns true if the topic is a DM and the other participant has blocked the given user.
+// Blocking does not delete the DM, it only makes it read-only for the blocked party.
+func (s *Server) dmBlocked(u *user.User, topic string) (bool, error) {
+	if s.userManager == nil || u == nil || !isDMTopic(topic) {
+		return false, nil
+	}
+	meta, err := s.userManager.TopicMeta(topic)
+	if err != nil {
+		return false, err
+	} else if meta == nil {
+		return false, nil
+	}
+	var partner string
+	switch u.Name {
+	case meta.DMUserA:
+		partner = meta.DMUserB
+	case meta.DMUserB:
+		partner = meta.DMUserA
+	default:
+		return false, nil
+	}
+	status, err := s.userManager.ContactStatus(partner, u.Name)
+	if err != nil {
+		return false, err
+	}
+	return status == user.ContactStatusBlocked, nil
+}
+
+// apiContactVerificationResponse is the response for GET/PUT /v1/coop/contacts/{username}/verification
+type apiContactVerificationResponse struct {
+	Username string                `json:"username"`
+	Verified bool                  `json:"verified"` // True if all of the contact's devices are verified
+	Devices  []*user.ContactDevice `json:"devices"`
+}
+
+// apiContactVerifyRequest is the request for PUT /v1/coop/contacts/{username}/verification. It lists the devices
+// (and fingerprints) the user compared the safety number for. If empty, all of the contact's current devices are verified.
+type apiContactVerifyRequest struct {
+	Devices []*user.DeviceFingerprint `json:"devices"`
+}
+
+// handleContactVerificationGet handles GET /v1/coop/contacts/{username}/verification - returns the
+// verification status of each of a contact's devices
+func (s *Server) handleContactVerificationGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	targetUsername, err := s.contactVerificationUsername(r, u)
+	if err != nil {
+		return err
+	}
+	return s.writeContactVerification(w, u, targetUsername)
+}
+
+// handleContactVerify handles PUT /v1/coop/contacts/{username}/verification - mark a contact's devices
+// as verified after comparing safety numbers
+func (s *Server) handleContactVerify(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	targetUsername, err := s.contactVerificationUsername(r, u)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiContactVerifyRequest](r.Body, jsonBodyBytesLimit, true)
+	if err != nil {
+		return err
+	}
+	devices := req.Devices
+	if len(devices) == 0 {
+		current, err := s.userManager.ContactDevices(u.Name, targetUsername)
+		if err != nil {
+			return err
+		}
+		for _, d := range current {
+			devices = append(devices, &user.DeviceFingerprint{DeviceID: d.DeviceID, Fingerprint: d.Fingerprint})
+		}
+	}
+	if len(devices) == 0 {
+		return errHTTPBadRequest.Wrap("contact has no devices")
+	}
+	if err := s.userManager.VerifyContactDevices(u.Name, targetUsername, devices); errors.Is(err, user.ErrDeviceNotFound) {
+		return errHTTPNotFound
+	} else if errors.Is(err, user.ErrFingerprintMismatch) {
+		return errHTTPConflictFingerprintMismatch
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionContactVerify, targetUsername, map[string]any{"devices": len(devices)})
+	return s.writeContactVerification(w, u, targetUsername)
+}
+
+// handleContactUnverify handles DELETE /v1/coop/contacts/{username}/verification - reset a contact to unverified
+func (s *Server) handleContactUnverify(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	targetUsername, err := s.contactVerificationUsername(r, u)
+	if err != nil {
+		return err
+	}
+	if err := s.userManager.UnverifyContact(u.Name, targetUsername); err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionContactUnverify, targetUsername, nil)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// contactVerificationUsername extracts the contact from the verification path, and ensures it is an accepted contact
+func (s *Server) contactVerificationUsername(r *http.Request, u *user.User) (string, error) {
+	targetUsername := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/coop/contacts/"), apiContactVerificationSuffix)
+	if !user.AllowedUsername(targetUsername) || targetUsername == u.Name {
+		return "", errHTTPBadRequestInvalidUsername
+	}
+	status, err := s.userManager.ContactStatus(u.Name, targetUsername)
+	if err != nil {
+		return "", err
+	} else if status != user.ContactStatusAccepted {
+		return "", errHTTPNotFound
+	}
+	return targetUsername, nil
+}
+
+func (s *Server) writeContactVerification(w http.ResponseWriter, u *user.User, targetUsername string) error {
+	devices, err := s.userManager.ContactDevices(u.Name, targetUsername)
+	if err != nil {
+		return err
+	}
+	verified := len(devices) > 0
+	for _, d := range devices {
+		if d.Status != user.VerificationStatusVerified {
+			verified = false
+		}
+	}
+	return s.writeJSON(w, &apiContactVerificationResponse{Username: targetUsername, Verified: verified, Devices: devices})
+}
+
 // handleUserSearch handles GET /v1/coop/users/search?q=... - search users
 func (s *Server) handleUserSearch(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	u := v.User()
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	apiContactsExportPath  = "/v1/coop/contacts/export.vcf"
+	apiContactsImportPath  = "/v1/coop/contacts/import"
+	contactImportSizeLimit = 1024 * 1024
+	contactImportCardsMax  = 1000
+	vCardUsernameProperty  = "X-COOP-USERNAME"
+	vCardLineLengthMax     = 75
+	vCardContentType       = "text/vcard; charset=utf-8"
+	vCardExportFilename    = "contacts.vcf"
+)
+
+// vCard is the part of a parsed vCard that is used to match it to a local user
+type vCard struct {
+	Usernames    []string
+	PhoneNumbers []string
+	Emails       []string
+}
+
+// apiContactImportEntry is the result of importing a single vCard that matched a local user.
+// Status is the resulting contact status ("accepted" or "pending"), or empty if Error is set.
+type apiContactImportEntry struct {
+	Username string `json:"username"`
+	Status   string `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// apiContactImportResponse is the response for POST /v1/coop/contacts/import. Skipped counts the
+// cards that were not processed, because the daily contact limit was reached.
+type apiContactImportResponse struct {
+	Matched   []*apiContactImportEntry `json:"matched"`
+	Unmatched int                      `json:"unmatched"`
+	Skipped   int                      `json:"skipped,omitempty"`
+}
+
+// handleContactsExport handles GET /v1/coop/contacts/export.vcf - exports the accepted contacts as vCard 4.0,
+// including nicknames and labels (as CATEGORIES). Phone numbers of contacts are never exported.
+func (s *Server) handleContactsExport(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	contacts, err := s.userManager.Contacts(v.User().Name, user.ContactStatusAccepted)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, c := range contacts {
+		writeVCard(&b, c)
+	}
+	w.Header().Set("Content-Type", vCardContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, vCardExportFilename))
+	w.Header().Set("Cache-Control", "no-store")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// handleContactsImport handles POST /v1/coop/contacts/import - imports a vCard 3.0/4.0 file. Each card is
+// matched to a local user by username (X-COOP-USERNAME, as written by the export) or by a verified phone
+// number (unless several users verified it), and a contact request is sent to every match, following the
+// same privacy rules as POST /v1/coop/contacts. Email addresses are parsed, but there are no verified
+// emails to match them against. Every lookup and contact request counts against the daily contact limit,
+// which is shared with POST /v1/coop/contacts; once it is reached, the remaining cards are skipped.
+func (s *Server) handleContactsImport(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	body, err := io.ReadAll(io.LimitReader(r.Body, contactImportSizeLimit+1))
+	if err != nil {
+		return err
+	} else if len(body) > contactImportSizeLimit {
+		return errHTTPEntityTooLargeContactImport
+	}
+	cards, err := parseVCards(string(body))
+	if err != nil {
+		return errHTTPBadRequest.Wrap("invalid vCard: %s", err.Error())
+	} else if len(cards) > contactImportCardsMax {
+		return errHTTPBadRequest.Wrap("too many vCards (max %d)", contactImportCardsMax)
+	}
+	response := &apiContactImportResponse{Matched: make([]*apiContactImportEntry, 0)}
+	seen := make(map[string]bool)
+	for i, card := range cards {
+		username, byPhone, err := s.matchVCard(v, card)
+		if errors.Is(err, errHTTPTooManyRequestsLimitContacts) {
+			response.Skipped = len(cards) - i
+			break
+		} else if err != nil {
+			return err
+		} else if username == "" {
+			response.Unmatched++
+			continue
+		} else if username == u.Name || seen[username] {
+			continue
+		}
+		seen[username] = true
+		if !v.ContactAllowed() {
+			response.Skipped = len(cards) - i
+			break
+		}
+		entry := &apiContactImportEntry{Username: username}
+		entry.Status, err = s.addContact(u, username)
+		if err != nil {
+			var e *errHTTP
+			if !errors.As(err, &e) {
+				return err
+			} else if byPhone && e.HTTPCode == http.StatusForbidden {
+				// Don't reveal who owns a phone number unless they can be added as a contact
+				response.Unmatched++
+				continue
+			}
+			entry.Error = e.Message
+		}
+		response.Matched = append(response.Matched, entry)
+	}
+	if len(cards) > 0 && response.Skipped == len(cards) {
+		return errHTTPTooManyRequestsLimitContacts
+	}
+	s.audit(r, v, auditActionContactImport, u.Name, map[string]any{"cards": len(cards), "matched": len(response.Matched), "unmatched": response.Unmatched, "skipped": response.Skipped})
+	log.Tag(tagContacts).Info("Contacts imported by %s: %d card(s), %d matched", u.Name, len(cards), len(response.Matched))
+	return s.writeJSON(w, response)
+}
+
+// matchVCard returns the local user a vCard belongs to, preferring the username over phone numbers. It
+// returns an empty username if nothing matched, and whether the match was made via a phone number. Each
+// lookup counts against the visitor's daily contact limit, see visitor.ContactAllowed.
+func (s *Server) matchVCard(v *visitor, card *vCard) (username string, byPhone bool, err error) {
+	for _, username := range card.Usernames {
+		if !v.ContactAllowed() {
+			return "", false, errHTTPTooManyRequestsLimitContacts
+		}
+		if _, err := s.userManager.User(username); err == nil {
+			return username, false, nil
+		} else if !errors.Is(err, user.ErrUserNotFound) {
+			return "", false, err
+		}
+	}
+	for _, phoneNumber := range card.PhoneNumbers {
+		if !v.ContactAllowed() {
+			return "", false, errHTTPTooManyRequestsLimitContacts
+		}
+		usernames, err := s.userManager.UsernamesByPhoneNumber(phoneNumber)
+		if err != nil {
+			return "", false, err
+		} else if len(usernames) == 1 {
+			return usernames[0], true, nil // Numbers verified by more than one user are ambiguous
+		}
+	}
+	return "", false, nil
+}
+
+// writeVCard writes a contact as a vCard 4.0
+func writeVCard(b *strings.Builder, c *user.Contact) {
+	name := c.DisplayName
+	if name == "" {
+		name = c.Username
+	}
+	writeVCardLine(b, "BEGIN:VCARD")
+	writeVCardLine(b, "VERSION:4.0")
+	writeVCardLine(b, "FN:"+escapeVCardValue(name))
+	if c.Nickname != "" {
+		writeVCardLine(b, "NICKNAME:"+escapeVCardValue(c.Nickname))
+	}
+	if len(c.Labels) > 0 {
+		categories := make([]string, len(c.Labels))
+		for i, label := range c.Labels {
+			categories[i] = escapeVCardValue(label)
+		}
+		writeVCardLine(b, "CATEGORIES:"+strings.Join(categories, ","))
+	}
+	writeVCardLine(b, vCardUsernameProperty+":"+escapeVCardValue(c.Username))
+	writeVCardLine(b, "END:VCARD")
+}
+
+// writeVCardLine writes a content line, folding it after 75 octets (RFC 6350, section 3.2) without
+// splitting multi-byte characters
+func writeVCardLine(b *strings.Builder, line string) {
+	limit := vCardLineLengthMax
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n ")
+		line = line[i:]
+		limit = vCardLineLengthMax - 1 // Continuation lines start with a space
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func escapeVCardValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+func unescapeVCardValue(value string) string {
+	return strings.NewReplacer(`\\`, `\`, `\,`, ",", `\;`, ";", `\n`, "\n", `\N`, "\n").Replace(value)
+}
+
+// parseVCards parses vCard 3.0 and 4.0 files, and extracts the properties used for matching. Unknown
+// properties are ignored.
+func parseVCards(data string) ([]*vCard, error) {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	lines := make([]string, 0)
+	for _, line := range strings.Split(data, "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:] // Unfold continuation line
+		} else if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	cards := make([]*vCard, 0)
+	var card *vCard
+	for _, line := range lines {
+		name, value, ok := splitVCardLine(line)
+		if !ok {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			if card != nil {
+				return nil, errors.New("nested BEGIN:VCARD")
+			}
+			card = &vCard{}
+		case name == "END" && strings.EqualFold(value, "VCARD"):
+			if card == nil {
+				return nil, errors.New("END:VCARD without BEGIN:VCARD")
+			}
+			cards = append(cards, card)
+			card = nil
+		case card == nil:
+			return nil, fmt.Errorf("property %s outside of vCard", name)
+		case name == vCardUsernameProperty:
+			if username := strings.TrimSpace(unescapeVCardValue(value)); username != "" {
+				card.Usernames = append(card.Usernames, username)
+			}
+		case name == "TEL":
+			if phoneNumber := normalizeVCardPhoneNumber(value); phoneNumber != "" {
+				card.PhoneNumbers = append(card.PhoneNumbers, phoneNumber)
+			}
+		case name == "EMAIL":
+			if email := strings.TrimSpace(unescapeVCardValue(value)); email != "" {
+				card.Emails = append(card.Emails, email)
+			}
+		}
+	}
+	if card != nil {
+		return nil, errors.New("BEGIN:VCARD without END:VCARD")
+	}
+	return cards, nil
+}
+
+// splitVCardLine splits a content line like "item1.TEL;TYPE=cell:+1 555 1234" into the upper-case
+// property name without group and parameters ("TEL"), and the value. Colons in quoted parameter
+// values are not treated as the separator.
+func splitVCardLine(line string) (name, value string, ok bool) {
+	quoted := false
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			name, _, _ = strings.Cut(line[:i], ";")
+			if dot := strings.LastIndex(name, "."); dot >= 0 {
+				name = name[dot+1:]
+			}
+			return strings.ToUpper(strings.TrimSpace(name)), line[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// normalizeVCardPhoneNumber turns a TEL value (text or tel: URI) into the E.164 format that verified
+// phone numbers are stored in, e.g. "tel:+1-555-123-4567" or "0049 30 1234" into "+15551234567" or
+// "+49301234". Numbers without a country code cannot be matched, and are dropped.
+func normalizeVCardPhoneNumber(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) > 4 && strings.EqualFold(value[:4], "tel:") {
+		value = value[4:]
+	}
+	value, _, _ = strings.Cut(value, ";") // Strip URI parameters like ;ext=123
+	var b strings.Builder
+	for i, c := range value {
+		if c == '+' && i == 0 || c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	phoneNumber := b.String()
+	if strings.HasPrefix(phoneNumber, "00") {
+		phoneNumber = "+" + phoneNumber[2:]
+	}
+	if !phoneNumberRegex.MatchString(phoneNumber) {
+		return ""
+	}
+	return phoneNumber
+}
@@ -11,7 +11,13 @@ import (
 	"strings"
 )
 
-const tagDM = "dm"
+const (
+	tagDM                  = "dm"
+	apiDMRequestsPath      = "/v1/coop/dm/requests"
+	apiDMRequestsPrefix    = apiDMRequestsPath + "/"
+	dmRequestAcceptSuffix  = "/accept"
+	dmRequestDeclineSuffix = "/decline"
+)
 
 // generateDMTopicID creates a random DM topic ID like "dm_a3f7b2c4e1d9f6a8"
 func generateDMTopicID() (string, error) {
@@ -37,11 +43,21 @@ type apiDMCreateResponse struct {
 }
 
 type apiDMListEntry struct {
-	Topic       string `json:"topic"`
-	Partner     string `json:"partner"`
-	DisplayName string `json:"display_name,omitempty"`
-	AvatarURL   string `json:"avatar_url,omitempty"`
-	LastSeen    int64  `json:"last_seen,omitempty"`
+	Topic       string                    `json:"topic"`
+	Partner     string                    `json:"partner"`
+	DisplayName string                    `json:"display_name,omitempty"`
+	AvatarURL   string                    `json:"avatar_url,omitempty"`
+	LastSeen    int64                     `json:"last_seen,omitempty"`
+	Devices     []*user.DeviceFingerprint `json:"devices,omitempty"` // E2E devices of the partner
+}
+
+type apiDMRequestEntry struct {
+	Topic        string `json:"topic"`
+	Partner      string `json:"partner"`
+	DisplayName  string `json:"display_name,omitempty"`
+	AvatarURL    string `json:"avatar_url,omitempty"`
+	CreatedAt    int64  `json:"created_at"`
+	MessageCount int    `json:"message_count"`
 }
 
 // handleDMCreate handles POST /v1/coop/dm - start or open a DM
@@ -79,7 +95,8 @@ func (s *Server) handleDMCreate(w http.ResponseWriter, r *http.Request, v *visit
 		return err
 	}
 
-	if contactStatus != user.ContactStatusAccepted {
+	request := contactStatus != user.ContactStatusAccepted
+	if request {
 		// Check if target has open privacy
 		privacy, err := s.userManager.ProfilePrivacy(req.Username)
 		if err != nil {
@@ -90,50 +107,75 @@ func (s *Server) handleDMCreate(w http.ResponseWriter, r *http.Request, v *visit
 		}
 	}
 
-	// Check if DM topic already exists between these users
-	topic, err := s.userManager.FindDMTopic(u.Name, req.Username)
+	topic, err := s.openDM(u.Name, req.Username, request)
 	if err != nil {
 		return err
 	}
 
-	if topic == "" {
+	// Resolve display name for the partner
+	displayName := req.Username
+	if profile, err := s.userManager.Profile(req.Username); err == nil && profile != nil && profile.DisplayName != "" {
+		displayName = profile.DisplayName
+	}
+
+	return s.writeJSON(w, &apiDMCreateResponse{Topic: topic, DisplayName: displayName})
+}
+
+// openDM returns the DM topic between two users, and creates it if it does not exist yet.
+// Permissions (contacts, privacy, blocks) must be checked by the caller. If request is set, a new
+// DM is created as a message request: it is only added to the partner's sidebar once accepted.
+// Opening a DM that the partner requested with the user accepts the request.
+func (s *Server) openDM(username, partner string, request bool) (string, error) {
+	// Check if DM topic already exists between these users
+	topic, err := s.userManager.FindDMTopic(username, partner)
+	if err != nil {
+		return "", err
+	}
+
+	if topic != "" {
+		if meta, err := s.dmRequest(topic); err != nil {
+			return "", err
+		} else if meta != nil && meta.DMRequestTo == username {
+			if err := s.acceptDMRequest(topic, username); err != nil {
+				return "", err
+			}
+		}
+	} else {
 		// Generate new random DM topic ID
 		topic, err = generateDMTopicID()
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		// Store DM user mapping in topic_meta
-		if err := s.userManager.SetDMTopicMeta(topic, u.Name, req.Username); err != nil {
-			return err
+		if err := s.userManager.SetDMTopicMeta(topic, username, partner); err != nil {
+			return "", err
 		}
 
 		// Grant access to both users
-		if err := s.userManager.AllowAccess(u.Name, topic, user.PermissionReadWrite); err != nil {
-			return err
+		if err := s.userManager.AllowAccess(username, topic, user.PermissionReadWrite); err != nil {
+			return "", err
 		}
-		if err := s.userManager.AllowAccess(req.Username, topic, user.PermissionReadWrite); err != nil {
-			return err
+		if err := s.userManager.AllowAccess(partner, topic, user.PermissionReadWrite); err != nil {
+			return "", err
 		}
 
 		// Add subscription for both users so the DM appears in their sidebar
-		if err := s.addSubscriptionsForUser(u.Name, []string{topic}); err != nil {
-			log.Tag(tagDM).Warn("Failed to add subscription for creator %s: %v", u.Name, err)
+		if err := s.addSubscriptionsForUser(username, []string{topic}); err != nil {
+			log.Tag(tagDM).Warn("Failed to add subscription for creator %s: %v", username, err)
 		}
-		if err := s.addSubscriptionsForUser(req.Username, []string{topic}); err != nil {
-			log.Tag(tagDM).Warn("Failed to add subscription for recipient %s: %v", req.Username, err)
+		if request {
+			if err := s.userManager.SetDMRequest(topic, partner); err != nil {
+				return "", err
+			}
+		} else if err := s.addSubscriptionsForUser(partner, []string{topic}); err != nil {
+			log.Tag(tagDM).Warn("Failed to add subscription for recipient %s: %v", partner, err)
 		}
 
-		log.Tag(tagDM).Info("DM created: %s <-> %s (topic=%s)", u.Name, req.Username, topic)
-	}
-
-	// Resolve display name for the partner
-	displayName := req.Username
-	if profile, err := s.userManager.Profile(req.Username); err == nil && profile != nil && profile.DisplayName != "" {
-		displayName = profile.DisplayName
+		log.Tag(tagDM).Info("DM created: %s <-> %s (topic=%s, request=%t)", username, partner, topic, request)
 	}
 
-	return s.writeJSON(w, &apiDMCreateResponse{Topic: topic, DisplayName: displayName})
+	return topic, nil
 }
 
 // handleDMList handles GET /v1/coop/dm - list all DMs for the current user
@@ -146,9 +188,13 @@ func (s *Server) handleDMList(w http.ResponseWriter, r *http.Request, v *visitor
 
 	entries := make([]*apiDMListEntry, 0, len(dmEntries))
 	for _, dm := range dmEntries {
+		if dm.RequestTo == u.Name {
+			continue // Pending message requests are listed in GET /v1/coop/dm/requests
+		}
 		entry := &apiDMListEntry{
 			Topic:   dm.Topic,
 			Partner: dm.Partner,
+			Devices: dm.Devices,
 		}
 		// Load partner profile
 		profile, err := s.userManager.Profile(dm.Partner)
@@ -157,8 +203,174 @@ func (s *Server) handleDMList(w http.ResponseWriter, r *http.Request, v *visitor
 			entry.AvatarURL = profile.AvatarURL
 			entry.LastSeen = profile.LastSeen
 		}
+		if status, err := s.userManager.ContactStatus(dm.Partner, u.Name); err == nil && status == user.ContactStatusBlocked {
+			entry.LastSeen = 0 // Don't leak the presence of a partner that blocked the user
+		}
 		entries = append(entries, entry)
 	}
 
 	return s.writeJSON(w, entries)
 }
+
+// handleDMRequestList handles GET /v1/coop/dm/requests - list pending message requests for the current user
+func (s *Server) handleDMRequestList(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	dmEntries, err := s.userManager.DMTopics(u.Name)
+	if err != nil {
+		return err
+	}
+	blocked, err := s.blockedUsernames(u)
+	if err != nil {
+		return err
+	}
+	entries := make([]*apiDMRequestEntry, 0)
+	for _, dm := range dmEntries {
+		if dm.RequestTo != u.Name || blocked[dm.Partner] {
+			continue
+		}
+		entry := &apiDMRequestEntry{
+			Topic:     dm.Topic,
+			Partner:   dm.Partner,
+			CreatedAt: dm.CreatedAt,
+		}
+		if meta, err := s.userManager.TopicMeta(dm.Topic); err == nil && meta != nil {
+			entry.MessageCount = meta.DMRequestCount
+		}
+		if profile, err := s.userManager.Profile(dm.Partner); err == nil && profile != nil {
+			entry.DisplayName = profile.DisplayName
+			entry.AvatarURL = profile.AvatarURL
+		}
+		entries = append(entries, entry)
+	}
+	return s.writeJSON(w, entries)
+}
+
+// handleDMRequestAccept handles POST /v1/coop/dm/requests/{topic}/accept - accept a message request,
+// which moves the DM into the user's main list and lifts the message limit for the sender
+func (s *Server) handleDMRequestAccept(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	meta, err := s.dmRequestFromPath(u, r.URL.Path, dmRequestAcceptSuffix)
+	if err != nil {
+		return err
+	}
+	if err := s.acceptDMRequest(meta.Topic, u.Name); err != nil {
+		return err
+	}
+	log.Tag(tagDM).Info("DM request accepted: %s <-> %s (topic=%s)", meta.DMUserA, meta.DMUserB, meta.Topic)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleDMRequestDecline handles POST /v1/coop/dm/requests/{topic}/decline - decline a message request,
+// which deletes the DM and its messages for both users. The sender may start a new request afterwards,
+// unless they are blocked.
+func (s *Server) handleDMRequestDecline(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	meta, err := s.dmRequestFromPath(u, r.URL.Path, dmRequestDeclineSuffix)
+	if err != nil {
+		return err
+	}
+	sender := meta.DMUserA
+	if sender == u.Name {
+		sender = meta.DMUserB
+	}
+	for _, username := range []string{u.Name, sender} {
+		if err := s.userManager.ResetAccess(username, meta.Topic); err != nil {
+			return err
+		}
+	}
+	if err := s.userManager.RemoveDMTopicMeta(meta.Topic); err != nil {
+		return err
+	}
+	if err := s.removeSubscriptionsForUser(sender, []string{meta.Topic}); err != nil {
+		log.Tag(tagDM).Warn("Failed to remove subscription for sender %s: %v", sender, err)
+	}
+	ids, err := s.messageCache.DeleteMessagesByTopic(meta.Topic)
+	if err != nil {
+		return err
+	}
+	if s.fileCache != nil && len(ids) > 0 {
+		if err := s.fileCache.Remove(attachmentFileIDs(ids)...); err != nil {
+			log.Tag(tagDM).Err(err).Warn("Failed to remove attachments for declined DM %s", meta.Topic)
+		}
+		s.pruneAttachmentBlobs()
+	}
+	log.Tag(tagDM).Info("DM request declined: %s -> %s (topic=%s, messages=%d)", sender, u.Name, meta.Topic, len(ids))
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// dmRequestFromPath returns the pending message request identified by the topic in the request path,
+// e.g. /v1/coop/dm/requests/{topic}/accept. Only the recipient of the request may act on it.
+func (s *Server) dmRequestFromPath(u *user.User, path, suffix string) (*user.TopicMeta, error) {
+	topic := strings.TrimSuffix(strings.TrimPrefix(path, apiDMRequestsPrefix), suffix)
+	if !isDMTopic(topic) || strings.Contains(topic, "/") {
+		return nil, errHTTPBadRequest.Wrap("invalid topic")
+	}
+	meta, err := s.dmRequest(topic)
+	if err != nil {
+		return nil, err
+	} else if meta == nil || meta.DMRequestTo != u.Name {
+		return nil, errHTTPNotFound
+	}
+	return meta, nil
+}
+
+// dmRequest returns the metadata of a DM topic if it is a pending message request, or nil otherwise
+func (s *Server) dmRequest(topic string) (*user.TopicMeta, error) {
+	if s.userManager == nil || !isDMTopic(topic) {
+		return nil, nil
+	}
+	meta, err := s.userManager.TopicMeta(topic)
+	if err != nil {
+		return nil, err
+	} else if meta == nil || meta.DMRequestTo == "" {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+// acceptDMRequest accepts a message request and adds the DM to the recipient's sidebar
+func (s *Server) acceptDMRequest(topic, recipient string) error {
+	if err := s.userManager.SetDMRequest(topic, ""); err != nil {
+		return err
+	}
+	if err := s.addSubscriptionsForUser(recipient, []string{topic}); err != nil {
+		log.Tag(tagDM).Warn("Failed to add subscription for recipient %s: %v", recipient, err)
+	}
+	return nil
+}
+
+// reserveDMRequestMessage reserves one of the messages the sender of a pending message request may send,
+// and returns errHTTPForbiddenDMRequestLimit if they have used up their messages. The limit is checked and the
+// message counted in one conditional update, so that concurrent messages cannot exceed it. It returns the pending
+// request, in which case no push notifications must be sent, or nil if the DM is not one. If the message is not
+// published, the reservation must be given back with releaseDMRequestMessage. Replies of the recipient are not counted.
+func (s *Server) reserveDMRequestMessage(u *user.User, topic string) (*user.TopicMeta, error) {
+	meta, err := s.dmRequest(topic)
+	if err != nil {
+		return nil, err
+	} else if meta == nil || isDMRequestRecipient(u, meta) {
+		return meta, nil
+	}
+	allowed, err := s.userManager.CountDMRequestMessage(topic, s.config.DMRequestMessageLimit)
+	if err != nil {
+		return nil, err
+	} else if !allowed {
+		return nil, errHTTPForbiddenDMRequestLimit
+	}
+	return meta, nil
+}
+
+// releaseDMRequestMessage gives back a message reserved with reserveDMRequestMessage
+func (s *Server) releaseDMRequestMessage(u *user.User, meta *user.TopicMeta) {
+	if meta == nil || isDMRequestRecipient(u, meta) {
+		return
+	}
+	if err := s.userManager.ReleaseDMRequestMessage(meta.Topic); err != nil {
+		log.Tag(tagDM).Err(err).Warn("Failed to release message request message in %s", meta.Topic)
+	}
+}
+
+// isDMRequestRecipient returns true if u is the recipient of the message request, who may reply without accepting
+func isDMRequestRecipient(u *user.User, meta *user.TopicMeta) bool {
+	return u != nil && u.Name == meta.DMRequestTo
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Encrypted messages are published with the envelope content type. The body is a JSON envelope that
+// carries one ciphertext per recipient device, encrypted by the sender's client. The server never sees
+// the plaintext: it stores the envelope as is, hands each subscriber only the ciphertext for its own
+// device, and uses a placeholder wherever a message body would otherwise be shown (previews, replies).
+
+const (
+	envelopeContentType        = "application/vnd.coop.envelope+json"
+	envelopeVersion            = 1
+	envelopePlaceholderMessage = "Encrypted message"
+	envelopeMaxRecipients      = 1000
+)
+
+// envelope is the body of an end-to-end encrypted message
+type envelope struct {
+	Version      int                  `json:"v"`
+	SenderDevice string               `json:"sender_device"`
+	Recipients   []*envelopeRecipient `json:"recipients"`
+}
+
+// envelopeRecipient is the ciphertext for a single recipient device. Type is opaque to the server,
+// and can be used by clients to distinguish e.g. prekey messages from regular session messages.
+type envelopeRecipient struct {
+	User       string `json:"user"`
+	Device     string `json:"device"`
+	Type       int    `json:"type,omitempty"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// handleBodyAsEnvelope reads the request body as an encrypted message envelope. Envelopes may be larger than
+// regular messages (up to EnvelopeSizeLimit), since they contain a ciphertext for every recipient device.
+func (s *Server) handleBodyAsEnvelope(v *visitor, m *message, body *util.PeekedReadCloser) error {
+	u := v.User()
+	if u == nil {
+		return errHTTPUnauthorized
+	} else if m.Attachment != nil {
+		return errHTTPBadRequestEnvelopeInvalid.Wrap("attachments cannot be combined with encrypted messages")
+	}
+	body, err := util.Peek(body, s.config.EnvelopeSizeLimit)
+	if err != nil {
+		return err
+	} else if body.LimitReached {
+		return errHTTPEntityTooLargeEnvelope
+	}
+	var env envelope
+	if err := json.Unmarshal(body.PeekedBytes, &env); err != nil {
+		return errHTTPBadRequestEnvelopeInvalid.Wrap("invalid JSON")
+	}
+	if err := validateEnvelope(&env); err != nil {
+		return err
+	}
+	devices, err := s.userManager.DeviceKeys(u.Name)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(devices, func(d *user.DeviceKeys) bool { return d.DeviceID == env.SenderDevice }) {
+		return errHTTPBadRequestEnvelopeInvalid.Wrap("sender device %s is not in the key directory", env.SenderDevice)
+	}
+	m.Envelope = &env
+	m.Message = envelopePlaceholderMessage
+	m.Encoding = ""
+	return nil
+}
+
+func validateEnvelope(env *envelope) *errHTTP {
+	if env.Version != envelopeVersion {
+		return errHTTPBadRequestEnvelopeInvalid.Wrap("unsupported version %d", env.Version)
+	} else if !user.AllowedDeviceID(env.SenderDevice) {
+		return errHTTPBadRequestEnvelopeInvalid.Wrap("invalid sender device")
+	} else if len(env.Recipients) == 0 || len(env.Recipients) > envelopeMaxRecipients {
+		return errHTTPBadRequestEnvelopeInvalid.Wrap("number of recipients must be between 1 and %d", envelopeMaxRecipients)
+	}
+	seen := make(map[string]bool)
+	for _, r := range env.Recipients {
+		if !user.AllowedUsername(r.User) || !user.AllowedDeviceID(r.Device) {
+			return errHTTPBadRequestEnvelopeInvalid.Wrap("invalid recipient")
+		} else if _, err := base64.StdEncoding.DecodeString(r.Ciphertext); err != nil || r.Ciphertext == "" {
+			return errHTTPBadRequestEnvelopeInvalid.Wrap("ciphertext for %s/%s must be base64-encoded", r.User, r.Device)
+		}
+		key := r.User + "/" + r.Device
+		if seen[key] {
+			return errHTTPBadRequestEnvelopeInvalid.Wrap("duplicate recipient %s", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// parseEnvelopeContentType returns true if the given Content-Type header denotes an encrypted message envelope
+func parseEnvelopeContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), envelopeContentType)
+}
+
+// readDeviceParam returns the E2E device ID a subscriber or publisher identifies as (if any)
+func readDeviceParam(r *http.Request) string {
+	return readParam(r, "x-device", "device")
+}
+
+// forDevice returns a copy of the message whose envelope only contains the ciphertext for the given user's
+// device. Subscribers that are not recipients (or did not identify their device) get an envelope without ciphertexts.
+func (m *message) forDevice(u *user.User, deviceID string) *message {
+	if m.Envelope == nil {
+		return m
+	}
+	recipients := make([]*envelopeRecipient, 0, 1)
+	if u != nil && deviceID != "" {
+		for _, r := range m.Envelope.Recipients {
+			if r.User == u.Name && r.Device == deviceID {
+				recipients = append(recipients, r)
+			}
+		}
+	}
+	clone, env := *m, *m.Envelope
+	env.Recipients = recipients
+	clone.Envelope = &env
+	return &clone
+}
+
+// withoutEnvelope returns a copy of the message without any envelope, e.g. for push notifications,
+// which should neither carry ciphertexts nor reveal the recipient devices
+func (m *message) withoutEnvelope() *message {
+	if m.Envelope == nil {
+		return m
+	}
+	clone := *m
+	clone.Envelope = nil
+	return &clone
+}
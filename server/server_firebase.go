@@ -247,7 +247,7 @@ func createAPNSAlertConfig(m *message, data map[string]string) *messaging.APNSCo
 				MutableContent: true,
 				Alert: &messaging.ApsAlert{
 					Title: m.Title,
-					Body:  maybeTruncateAPNSBodyMessage(m.Message),
+					Body:  maybeTruncateAPNSBodyMessage(messagePlainText(m)),
 				},
 			},
 		},
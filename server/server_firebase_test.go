@@ -359,3 +359,21 @@ func TestToFirebaseSender_Abuse(t *testing.T) {
 	require.Equal(t, errFirebaseTemporarilyBanned, client.Send(visitor, &message{Topic: "mytopic"}))
 	require.Equal(t, 0, len(sender.Messages()))
 }
+
+func TestToFirebaseMessage_Message_Envelope(t *testing.T) {
+	m := newDefaultMessage("mytopic", envelopePlaceholderMessage)
+	m.ContentType = envelopeContentType
+	m.Envelope = &envelope{
+		Version:      envelopeVersion,
+		SenderDevice: "laptop",
+		Recipients:   []*envelopeRecipient{{User: "ben", Device: "phone", Ciphertext: "c2VjcmV0"}},
+	}
+	fbm, err := toFirebaseMessage(m, &testAuther{Allow: true})
+	require.Nil(t, err)
+	require.Equal(t, envelopePlaceholderMessage, fbm.Data["message"])
+	require.Equal(t, envelopeContentType, fbm.Data["content_type"])
+	b, err := json.Marshal(fbm)
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "c2VjcmV0")
+	require.NotContains(t, string(b), "phone")
+}
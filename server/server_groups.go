@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -94,6 +95,7 @@ func (s *Server) handleTopicMetaUpdate(w http.ResponseWriter, r *http.Request, v
 type apiGroupCreateRequest struct {
 	Name    string   `json:"name"`
 	Members []string `json:"members"`
+	Labels  []string `json:"labels,omitempty"` // Contact labels, resolved to the contacts with that label
 }
 
 type apiGroupCreateResponse struct {
@@ -114,6 +116,17 @@ func (s *Server) handleGroupCreate(w http.ResponseWriter, r *http.Request, v *vi
 	if req.Name == "" {
 		return errHTTPBadRequest.Wrap("group name required")
 	}
+	for _, label := range req.Labels {
+		usernames, err := s.userManager.ContactUsernamesByLabel(u.Name, label)
+		if err != nil {
+			return err
+		}
+		for _, username := range usernames {
+			if !slices.Contains(req.Members, username) {
+				req.Members = append(req.Members, username)
+			}
+		}
+	}
 	if len(req.Members) == 0 {
 		return errHTTPBadRequest.Wrap("at least one member required")
 	}
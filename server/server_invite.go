@@ -107,6 +107,7 @@ func (s *Server) handleInviteCreate(w http.ResponseWriter, r *http.Request, v *v
 	); err != nil {
 		return err
 	}
+	s.audit(r, v, auditActionInviteCreate, auditToken(token), map[string]any{"topics": req.Topics, "max_uses": maxUses, "expires": expiresAt})
 	inviteURL := ""
 	if s.config.BaseURL != "" {
 		inviteURL = s.config.BaseURL + "/v1/invite/" + token
@@ -176,6 +177,7 @@ func (s *Server) handleInviteDelete(w http.ResponseWriter, r *http.Request, v *v
 	if rowsAffected == 0 {
 		return errHTTPBadRequestInviteNotFound
 	}
+	s.audit(r, v, auditActionInviteDelete, auditToken(token), nil)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -215,6 +217,9 @@ func (s *Server) handleInviteRedeem(w http.ResponseWriter, r *http.Request, v *v
 	if !user.AllowedUsername(req.Username) || req.Password == "" {
 		return errHTTPBadRequest.Wrap("username invalid or password missing")
 	}
+	if err := s.validatePassword(req.Username, req.Password); err != nil {
+		return err
+	}
 	// Atomically increment used_count to prevent race condition (TOCTOU)
 	db := s.messageCache.DB()
 	result, err := db.Exec(
@@ -242,6 +247,7 @@ func (s *Server) handleInviteRedeem(w http.ResponseWriter, r *http.Request, v *v
 	if err := s.userManager.AddUser(req.Username, req.Password, user.RoleUser, false); err != nil {
 		return err
 	}
+	s.auditAs(r, req.Username, auditActionInviteRedeem, auditToken(token), map[string]any{"topics": inv.Topics})
 	// Grant access to topics and add as account subscriptions
 	var grantedTopics []string
 	if inv.Topics != "" {
@@ -351,6 +357,7 @@ func (s *Server) handleInviteJoin(w http.ResponseWriter, r *http.Request, v *vis
 			return err
 		}
 	}
+	s.audit(r, v, auditActionInviteJoin, auditToken(token), map[string]any{"topics": inv.Topics})
 	return s.writeJSON(w, &apiInviteJoinResponse{
 		Success: true,
 		Topics:  topics,
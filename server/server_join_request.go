@@ -53,6 +53,7 @@ func (s *Server) handleJoinRequestCreate(w http.ResponseWriter, r *http.Request,
 		}
 		return err
 	}
+	s.audit(r, v, auditActionJoinRequestCreate, req.Topic, nil)
 	return s.writeJSON(w, newSuccessResponse())
 }
 
@@ -166,5 +167,6 @@ func (s *Server) handleJoinRequestResolve(w http.ResponseWriter, r *http.Request
 			}
 		}
 	}
+	s.audit(r, v, auditActionJoinRequestResolve, username, map[string]any{"id": id, "topic": topic, "status": req.Status})
 	return s.writeJSON(w, newSuccessResponse())
 }
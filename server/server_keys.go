@@ -0,0 +1,361 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// The key directory holds the public E2E key material of each user's devices: a long-term identity key,
+// a signed prekey, and a pool of one-time prekeys. The server never sees private keys, and treats all
+// keys as opaque base64 blobs. Senders claim a prekey bundle per recipient device to start a session.
+
+const (
+	apiKeysDevicesPrefix = "/v1/coop/keys/devices/"
+	apiKeysUsersPrefix   = "/v1/coop/keys/users/"
+	apiKeysBundlesSuffix = "/bundles"
+	apiKeysBackupPath    = "/v1/coop/keys/backup"
+
+	apiKeyBackupVerifierHeader = "X-Backup-Verifier"
+	coopKeyChangeEvent         = "coop_key_change"
+	tagKeys                    = "keys"
+)
+
+// apiKeysPublishRequest is the request for PUT /v1/coop/keys/devices/{device}
+type apiKeysPublishRequest struct {
+	IdentityKey           string                `json:"identity_key"`
+	SignedPrekeyID        int64                 `json:"signed_prekey_id"`
+	SignedPrekey          string                `json:"signed_prekey"`
+	SignedPrekeySignature string                `json:"signed_prekey_signature"`
+	OneTimePrekeys        []*user.OneTimePrekey `json:"one_time_prekeys,omitempty"`
+}
+
+// apiKeysPublishResponse is the response for PUT /v1/coop/keys/devices/{device}
+type apiKeysPublishResponse struct {
+	DeviceID        string `json:"device_id"`
+	Fingerprint     string `json:"fingerprint"`
+	OneTimePrekeys  int    `json:"one_time_prekeys"`
+	IdentityChanged bool   `json:"identity_changed,omitempty"` // The device is new, or its identity key was replaced
+}
+
+// apiKeysDevicesResponse is the response for GET /v1/coop/keys/users/{username}
+type apiKeysDevicesResponse struct {
+	Username string             `json:"username"`
+	Devices  []*user.DeviceKeys `json:"devices"`
+}
+
+// apiKeysBundlesResponse is the response for POST /v1/coop/keys/users/{username}/bundles
+type apiKeysBundlesResponse struct {
+	Username string               `json:"username"`
+	Bundles  []*user.PrekeyBundle `json:"bundles"`
+}
+
+// handleKeysPublish handles PUT /v1/coop/keys/devices/{device} - publish or refresh the keys of one of
+// the current user's devices, and top up its one-time prekeys
+func (s *Server) handleKeysPublish(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	deviceID := strings.TrimPrefix(r.URL.Path, apiKeysDevicesPrefix)
+	if !user.AllowedDeviceID(deviceID) {
+		return errHTTPBadRequestDeviceKeysInvalid.Wrap("invalid device ID")
+	}
+	req, err := readJSONWithLimit[apiKeysPublishRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	keys := &user.DeviceKeys{
+		DeviceID:              deviceID,
+		IdentityKey:           req.IdentityKey,
+		SignedPrekeyID:        req.SignedPrekeyID,
+		SignedPrekey:          req.SignedPrekey,
+		SignedPrekeySignature: req.SignedPrekeySignature,
+	}
+	identityChanged, err := s.userManager.PublishDeviceKeys(u.ID, keys, req.OneTimePrekeys)
+	if errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestDeviceKeysInvalid
+	} else if errors.Is(err, user.ErrTooManyDevices) {
+		return errHTTPTooManyRequestsLimitDevices
+	} else if errors.Is(err, user.ErrTooManyPrekeys) {
+		return errHTTPTooManyRequestsLimitPrekeys
+	} else if err != nil {
+		return err
+	}
+	devices, err := s.userManager.DeviceKeys(u.Name)
+	if err != nil {
+		return err
+	}
+	response := &apiKeysPublishResponse{DeviceID: deviceID, IdentityChanged: identityChanged}
+	for _, d := range devices {
+		if d.DeviceID == deviceID {
+			response.Fingerprint = d.Fingerprint
+			response.OneTimePrekeys = d.OneTimePrekeys
+		}
+	}
+	logvr(v, r).
+		Tag(tagKeys).
+		Fields(log.Context{"device_id": deviceID, "one_time_prekeys": len(req.OneTimePrekeys), "identity_changed": identityChanged}).
+		Debug("Published device keys")
+	s.audit(r, v, auditActionKeysPublish, u.Name, map[string]any{"device_id": deviceID, "fingerprint": response.Fingerprint, "identity_changed": identityChanged})
+	if identityChanged {
+		s.publishKeyChange(v, u, &apiKeyChangeEvent{Username: u.Name, DeviceID: deviceID, Fingerprint: response.Fingerprint})
+	}
+	return s.writeJSON(w, response)
+}
+
+// publishKeyChange emits a coop_key_change event into every DM and group the user takes part in, so that
+// other members can warn about the new, replaced or removed identity key (and invalidate a previous safety
+// number verification). Events are stored like nudges. Failures are logged, since the keys themselves have
+// already been changed.
+func (s *Server) publishKeyChange(v *visitor, u *user.User, event *apiKeyChangeEvent) {
+	topics, err := s.userManager.ChatTopics(u.Name)
+	if err != nil {
+		logv(v).Tag(tagKeys).Err(err).Warn("Cannot determine topics for key change event")
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logv(v).Tag(tagKeys).Err(err).Warn("Cannot encode key change event")
+		return
+	}
+	for _, id := range topics {
+		t, err := s.topicFromID(id)
+		if err != nil {
+			logv(v).Tag(tagKeys).Field("topic", id).Err(err).Warn("Cannot publish key change event")
+			continue
+		}
+		m := newMessage(coopKeyChangeEvent, id, string(body))
+		m.SenderName = u.Name
+		m.Sender = v.IP()
+		m.User = v.MaybeUserID()
+		m.Expires = time.Unix(m.Time, 0).Add(v.Limits().MessageExpiryDuration).Unix()
+		if err := t.Publish(v, m); err != nil {
+			logvm(v, m).Tag(tagKeys).Err(err).Warn("Cannot publish key change event")
+			continue
+		}
+		if err := s.messageCache.AddMessage(m); err != nil {
+			logvm(v, m).Tag(tagKeys).Err(err).Warn("Cannot store key change event")
+		}
+	}
+	logv(v).
+		Tag(tagKeys).
+		Fields(log.Context{"device_id": event.DeviceID, "topics": len(topics)}).
+		Debug("Published key change event")
+}
+
+// apiKeyChangeEvent is the body of a coop_key_change event, emitted when a user's set of identity keys changes,
+// i.e. when a device is added or removed, or its identity key is replaced. Removed devices have no fingerprint.
+type apiKeyChangeEvent struct {
+	Username    string `json:"username"`
+	DeviceID    string `json:"device_id"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Removed     bool   `json:"removed,omitempty"`
+}
+
+// handleKeysDelete handles DELETE /v1/coop/keys/devices/{device} - remove one of the current user's devices
+func (s *Server) handleKeysDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	deviceID := strings.TrimPrefix(r.URL.Path, apiKeysDevicesPrefix)
+	if !user.AllowedDeviceID(deviceID) {
+		return errHTTPBadRequestDeviceKeysInvalid.Wrap("invalid device ID")
+	}
+	if err := s.userManager.RemoveDeviceKeys(u.ID, deviceID); errors.Is(err, user.ErrDeviceNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionKeysDelete, u.Name, map[string]any{"device_id": deviceID})
+	s.publishKeyChange(v, u, &apiKeyChangeEvent{Username: u.Name, DeviceID: deviceID, Removed: true})
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleKeysDevices handles GET /v1/coop/keys/users/{username} - list a user's devices and their public keys
+func (s *Server) handleKeysDevices(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	username := strings.TrimPrefix(r.URL.Path, apiKeysUsersPrefix)
+	if err := s.ensureKeysUserExists(username); err != nil {
+		return err
+	}
+	devices, err := s.userManager.DeviceKeys(username)
+	if err != nil {
+		return err
+	}
+	return s.writeJSON(w, &apiKeysDevicesResponse{Username: username, Devices: devices})
+}
+
+// handleKeysBundles handles POST /v1/coop/keys/users/{username}/bundles?device={device} - claim a prekey
+// bundle for each of a user's devices (or only the given device). Every bundle consumes one one-time prekey,
+// so only the user themselves, their contacts, and users they share a DM or group with may claim bundles.
+func (s *Server) handleKeysBundles(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiKeysUsersPrefix), apiKeysBundlesSuffix)
+	if err := s.ensureKeysUserExists(username); err != nil {
+		return err
+	}
+	if allowed, err := s.keysBundlesAllowed(v.User(), username); err != nil {
+		return err
+	} else if !allowed {
+		return errHTTPForbidden.Wrap("not a contact - send a contact request or open a conversation first")
+	}
+	deviceID := r.URL.Query().Get("device")
+	if deviceID != "" && !user.AllowedDeviceID(deviceID) {
+		return errHTTPBadRequestDeviceKeysInvalid.Wrap("invalid device ID")
+	}
+	bundles, err := s.userManager.ClaimPrekeyBundles(username, deviceID)
+	if errors.Is(err, user.ErrDeviceNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagKeys).
+		Fields(log.Context{"keys_username": username, "keys_device_id": deviceID, "bundles": len(bundles)}).
+		Debug("Claimed prekey bundles")
+	return s.writeJSON(w, &apiKeysBundlesResponse{Username: username, Bundles: bundles})
+}
+
+// keysBundlesAllowed returns true if the user may claim prekey bundles of the given user, i.e. if it is the
+// user themselves, an accepted contact, or a member of a DM or group the user also takes part in
+func (s *Server) keysBundlesAllowed(u *user.User, username string) (bool, error) {
+	if u.Name == username {
+		return true, nil
+	}
+	status, err := s.userManager.ContactStatus(u.Name, username)
+	if err != nil {
+		return false, err
+	} else if status == user.ContactStatusAccepted {
+		return true, nil
+	}
+	topics, err := s.userManager.ChatTopics(u.Name)
+	if err != nil || len(topics) == 0 {
+		return false, err
+	}
+	partnerTopics, err := s.userManager.ChatTopics(username)
+	if err != nil {
+		return false, err
+	}
+	for _, topic := range partnerTopics {
+		if slices.Contains(topics, topic) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Server) ensureKeysUserExists(username string) error {
+	if !user.AllowedUsername(username) {
+		return errHTTPBadRequestInvalidUsername
+	}
+	if _, err := s.userManager.User(username); errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// apiKeyBackupRequest is the request for PUT /v1/coop/keys/backup. The verifier is derived from the recovery
+// passphrase on the client (independently of the encryption key), and must be presented to fetch the data.
+type apiKeyBackupRequest struct {
+	Version  int    `json:"version"`
+	KDF      string `json:"kdf"`
+	Verifier string `json:"verifier"`
+	Data     string `json:"data"`
+}
+
+// apiKeyBackupResponse is the response for GET/PUT /v1/coop/keys/backup. Data is only included if
+// the correct verifier was passed in the X-Backup-Verifier header.
+type apiKeyBackupResponse struct {
+	Version      int    `json:"version"`
+	KDF          string `json:"kdf"`
+	Data         string `json:"data,omitempty"`
+	Size         int64  `json:"size"`
+	Revision     int64  `json:"revision"`
+	CreatedAt    int64  `json:"created_at"`
+	UpdatedAt    int64  `json:"updated_at"`
+	AttemptsLeft int    `json:"attempts_left"`
+}
+
+// handleKeyBackupPut handles PUT /v1/coop/keys/backup - store or replace the current user's encrypted key backup
+func (s *Server) handleKeyBackupPut(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiKeyBackupRequest](r.Body, int(s.config.KeyBackupSizeLimit*2)+jsonBodyBytesLimit, false) // Base64 and JSON overhead
+	if err != nil {
+		return err
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(req.Data))) > s.config.KeyBackupSizeLimit {
+		return errHTTPEntityTooLargeKeyBackup
+	}
+	backup, err := s.userManager.SetKeyBackup(u.ID, req.Version, req.KDF, req.Data, req.Verifier)
+	if errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestKeyBackupInvalid
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionKeyBackupUpdate, u.Name, map[string]any{"version": backup.Version, "revision": backup.Revision, "size": backup.Size})
+	return s.writeJSON(w, newKeyBackupResponse(backup))
+}
+
+// handleKeyBackupGet handles GET /v1/coop/keys/backup - returns the backup's metadata (including the key derivation
+// parameters), and if the X-Backup-Verifier header is set and correct, the encrypted data. Failed attempts are counted
+// per user (see user.KeyBackupFailureLimit) and per IP address (like failed logins).
+func (s *Server) handleKeyBackupGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	verifier := r.Header.Get(apiKeyBackupVerifierHeader)
+	if verifier == "" {
+		backup, err := s.userManager.KeyBackup(u.ID)
+		if errors.Is(err, user.ErrKeyBackupNotFound) {
+			return errHTTPNotFound
+		} else if err != nil {
+			return err
+		}
+		return s.writeJSON(w, newKeyBackupResponse(backup))
+	}
+	vip := s.visitor(v.IP(), nil)
+	if !vip.AuthAllowed() {
+		return errHTTPTooManyRequestsLimitAuthFailure
+	}
+	backup, err := s.userManager.VerifyKeyBackup(u.ID, verifier)
+	if errors.Is(err, user.ErrKeyBackupNotFound) {
+		return errHTTPNotFound
+	} else if errors.Is(err, user.ErrKeyBackupLocked) {
+		s.audit(r, v, auditActionKeyBackupLocked, u.Name, nil)
+		return errHTTPTooManyRequestsLimitKeyBackup
+	} else if errors.Is(err, user.ErrKeyBackupInvalid) {
+		vip.AuthFailed()
+		s.audit(r, v, auditActionKeyBackupFailure, u.Name, map[string]any{"attempts_left": backup.AttemptsLeft()})
+		return errHTTPForbiddenKeyBackupVerifier.Fields(log.Context{"attempts_left": backup.AttemptsLeft()})
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionKeyBackupFetch, u.Name, map[string]any{"revision": backup.Revision})
+	return s.writeJSON(w, newKeyBackupResponse(backup))
+}
+
+// handleKeyBackupDelete handles DELETE /v1/coop/keys/backup - delete the current user's key backup
+func (s *Server) handleKeyBackupDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	if err := s.userManager.RemoveKeyBackup(u.ID); errors.Is(err, user.ErrKeyBackupNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionKeyBackupDelete, u.Name, nil)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func newKeyBackupResponse(backup *user.KeyBackup) *apiKeyBackupResponse {
+	return &apiKeyBackupResponse{
+		Version:      backup.Version,
+		KDF:          backup.KDF,
+		Data:         backup.Data,
+		Size:         backup.Size,
+		Revision:     backup.Revision,
+		CreatedAt:    backup.CreatedAt.Unix(),
+		UpdatedAt:    backup.UpdatedAt.Unix(),
+		AttemptsLeft: backup.AttemptsLeft(),
+	}
+}
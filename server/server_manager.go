@@ -4,6 +4,7 @@ import (
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
 	"strings"
+	"time"
 )
 
 func (s *Server) execManager() {
@@ -15,6 +16,7 @@ func (s *Server) execManager() {
 	s.pruneTokens()
 	s.pruneAttachments()
 	s.pruneMessages()
+	s.pruneReportSnapshots()
 	s.pruneAndNotifyWebPushSubscriptions()
 
 	// Message count per topic
@@ -65,12 +67,16 @@ func (s *Server) execManager() {
 	}
 
 	// Users
-	var usersCount int64
+	var usersCount, usersLockedCount int64
 	if s.userManager != nil {
 		usersCount, err = s.userManager.UsersCount()
 		if err != nil {
 			log.Tag(tagManager).Err(err).Warn("Error counting users")
 		}
+		usersLockedCount, err = s.userManager.LockedUsersCount()
+		if err != nil {
+			log.Tag(tagManager).Err(err).Warn("Error counting locked users")
+		}
 	}
 
 	// Print stats
@@ -91,6 +97,7 @@ func (s *Server) execManager() {
 			"subscribers":             subscribers,
 			"visitors":                visitorsCount,
 			"users":                   usersCount,
+			"users_locked":            usersLockedCount,
 			"emails_received":         receivedMailTotal,
 			"emails_received_success": receivedMailSuccess,
 			"emails_received_failure": receivedMailFailure,
@@ -102,6 +109,7 @@ func (s *Server) execManager() {
 	mset(metricMessagesCached, messagesCached)
 	mset(metricVisitors, visitorsCount)
 	mset(metricUsers, usersCount)
+	mset(metricUsersLocked, usersLockedCount)
 	mset(metricSubscribers, subscribers)
 	mset(metricTopics, topicsCount)
 }
@@ -136,8 +144,17 @@ func (s *Server) pruneTokens() {
 				if err := s.userManager.RemoveDeletedUsers(); err != nil {
 					log.Tag(tagManager).Err(err).Warn("Error deleting soft-deleted users")
 				}
+				if err := s.userManager.RemoveExpiredLoginFailures(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error removing expired login failures")
+				}
+				if err := s.userManager.RemoveExpiredContactInvites(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error removing expired contact invites")
+				}
+				if err := s.userManager.RemoveExpiredSuspensions(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error lifting expired user suspensions")
+				}
 			}).
-			Debug("Removed expired tokens and users")
+			Debug("Removed expired tokens, users, login failures, contact invites and suspensions")
 	}
 }
 
@@ -155,7 +172,7 @@ func (s *Server) pruneAttachments() {
 				if log.Tag(tagManager).IsDebug() {
 					log.Tag(tagManager).Debug("Deleting attachments %s", strings.Join(ids, ", "))
 				}
-				if err := s.fileCache.Remove(ids...); err != nil {
+				if err := s.fileCache.Remove(attachmentFileIDs(ids)...); err != nil {
 					log.Tag(tagManager).Err(err).Warn("Error deleting attachments")
 				}
 				if err := s.messageCache.MarkAttachmentsDeleted(ids...); err != nil {
@@ -164,10 +181,34 @@ func (s *Server) pruneAttachments() {
 			} else {
 				log.Tag(tagManager).Debug("No expired attachments to delete")
 			}
+			s.pruneAttachmentBlobs()
+			s.pruneUploads()
 		}).
 		Debug("Deleted expired attachments")
 }
 
+// pruneAttachmentBlobs deletes attachment blobs once the last message referencing them has expired (or was
+// deleted), and the blob was not used for AttachmentBlobGracePeriod
+func (s *Server) pruneAttachmentBlobs() {
+	s.attachmentBlobsMu.Lock()
+	defer s.attachmentBlobsMu.Unlock()
+	hashes, err := s.messageCache.AttachmentBlobsUnreferenced(time.Now().Add(-s.config.AttachmentBlobGracePeriod))
+	if err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error retrieving unreferenced attachment blobs")
+		return
+	} else if len(hashes) == 0 {
+		return
+	}
+	log.Tag(tagManager).Debug("Deleting %d unreferenced attachment blob(s)", len(hashes))
+	if err := s.fileCache.Remove(attachmentFileIDs(hashes)...); err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error deleting attachment blobs")
+		return
+	}
+	if err := s.messageCache.DeleteAttachmentBlobs(hashes...); err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error deleting attachment blobs")
+	}
+}
+
 func (s *Server) pruneMessages() {
 	log.
 		Tag(tagManager).
@@ -177,13 +218,16 @@ func (s *Server) pruneMessages() {
 				log.Tag(tagManager).Err(err).Warn("Error retrieving expired messages")
 			} else if len(expiredMessageIDs) > 0 {
 				if s.fileCache != nil {
-					if err := s.fileCache.Remove(expiredMessageIDs...); err != nil {
+					if err := s.fileCache.Remove(attachmentFileIDs(expiredMessageIDs)...); err != nil {
 						log.Tag(tagManager).Err(err).Warn("Error deleting attachments for expired messages")
 					}
 				}
 				if err := s.messageCache.DeleteMessages(expiredMessageIDs...); err != nil {
 					log.Tag(tagManager).Err(err).Warn("Error marking attachments deleted")
 				}
+				if s.fileCache != nil {
+					s.pruneAttachmentBlobs()
+				}
 			} else {
 				log.Tag(tagManager).Debug("No expired messages to delete")
 			}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	markdownContentType = "text/markdown"
+)
+
+var (
+	markdownCodeClassRegex  = regexp.MustCompile(`^language-[a-zA-Z0-9_+-]+$`)
+	markdownBlankLinesRegex = regexp.MustCompile(`\n{3,}`)
+	markdownPolicy          = newMarkdownPolicy()
+	markdownPlainTextPolicy = bluemonday.StrictPolicy()
+)
+
+// apiMessageHTMLResponse is the response for GET /v1/coop/messages/{id}/html
+type apiMessageHTMLResponse struct {
+	ID          string `json:"id"`
+	Topic       string `json:"topic"`
+	ContentType string `json:"content_type,omitempty"`
+	HTML        string `json:"html"`
+}
+
+// newMarkdownPolicy returns the policy used to sanitize rendered messages: user generated content,
+// links only to http(s) and mailto URLs, and nothing that can run scripts or load active content
+func newMarkdownPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.RequireNoFollowOnLinks(true)
+	p.RequireNoReferrerOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	p.AllowAttrs("class").Matching(markdownCodeClassRegex).OnElements("code")
+	return p
+}
+
+// renderMessageHTML renders the message body as sanitized HTML. Markdown messages are rendered,
+// plain text messages are escaped. Binary (base64-encoded) and encrypted messages have no HTML representation.
+func renderMessageHTML(m *message) string {
+	if m.Encoding != "" || m.Envelope != nil {
+		return ""
+	} else if m.ContentType == markdownContentType {
+		return renderMarkdown(m.Message)
+	}
+	return "<p>" + strings.ReplaceAll(html.EscapeString(m.Message), "\n", "<br>\n") + "</p>"
+}
+
+// renderMarkdown renders markdown to HTML, and sanitizes the result. Raw HTML in the markdown is
+// passed to the sanitizer, which removes everything but harmless formatting.
+func renderMarkdown(markdown string) string {
+	rendered := blackfriday.Run(
+		[]byte(strings.ReplaceAll(markdown, "\r\n", "\n")),
+		blackfriday.WithExtensions(blackfriday.CommonExtensions|blackfriday.HardLineBreak),
+	)
+	return strings.TrimSpace(string(markdownPolicy.SanitizeBytes(rendered)))
+}
+
+// messagePlainText returns the message body as plain text, for consumers that cannot display HTML, such as
+// emails, web push and Firebase notifications, and phone calls. For markdown messages, the text is derived
+// from the sanitized HTML rendering (see renderMessageHTML), so that neither markup nor raw markdown is passed on.
+func messagePlainText(m *message) string {
+	if m.ContentType != markdownContentType || m.Encoding != "" || m.Envelope != nil {
+		return m.Message
+	}
+	rendered := m.HTML
+	if rendered == "" {
+		rendered = renderMessageHTML(m)
+	}
+	text := html.UnescapeString(markdownPlainTextPolicy.Sanitize(rendered))
+	return strings.TrimSpace(markdownBlankLinesRegex.ReplaceAllString(text, "\n\n"))
+}
+
+// isCoopTopic returns true if the topic is a Coop chat topic (group or direct message), i.e. if
+// it has topic metadata
+func (s *Server) isCoopTopic(topic string) bool {
+	if s.userManager == nil {
+		return false
+	}
+	meta, err := s.userManager.TopicMeta(topic)
+	return err == nil && meta != nil
+}
+
+// handleMessageHTML returns the sanitized HTML rendering of a message. Messages in Coop chat topics
+// are rendered at publish time; all others (e.g. published before the upgrade) are rendered on the fly.
+func (s *Server) handleMessageHTML(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	// Parse path: /v1/coop/messages/{messageId}/html
+	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/coop/messages/"), "/")
+	if len(pathParts) != 2 || pathParts[0] == "" {
+		return errHTTPBadRequest.Wrap("invalid message ID")
+	}
+	m, err := s.messageCache.Message(pathParts[0])
+	if err != nil {
+		return errHTTPNotFound
+	}
+	if err := s.userManager.Authorize(v.User(), m.Topic, user.PermissionRead); err != nil {
+		return errHTTPForbidden
+	}
+	rendered := m.HTML
+	if rendered == "" {
+		rendered = renderMessageHTML(m)
+	}
+	return s.writeJSON(w, &apiMessageHTMLResponse{
+		ID:          m.ID,
+		Topic:       m.Topic,
+		ContentType: m.ContentType,
+		HTML:        rendered,
+	})
+}
@@ -25,6 +25,9 @@ var (
 	metricSubscribers                  prometheus.Gauge
 	metricTopics                       prometheus.Gauge
 	metricUsers                        prometheus.Gauge
+	metricUsersLocked                  prometheus.Gauge
+	metricLoginFailures                prometheus.Counter
+	metricLoginLockouts                prometheus.Counter
 	metricHTTPRequests                 *prometheus.CounterVec
 )
 
@@ -83,6 +86,15 @@ func initMetrics() {
 	metricUsers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ntfy_users_total",
 	})
+	metricUsersLocked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntfy_users_locked_total",
+	})
+	metricLoginFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_login_failures_total",
+	})
+	metricLoginLockouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_login_lockouts_total",
+	})
 	metricSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ntfy_subscribers_total",
 	})
@@ -111,6 +123,9 @@ func initMetrics() {
 		metricAttachmentsTotalSize,
 		metricVisitors,
 		metricUsers,
+		metricUsersLocked,
+		metricLoginFailures,
+		metricLoginLockouts,
 		metricSubscribers,
 		metricTopics,
 		metricHTTPRequests,
@@ -1,7 +1,12 @@
 package server
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"heckel.io/ntfy/v2/util"
 )
@@ -12,8 +17,93 @@ const (
 	contextRateVisitor contextKey = iota + 2586
 	contextTopic
 	contextMatrixPushKey
+	contextCSPNonce
 )
 
+const (
+	cspNoncePlaceholder = "{nonce}"
+	cspNonceBytes       = 16
+)
+
+// withSecurityHeaders sets the security and CORS response headers for all requests, including
+// error responses. If the Content-Security-Policy contains a nonce placeholder, a fresh nonce is
+// generated and stored in the request context, so that the web app index can add it to its script tags.
+// The docs are generated by MkDocs and rely on inline scripts, so they are served without a policy.
+func (s *Server) withSecurityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.ContentSecurityPolicy != "" && !docsRegex.MatchString(r.URL.Path) {
+			policy := s.config.ContentSecurityPolicy
+			if strings.Contains(policy, cspNoncePlaceholder) {
+				nonce, err := newCSPNonce()
+				if err != nil {
+					logr(r).Err(err).Warn("Cannot generate Content-Security-Policy nonce")
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				policy = strings.ReplaceAll(policy, cspNoncePlaceholder, nonce)
+				r = withContext(r, map[contextKey]any{contextCSPNonce: nonce})
+			}
+			w.Header().Set("Content-Security-Policy", policy)
+		}
+		if s.config.StrictTransportSecurityMaxAge > 0 && (r.TLS != nil || strings.HasPrefix(s.config.BaseURL, "https://")) {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int64(s.config.StrictTransportSecurityMaxAge.Seconds())))
+		}
+		if s.config.XFrameOptions != "" {
+			w.Header().Set("X-Frame-Options", s.config.XFrameOptions)
+		}
+		if s.config.ReferrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", s.config.ReferrerPolicy)
+		}
+		if s.config.PermissionsPolicy != "" {
+			w.Header().Set("Permissions-Policy", s.config.PermissionsPolicy)
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		s.setCORSHeaders(w, r)
+		next(w, r)
+	}
+}
+
+// setCORSHeaders allows cross-origin requests from the configured origins. With the wildcard origin,
+// all origins are allowed, but credentials are never included. Otherwise, the request's Origin is only
+// reflected if it is in the allowlist.
+func (s *Server) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	if util.Contains(s.config.AccessControlAllowOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !s.originAllowed(origin) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if s.config.AccessControlAllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (s *Server) originAllowed(origin string) bool {
+	for _, allowed := range s.config.AccessControlAllowOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// addCSPNonce adds the nonce attribute to all script tags of the given HTML page
+func addCSPNonce(html []byte, nonce string) []byte {
+	return bytes.ReplaceAll(html, []byte("<script"), []byte(fmt.Sprintf(`<script nonce="%s"`, nonce)))
+}
+
+func newCSPNonce() (string, error) {
+	b := make([]byte, cspNonceBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
 func (s *Server) limitRequests(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		if util.ContainsIP(s.config.VisitorRequestExemptPrefixes, v.ip) {
@@ -25,6 +115,19 @@ func (s *Server) limitRequests(next handleFunc) handleFunc {
 	}
 }
 
+// limitMessages applies the visitor's message limiter to requests that publish a message, but have no topic
+// in the path, e.g. sharing a contact card. Publishing to a topic is limited in handlePublishInternal.
+func (s *Server) limitMessages(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if util.ContainsIP(s.config.VisitorRequestExemptPrefixes, v.ip) {
+			return next(w, r, v)
+		} else if !v.MessageAllowed() {
+			return errHTTPTooManyRequestsLimitMessages
+		}
+		return next(w, r, v)
+	}
+}
+
 // limitRequestsWithTopic limits requests with a topic and stores the rate-limiting-subscriber and topic into request.Context
 func (s *Server) limitRequestsWithTopic(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -67,6 +170,15 @@ func (s *Server) ensureWebPushEnabled(next handleFunc) handleFunc {
 	}
 }
 
+func (s *Server) ensureOIDCEnabled(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.userManager == nil || s.oidcProvider == nil {
+			return errHTTPNotFound
+		}
+		return next(w, r, v)
+	}
+}
+
 func (s *Server) ensureUserManager(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		if s.userManager == nil {
@@ -0,0 +1,492 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	tagOIDC                    = "oidc"
+	apiAuthOIDCLoginPath       = "/v1/auth/oidc/login"
+	apiAuthOIDCCallbackPath    = "/v1/auth/oidc/callback"
+	oidcStateCookie            = "coop-oidc-state"
+	oidcStateExpiry            = 10 * time.Minute
+	oidcStatesMax              = 10000 // Pending logins kept in memory; more are rejected until states expire
+	oidcDiscoveryCacheDuration = 24 * time.Hour
+	oidcJWKSCacheDuration      = time.Hour
+	oidcHTTPTimeout            = 10 * time.Second
+	oidcTokenLabel             = "Single sign-on"
+)
+
+var (
+	errOIDCInvalidIDToken = errors.New("invalid ID token")
+	errOIDCUnknownKey     = errors.New("unknown signing key")
+)
+
+// oidcDiscovery is the subset of the OpenID provider metadata (/.well-known/openid-configuration) we need
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcJWK is a single JSON Web Key, as published by the provider's JWKS endpoint (RSA and EC keys only)
+type oidcJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcState is the server-side state of a pending login, keyed by the "state" parameter
+type oidcState struct {
+	verifier string // PKCE code verifier
+	nonce    string
+	expires  time.Time
+}
+
+// oidcProvider implements the OpenID Connect authorization code flow (with PKCE) against a single
+// identity provider. Provider metadata and signing keys are fetched lazily and cached.
+type oidcProvider struct {
+	config *Config
+	client *http.Client
+	states map[string]*oidcState
+	keys   map[string]any // Key ID -> *rsa.PublicKey or *ecdsa.PublicKey
+	mu     sync.Mutex
+
+	discoveryUpdated time.Time
+	discovery        *oidcDiscovery
+	keysUpdated      time.Time
+}
+
+func newOIDCProvider(conf *Config) *oidcProvider {
+	return &oidcProvider{
+		config: conf,
+		client: &http.Client{Timeout: oidcHTTPTimeout},
+		states: make(map[string]*oidcState),
+		keys:   make(map[string]any),
+	}
+}
+
+// Discovery returns the cached provider metadata, or fetches it if it is missing or out of date
+func (p *oidcProvider) Discovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discoveryLocked()
+}
+
+func (p *oidcProvider) discoveryLocked() (*oidcDiscovery, error) {
+	if p.discovery != nil && time.Since(p.discoveryUpdated) < oidcDiscoveryCacheDuration {
+		return p.discovery, nil
+	}
+	discoveryURL := strings.TrimSuffix(p.config.AuthOIDCIssuer, "/") + "/.well-known/openid-configuration"
+	var discovery oidcDiscovery
+	if err := p.fetchJSON(discoveryURL, &discovery); err != nil {
+		return nil, err
+	} else if discovery.Issuer != p.config.AuthOIDCIssuer {
+		return nil, fmt.Errorf("issuer mismatch, expected %s, got %s", p.config.AuthOIDCIssuer, discovery.Issuer)
+	} else if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("incomplete provider metadata")
+	}
+	p.discovery = &discovery
+	p.discoveryUpdated = time.Now()
+	return p.discovery, nil
+}
+
+// Key returns the public key with the given key ID. Keys are cached, and only re-fetched if they are
+// out of date, or if the key ID is unknown (the provider may have rotated its keys).
+func (p *oidcProvider) Key(kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok && time.Since(p.keysUpdated) < oidcJWKSCacheDuration {
+		return key, nil
+	}
+	if err := p.refreshKeysLocked(); err != nil {
+		return nil, err
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errOIDCUnknownKey
+}
+
+func (p *oidcProvider) refreshKeysLocked() error {
+	discovery, err := p.discoveryLocked()
+	if err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []*oidcJWK `json:"keys"`
+	}
+	if err := p.fetchJSON(discovery.JWKSURI, &jwks); err != nil {
+		return err
+	}
+	keys := make(map[string]any)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Tag(tagOIDC).Err(err).Debug("Ignoring invalid key %s", jwk.Kid)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys = keys
+	p.keysUpdated = time.Now()
+	return nil
+}
+
+func (p *oidcProvider) fetchJSON(u string, v any) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// OAuth2Config returns the OAuth 2.0 client configuration for the provider
+func (p *oidcProvider) OAuth2Config() (*oauth2.Config, error) {
+	discovery, err := p.Discovery()
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Config{
+		ClientID:     p.config.AuthOIDCClientID,
+		ClientSecret: p.config.AuthOIDCClientSecret,
+		RedirectURL:  strings.TrimSuffix(p.config.BaseURL, "/") + apiAuthOIDCCallbackPath,
+		Scopes:       p.config.AuthOIDCScopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+	}, nil
+}
+
+// AddState stores the state of a new login, and prunes expired states. It returns false if there
+// are too many pending logins, see oidcStatesMax.
+func (p *oidcProvider) AddState(state string, s *oidcState) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range p.states {
+		if time.Now().After(v.expires) {
+			delete(p.states, k)
+		}
+	}
+	if len(p.states) >= oidcStatesMax {
+		return false
+	}
+	p.states[state] = s
+	return true
+}
+
+// RemoveState removes and returns the state of a pending login. A state can only be used once.
+func (p *oidcProvider) RemoveState(state string) (*oidcState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.states[state]
+	if !ok {
+		return nil, false
+	}
+	delete(p.states, state)
+	if time.Now().After(s.expires) {
+		return nil, false
+	}
+	return s, true
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of the ID token,
+// and returns its claims
+func (p *oidcProvider) VerifyIDToken(rawIDToken, nonce string) (jwt.MapClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.config.AuthOIDCIssuer),
+		jwt.WithAudience(p.config.AuthOIDCClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.Key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce == "" || claimNonce != nonce {
+		return nil, errOIDCInvalidIDToken
+	}
+	return claims, nil
+}
+
+// PublicKey converts the JWK to an *rsa.PublicKey or *ecdsa.PublicKey
+func (k *oidcJWK) PublicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// handleOIDCLogin starts the login with the identity provider: it stores the state, nonce and
+// PKCE verifier, binds the state to the browser via a cookie, and redirects to the provider
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	conf, err := s.oidcProvider.OAuth2Config()
+	if err != nil {
+		logvr(v, r).Tag(tagOIDC).Err(err).Warn("Cannot retrieve OpenID provider metadata")
+		return errHTTPInternalError
+	}
+	state, nonce, verifier := oauth2.GenerateVerifier(), oauth2.GenerateVerifier(), oauth2.GenerateVerifier()
+	if !s.oidcProvider.AddState(state, &oidcState{
+		verifier: verifier,
+		nonce:    nonce,
+		expires:  time.Now().Add(oidcStateExpiry),
+	}) {
+		logvr(v, r).Tag(tagOIDC).Warn("Too many pending single sign-on logins, rejecting login")
+		return errHTTPTooManyRequestsLimitLogins
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     apiAuthOIDCCallbackPath,
+		MaxAge:   int(oidcStateExpiry.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.config.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	authURL := conf.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("nonce", nonce))
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// handleOIDCCallback completes the login: it exchanges the authorization code for an ID token, verifies it,
+// provisions or updates the user, and hands a new access token to the web app via the URL fragment
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		logvr(v, r).Tag(tagOIDC).Field("oidc_error", errParam).Debug("Login rejected by identity provider")
+		return errHTTPUnauthorized
+	}
+	state, code := r.URL.Query().Get("state"), r.URL.Query().Get("code")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || code == "" || cookie.Value != state {
+		return errHTTPBadRequest.Wrap("invalid or missing state")
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: apiAuthOIDCCallbackPath, MaxAge: -1})
+	pending, ok := s.oidcProvider.RemoveState(state)
+	if !ok {
+		return errHTTPBadRequest.Wrap("login expired, please try again")
+	}
+	conf, err := s.oidcProvider.OAuth2Config()
+	if err != nil {
+		logvr(v, r).Tag(tagOIDC).Err(err).Warn("Cannot retrieve OpenID provider metadata")
+		return errHTTPInternalError
+	}
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, s.oidcProvider.client)
+	token, err := conf.Exchange(ctx, code, oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		logvr(v, r).Tag(tagOIDC).Err(err).Debug("Cannot exchange authorization code")
+		return errHTTPUnauthorized
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		logvr(v, r).Tag(tagOIDC).Debug("Token response does not contain an ID token")
+		return errHTTPUnauthorized
+	}
+	claims, err := s.oidcProvider.VerifyIDToken(rawIDToken, pending.nonce)
+	if err != nil {
+		logvr(v, r).Tag(tagOIDC).Err(err).Debug("Invalid ID token")
+		return errHTTPUnauthorized
+	}
+	u, err := s.oidcProvisionUser(v, r, claims)
+	if err != nil {
+		return err
+	}
+	accessToken, err := s.userManager.CreateToken(u.ID, oidcTokenLabel, time.Now().Add(tokenExpiryDuration), v.IP(), false)
+	if err != nil {
+		return err
+	}
+	s.auditAs(r, u.Name, auditActionLogin, auditToken(accessToken.Value), map[string]any{"method": "oidc", "label": accessToken.Label})
+	fragment := url.Values{}
+	fragment.Set("oidc_token", accessToken.Value)
+	fragment.Set("username", u.Name)
+	http.Redirect(w, r, path.Join(s.config.WebRoot, "login")+"#"+fragment.Encode(), http.StatusSeeOther)
+	return nil
+}
+
+// oidcProvisionUser looks up the user that is linked to the identity in the ID token (issuer and subject),
+// creates and links a new user if there is none yet (just-in-time provisioning), and syncs role and tier from
+// the configured group mappings. Existing users that are not linked to the identity are never taken over, even
+// if the username claim matches; an admin has to link them explicitly (see handleAdminUserOIDCLink). Suspended
+// users are rejected before anything is changed.
+func (s *Server) oidcProvisionUser(v *visitor, r *http.Request, claims jwt.MapClaims) (*user.User, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		logvr(v, r).Tag(tagOIDC).Info("Rejecting login, subject claim missing")
+		return nil, errHTTPUnauthorized
+	}
+	groups := oidcGroups(claims, s.config.AuthOIDCGroupsClaim)
+	u, err := s.userManager.UserByOIDCSubject(s.config.AuthOIDCIssuer, subject)
+	if errors.Is(err, user.ErrUserNotFound) {
+		u, err = s.oidcCreateUser(v, r, claims, subject, groups)
+	}
+	if err != nil {
+		return nil, err
+	} else if u.Deleted {
+		return nil, errHTTPForbidden.Wrap("user is deleted")
+	} else if u.Suspended() {
+		logvr(v, r).Tag(tagOIDC).Field("user_name", u.Name).Info("Rejecting login, user %s is suspended", u.Name)
+		return nil, errHTTPForbiddenUserSuspended
+	}
+	username := u.Name
+	if role := s.oidcRole(groups, u.Role); role != u.Role {
+		logvr(v, r).Tag(tagOIDC).Field("user_name", username).Info("Changing role of user %s to %s based on group claim", username, role)
+		if err := s.userManager.ChangeRole(username, role); err != nil {
+			return nil, err
+		}
+	}
+	if tierCode := s.oidcTier(groups); tierCode != "" && (u.Tier == nil || u.Tier.Code != tierCode) {
+		logvr(v, r).Tag(tagOIDC).Field("user_name", username).Info("Changing tier of user %s to %s based on group claim", username, tierCode)
+		if err := s.userManager.ChangeTier(username, tierCode); err != nil {
+			return nil, err
+		}
+	}
+	return s.userManager.User(username)
+}
+
+// oidcCreateUser creates a new user named after the username claim, and links it to the identity provider's
+// subject. If a user with that name already exists, the login is rejected.
+func (s *Server) oidcCreateUser(v *visitor, r *http.Request, claims jwt.MapClaims, subject string, groups []string) (*user.User, error) {
+	username, _ := claims[s.config.AuthOIDCUsernameClaim].(string)
+	if !user.AllowedUsername(username) {
+		logvr(v, r).Tag(tagOIDC).Field("user_name", username).Info("Rejecting login, username claim %s missing or invalid", s.config.AuthOIDCUsernameClaim)
+		return nil, errHTTPForbidden.Wrap("username not allowed")
+	}
+	if _, err := s.userManager.User(username); err == nil {
+		logvr(v, r).Tag(tagOIDC).Field("user_name", username).Info("Rejecting login, user %s exists but is not linked to this single sign-on identity", username)
+		return nil, errHTTPForbidden.Wrap("username is taken by an account that is not linked to single sign-on")
+	} else if !errors.Is(err, user.ErrUserNotFound) {
+		return nil, err
+	}
+	logvr(v, r).Tag(tagOIDC).Field("user_name", username).Info("Creating user %s via single sign-on", username)
+	if err := s.userManager.AddUser(username, oauth2.GenerateVerifier(), s.oidcRole(groups, user.RoleUser), false); err != nil {
+		return nil, err
+	}
+	s.auditAs(r, username, auditActionAccountCreate, username, map[string]any{"method": "oidc"})
+	u, err := s.userManager.User(username)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.userManager.LinkOIDCSubject(u.ID, s.config.AuthOIDCIssuer, subject); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// oidcRole returns RoleAdmin if the user is a member of one of the admin groups, and RoleUser if not.
+// If no admin groups are configured, the role is not managed by the identity provider.
+func (s *Server) oidcRole(groups []string, current user.Role) user.Role {
+	if len(s.config.AuthOIDCAdminGroups) == 0 {
+		return current
+	}
+	for _, group := range groups {
+		for _, adminGroup := range s.config.AuthOIDCAdminGroups {
+			if group == adminGroup {
+				return user.RoleAdmin
+			}
+		}
+	}
+	return user.RoleUser
+}
+
+// oidcTier returns the tier code of the first configured tier group the user is a member of, if any
+func (s *Server) oidcTier(groups []string) string {
+	for _, tierGroup := range s.config.AuthOIDCTierGroups {
+		for _, group := range groups {
+			if group == tierGroup.Group {
+				return tierGroup.Tier
+			}
+		}
+	}
+	return ""
+}
+
+// oidcGroups reads the group claim, which may be a list of strings or a single string
+func oidcGroups(claims jwt.MapClaims, claim string) []string {
+	switch groups := claims[claim].(type) {
+	case string:
+		return []string{groups}
+	case []any:
+		result := make([]string, 0, len(groups))
+		for _, group := range groups {
+			if s, ok := group.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// fakeOIDCProvider is a minimal in-process OpenID provider. Authorization codes are registered
+// directly by the test (skipping the browser interaction), and redeemed via the token endpoint.
+type fakeOIDCProvider struct {
+	server         *httptest.Server
+	key            *rsa.PrivateKey
+	codes          map[string]*fakeOIDCCode
+	discoveryCount atomic.Int32
+	jwksCount      atomic.Int32
+	mu             sync.Mutex
+}
+
+type fakeOIDCCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	p := &fakeOIDCProvider{
+		key:   key,
+		codes: make(map[string]*fakeOIDCCode),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		p.discoveryCount.Add(1)
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.jwksCount.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{
+				{
+					"kid": "key1",
+					"kty": "RSA",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "coop" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p.mu.Lock()
+		code, ok := p.codes[r.Form.Get("code")]
+		delete(p.codes, r.Form.Get("code"))
+		p.mu.Unlock()
+		verifierHash := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != code.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "fake-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.sign(t, code.claims),
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeOIDCProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "key1"
+	signed, err := token.SignedString(p.key)
+	require.Nil(t, err)
+	return signed
+}
+
+// authorize simulates the user logging in at the provider, and returns the authorization code
+func (p *fakeOIDCProvider) authorize(authURL *url.URL, claims jwt.MapClaims) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code := util.RandomString(16)
+	p.codes[code] = &fakeOIDCCode{
+		challenge: authURL.Query().Get("code_challenge"),
+		claims:    claims,
+	}
+	return code
+}
+
+func (p *fakeOIDCProvider) claims(username, nonce string, groups ...string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                p.server.URL,
+		"aud":                "coop",
+		"sub":                "sub-" + username,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              nonce,
+		"preferred_username": username,
+		"groups":             groups,
+	}
+}
+
+func newTestConfigWithOIDC(t *testing.T, p *fakeOIDCProvider) *Config {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthOIDCIssuer = p.server.URL
+	conf.AuthOIDCClientID = "coop"
+	conf.AuthOIDCClientSecret = "secret"
+	conf.AuthOIDCAdminGroups = []string{"coop-admins"}
+	conf.AuthOIDCTierGroups = []user.TierGroup{{Group: "staff", Tier: "pro"}}
+	return conf
+}
+
+// oidcLogin starts the login flow, and returns the provider's authorization URL and the state cookie
+func oidcLogin(t *testing.T, s *Server) (*url.URL, string) {
+	rr := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 302, rr.Code)
+	authURL, err := url.Parse(rr.Header().Get("Location"))
+	require.Nil(t, err)
+	cookie := rr.Result().Cookies()[0]
+	require.Equal(t, oidcStateCookie, cookie.Name)
+	require.True(t, cookie.HttpOnly)
+	return authURL, cookie.Name + "=" + cookie.Value
+}
+
+func TestOIDC_Login_ProvisionUser(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	s := newTestServer(t, newTestConfigWithOIDC(t, p))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", Name: "Pro"}))
+
+	// Start login, check redirect to provider
+	authURL, cookie := oidcLogin(t, s)
+	require.True(t, strings.HasPrefix(authURL.String(), p.server.URL+"/authorize?"))
+	require.Equal(t, "code", authURL.Query().Get("response_type"))
+	require.Equal(t, "coop", authURL.Query().Get("client_id"))
+	require.Equal(t, "S256", authURL.Query().Get("code_challenge_method"))
+	require.Equal(t, "http://127.0.0.1:12345/v1/auth/oidc/callback", authURL.Query().Get("redirect_uri"))
+	require.Equal(t, "openid profile email", authURL.Query().Get("scope"))
+	require.NotEmpty(t, authURL.Query().Get("nonce"))
+
+	// Callback creates the user, maps groups to role and tier, and hands out a token
+	state, nonce := authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	code := p.authorize(authURL, p.claims("alice", nonce, "coop-admins", "staff"))
+	rr := request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 303, rr.Code)
+	redirect, err := url.Parse(rr.Header().Get("Location"))
+	require.Nil(t, err)
+	require.Equal(t, "/login", redirect.Path)
+	fragment, err := url.ParseQuery(redirect.Fragment)
+	require.Nil(t, err)
+	require.Equal(t, "alice", fragment.Get("username"))
+
+	u, err := s.userManager.User("alice")
+	require.Nil(t, err)
+	require.Equal(t, user.RoleAdmin, u.Role)
+	require.Equal(t, "pro", u.Tier.Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(fragment.Get("oidc_token")),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](rr.Result().Body)
+	require.Equal(t, "alice", account.Username)
+
+	// Second login: user is no longer in the admin group, role is synced; discovery and keys are cached
+	authURL, cookie = oidcLogin(t, s)
+	state, nonce = authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	code = p.authorize(authURL, p.claims("alice", nonce, "staff"))
+	rr = request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 303, rr.Code)
+	u, err = s.userManager.User("alice")
+	require.Nil(t, err)
+	require.Equal(t, user.RoleUser, u.Role)
+	require.Equal(t, int32(1), p.discoveryCount.Load())
+	require.Equal(t, int32(1), p.jwksCount.Load())
+}
+
+func TestOIDC_Login_ExistingUserNotLinked(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	conf := newTestConfigWithOIDC(t, p)
+	conf.AuthOIDCAdminGroups = nil // Role is not managed by the identity provider
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+
+	// Identity provider claims to be "phil", but the local admin is not linked to this identity
+	authURL, cookie := oidcLogin(t, s)
+	state, nonce := authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	code := p.authorize(authURL, p.claims("phil", nonce))
+	rr := request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Empty(t, rr.Header().Get("Location"))
+	phil, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, user.RoleAdmin, phil.Role)
+	tokens, err := s.userManager.Tokens(phil.ID)
+	require.Nil(t, err)
+	require.Empty(t, tokens)
+
+	// Admin links the account explicitly, after which the identity can log in as phil
+	rr = request(t, s, "PUT", "/api/admin/users/phil/oidc", `{"subject":"sub-phil"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 204, rr.Code)
+
+	authURL, cookie = oidcLogin(t, s)
+	state, nonce = authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	code = p.authorize(authURL, p.claims("phil", nonce))
+	rr = request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 303, rr.Code)
+
+	// Linked identity keeps logging in as phil, even if the username claim changes
+	authURL, cookie = oidcLogin(t, s)
+	state, nonce = authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	claims := p.claims("phil", nonce)
+	claims["preferred_username"] = "philipp"
+	code = p.authorize(authURL, claims)
+	rr = request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 303, rr.Code)
+	redirect, err := url.Parse(rr.Header().Get("Location"))
+	require.Nil(t, err)
+	fragment, err := url.ParseQuery(redirect.Fragment)
+	require.Nil(t, err)
+	require.Equal(t, "phil", fragment.Get("username"))
+	_, err = s.userManager.User("philipp")
+	require.Equal(t, user.ErrUserNotFound, err)
+
+	// The same identity cannot be linked to a second user
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	rr = request(t, s, "PUT", "/api/admin/users/ben/oidc", `{"subject":"sub-phil"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40911, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestOIDC_Login_SuspendedUser(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	s := newTestServer(t, newTestConfigWithOIDC(t, p))
+	defer s.closeDatabases()
+
+	// First login provisions alice as a regular user
+	authURL, cookie := oidcLogin(t, s)
+	state, nonce := authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	code := p.authorize(authURL, p.claims("alice", nonce))
+	rr := request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 303, rr.Code)
+	alice, err := s.userManager.User("alice")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.SuspendUser(alice.ID, "spam", "phil", time.Time{}))
+	tokens, err := s.userManager.Tokens(alice.ID)
+	require.Nil(t, err)
+	tokenCount := len(tokens)
+
+	// Suspended user gets no token, no audited login, and no role change from the group claim
+	authURL, cookie = oidcLogin(t, s)
+	state, nonce = authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	code = p.authorize(authURL, p.claims("alice", nonce, "coop-admins"))
+	rr = request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40305, toHTTPError(t, rr.Body.String()).Code)
+	require.Empty(t, rr.Header().Get("Location"))
+	alice, err = s.userManager.User("alice")
+	require.Nil(t, err)
+	require.Equal(t, user.RoleUser, alice.Role)
+	tokens, err = s.userManager.Tokens(alice.ID)
+	require.Nil(t, err)
+	require.Len(t, tokens, tokenCount)
+	entries, err := s.userManager.AuditEntries(&user.AuditFilter{Action: auditActionLogin})
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestOIDC_Callback_Invalid(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	s := newTestServer(t, newTestConfigWithOIDC(t, p))
+	defer s.closeDatabases()
+
+	// State cookie does not match
+	authURL, _ := oidcLogin(t, s)
+	state, nonce := authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	code := p.authorize(authURL, p.claims("alice", nonce))
+	rr := request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": oidcStateCookie + "=someotherstate",
+	})
+	require.Equal(t, 400, rr.Code)
+
+	// Wrong nonce in ID token
+	authURL, cookie := oidcLogin(t, s)
+	state = authURL.Query().Get("state")
+	code = p.authorize(authURL, p.claims("alice", "wrong-nonce"))
+	rr = request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// State cannot be used twice
+	rr = request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 400, rr.Code)
+
+	// Wrong audience
+	authURL, cookie = oidcLogin(t, s)
+	state, nonce = authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	claims := p.claims("alice", nonce)
+	claims["aud"] = "someone-else"
+	code = p.authorize(authURL, claims)
+	rr = request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Invalid username
+	authURL, cookie = oidcLogin(t, s)
+	state, nonce = authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	code = p.authorize(authURL, p.claims("not a valid username!", nonce))
+	rr = request(t, s, "GET", "/v1/auth/oidc/callback?state="+state+"&code="+code, "", map[string]string{
+		"Cookie": cookie,
+	})
+	require.Equal(t, 403, rr.Code)
+
+	_, err := s.userManager.User("alice")
+	require.Equal(t, user.ErrUserNotFound, err)
+}
+
+func TestOIDC_Login_Limits(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	conf := newTestConfigWithOIDC(t, p)
+	conf.VisitorRequestLimitBurst = 2
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	// Pending logins are capped
+	s.oidcProvider.mu.Lock()
+	for i := 0; i < oidcStatesMax; i++ {
+		s.oidcProvider.states[util.RandomString(16)] = &oidcState{expires: time.Now().Add(oidcStateExpiry)}
+	}
+	s.oidcProvider.mu.Unlock()
+	rr := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42919, toHTTPError(t, rr.Body.String()).Code)
+
+	// Expired states make room again
+	s.oidcProvider.mu.Lock()
+	for _, state := range s.oidcProvider.states {
+		state.expires = time.Now().Add(-time.Second)
+	}
+	s.oidcProvider.mu.Unlock()
+	oidcLogin(t, s)
+
+	// The login endpoint is behind the visitor request limiter
+	rr = request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42901, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestOIDC_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	rr := request(t, s, "GET", "/v1/auth/oidc/login", "", nil)
+	require.Equal(t, 404, rr.Code)
+}
@@ -1,12 +1,19 @@
 package server
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"heckel.io/ntfy/v2/log"
@@ -21,19 +28,16 @@ const (
 	tagProfile       = "profile"
 )
 
-var avatarAllowedTypes = map[string]string{
-	"image/jpeg": ".jpg",
-	"image/png":  ".png",
-	"image/webp": ".webp",
-	"image/gif":  ".gif",
-}
+// Avatars are not counted towards the attachment total size limit
+const avatarTotalSizeLimit = math.MaxInt64
 
-func (s *Server) avatarDir() string {
-	if s.config.AttachmentCacheDir == "" {
-		return ""
-	}
-	return filepath.Join(s.config.AttachmentCacheDir, avatarDirName)
-}
+// Avatar files are named av_<id>.<ext>, with additional size variants named av_<id>_<size>.<ext>. Avatars
+// uploaded before they were processed have no variants, and may be WebP or GIF images.
+var avatarIDRegex = regexp.MustCompile(fmt.Sprintf(`^%s[0-9a-f]{%d}(_[0-9]+)?\.(jpg|png|webp|gif)$`, avatarIDPrefix, avatarIDRandLen))
+
+// avatarSizes are the sizes (in pixels) of the square avatar variants. The first one is the default, and is
+// stored under the avatar ID itself.
+var avatarSizes = []int{256, 64}
 
 func generateAvatarID() string {
 	b := make([]byte, avatarIDRandLen/2)
@@ -47,13 +51,9 @@ func (s *Server) handleAvatarUpload(w http.ResponseWriter, r *http.Request, v *v
 	if u == nil {
 		return errHTTPForbidden
 	}
-	dir := s.avatarDir()
-	if dir == "" {
+	if s.avatarStore == nil {
 		return errHTTPBadRequest.Wrap("avatar uploads not configured")
 	}
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
-	}
 
 	// Limit body to avatarMaxSize
 	r.Body = http.MaxBytesReader(w, r.Body, avatarMaxSize)
@@ -62,44 +62,37 @@ func (s *Server) handleAvatarUpload(w http.ResponseWriter, r *http.Request, v *v
 	if err := r.ParseMultipartForm(avatarMaxSize); err != nil {
 		return errHTTPBadRequest.Wrap("file too large (max 512 KB)")
 	}
-	file, header, err := r.FormFile("file")
+	file, _, err := r.FormFile("file")
 	if err != nil {
 		return errHTTPBadRequest.Wrap("missing file field")
 	}
 	defer file.Close()
 
-	// Validate content type
-	contentType := header.Header.Get("Content-Type")
-	ext, ok := avatarAllowedTypes[contentType]
-	if !ok {
-		return errHTTPBadRequest.Wrap("invalid file type, allowed: jpeg, png, webp, gif")
-	}
-
-	// Generate avatar ID and save
-	avatarID := generateAvatarID()
-	filename := avatarID + ext
-	destPath := filepath.Join(dir, filename)
-
-	dest, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	// Decode and re-encode the image, the client-provided content type is not trusted
+	data, err := io.ReadAll(file)
 	if err != nil {
 		return err
 	}
-	defer dest.Close()
+	avatar, err := processAvatar(data, avatarSizes)
+	if err != nil {
+		return errHTTPBadRequestAvatarInvalid
+	}
 
-	if _, err := io.Copy(dest, file); err != nil {
-		os.Remove(destPath)
+	// Generate avatar ID and save
+	filename := generateAvatarID() + avatar.ext
+	if err := s.writeAvatarFiles(filename, avatar); err != nil {
 		return err
 	}
 
 	// Delete old avatar if exists
 	oldAvatarID, err := s.userManager.ProfileAvatarID(u.ID)
 	if err == nil && oldAvatarID != "" {
-		s.deleteAvatarFile(dir, oldAvatarID)
+		s.deleteAvatarFile(oldAvatarID)
 	}
 
 	// Update DB
 	if err := s.userManager.UpdateProfileAvatar(u.ID, filename); err != nil {
-		os.Remove(destPath)
+		s.deleteAvatarFile(filename)
 		return err
 	}
 
@@ -111,20 +104,40 @@ func (s *Server) handleAvatarUpload(w http.ResponseWriter, r *http.Request, v *v
 
 // handleAvatarGet handles GET /v1/coop/profile/avatar/{avatarId}
 func (s *Server) handleAvatarGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	dir := s.avatarDir()
-	if dir == "" {
+	if s.avatarStore == nil {
 		return errHTTPNotFound
 	}
 
 	// Parse avatar ID from path
 	avatarID := strings.TrimPrefix(r.URL.Path, "/v1/coop/profile/avatar/")
-	if avatarID == "" || strings.Contains(avatarID, "/") || strings.Contains(avatarID, "..") {
+	if !avatarIDRegex.MatchString(avatarID) {
 		return errHTTPNotFound
 	}
+	variant := avatarSizes[0]
+	if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
+		var err error
+		if variant, err = strconv.Atoi(sizeParam); err != nil || !slices.Contains(avatarSizes, variant) {
+			return errHTTPBadRequestAvatarSizeInvalid
+		}
+	}
+	fileID := avatarVariantID(avatarID, variant)
+	size, err := s.avatarStore.Stat(fileID)
+	if err != nil {
+		// Avatars uploaded before they were processed only have the original
+		fileID = avatarID
+		if size, err = s.avatarStore.Stat(fileID); err != nil {
+			return errHTTPNotFound
+		}
+	}
 
-	filePath := filepath.Join(dir, avatarID)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return errHTTPNotFound
+	// Avatar files never change (a new upload gets a new ID), so the file ID is a strong ETag,
+	// and the file can be cached forever
+	etag := strconv.Quote(fileID)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
 	}
 
 	// Detect content type from extension
@@ -142,9 +155,14 @@ func (s *Server) handleAvatarGet(w http.ResponseWriter, r *http.Request, v *visi
 	}
 
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	http.ServeFile(w, r, filePath)
-	return nil
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	f, err := s.avatarStore.Read(fileID, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
 }
 
 // handleAvatarDelete handles DELETE /v1/coop/profile/avatar
@@ -153,15 +171,14 @@ func (s *Server) handleAvatarDelete(w http.ResponseWriter, r *http.Request, v *v
 	if u == nil {
 		return errHTTPForbidden
 	}
-	dir := s.avatarDir()
-	if dir == "" {
+	if s.avatarStore == nil {
 		return s.writeJSON(w, newSuccessResponse())
 	}
 
 	// Get current avatar
 	oldAvatarID, err := s.userManager.ProfileAvatarID(u.ID)
 	if err == nil && oldAvatarID != "" {
-		s.deleteAvatarFile(dir, oldAvatarID)
+		s.deleteAvatarFile(oldAvatarID)
 	}
 
 	// Clear in DB
@@ -173,15 +190,83 @@ func (s *Server) handleAvatarDelete(w http.ResponseWriter, r *http.Request, v *v
 	return s.writeJSON(w, newSuccessResponse())
 }
 
-// deleteAvatarFile removes an avatar file from disk
-func (s *Server) deleteAvatarFile(dir, avatarID string) {
+// syncAvatar stores an avatar provided by an external directory (e.g. LDAP jpegPhoto). The avatar ID is
+// derived from the user ID and the image contents, so an unchanged image is not written again on every login.
+func (s *Server) syncAvatar(u *user.User, avatar []byte) error {
+	if s.avatarStore == nil || len(avatar) > avatarMaxSize {
+		return nil
+	}
+	hash := sha256.Sum256(append([]byte(u.ID), avatar...))
+	baseID := avatarIDPrefix + hex.EncodeToString(hash[:])[:avatarIDRandLen]
+	oldAvatarID, err := s.userManager.ProfileAvatarID(u.ID)
+	if err != nil {
+		return err
+	} else if strings.TrimSuffix(oldAvatarID, filepath.Ext(oldAvatarID)) == baseID {
+		return nil
+	}
+	processed, err := processAvatar(avatar, avatarSizes)
+	if err != nil {
+		log.Tag(tagProfile).Err(err).Debug("Ignoring invalid avatar for user %s", u.Name)
+		return nil
+	}
+	filename := baseID + processed.ext
+	if err := s.writeAvatarFiles(filename, processed); err != nil {
+		return err
+	}
+	if err := s.userManager.UpdateProfileAvatar(u.ID, filename); err != nil {
+		s.deleteAvatarFile(filename)
+		return err
+	}
+	s.deleteAvatarFile(oldAvatarID)
+	log.Tag(tagProfile).Debug("Avatar synced for user %s", u.Name)
+	return nil
+}
+
+// writeAvatarFiles stores all size variants of a processed avatar. Existing files are kept, since
+// their contents are the same (see syncAvatar).
+func (s *Server) writeAvatarFiles(avatarID string, avatar *processedAvatar) error {
+	for _, size := range avatarSizes {
+		_, err := s.avatarStore.Write(avatarVariantID(avatarID, size), bytes.NewReader(avatar.variants[size]))
+		if err != nil && !errors.Is(err, errFileExists) {
+			s.deleteAvatarFile(avatarID)
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAvatarFile removes an avatar and its size variants from the avatar store
+func (s *Server) deleteAvatarFile(avatarID string) {
 	if avatarID == "" {
 		return
 	}
-	filePath := filepath.Join(dir, avatarID)
-	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-		log.Tag(tagProfile).Err(err).Warn("Failed to delete avatar file %s", filePath)
+	fileIDs := make([]string, 0, len(avatarSizes))
+	for _, size := range avatarSizes {
+		fileIDs = append(fileIDs, avatarVariantID(avatarID, size))
 	}
+	if err := s.avatarStore.Remove(fileIDs...); err != nil {
+		log.Tag(tagProfile).Err(err).Warn("Failed to delete avatar file %s", avatarID)
+	}
+}
+
+// avatarVariantID returns the file ID of the given size variant of an avatar
+func avatarVariantID(avatarID string, size int) string {
+	if size == avatarSizes[0] {
+		return avatarID
+	}
+	ext := filepath.Ext(avatarID)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(avatarID, ext), size, ext)
+}
+
+// etagMatches returns true if the If-None-Match header contains the given ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 // handleProfileGet handles GET /v1/coop/profile (own profile)
@@ -283,6 +368,16 @@ func (s *Server) handleProfilesByTopic(w http.ResponseWriter, r *http.Request, v
 	if err != nil {
 		return err
 	}
+	// Users that blocked the requester remain listed as members, but without presence
+	blockers, err := s.userManager.BlockerNames(u.ID)
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		if blockers[p.Username] {
+			p.LastSeen = 0
+		}
+	}
 	return s.writeJSON(w, profiles)
 }
 
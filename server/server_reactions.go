@@ -50,6 +50,21 @@ func (s *Server) handleReactionAdd(w http.ResponseWriter, r *http.Request, v *vi
 		return errHTTPForbidden
 	}
 
+	// Users cannot react in a DM that was made read-only, or to messages of users that blocked them
+	if blocked, err := s.dmBlocked(u, msg.Topic); err != nil {
+		return err
+	} else if blocked {
+		return errHTTPForbiddenDMBlocked
+	}
+	if msg.User != "" {
+		blockers, err := s.blockerIDs(u.ID)
+		if err != nil {
+			return err
+		} else if blockers[msg.User] {
+			return errHTTPForbidden.Wrap("blocked")
+		}
+	}
+
 	username := u.Name
 	now := time.Now().Unix()
 	db := s.messageCache.DB()
@@ -102,6 +117,10 @@ func (s *Server) handleReactionList(w http.ResponseWriter, r *http.Request, v *v
 	if u != nil {
 		requestingUser = u.Name
 	}
+	blocked, err := s.blockedUsernames(u)
+	if err != nil {
+		return err
+	}
 
 	db := s.messageCache.DB()
 	rows, err := db.Query(
@@ -121,6 +140,9 @@ func (s *Server) handleReactionList(w http.ResponseWriter, r *http.Request, v *v
 		if err := rows.Scan(&emoji, &username); err != nil {
 			return err
 		}
+		if blocked[username] {
+			continue
+		}
 		group, exists := emojiMap[emoji]
 		if !exists {
 			group = &apiReactionGroup{Emoji: emoji, Users: make([]string, 0)}
@@ -203,6 +225,10 @@ func (s *Server) handleReactionsByTopic(w http.ResponseWriter, r *http.Request,
 	if u != nil {
 		requestingUser = u.Name
 	}
+	blocked, err := s.blockedUsernames(u)
+	if err != nil {
+		return err
+	}
 
 	db := s.messageCache.DB()
 	rows, err := db.Query(
@@ -227,6 +253,9 @@ func (s *Server) handleReactionsByTopic(w http.ResponseWriter, r *http.Request,
 		if err := rows.Scan(&msgID, &emoji, &username); err != nil {
 			return err
 		}
+		if blocked[username] {
+			continue
+		}
 		if _, exists := msgMap[msgID]; !exists {
 			msgMap[msgID] = make(map[string]*apiReactionGroup)
 			msgOrder = append(msgOrder, msgID)
@@ -258,3 +287,19 @@ func (s *Server) handleReactionsByTopic(w http.ResponseWriter, r *http.Request,
 	return s.writeJSON(w, result)
 }
 
+// blockedUsernames returns the usernames of the users the given user has blocked, so that
+// their reactions can be hidden from the blocker
+func (s *Server) blockedUsernames(u *user.User) (map[string]bool, error) {
+	blocked := make(map[string]bool)
+	if u == nil {
+		return blocked, nil
+	}
+	contacts, err := s.userManager.Contacts(u.Name, user.ContactStatusBlocked)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range contacts {
+		blocked[c.Username] = true
+	}
+	return blocked, nil
+}
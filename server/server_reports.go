@@ -0,0 +1,542 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	tagReports                = "reports"
+	apiReportsPath            = "/v1/coop/reports"
+	apiAdminReportsPath       = "/v1/admin/reports"
+	apiAdminReportsPrefix     = apiAdminReportsPath + "/"
+	reportCommentLengthMax    = 1000
+	reportNoteLengthMax       = 500
+	reportSnapshotMessagesMax = 20 // Number of recent messages captured for user and group reports
+	reportsDefaultLimit       = 100
+	reportsMaxLimit           = 1000
+)
+
+// Actions an admin can take on a report, see handleAdminReportUpdate
+const (
+	reportActionDeleteMessage = "delete_message"
+	reportActionSuspendUser   = "suspend_user"
+	reportActionWarn          = "warn"
+	reportActionDismiss       = "dismiss"
+)
+
+// reportCategories are the reasons a user can select when filing a report
+var reportCategories = []string{"spam", "harassment", "hate", "violence", "sexual", "illegal", "impersonation", "other"}
+
+// apiReportCreateRequest is the request for POST /v1/coop/reports. Depending on the type, the topic and
+// message ID (message), the username and an optional topic (user), or the topic (group) must be set.
+type apiReportCreateRequest struct {
+	Type      string `json:"type"`
+	Topic     string `json:"topic,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Category  string `json:"category"`
+	Comment   string `json:"comment,omitempty"`
+}
+
+// apiReportResponse is a report as seen by the reporter
+type apiReportResponse struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Topic     string `json:"topic,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Category  string `json:"category"`
+	Comment   string `json:"comment,omitempty"`
+	Status    string `json:"status"`
+	Created   int64  `json:"created"`
+	Updated   int64  `json:"updated"`
+}
+
+// apiAdminReportUpdateRequest is the request for PUT /v1/admin/reports/{id}. Until is only used by
+// the suspend_user action, and is a Unix timestamp, or zero to suspend indefinitely.
+type apiAdminReportUpdateRequest struct {
+	Action string `json:"action"`
+	Note   string `json:"note,omitempty"`
+	Until  int64  `json:"until,omitempty"`
+}
+
+type apiAdminReportAction struct {
+	ID     int64  `json:"id"`
+	Action string `json:"action"`
+	Actor  string `json:"actor"`
+	Note   string `json:"note,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+// apiAdminReport is a report as seen by admins, including the snapshot of the reported messages
+type apiAdminReport struct {
+	ID        string                  `json:"id"`
+	Reporter  string                  `json:"reporter"`
+	Type      string                  `json:"type"`
+	Topic     string                  `json:"topic,omitempty"`
+	MessageID string                  `json:"message_id,omitempty"`
+	Username  string                  `json:"username,omitempty"`
+	Category  string                  `json:"category"`
+	Comment   string                  `json:"comment,omitempty"`
+	Snapshot  json.RawMessage         `json:"snapshot"`
+	Status    string                  `json:"status"`
+	Created   int64                   `json:"created"`
+	Updated   int64                   `json:"updated"`
+	Actions   []*apiAdminReportAction `json:"actions"`
+}
+
+type apiAdminReportsResponse struct {
+	Reports []*apiAdminReport `json:"reports"`
+}
+
+// reportSnapshotMessage is a reported message as stored in a report. It only contains what moderators need to
+// judge the report; envelopes (ciphertexts and recipient devices) and attachment URLs are not copied. Expired
+// messages are removed from the snapshot once the report is resolved or dismissed (see pruneReportSnapshots).
+type reportSnapshotMessage struct {
+	ID          string                    `json:"id"`
+	Time        int64                     `json:"time"`
+	Expires     int64                     `json:"expires,omitempty"`
+	Sender      string                    `json:"sender,omitempty"`
+	Title       string                    `json:"title,omitempty"`
+	Message     string                    `json:"message,omitempty"`
+	ContentType string                    `json:"content_type,omitempty"`
+	Encoding    string                    `json:"encoding,omitempty"`
+	Attachment  *reportSnapshotAttachment `json:"attachment,omitempty"`
+}
+
+type reportSnapshotAttachment struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// handleReportCreate handles POST /v1/coop/reports - reports a message, a user or a group to the admins.
+// The reported messages are copied from the message cache into the report, so that they are still
+// available to the admins if they are deleted or expire. Attachments are only referenced, not copied.
+func (s *Server) handleReportCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiReportCreateRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	req.Comment = strings.TrimSpace(req.Comment)
+	if !slices.Contains(reportCategories, req.Category) {
+		return errHTTPBadRequest.Wrap("invalid category, must be one of: %s", strings.Join(reportCategories, ", "))
+	} else if len(req.Comment) > reportCommentLengthMax {
+		return errHTTPBadRequest.Wrap("comment too long (max %d)", reportCommentLengthMax)
+	}
+	if req.Topic != "" {
+		if err := s.userManager.Authorize(u, req.Topic, user.PermissionRead); err != nil {
+			return errHTTPForbidden
+		}
+	}
+	report := &user.Report{
+		Reporter: u.Name,
+		Type:     user.ReportType(req.Type),
+		Topic:    req.Topic,
+		Category: req.Category,
+		Comment:  req.Comment,
+	}
+	var messages []*message
+	switch report.Type {
+	case user.ReportTypeMessage:
+		if req.Topic == "" || req.MessageID == "" {
+			return errHTTPBadRequest.Wrap("topic and message_id are required")
+		}
+		m, err := s.messageCache.Message(req.MessageID)
+		if errors.Is(err, errMessageNotFound) || (err == nil && m.Topic != req.Topic) {
+			return errHTTPNotFound
+		} else if err != nil {
+			return err
+		}
+		if m.User != "" {
+			sender, err := s.userManager.UserByID(m.User)
+			if err != nil && !errors.Is(err, user.ErrUserNotFound) {
+				return err
+			} else if sender != nil {
+				report.ReportedUser = sender.Name
+			}
+		}
+		report.MessageID = m.ID
+		messages = []*message{m}
+	case user.ReportTypeUser:
+		if req.Username == "" {
+			return errHTTPBadRequest.Wrap("username is required")
+		}
+		reported, err := s.userManager.User(req.Username)
+		if errors.Is(err, user.ErrUserNotFound) || (err == nil && reported.Name == user.Everyone) {
+			return errHTTPBadRequestUserNotFound
+		} else if err != nil {
+			return err
+		}
+		report.ReportedUser = reported.Name
+		if req.Topic != "" {
+			if messages, err = s.reportSnapshotMessages(req.Topic, reported.ID); err != nil {
+				return err
+			}
+		}
+	case user.ReportTypeGroup:
+		if req.Topic == "" {
+			return errHTTPBadRequest.Wrap("topic is required")
+		}
+		if messages, err = s.reportSnapshotMessages(req.Topic, ""); err != nil {
+			return err
+		}
+	default:
+		return errHTTPBadRequest.Wrap("invalid type, must be message, user or group")
+	}
+	if report.ReportedUser == u.Name {
+		return errHTTPBadRequest.Wrap("cannot report yourself")
+	}
+	snapshot := make([]*reportSnapshotMessage, 0, len(messages))
+	for _, m := range messages {
+		snapshot = append(snapshot, newReportSnapshotMessage(m))
+	}
+	if report.Snapshot, report.SnapshotExpires, err = encodeReportSnapshot(snapshot); err != nil {
+		return err
+	}
+	if err := s.userManager.AddReport(report); errors.Is(err, user.ErrTooManyReports) {
+		return errHTTPTooManyRequestsLimitReports
+	} else if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionReportCreate, report.ID, map[string]any{"type": string(report.Type), "category": report.Category, "topic": report.Topic, "user": report.ReportedUser})
+	log.Tag(tagReports).Info("Report %s (%s, %s) filed by %s", report.ID, report.Type, report.Category, u.Name)
+	return s.writeJSON(w, newAPIReportResponse(report))
+}
+
+// handleReportList handles GET /v1/coop/reports - lists the reports filed by the user, and their status
+func (s *Server) handleReportList(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	reports, err := s.userManager.Reports(&user.ReportFilter{Reporter: v.User().Name})
+	if err != nil {
+		return err
+	}
+	response := make([]*apiReportResponse, 0, len(reports))
+	for _, report := range reports {
+		response = append(response, newAPIReportResponse(report))
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAdminReportsGet returns the reports, newest first, optionally filtered by the status and limit
+// query parameters (Admin endpoint)
+func (s *Server) handleAdminReportsGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	query := r.URL.Query()
+	filter := &user.ReportFilter{
+		Status: user.ReportStatus(query.Get("status")),
+		Limit:  reportsDefaultLimit,
+	}
+	switch filter.Status {
+	case "", user.ReportStatusOpen, user.ReportStatusResolved, user.ReportStatusDismissed:
+	default:
+		return errHTTPBadRequest.Wrap("invalid status, must be open, resolved or dismissed")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 || filter.Limit > reportsMaxLimit {
+			return errHTTPBadRequest.Wrap("invalid limit, must be between 1 and %d", reportsMaxLimit)
+		}
+	}
+	reports, err := s.userManager.Reports(filter)
+	if err != nil {
+		return err
+	}
+	response := &apiAdminReportsResponse{
+		Reports: make([]*apiAdminReport, 0, len(reports)),
+	}
+	for _, report := range reports {
+		response.Reports = append(response.Reports, newAPIAdminReport(report))
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAdminReportUpdate handles PUT /v1/admin/reports/{id} - takes an action on a report (Admin endpoint).
+// The action is recorded on the report and in the audit log, and the reporter is notified via their sync
+// topic if the status of the report changed. Actions other than dismiss resolve the report.
+func (s *Server) handleAdminReportUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	id := strings.TrimPrefix(r.URL.Path, apiAdminReportsPrefix)
+	if id == "" || strings.Contains(id, "/") {
+		return errHTTPNotFound
+	}
+	req, err := readJSONWithLimit[apiAdminReportUpdateRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if len(req.Note) > reportNoteLengthMax {
+		return errHTTPBadRequest.Wrap("note too long (max %d)", reportNoteLengthMax)
+	}
+	report, err := s.userManager.Report(id)
+	if errors.Is(err, user.ErrReportNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return err
+	}
+	status := user.ReportStatusResolved
+	switch req.Action {
+	case reportActionDeleteMessage:
+		if report.MessageID == "" {
+			return errHTTPBadRequest.Wrap("report is not about a message")
+		}
+		if err := s.deleteReportedMessage(r, v, report); err != nil {
+			return err
+		}
+	case reportActionSuspendUser:
+		reported, err := s.reportedUser(report)
+		if err != nil {
+			return err
+		} else if reported.ID == v.User().ID {
+			return errHTTPBadRequest.Wrap("cannot suspend yourself")
+		}
+		until, err := parseSuspensionUntil(req.Until)
+		if err != nil {
+			return err
+		}
+		reason := req.Note
+		if reason == "" {
+			reason = "reported for " + report.Category
+		}
+		if err := s.suspendUser(r, v, reported, reason, until, map[string]any{"report": report.ID}); err != nil {
+			return err
+		}
+	case reportActionWarn:
+		reported, err := s.reportedUser(report)
+		if err != nil {
+			return err
+		}
+		reason := req.Note
+		if reason == "" {
+			reason = report.Category
+		}
+		go func() {
+			if err := s.publishAccountWarningEvent(v, reported, reason); err != nil {
+				logv(v).Err(err).Trace("Error publishing to user's sync topic")
+			}
+		}()
+	case reportActionDismiss:
+		status = user.ReportStatusDismissed
+	default:
+		return errHTTPBadRequest.Wrap("invalid action, must be delete_message, suspend_user, warn or dismiss")
+	}
+	updated, err := s.userManager.AddReportAction(report.ID, req.Action, v.User().Name, req.Note, status)
+	if err != nil {
+		return err
+	}
+	s.audit(r, v, auditActionAdminReportAction, report.ID, map[string]any{"action": req.Action, "user": report.ReportedUser})
+	logvr(v, r).Tag(tagReports).Info("admin: %s on report %s", req.Action, report.ID)
+	if updated.Status != report.Status {
+		if reporter, err := s.userManager.User(report.Reporter); err == nil {
+			go func() {
+				if err := s.publishReportStatusEvent(v, reporter, updated); err != nil {
+					logv(v).Err(err).Trace("Error publishing to user's sync topic")
+				}
+			}()
+		}
+	}
+	return s.writeJSON(w, newAPIAdminReport(updated))
+}
+
+// reportSnapshotMessages returns the most recent messages of a topic, optionally only those of the user
+// with the given user ID, to be stored in a report
+func (s *Server) reportSnapshotMessages(topic, userID string) ([]*message, error) {
+	cached, err := s.messageCache.Messages(topic, sinceAllMessages, false)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*message, 0)
+	for _, m := range cached {
+		if m.Event == messageEvent && (userID == "" || m.User == userID) {
+			messages = append(messages, m)
+		}
+	}
+	if len(messages) > reportSnapshotMessagesMax {
+		messages = messages[len(messages)-reportSnapshotMessagesMax:]
+	}
+	return messages, nil
+}
+
+// pruneReportSnapshots removes expired messages from the snapshots of resolved and dismissed reports, so that
+// reporting a message does not keep it beyond the expiry that applies to the message cache. Snapshots of open
+// reports are kept, so that the evidence is still there when a moderator gets to the report. The report itself
+// is kept.
+func (s *Server) pruneReportSnapshots() {
+	if s.userManager == nil {
+		return
+	}
+	reports, err := s.userManager.ReportsWithExpiredSnapshots()
+	if err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error retrieving reports with expired snapshots")
+		return
+	}
+	now := time.Now().Unix()
+	for _, report := range reports {
+		var snapshot []*reportSnapshotMessage
+		if err := json.Unmarshal([]byte(report.Snapshot), &snapshot); err != nil {
+			log.Tag(tagManager).Err(err).Warn("Cannot decode snapshot of report %s", report.ID)
+			continue
+		}
+		snapshot = slices.DeleteFunc(snapshot, func(m *reportSnapshotMessage) bool {
+			return m.Expires > 0 && m.Expires <= now
+		})
+		encoded, expires, err := encodeReportSnapshot(snapshot)
+		if err != nil {
+			log.Tag(tagManager).Err(err).Warn("Cannot encode snapshot of report %s", report.ID)
+			continue
+		}
+		if err := s.userManager.SetReportSnapshot(report.ID, encoded, expires); err != nil {
+			log.Tag(tagManager).Err(err).Warn("Cannot update snapshot of report %s", report.ID)
+		}
+	}
+	if len(reports) > 0 {
+		log.Tag(tagManager).Debug("Pruned snapshots of %d report(s)", len(reports))
+	}
+}
+
+func newReportSnapshotMessage(m *message) *reportSnapshotMessage {
+	snapshot := &reportSnapshotMessage{
+		ID:          m.ID,
+		Time:        m.Time,
+		Expires:     m.Expires,
+		Sender:      m.SenderName,
+		Title:       m.Title,
+		Message:     m.Message,
+		ContentType: m.ContentType,
+		Encoding:    m.Encoding,
+	}
+	if m.Attachment != nil {
+		snapshot.Attachment = &reportSnapshotAttachment{
+			Name: m.Attachment.Name,
+			Type: m.Attachment.Type,
+			Size: m.Attachment.Size,
+		}
+	}
+	return snapshot
+}
+
+// encodeReportSnapshot returns the JSON encoding of the snapshot, and the time at which its first message expires
+func encodeReportSnapshot(snapshot []*reportSnapshotMessage) (string, time.Time, error) {
+	var expires int64
+	for _, m := range snapshot {
+		if m.Expires > 0 && (expires == 0 || m.Expires < expires) {
+			expires = m.Expires
+		}
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if expires == 0 {
+		return string(b), time.Time{}, nil
+	}
+	return string(b), time.Unix(expires, 0), nil
+}
+
+// reportedUser returns the user a report is about, or an error if there is none (anymore)
+func (s *Server) reportedUser(report *user.Report) (*user.User, error) {
+	if report.ReportedUser == "" {
+		return nil, errHTTPBadRequest.Wrap("report is not about a user")
+	}
+	u, err := s.userManager.User(report.ReportedUser)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return nil, errHTTPBadRequestUserNotFound
+	}
+	return u, err
+}
+
+// deleteReportedMessage deletes the reported message from the message cache, and publishes a delete event
+// for its sequence ID, so that clients remove it as well. If the message is already gone, nothing is done.
+func (s *Server) deleteReportedMessage(r *http.Request, v *visitor, report *user.Report) error {
+	m, err := s.messageCache.Message(report.MessageID)
+	if errors.Is(err, errMessageNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	t, err := s.topicFromID(m.Topic)
+	if err != nil {
+		return err
+	}
+	sequenceID := m.SequenceID
+	if sequenceID == "" {
+		sequenceID = m.ID
+	}
+	dm := newActionMessage(messageDeleteEvent, m.Topic, sequenceID)
+	dm.Sender = v.IP()
+	dm.User = v.MaybeUserID()
+	dm.Expires = time.Unix(dm.Time, 0).Add(v.Limits().MessageExpiryDuration).Unix()
+	if err := t.Publish(v, dm); err != nil {
+		return err
+	}
+	if s.firebaseClient != nil {
+		go s.sendToFirebase(v, dm)
+	}
+	if s.config.WebPushPublicKey != "" {
+		go s.publishToWebPushEndpoints(v, dm)
+	}
+	if err := s.messageCache.DeleteMessages(m.ID); err != nil {
+		return err
+	}
+	if err := s.messageCache.AddMessage(dm); err != nil {
+		return err
+	}
+	if s.fileCache != nil && m.Attachment != nil {
+		if err := s.fileCache.Remove(attachmentFileIDs([]string{m.ID})...); err != nil {
+			logvrm(v, r, m).Tag(tagReports).Err(err).Warn("Error removing attachment of reported message")
+		}
+		s.pruneAttachmentBlobs()
+	}
+	return nil
+}
+
+func newAPIReportResponse(report *user.Report) *apiReportResponse {
+	return &apiReportResponse{
+		ID:        report.ID,
+		Type:      string(report.Type),
+		Topic:     report.Topic,
+		MessageID: report.MessageID,
+		Username:  report.ReportedUser,
+		Category:  report.Category,
+		Comment:   report.Comment,
+		Status:    string(report.Status),
+		Created:   report.Created.Unix(),
+		Updated:   report.Updated.Unix(),
+	}
+}
+
+func newAPIAdminReport(report *user.Report) *apiAdminReport {
+	actions := make([]*apiAdminReportAction, 0, len(report.Actions))
+	for _, a := range report.Actions {
+		actions = append(actions, &apiAdminReportAction{
+			ID:     a.ID,
+			Action: a.Action,
+			Actor:  a.Actor,
+			Note:   a.Note,
+			Time:   a.Time.Unix(),
+		})
+	}
+	return &apiAdminReport{
+		ID:        report.ID,
+		Reporter:  report.Reporter,
+		Type:      string(report.Type),
+		Topic:     report.Topic,
+		MessageID: report.MessageID,
+		Username:  report.ReportedUser,
+		Category:  report.Category,
+		Comment:   report.Comment,
+		Snapshot:  json.RawMessage(report.Snapshot),
+		Status:    string(report.Status),
+		Created:   report.Created.Unix(),
+		Updated:   report.Updated.Unix(),
+		Actions:   actions,
+	}
+}
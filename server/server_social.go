@@ -102,6 +102,13 @@ func (s *Server) handleTypingEvent(w http.ResponseWriter, r *http.Request, v *vi
 		return errHTTPForbidden
 	}
 
+	// Typing events from a blocked party are dropped silently
+	if blocked, err := s.dmBlocked(u, req.Topic); err != nil {
+		return err
+	} else if blocked {
+		return s.writeJSON(w, newSuccessResponse())
+	}
+
 	// Rate limit
 	if !s.socialRateLimiter.Allow(coopTypingEvent, u.Name, req.Topic, typingRateLimit) {
 		return s.writeJSON(w, newSuccessResponse())
@@ -115,6 +122,7 @@ func (s *Server) handleTypingEvent(w http.ResponseWriter, r *http.Request, v *vi
 
 	m := newMessage(coopTypingEvent, req.Topic, "")
 	m.SenderName = u.Name
+	m.User = v.MaybeUserID() // Lets the fan-out skip subscribers that blocked the sender
 	if err := t.Publish(v, m); err != nil {
 		return err
 	}
@@ -142,6 +150,16 @@ func (s *Server) handleNudge(w http.ResponseWriter, r *http.Request, v *visitor)
 	if err := s.userManager.Authorize(u, req.Topic, user.PermissionWrite); err != nil {
 		return errHTTPForbidden
 	}
+	if blocked, err := s.dmBlocked(u, req.Topic); err != nil {
+		return err
+	} else if blocked {
+		return errHTTPForbiddenDMBlocked
+	}
+	if meta, err := s.dmRequest(req.Topic); err != nil {
+		return err
+	} else if meta != nil && meta.DMRequestTo != u.Name {
+		return errHTTPForbiddenDMRequestLimit // No nudges until the message request is accepted
+	}
 
 	// Rate limit: 1 nudge per 30s per user per topic
 	if !s.socialRateLimiter.Allow(coopNudgeEvent, u.Name, req.Topic, nudgeRateLimit) {
@@ -205,6 +223,16 @@ func (s *Server) handleSlashCommand(w http.ResponseWriter, r *http.Request, v *v
 		if err := s.userManager.Authorize(u, req.Topic, user.PermissionWrite); err != nil {
 			return errHTTPForbidden
 		}
+		if blocked, err := s.dmBlocked(u, req.Topic); err != nil {
+			return err
+		} else if blocked {
+			return errHTTPForbiddenDMBlocked
+		}
+		if meta, err := s.dmRequest(req.Topic); err != nil {
+			return err
+		} else if meta != nil && meta.DMRequestTo != u.Name {
+			return errHTTPForbiddenDMRequestLimit // No nudges until the message request is accepted
+		}
 		if !s.socialRateLimiter.Allow(coopNudgeEvent, u.Name, req.Topic, nudgeRateLimit) {
 			return errHTTPTooManyRequests.Wrap("nudge rate limit exceeded")
 		}
@@ -256,6 +284,6 @@ func (s *Server) handleSlashCommand(w http.ResponseWriter, r *http.Request, v *v
 		return s.writeJSON(w, map[string]string{"result": "left_topic", "topic": req.Topic})
 
 	default:
-		return errHTTPBadRequest.Wrap("unknown command: " + req.Command)
+		return errHTTPBadRequest.Wrap("unknown command: %s", req.Command)
 	}
 }
@@ -3,6 +3,7 @@ package server
 import (
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
 )
 
 const tagSubscription = "subscription"
@@ -55,3 +56,38 @@ func (s *Server) addSubscriptionsForUser(username string, topics []string) error
 	log.Tag(tagSubscription).Info("Added subscriptions for user %s: %v", username, topics)
 	return nil
 }
+
+// removeSubscriptionsForUser removes topics from a user's Prefs.Subscriptions, e.g. when a DM is deleted.
+// Like addSubscriptionsForUser, other sessions of the user only see the change after a refresh.
+func (s *Server) removeSubscriptionsForUser(username string, topics []string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+
+	u, err := s.userManager.User(username)
+	if err != nil {
+		return err
+	}
+	if u.Prefs == nil || len(u.Prefs.Subscriptions) == 0 {
+		return nil
+	}
+
+	prefs := u.Prefs
+	subscriptions := make([]*user.Subscription, 0, len(prefs.Subscriptions))
+	for _, sub := range prefs.Subscriptions {
+		if sub.BaseURL != s.config.BaseURL || !util.Contains(topics, sub.Topic) {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	if len(subscriptions) == len(prefs.Subscriptions) {
+		return nil
+	}
+	prefs.Subscriptions = subscriptions
+
+	if err := s.userManager.ChangeSettings(u.ID, prefs); err != nil {
+		return err
+	}
+
+	log.Tag(tagSubscription).Info("Removed subscriptions for user %s: %v", username, topics)
+	return nil
+}
@@ -2,20 +2,30 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	_ "embed"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -281,6 +291,111 @@ func TestServer_WebEnabled(t *testing.T) {
 	rr = request(t, s2, "GET", "/app.html", "", nil)
 	require.Equal(t, 200, rr.Code)
 }
+
+func TestServer_SecurityHeaders(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	rr := request(t, s, "GET", "/v1/health", "", nil)
+	require.Equal(t, 200, rr.Code)
+	csp := rr.Header().Get("Content-Security-Policy")
+	require.Contains(t, csp, "default-src 'self'")
+	require.Regexp(t, `script-src 'self' 'nonce-[A-Za-z0-9+/]{22}=='`, csp)
+	require.NotContains(t, csp, "{nonce}")
+	require.Equal(t, "DENY", rr.Header().Get("X-Frame-Options"))
+	require.Equal(t, "strict-origin-when-cross-origin", rr.Header().Get("Referrer-Policy"))
+	require.Contains(t, rr.Header().Get("Permissions-Policy"), "camera=()")
+	require.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	require.Equal(t, "", rr.Header().Get("Strict-Transport-Security")) // Plain HTTP
+	require.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// Nonce changes with every request
+	rr2 := request(t, s, "GET", "/v1/health", "", nil)
+	require.NotEqual(t, csp, rr2.Header().Get("Content-Security-Policy"))
+
+	// Error responses have the headers too
+	rr = request(t, s, "GET", "/v1/does-not-exist", "", nil)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, "DENY", rr.Header().Get("X-Frame-Options"))
+	require.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// Web app index is never cached, since the nonce changes
+	rr = request(t, s, "GET", "/", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "no-cache", rr.Header().Get("Cache-Control"))
+	require.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+}
+
+func TestServer_SecurityHeaders_Config(t *testing.T) {
+	c := newTestConfig(t)
+	c.BaseURL = "https://coop.example.com"
+	c.ContentSecurityPolicy = "default-src 'none'"
+	c.XFrameOptions = ""
+	c.ReferrerPolicy = "no-referrer"
+	c.PermissionsPolicy = ""
+	s := newTestServer(t, c)
+
+	rr := request(t, s, "GET", "/v1/health", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "default-src 'none'", rr.Header().Get("Content-Security-Policy"))
+	require.Equal(t, "max-age=31536000; includeSubDomains", rr.Header().Get("Strict-Transport-Security"))
+	require.Equal(t, "no-referrer", rr.Header().Get("Referrer-Policy"))
+	require.NotContains(t, rr.Header(), "X-Frame-Options")
+	require.NotContains(t, rr.Header(), "Permissions-Policy")
+
+	// HSTS can be disabled
+	c.StrictTransportSecurityMaxAge = 0
+	rr = request(t, s, "GET", "/v1/health", "", nil)
+	require.NotContains(t, rr.Header(), "Strict-Transport-Security")
+}
+
+func TestServer_CORS_Allowlist(t *testing.T) {
+	c := newTestConfig(t)
+	c.AccessControlAllowOrigins = []string{"https://coop.example.com", "http://localhost:3000/"}
+	c.AccessControlAllowCredentials = true
+	s := newTestServer(t, c)
+
+	// Allowed origin is reflected, with credentials
+	rr := request(t, s, "GET", "/v1/health", "", map[string]string{
+		"Origin": "https://coop.example.com",
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "https://coop.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "Origin", rr.Header().Get("Vary"))
+
+	rr = request(t, s, "GET", "/v1/health", "", map[string]string{
+		"Origin": "http://localhost:3000",
+	})
+	require.Equal(t, "http://localhost:3000", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// Other origins get no CORS headers
+	rr = request(t, s, "GET", "/v1/health", "", map[string]string{
+		"Origin": "https://evil.example.com",
+	})
+	require.Equal(t, 200, rr.Code)
+	require.NotContains(t, rr.Header(), "Access-Control-Allow-Origin")
+	require.NotContains(t, rr.Header(), "Access-Control-Allow-Credentials")
+	require.Equal(t, "Origin", rr.Header().Get("Vary"))
+
+	// Preflight echoes the requested headers, since the wildcard does not work with credentials
+	rr = request(t, s, "OPTIONS", "/mytopic", "", map[string]string{
+		"Origin":                         "https://coop.example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "authorization,content-type",
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "https://coop.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "authorization,content-type", rr.Header().Get("Access-Control-Allow-Headers"))
+	require.Contains(t, rr.Header().Get("Access-Control-Allow-Methods"), "POST")
+}
+
+func TestServer_AddCSPNonce(t *testing.T) {
+	html := `<html><head><script src="/config.js"></script></head><body><script type="module" src="/app.js"></script></body></html>`
+	require.Equal(t,
+		`<html><head><script nonce="abc" src="/config.js"></script></head><body><script nonce="abc" type="module" src="/app.js"></script></body></html>`,
+		string(addCSPNonce([]byte(html), "abc")),
+	)
+}
 func TestServer_PublishLargeMessage(t *testing.T) {
 	c := newTestConfig(t)
 	c.AttachmentCacheDir = "" // Disable attachments
@@ -1206,6 +1321,7 @@ func TestServer_DailyMessageQuotaFromDatabase(t *testing.T) {
 
 type testMailer struct {
 	count int
+	last  *message
 	mu    sync.Mutex
 }
 
@@ -1213,9 +1329,16 @@ func (t *testMailer) Send(v *visitor, m *message, to string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.count++
+	t.last = m
 	return nil
 }
 
+func (t *testMailer) Last() *message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
 func (t *testMailer) Counts() (total int64, success int64, failure int64) {
 	return 0, 0, 0
 }
@@ -1711,6 +1834,98 @@ func TestServer_PublishMarkdown_NotMarkdown(t *testing.T) {
 	require.Equal(t, "", m.ContentType)
 }
 
+func TestServer_PublishMarkdown_CoopTopicSanitized(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "team", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("phil", "other", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.SetTopicMeta("team", "Team", "", "", "phil"))
+
+	body := "**bold** <img src=x onerror=alert(1)> [click](javascript:alert(1)) [docs](https://example.com)\n<script>alert(2)</script>"
+	response := request(t, s, "PUT", "/team", body, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Content-Type":  "text/markdown",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, body, m.Message) // Raw markdown is kept for editing
+
+	// Sanitized HTML is stored at publish time
+	stored, err := s.messageCache.Message(m.ID)
+	require.Nil(t, err)
+	require.Contains(t, stored.HTML, "<strong>bold</strong>")
+	require.Contains(t, stored.HTML, `<a href="https://example.com" rel="nofollow noreferrer noopener" target="_blank">docs</a>`)
+	require.NotContains(t, stored.HTML, "onerror")
+	require.NotContains(t, stored.HTML, "javascript:")
+	require.NotContains(t, stored.HTML, "<script")
+
+	response = request(t, s, "GET", "/v1/coop/messages/"+m.ID+"/html", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	rendered, _ := util.UnmarshalJSON[apiMessageHTMLResponse](io.NopCloser(response.Body))
+	require.Equal(t, m.ID, rendered.ID)
+	require.Equal(t, "team", rendered.Topic)
+	require.Equal(t, "text/markdown", rendered.ContentType)
+	require.Equal(t, stored.HTML, rendered.HTML)
+
+	// No read access to the topic
+	response = request(t, s, "GET", "/v1/coop/messages/"+m.ID+"/html", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+
+	// Non-Coop topics are not rendered at publish time, but the endpoint renders them on the fly
+	response = request(t, s, "PUT", "/other", "line 1\n<b>line 2</b>", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	m = toMessage(t, response.Body.String())
+	stored, err = s.messageCache.Message(m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "", stored.HTML)
+	response = request(t, s, "GET", "/v1/coop/messages/"+m.ID+"/html", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	rendered, _ = util.UnmarshalJSON[apiMessageHTMLResponse](io.NopCloser(response.Body))
+	require.Equal(t, "<p>line 1<br>\n&lt;b&gt;line 2&lt;/b&gt;</p>", rendered.HTML)
+
+	response = request(t, s, "GET", "/v1/coop/messages/doesnotexist/html", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 404, response.Code)
+}
+
+func TestMessagePlainText_Markdown(t *testing.T) {
+	m := &message{
+		Message:     "**Hello** <script>alert(1)</script>[docs](https://example.com) &amp; more\n\n- one\n- two",
+		ContentType: markdownContentType,
+	}
+	text := messagePlainText(m)
+	require.Equal(t, "Hello docs & more\n\none\n\ntwo", text)
+	require.NotContains(t, text, "script")
+
+	// Payloads for push notifications carry the plain text, but keep the raw markdown in the message
+	payload := newWebPushPayload("https://ntfy.sh/mytopic", m)
+	require.Equal(t, text, payload.Preview)
+	require.Equal(t, m.Message, payload.Message.Message)
+	fbm, err := toFirebaseMessage(&message{Event: messageEvent, Topic: "mytopic", Message: m.Message, ContentType: markdownContentType}, nil)
+	require.Nil(t, err)
+	require.Equal(t, text, fbm.APNS.Payload.Aps.Alert.Body)
+	require.Equal(t, m.Message, fbm.Data["message"])
+
+	// Plain text messages are passed on as is
+	plain := &message{Message: "**not markdown**"}
+	require.Equal(t, "**not markdown**", messagePlainText(plain))
+	require.Empty(t, newWebPushPayload("https://ntfy.sh/mytopic", plain).Preview)
+}
+
 func TestServer_PublishAsJSON(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	body := `{"topic":"mytopic","message":"A message","title":"a title\nwith lines","tags":["tag1","tag 2"],` +
@@ -1897,7 +2112,7 @@ func TestServer_PublishAttachment(t *testing.T) {
 	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(179*time.Minute).Unix()) // Almost 3 hours
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
 	require.Equal(t, netip.Addr{}, msg.Sender) // Should never be returned
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID)))
 
 	// GET
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
@@ -1918,159 +2133,630 @@ func TestServer_PublishAttachment(t *testing.T) {
 	require.Equal(t, int64(5000), size)
 }
 
-func TestServer_PublishAttachmentShortWithFilename(t *testing.T) {
-	c := newTestConfig(t)
-	c.BehindProxy = true
+func TestServer_PublishAttachment_CoopTopicSignedURL(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
 	s := newTestServer(t, c)
-	content := "this is an ATTACHMENT"
-	response := request(t, s, "PUT", "/mytopic?f=myfile.txt", content, map[string]string{
-		"X-Forwarded-For": "1.2.3.4",
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("eve", "eve", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "dm-phil-ben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("ben", "dm-phil-ben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.SetDMTopicMeta("dm-phil-ben", "phil", "ben"))
+
+	// Publisher gets a URL signed for themselves
+	content := "private photo"
+	response := request(t, s, "PUT", "/dm-phil-ben?f=photo.txt", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
 	})
+	require.Equal(t, 200, response.Code)
 	msg := toMessage(t, response.Body.String())
-	require.Equal(t, "myfile.txt", msg.Attachment.Name)
-	require.Equal(t, "text/plain; charset=utf-8", msg.Attachment.Type)
-	require.Equal(t, int64(21), msg.Attachment.Size)
-	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(3*time.Hour).Unix())
-	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-	require.Equal(t, netip.Addr{}, msg.Sender) // Should never be returned
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+	signedURL, err := url.Parse(msg.Attachment.URL)
+	require.Nil(t, err)
+	require.Equal(t, "/file/"+msg.ID+".txt", signedURL.Path)
+	require.Equal(t, "phil", signedURL.Query().Get("u"))
+	require.NotEmpty(t, signedURL.Query().Get("sig"))
 
-	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	// Without credentials or signature, the file is not readable; HEAD neither
+	path := "/file/" + msg.ID + ".txt"
 	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", path, "", map[string]string{
+		"Authorization": util.BasicAuth("eve", "eve"),
+	})
+	require.Equal(t, 403, response.Code)
+
+	// With credentials, or with the signed URL
+	response = request(t, s, "GET", path, "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+	response = request(t, s, "GET", signedURL.RequestURI(), "", nil)
 	require.Equal(t, 200, response.Code)
-	require.Equal(t, "21", response.Header().Get("Content-Length"))
 	require.Equal(t, content, response.Body.String())
 
-	// Slightly unrelated cross-test: make sure we add an owner for internal attachments
-	size, err := s.messageCache.AttachmentBytesUsedBySender("1.2.3.4")
-	require.Nil(t, err)
-	require.Equal(t, int64(21), size)
-}
+	// Tampered signatures and URLs for other messages are rejected
+	query := signedURL.Query()
+	query.Set("u", "ben")
+	response = request(t, s, "GET", path+"?"+query.Encode(), "", nil)
+	require.Equal(t, 403, response.Code)
 
-func TestServer_PublishAttachmentExternalWithoutFilename(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-	response := request(t, s, "PUT", "/mytopic", "", map[string]string{
-		"Attach": "https://upload.wikimedia.org/wikipedia/commons/f/fd/Pink_flower.jpg",
+	// Subscribers get a URL signed for themselves
+	response = request(t, s, "GET", "/dm-phil-ben/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
 	})
-	msg := toMessage(t, response.Body.String())
-	require.Equal(t, "You received a file: Pink_flower.jpg", msg.Message)
-	require.Equal(t, "Pink_flower.jpg", msg.Attachment.Name)
-	require.Equal(t, "https://upload.wikimedia.org/wikipedia/commons/f/fd/Pink_flower.jpg", msg.Attachment.URL)
-	require.Equal(t, "", msg.Attachment.Type)
-	require.Equal(t, int64(0), msg.Attachment.Size)
-	require.Equal(t, int64(0), msg.Attachment.Expires)
-	require.Equal(t, netip.Addr{}, msg.Sender)
-
-	// Slightly unrelated cross-test: make sure we don't add an owner for external attachments
-	size, err := s.messageCache.AttachmentBytesUsedBySender("127.0.0.1")
+	require.Equal(t, 200, response.Code)
+	polled := toMessage(t, strings.TrimSpace(response.Body.String()))
+	benURL, err := url.Parse(polled.Attachment.URL)
 	require.Nil(t, err)
-	require.Equal(t, int64(0), size)
+	require.Equal(t, "ben", benURL.Query().Get("u"))
+	response = request(t, s, "GET", benURL.RequestURI(), "", nil)
+	require.Equal(t, 200, response.Code)
+
+	// Signed URLs stop working when the user loses access, and when they expire
+	require.Nil(t, s.userManager.ResetAccess("ben", "dm-phil-ben"))
+	response = request(t, s, "GET", benURL.RequestURI(), "", nil)
+	require.Equal(t, 403, response.Code)
+
+	expired := s.attachmentURLSignature(msg.ID, "phil", time.Now().Add(-time.Minute).Unix())
+	response = request(t, s, "GET", fmt.Sprintf("%s?u=phil&exp=%d&sig=%s", path, time.Now().Add(-time.Minute).Unix(), expired), "", nil)
+	require.Equal(t, 403, response.Code)
 }
 
-func TestServer_PublishAttachmentExternalWithFilename(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-	response := request(t, s, "PUT", "/mytopic", "This is a custom message", map[string]string{
-		"X-Attach": "https://upload.wikimedia.org/wikipedia/commons/f/fd/Pink_flower.jpg",
-		"File":     "some file.jpg",
+func TestServer_PublishAttachment_CoopTopicEmailURL(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	mailer := &testMailer{}
+	s.smtpSender = mailer
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "dm-phil-ben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("ben", "dm-phil-ben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.SetDMTopicMeta("dm-phil-ben", "phil", "ben"))
+
+	response := request(t, s, "PUT", "/dm-phil-ben?f=photo.txt", "private photo", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Email":         "someone@example.com",
 	})
+	require.Equal(t, 200, response.Code)
 	msg := toMessage(t, response.Body.String())
-	require.Equal(t, "This is a custom message", msg.Message)
-	require.Equal(t, "some file.jpg", msg.Attachment.Name)
-	require.Equal(t, "https://upload.wikimedia.org/wikipedia/commons/f/fd/Pink_flower.jpg", msg.Attachment.URL)
-	require.Equal(t, "", msg.Attachment.Type)
-	require.Equal(t, int64(0), msg.Attachment.Size)
-	require.Equal(t, int64(0), msg.Attachment.Expires)
-	require.Equal(t, netip.Addr{}, msg.Sender)
-}
+	waitFor(t, func() bool {
+		return mailer.Count() == 1
+	})
 
-func TestServer_PublishAttachmentBadURL(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-	response := request(t, s, "PUT", "/mytopic?a=not+a+URL", "", nil)
-	err := toHTTPError(t, response.Body.String())
-	require.Equal(t, 400, response.Code)
-	require.Equal(t, 400, err.HTTPCode)
-	require.Equal(t, 40013, err.Code)
-}
+	// The emailed URL is not signed for the publisher, but for this message only
+	emailURL, err := url.Parse(mailer.Last().Attachment.URL)
+	require.Nil(t, err)
+	require.Equal(t, "/file/"+msg.ID+".txt", emailURL.Path)
+	require.Empty(t, emailURL.Query().Get("u"))
+	require.NotEmpty(t, emailURL.Query().Get("sig"))
+	response = request(t, s, "GET", emailURL.RequestURI(), "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "private photo", response.Body.String())
 
-func TestServer_PublishAttachmentTooLargeContentLength(t *testing.T) {
-	content := util.RandomString(5000) // > 4096
-	s := newTestServer(t, newTestConfig(t))
-	response := request(t, s, "PUT", "/mytopic", content, map[string]string{
-		"Content-Length": "20000000",
-	})
-	err := toHTTPError(t, response.Body.String())
-	require.Equal(t, 413, response.Code)
-	require.Equal(t, 413, err.HTTPCode)
-	require.Equal(t, 41301, err.Code)
+	// The signature cannot be reused as the publisher
+	query := emailURL.Query()
+	query.Set("u", "phil")
+	response = request(t, s, "GET", emailURL.Path+"?"+query.Encode(), "", nil)
+	require.Equal(t, 403, response.Code)
 }
 
-func TestServer_PublishAttachmentTooLargeBodyAttachmentFileSizeLimit(t *testing.T) {
-	content := util.RandomString(5001) // > 5000, see below
-	c := newTestConfig(t)
-	c.AttachmentFileSizeLimit = 5000
+func TestServer_PublishAttachment_Range(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
 	s := newTestServer(t, c)
-	response := request(t, s, "PUT", "/mytopic", content, nil)
-	err := toHTTPError(t, response.Body.String())
-	require.Equal(t, 413, response.Code)
-	require.Equal(t, 413, err.HTTPCode)
-	require.Equal(t, 41301, err.Code)
-}
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
 
-func TestServer_PublishAttachmentExpiryBeforeDelivery(t *testing.T) {
-	c := newTestConfig(t)
-	c.AttachmentExpiryDuration = 10 * time.Minute
-	s := newTestServer(t, c)
-	response := request(t, s, "PUT", "/mytopic", util.RandomString(5000), map[string]string{
-		"Delay": "11 min", // > AttachmentExpiryDuration
+	content := "0123456789abcdefghij"
+	response := request(t, s, "PUT", "/mytopic?f=range.txt", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
 	})
-	err := toHTTPError(t, response.Body.String())
-	require.Equal(t, 400, response.Code)
-	require.Equal(t, 400, err.HTTPCode)
-	require.Equal(t, 40015, err.Code)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	path := "/file/" + msg.ID + ".txt"
+
+	tests := []struct {
+		rangeHeader  string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"", 200, "", content},
+		{"bytes=0-4", 206, "bytes 0-4/20", "01234"},
+		{"bytes=10-", 206, "bytes 10-19/20", "abcdefghij"},
+		{"bytes=-3", 206, "bytes 17-19/20", "hij"},
+		{"bytes=15-100", 206, "bytes 15-19/20", "fghij"},
+		{"bytes=0-1,5-6", 200, "", content}, // Multiple ranges are not supported
+		{"bytes=20-", 416, "bytes */20", ""},
+	}
+	for _, test := range tests {
+		headers := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+		if test.rangeHeader != "" {
+			headers["Range"] = test.rangeHeader
+		}
+		response := request(t, s, "GET", path, "", headers)
+		require.Equal(t, test.status, response.Code, test.rangeHeader)
+		require.Equal(t, test.contentRange, response.Header().Get("Content-Range"), test.rangeHeader)
+		if test.status != 416 {
+			require.Equal(t, "bytes", response.Header().Get("Accept-Ranges"))
+			require.Equal(t, test.body, response.Body.String(), test.rangeHeader)
+		}
+	}
 }
 
-func TestServer_PublishAttachmentTooLargeBodyVisitorAttachmentTotalSizeLimit(t *testing.T) {
-	c := newTestConfig(t)
-	c.VisitorAttachmentTotalSizeLimit = 10000
+func TestServer_PublishAttachment_Image(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
 	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	headers := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
 
-	response := request(t, s, "PUT", "/mytopic", "text file!"+util.RandomString(4990), nil)
+	content := newTestJPEG(t, 800, 600, 1, "GPS 48.2082N 16.3738E")
+	response := request(t, s, "PUT", "/mytopic?f=photo.jpg", string(content), headers)
+	require.Equal(t, 200, response.Code)
 	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "image/jpeg", msg.Attachment.Type)
+	require.Equal(t, 800, msg.Attachment.Width)
+	require.Equal(t, 600, msg.Attachment.Height)
+	require.Len(t, msg.Attachment.BlurHash, 28)
+	require.Less(t, msg.Attachment.Size, int64(len(content)))
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID)+"_thumb"))
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID)+"_preview"))
+
+	// Dimensions are stored with the message
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", headers)
+	polled := toMessage(t, strings.TrimSpace(response.Body.String()))
+	require.Equal(t, 800, polled.Attachment.Width)
+	require.Equal(t, msg.Attachment.BlurHash, polled.Attachment.BlurHash)
+
+	// Original without metadata
+	path := "/file/" + msg.ID + ".jpg"
+	response = request(t, s, "GET", path, "", headers)
+	require.Equal(t, 200, response.Code)
+	require.NotContains(t, response.Body.String(), "GPS 48.2082N")
+	original := response.Body.String()
+
+	// Thumbnail
+	response = request(t, s, "GET", path+"?size=thumb", "", headers)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "image/jpeg", response.Header().Get("Content-Type"))
+	require.Empty(t, response.Header().Get("Content-Disposition"))
+	thumbnail, err := jpeg.Decode(response.Body)
+	require.Nil(t, err)
+	require.Equal(t, image.Rect(0, 0, 320, 240), thumbnail.Bounds())
+
+	// Image is smaller than the preview size, so the original is returned
+	response = request(t, s, "GET", path+"?size=preview", "", headers)
 	require.Equal(t, 200, response.Code)
-	require.Equal(t, "You received a file: attachment.txt", msg.Message)
-	require.Equal(t, int64(5000), msg.Attachment.Size)
+	require.Equal(t, original, response.Body.String())
 
-	content := util.RandomString(5001) // 5000+5001 > , see below
-	response = request(t, s, "PUT", "/mytopic", content, nil)
-	err := toHTTPError(t, response.Body.String())
-	require.Equal(t, 413, response.Code)
-	require.Equal(t, 413, err.HTTPCode)
-	require.Equal(t, 41301, err.Code)
+	response = request(t, s, "GET", path+"?size=huge", "", headers)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40061, toHTTPError(t, response.Body.String()).Code)
 }
 
-func TestServer_PublishAttachmentAndExpire(t *testing.T) {
-	t.Parallel()
-	content := util.RandomString(5000) // > 4096
-
+func TestServer_PublishAttachment_ImageMetadataNotStripped(t *testing.T) {
 	c := newTestConfig(t)
-	c.AttachmentExpiryDuration = time.Millisecond // Hack
+	c.CacheDuration = time.Hour
 	s := newTestServer(t, c)
+	defer s.closeDatabases()
 
-	// Publish and make sure we can retrieve it
-	response := request(t, s, "PUT", "/mytopic", content, nil)
-	msg := toMessage(t, response.Body.String())
-	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-	file := filepath.Join(s.config.AttachmentCacheDir, msg.ID)
-	require.FileExists(t, file)
+	// JPEG that is cut off in the middle of its EXIF segment: the metadata cannot be stripped, so it is rejected
+	content := newTestJPEG(t, 800, 600, 1, "GPS 48.2082N 16.3738E")
+	truncated := content[:bytes.Index(content, []byte("GPS 48.2082N"))+8]
+	response := request(t, s, "PUT", "/mytopic?f=photo.jpg", string(truncated), nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40066, toHTTPError(t, response.Body.String()).Code)
 
-	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
-	response = request(t, s, "GET", path, "", nil)
-	require.Equal(t, 200, response.Code)
-	require.Equal(t, content, response.Body.String())
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Empty(t, strings.TrimSpace(response.Body.String()))
+	require.Equal(t, int64(0), s.fileCache.Size())
+}
 
-	// Prune and makes sure it's gone
-	waitFor(t, func() bool {
-		s.execManager() // May run many times
+func TestServer_PublishAttachment_Dedup(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AttachmentExpiryDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("phil", "othertopic", user.PermissionReadWrite))
+	headers := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	content := "the same file, sent twice"
+	response := request(t, s, "PUT", "/mytopic?f=a.txt", content, headers)
+	require.Equal(t, 200, response.Code)
+	msg1 := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/othertopic?f=b.txt", content, headers)
+	require.Equal(t, 200, response.Code)
+	msg2 := toMessage(t, response.Body.String())
+
+	// Stored once, named after the content hash
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	require.Equal(t, hash, toAttachmentFileID(t, s, msg1.ID))
+	require.Equal(t, hash, toAttachmentFileID(t, s, msg2.ID))
+	require.FileExists(t, filepath.Join(c.AttachmentCacheDir, hash))
+	require.NoFileExists(t, filepath.Join(c.AttachmentCacheDir, msg1.ID))
+	require.NoFileExists(t, filepath.Join(c.AttachmentCacheDir, msg2.ID))
+	refs, err := s.messageCache.AttachmentBlobRefs(hash)
+	require.Nil(t, err)
+	require.Equal(t, 2, refs)
+
+	for _, path := range []string{"/file/" + msg1.ID + ".txt", "/file/" + msg2.ID + ".txt"} {
+		response = request(t, s, "GET", path, "", headers)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, content, response.Body.String())
+	}
+
+	// Blob is kept until the last message referencing it is gone
+	require.Nil(t, s.messageCache.DeleteMessages(msg1.ID))
+	s.execManager()
+	require.FileExists(t, filepath.Join(c.AttachmentCacheDir, hash))
+	response = request(t, s, "GET", "/file/"+msg2.ID+".txt", "", headers)
+	require.Equal(t, 200, response.Code)
+
+	require.Nil(t, s.messageCache.DeleteMessages(msg2.ID))
+	s.execManager()
+	require.NoFileExists(t, filepath.Join(c.AttachmentCacheDir, hash))
+}
+
+func TestServer_PublishAttachment_DedupQuotaPolicy(t *testing.T) {
+	for _, policy := range []string{AttachmentQuotaPolicyUpload, AttachmentQuotaPolicyUnique} {
+		t.Run(policy, func(t *testing.T) {
+			c := newTestConfigWithAuthFile(t)
+			c.CacheDuration = time.Hour
+			c.AuthDefault = user.PermissionDenyAll
+			c.AttachmentQuotaPolicy = policy
+			s := newTestServer(t, c)
+			defer s.closeDatabases()
+			require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+			require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+			headers := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+			content := strings.Repeat("x", 1000)
+			for i := 0; i < 2; i++ {
+				response := request(t, s, "PUT", "/mytopic?f=x.txt", content, headers)
+				require.Equal(t, 200, response.Code)
+			}
+			u, err := s.userManager.User("phil")
+			require.Nil(t, err)
+			info, err := s.visitor(netip.MustParseAddr("9.9.9.9"), u).Info()
+			require.Nil(t, err)
+			if policy == AttachmentQuotaPolicyUnique {
+				require.Equal(t, int64(1000), info.Stats.AttachmentTotalSize)
+			} else {
+				require.Equal(t, int64(2000), info.Stats.AttachmentTotalSize)
+			}
+		})
+	}
+}
+
+func TestServer_ResumableUpload(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	c.AttachmentExpiryDuration = time.Hour
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	chunk := func(offset int) map[string]string {
+		return map[string]string{"Authorization": util.BasicAuth("phil", "phil"), "Upload-Offset": strconv.Itoa(offset)}
+	}
+
+	rr := request(t, s, "POST", "/v1/coop/uploads", `{"filename":"notes.txt","size":21}`, phil)
+	require.Equal(t, 200, rr.Code)
+	upload, _ := util.UnmarshalJSON[apiUploadResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "notes.txt", upload.Filename)
+	require.Equal(t, int64(0), upload.Offset)
+	path := "/v1/coop/uploads/" + upload.ID
+
+	rr = request(t, s, "PATCH", path, "hello ", chunk(0))
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "6", rr.Header().Get("Upload-Offset"))
+	require.FileExists(t, filepath.Join(c.AttachmentCacheDir, uploadChunkID(upload.ID, 0)))
+
+	// Retried chunk is rejected, the client continues at the returned offset
+	rr = request(t, s, "PATCH", path, "hello ", chunk(0))
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40908, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PATCH", path, "hello ", phil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40065, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "GET", path, "", map[string]string{"Authorization": util.BasicAuth("ben", "ben")})
+	require.Equal(t, 404, rr.Code)
+	rr = request(t, s, "GET", path, "", phil)
+	require.Equal(t, 200, rr.Code)
+	upload, _ = util.UnmarshalJSON[apiUploadResponse](io.NopCloser(rr.Body))
+	require.Equal(t, int64(6), upload.Offset)
+
+	// Incomplete uploads cannot be attached, and chunks cannot exceed the announced size
+	rr = request(t, s, "PUT", "/mytopic", "", map[string]string{"Authorization": util.BasicAuth("phil", "phil"), "Upload": upload.ID})
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40910, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PATCH", path, "resumable world, and more", chunk(6))
+	require.Equal(t, 413, rr.Code)
+	rr = request(t, s, "PATCH", path, "resumable ", chunk(6))
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PATCH", path, "world", chunk(16))
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "21", rr.Header().Get("Upload-Offset"))
+
+	// Attach to message
+	rr = request(t, s, "PUT", "/mytopic", "Here you go", map[string]string{"Authorization": util.BasicAuth("phil", "phil"), "Upload": upload.ID})
+	require.Equal(t, 200, rr.Code)
+	msg := toMessage(t, rr.Body.String())
+	require.Equal(t, "Here you go", msg.Message)
+	require.Equal(t, "notes.txt", msg.Attachment.Name)
+	require.Equal(t, int64(21), msg.Attachment.Size)
+	require.Equal(t, "text/plain; charset=utf-8", msg.Attachment.Type)
+	rr = request(t, s, "GET", "/file/"+msg.ID+".txt", "", phil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "hello resumable world", rr.Body.String())
+
+	// Upload and its chunks are gone
+	rr = request(t, s, "GET", path, "", phil)
+	require.Equal(t, 404, rr.Code)
+	require.NoFileExists(t, filepath.Join(c.AttachmentCacheDir, uploadChunkID(upload.ID, 0)))
+	rr = request(t, s, "PUT", "/mytopic", "", map[string]string{"Authorization": util.BasicAuth("phil", "phil"), "Upload": upload.ID})
+	require.Equal(t, 404, rr.Code)
+}
+
+func TestServer_ResumableUpload_Limits(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AttachmentFileSizeLimit = 100
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	rr := request(t, s, "POST", "/v1/coop/uploads", `{"filename":"big.bin","size":101}`, phil)
+	require.Equal(t, 413, rr.Code)
+	rr = request(t, s, "POST", "/v1/coop/uploads", `{"filename":"../big.bin","size":10}`, phil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40064, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/coop/uploads", `{"filename":"big.bin","size":10}`, nil)
+	require.Equal(t, 401, rr.Code)
+	for i := 0; i < uploadsLimit; i++ {
+		rr = request(t, s, "POST", "/v1/coop/uploads", `{"filename":"big.bin","size":10}`, phil)
+		require.Equal(t, 200, rr.Code)
+	}
+	rr = request(t, s, "POST", "/v1/coop/uploads", `{"filename":"big.bin","size":10}`, phil)
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42915, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_ResumableUpload_ChunkRequestLimit(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.VisitorRequestLimitBurst = 3
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	chunk := map[string]string{"Authorization": util.BasicAuth("phil", "phil"), "Upload-Offset": "0"}
+
+	rr := request(t, s, "POST", "/v1/coop/uploads", `{"filename":"notes.txt","size":10}`, phil)
+	require.Equal(t, 200, rr.Code)
+	upload, _ := util.UnmarshalJSON[apiUploadResponse](io.NopCloser(rr.Body))
+
+	// Chunks count against the request limit, just like creating the upload
+	for i := 0; i < 2; i++ {
+		rr = request(t, s, "PATCH", "/v1/coop/uploads/"+upload.ID, "", chunk)
+		require.NotEqual(t, 429, rr.Code)
+	}
+	rr = request(t, s, "PATCH", "/v1/coop/uploads/"+upload.ID, "", chunk)
+	require.Equal(t, 429, rr.Code)
+	require.Equal(t, 42901, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_ResumableUpload_Expired(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	rr := request(t, s, "POST", "/v1/coop/uploads", `{"filename":"notes.txt","size":100}`, phil)
+	require.Equal(t, 200, rr.Code)
+	upload, _ := util.UnmarshalJSON[apiUploadResponse](io.NopCloser(rr.Body))
+	s.config.AttachmentUploadExpiry = -time.Second // Expires with this chunk
+	rr = request(t, s, "PATCH", "/v1/coop/uploads/"+upload.ID, "hello", map[string]string{"Authorization": util.BasicAuth("phil", "phil"), "Upload-Offset": "0"})
+	require.Equal(t, 200, rr.Code)
+	require.FileExists(t, filepath.Join(c.AttachmentCacheDir, uploadChunkID(upload.ID, 0)))
+
+	rr = request(t, s, "GET", "/v1/coop/uploads/"+upload.ID, "", phil)
+	require.Equal(t, 404, rr.Code)
+	s.execManager()
+	require.NoFileExists(t, filepath.Join(c.AttachmentCacheDir, uploadChunkID(upload.ID, 0)))
+	uploads, err := s.messageCache.AttachmentUploadsExpired()
+	require.Nil(t, err)
+	require.Empty(t, uploads)
+}
+
+func TestServer_PublishAttachmentShortWithFilename(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	content := "this is an ATTACHMENT"
+	response := request(t, s, "PUT", "/mytopic?f=myfile.txt", content, map[string]string{
+		"X-Forwarded-For": "1.2.3.4",
+	})
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "myfile.txt", msg.Attachment.Name)
+	require.Equal(t, "text/plain; charset=utf-8", msg.Attachment.Type)
+	require.Equal(t, int64(21), msg.Attachment.Size)
+	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(3*time.Hour).Unix())
+	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
+	require.Equal(t, netip.Addr{}, msg.Sender) // Should never be returned
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID)))
+
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "21", response.Header().Get("Content-Length"))
+	require.Equal(t, content, response.Body.String())
+
+	// Slightly unrelated cross-test: make sure we add an owner for internal attachments
+	size, err := s.messageCache.AttachmentBytesUsedBySender("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(21), size)
+}
+
+func TestServer_PublishAttachmentExternalWithoutFilename(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Attach": "https://upload.wikimedia.org/wikipedia/commons/f/fd/Pink_flower.jpg",
+	})
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "You received a file: Pink_flower.jpg", msg.Message)
+	require.Equal(t, "Pink_flower.jpg", msg.Attachment.Name)
+	require.Equal(t, "https://upload.wikimedia.org/wikipedia/commons/f/fd/Pink_flower.jpg", msg.Attachment.URL)
+	require.Equal(t, "", msg.Attachment.Type)
+	require.Equal(t, int64(0), msg.Attachment.Size)
+	require.Equal(t, int64(0), msg.Attachment.Expires)
+	require.Equal(t, netip.Addr{}, msg.Sender)
+
+	// Slightly unrelated cross-test: make sure we don't add an owner for external attachments
+	size, err := s.messageCache.AttachmentBytesUsedBySender("127.0.0.1")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), size)
+}
+
+func TestServer_PublishAttachmentExternalWithFilename(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "This is a custom message", map[string]string{
+		"X-Attach": "https://upload.wikimedia.org/wikipedia/commons/f/fd/Pink_flower.jpg",
+		"File":     "some file.jpg",
+	})
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "This is a custom message", msg.Message)
+	require.Equal(t, "some file.jpg", msg.Attachment.Name)
+	require.Equal(t, "https://upload.wikimedia.org/wikipedia/commons/f/fd/Pink_flower.jpg", msg.Attachment.URL)
+	require.Equal(t, "", msg.Attachment.Type)
+	require.Equal(t, int64(0), msg.Attachment.Size)
+	require.Equal(t, int64(0), msg.Attachment.Expires)
+	require.Equal(t, netip.Addr{}, msg.Sender)
+}
+
+func TestServer_PublishAttachmentBadURL(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic?a=not+a+URL", "", nil)
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 400, err.HTTPCode)
+	require.Equal(t, 40013, err.Code)
+}
+
+func TestServer_PublishAttachmentTooLargeContentLength(t *testing.T) {
+	content := util.RandomString(5000) // > 4096
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"Content-Length": "20000000",
+	})
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 413, err.HTTPCode)
+	require.Equal(t, 41301, err.Code)
+}
+
+func TestServer_PublishAttachmentTooLargeBodyAttachmentFileSizeLimit(t *testing.T) {
+	content := util.RandomString(5001) // > 5000, see below
+	c := newTestConfig(t)
+	c.AttachmentFileSizeLimit = 5000
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 413, err.HTTPCode)
+	require.Equal(t, 41301, err.Code)
+}
+
+func TestServer_PublishAttachmentExpiryBeforeDelivery(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentExpiryDuration = 10 * time.Minute
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(5000), map[string]string{
+		"Delay": "11 min", // > AttachmentExpiryDuration
+	})
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 400, err.HTTPCode)
+	require.Equal(t, 40015, err.Code)
+}
+
+func TestServer_PublishAttachmentTooLargeBodyVisitorAttachmentTotalSizeLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorAttachmentTotalSizeLimit = 10000
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "text file!"+util.RandomString(4990), nil)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "You received a file: attachment.txt", msg.Message)
+	require.Equal(t, int64(5000), msg.Attachment.Size)
+
+	content := util.RandomString(5001) // 5000+5001 > , see below
+	response = request(t, s, "PUT", "/mytopic", content, nil)
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 413, err.HTTPCode)
+	require.Equal(t, 41301, err.Code)
+}
+
+func TestServer_PublishAttachmentTooLargeImageVisitorAttachmentTotalSizeLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorAttachmentTotalSizeLimit = 500
+	s := newTestServer(t, c)
+
+	// Images are checked against the limits before they are processed
+	image := newTestPNG(t, 200, 200)
+	require.Greater(t, len(image), 500)
+	response := request(t, s, "PUT", "/mytopic?f=image.png", string(image), nil)
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 41301, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishAttachmentAndExpire(t *testing.T) {
+	t.Parallel()
+	content := util.RandomString(5000) // > 4096
+
+	c := newTestConfig(t)
+	c.AttachmentExpiryDuration = time.Millisecond // Hack
+	s := newTestServer(t, c)
+
+	// Publish and make sure we can retrieve it
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	msg := toMessage(t, response.Body.String())
+	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
+	file := filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID))
+	require.FileExists(t, file)
+
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+
+	// Prune and makes sure it's gone
+	waitFor(t, func() bool {
+		s.execManager() // May run many times
 		return !util.FileExists(file)
 	})
 	response = request(t, s, "GET", path, "", nil)
@@ -2108,7 +2794,7 @@ func TestServer_PublishAttachmentWithTierBasedExpiry(t *testing.T) {
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
 	require.True(t, msg.Attachment.Expires > time.Now().Add(sevenDays-30*time.Second).Unix())
 	require.True(t, msg.Expires > time.Now().Add(sevenDays-30*time.Second).Unix())
-	file := filepath.Join(s.config.AttachmentCacheDir, msg.ID)
+	file := filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID))
 	require.FileExists(t, file)
 
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
@@ -2186,7 +2872,7 @@ func TestServer_PublishAttachmentWithTierBasedLimits(t *testing.T) {
 	response := request(t, s, "PUT", "/mytopic", smallFile, nil)
 	msg := toMessage(t, response.Body.String())
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID)))
 
 	// Publish large file as anonymous
 	response = request(t, s, "PUT", "/mytopic", largeFile, nil)
@@ -2208,7 +2894,7 @@ func TestServer_PublishAttachmentWithTierBasedLimits(t *testing.T) {
 		require.Equal(t, 200, response.Code)
 		msg = toMessage(t, response.Body.String())
 		require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-		require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+		require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID)))
 	}
 	response = request(t, s, "PUT", "/mytopic", largeFile, map[string]string{
 		"Authorization": util.BasicAuth("phil", "phil"),
@@ -3750,7 +4436,7 @@ func TestServer_DeleteScheduledMessage_WithAttachment(t *testing.T) {
 	require.NotNil(t, msg.Attachment)
 
 	// Verify attachment file exists
-	attachmentFile := filepath.Join(s.config.AttachmentCacheDir, msg.ID)
+	attachmentFile := filepath.Join(s.config.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID))
 	require.FileExists(t, attachmentFile)
 
 	// Delete the scheduled message
@@ -3769,6 +4455,7 @@ func newTestConfig(t *testing.T) *Config {
 	conf.CacheFile = filepath.Join(t.TempDir(), "cache.db")
 	conf.CacheStartupQueries = "pragma journal_mode = WAL; pragma synchronous = normal; pragma temp_store = memory;"
 	conf.AttachmentCacheDir = t.TempDir()
+	conf.AttachmentBlobGracePeriod = 0 // Unreferenced attachment blobs are pruned right away
 	conf.TemplateDir = t.TempDir()
 	return conf
 }
@@ -3777,6 +4464,8 @@ func configureAuth(t *testing.T, conf *Config) *Config {
 	conf.AuthFile = filepath.Join(t.TempDir(), "user.db")
 	conf.AuthStartupQueries = "pragma journal_mode = WAL; pragma synchronous = normal; pragma temp_store = memory;"
 	conf.AuthBcryptCost = bcrypt.MinCost // This speeds up tests a lot
+	conf.AuthPasswordMinLength = 0       // Most tests use short passwords, e.g. "phil"/"phil"
+	conf.AuthPasswordDisallowUsername = false
 	return conf
 }
 
@@ -3844,6 +4533,13 @@ func toMessage(t *testing.T, s string) *message {
 	return &m
 }
 
+// toAttachmentFileID returns the ID of the stored file of a message's attachment, see attachmentFileID
+func toAttachmentFileID(t *testing.T, s *Server, messageID string) string {
+	m, err := s.messageCache.Message(messageID)
+	require.Nil(t, err)
+	return attachmentFileID(m)
+}
+
 func toHTTPError(t *testing.T, s string) *errHTTP {
 	var e errHTTP
 	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&e))
@@ -4058,3 +4754,1439 @@ func TestServer_HandleError_SkipsWriteHeaderOnHijackedConnection(t *testing.T) {
 		require.True(t, mock.writeHeaderHit, "WriteHeader should be called for error: %s", err.Error())
 	}
 }
+
+func TestServer_KeyDirectory(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("eve", "eve", user.RoleUser, false))
+	require.Nil(t, s.userManager.SetDMTopicMeta("dm-phil-ben", "phil", "ben"))
+
+	// Publish keys for phil's laptop
+	response := request(t, s, "PUT", "/v1/coop/keys/devices/laptop", `{"identity_key":"aWRlbnRpdHk=","signed_prekey_id":7,"signed_prekey":"c2lnbmVk","signed_prekey_signature":"c2ln","one_time_prekeys":[{"key_id":1,"public_key":"b3RrMQ=="}]}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	published, err := util.UnmarshalJSON[apiKeysPublishResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "laptop", published.DeviceID)
+	require.Equal(t, 1, published.OneTimePrekeys)
+	require.Equal(t, 64, len(published.Fingerprint))
+
+	// Invalid keys, device IDs and anonymous requests are rejected
+	response = request(t, s, "PUT", "/v1/coop/keys/devices/phone", `{"identity_key":"???","signed_prekey":"c2lnbmVk","signed_prekey_signature":"c2ln"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40058, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/v1/coop/keys/devices/a.b", `{}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "GET", "/v1/coop/keys/users/phil", "", nil)
+	require.Equal(t, 401, response.Code)
+
+	// Ben lists phil's devices without consuming prekeys
+	response = request(t, s, "GET", "/v1/coop/keys/users/phil", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	devices, err := util.UnmarshalJSON[apiKeysDevicesResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(devices.Devices))
+	require.Equal(t, "aWRlbnRpdHk=", devices.Devices[0].IdentityKey)
+	require.Equal(t, 1, devices.Devices[0].OneTimePrekeys)
+	response = request(t, s, "GET", "/v1/coop/keys/users/nobody", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 404, response.Code)
+
+	// Strangers cannot claim bundles, and thereby drain the one-time prekeys
+	response = request(t, s, "POST", "/v1/coop/keys/users/phil/bundles", "", map[string]string{
+		"Authorization": util.BasicAuth("eve", "eve"),
+	})
+	require.Equal(t, 403, response.Code)
+
+	// Ben claims bundles: the first one includes the one-time prekey, the second does not
+	response = request(t, s, "POST", "/v1/coop/keys/users/phil/bundles", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	bundles, err := util.UnmarshalJSON[apiKeysBundlesResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(bundles.Bundles))
+	require.Equal(t, int64(7), bundles.Bundles[0].SignedPrekeyID)
+	require.Equal(t, "b3RrMQ==", bundles.Bundles[0].OneTimePrekey.PublicKey)
+	response = request(t, s, "POST", "/v1/coop/keys/users/phil/bundles?device=laptop", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	bundles, err = util.UnmarshalJSON[apiKeysBundlesResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Nil(t, bundles.Bundles[0].OneTimePrekey)
+	response = request(t, s, "POST", "/v1/coop/keys/users/phil/bundles?device=phone", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 404, response.Code)
+
+	// The DM list includes the partner's device fingerprints
+	response = request(t, s, "GET", "/v1/coop/dm", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	dms, err := util.UnmarshalJSON[[]*apiDMListEntry](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(*dms))
+	require.Equal(t, published.Fingerprint, (*dms)[0].Devices[0].Fingerprint)
+
+	// Removing the device, and the audit trail
+	response = request(t, s, "DELETE", "/v1/coop/keys/devices/laptop", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/v1/coop/keys/devices/laptop", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 404, response.Code)
+	entries, err := s.userManager.AuditEntries(&user.AuditFilter{Action: "keys"})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, auditActionKeysDelete, entries[0].Action)
+	require.Equal(t, auditActionKeysPublish, entries[1].Action)
+}
+
+func TestServer_PublishEnvelope(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "dm-phil-ben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("ben", "dm-phil-ben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.SetDMTopicMeta("dm-phil-ben", "phil", "ben"))
+	phil, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	_, err = s.userManager.PublishDeviceKeys(phil.ID, &user.DeviceKeys{DeviceID: "laptop", IdentityKey: "aWQ=", SignedPrekey: "c3Br", SignedPrekeySignature: "c2ln"}, nil)
+	require.Nil(t, err)
+
+	// Publish an encrypted message for ben's phone and phil's tablet
+	envelopeHeaders := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Content-Type":  envelopeContentType,
+	}
+	body := `{"v":1,"sender_device":"laptop","recipients":[{"user":"ben","device":"phone","type":3,"ciphertext":"Zm9yIGJlbg=="},{"user":"phil","device":"tablet","ciphertext":"Zm9yIHBoaWw="}]}`
+	response := request(t, s, "PUT", "/dm-phil-ben", body, envelopeHeaders)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, envelopePlaceholderMessage, msg.Message)
+	require.Equal(t, envelopeContentType, msg.ContentType)
+	require.Equal(t, 0, len(msg.Envelope.Recipients)) // Publisher did not identify a recipient device
+
+	// Stored as is, without HTML rendering
+	stored, err := s.messageCache.Message(msg.ID)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(stored.Envelope.Recipients))
+	require.Equal(t, "", stored.HTML)
+
+	// Each device only gets its own ciphertext
+	response = request(t, s, "GET", "/dm-phil-ben/json?poll=1&device=phone", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	msg = toMessage(t, response.Body.String())
+	require.Equal(t, "laptop", msg.Envelope.SenderDevice)
+	require.Equal(t, []*envelopeRecipient{{User: "ben", Device: "phone", Type: 3, Ciphertext: "Zm9yIGJlbg=="}}, msg.Envelope.Recipients)
+	require.NotContains(t, response.Body.String(), "Zm9yIHBoaWw=")
+	response = request(t, s, "GET", "/dm-phil-ben/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+		"X-Device":      "tablet", // Not ben's device
+	})
+	require.Equal(t, 200, response.Code)
+	msg = toMessage(t, response.Body.String())
+	require.Equal(t, 0, len(msg.Envelope.Recipients))
+
+	// Replies to encrypted messages do not leak a preview
+	response = request(t, s, "PUT", "/dm-phil-ben", "plain reply", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+		"X-Reply-To":    msg.ID,
+	})
+	require.Equal(t, 200, response.Code)
+	reply := toMessage(t, response.Body.String())
+	require.Equal(t, msg.ID, reply.ReplyTo)
+	require.Equal(t, "", reply.ReplyToText)
+
+	// Invalid envelopes
+	for _, invalid := range []string{
+		`not json`,
+		`{"v":2,"sender_device":"laptop","recipients":[{"user":"ben","device":"phone","ciphertext":"eA=="}]}`,
+		`{"v":1,"sender_device":"laptop","recipients":[]}`,
+		`{"v":1,"sender_device":"laptop","recipients":[{"user":"ben","device":"phone","ciphertext":"not base64!"}]}`,
+		`{"v":1,"sender_device":"laptop","recipients":[{"user":"ben","device":"phone","ciphertext":"eA=="},{"user":"ben","device":"phone","ciphertext":"eA=="}]}`,
+		`{"v":1,"sender_device":"phone","recipients":[{"user":"ben","device":"phone","ciphertext":"eA=="}]}`, // Not phil's device
+	} {
+		response = request(t, s, "PUT", "/dm-phil-ben", invalid, envelopeHeaders)
+		require.Equal(t, 400, response.Code, invalid)
+		require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+	}
+
+	// Envelopes may exceed the message size limit, but not the envelope size limit
+	large := `{"v":1,"sender_device":"laptop","recipients":[{"user":"ben","device":"phone","ciphertext":"` + strings.Repeat("A", 8000) + `"}]}`
+	response = request(t, s, "PUT", "/dm-phil-ben", large, envelopeHeaders)
+	require.Equal(t, 200, response.Code)
+	require.Nil(t, toMessage(t, response.Body.String()).Attachment)
+	s.config.EnvelopeSizeLimit = 1024
+	response = request(t, s, "PUT", "/dm-phil-ben", large, envelopeHeaders)
+	require.Equal(t, 413, response.Code)
+}
+
+func TestServer_KeyBackup(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.KeyBackupSizeLimit = 16
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	auth := util.BasicAuth("phil", "phil")
+
+	// No backup yet, invalid and too large backups
+	response := request(t, s, "GET", "/v1/coop/keys/backup", "", map[string]string{"Authorization": auth})
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "PUT", "/v1/coop/keys/backup", `{"version":1,"kdf":"argon2id","verifier":"","data":"ZW5jcnlwdGVk"}`, map[string]string{"Authorization": auth})
+	require.Equal(t, 40060, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/v1/coop/keys/backup", `{"version":1,"kdf":"argon2id","verifier":"v1","data":"dGhpcyBpcyB3YXkgdG9vIGxhcmdlIGZvciB0aGUgbGltaXQ="}`, map[string]string{"Authorization": auth})
+	require.Equal(t, 41305, toHTTPError(t, response.Body.String()).Code)
+
+	// Store backup, metadata is readable without verifier, data only with verifier
+	response = request(t, s, "PUT", "/v1/coop/keys/backup", `{"version":1,"kdf":"argon2id","verifier":"v1","data":"ZW5jcnlwdGVk"}`, map[string]string{"Authorization": auth})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/v1/coop/keys/backup", "", map[string]string{"Authorization": auth})
+	require.Equal(t, 200, response.Code)
+	backup, err := util.UnmarshalJSON[apiKeyBackupResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "argon2id", backup.KDF)
+	require.Equal(t, "", backup.Data)
+	require.Equal(t, int64(9), backup.Size)
+	require.Equal(t, user.KeyBackupFailureLimit, backup.AttemptsLeft)
+	response = request(t, s, "GET", "/v1/coop/keys/backup", "", map[string]string{"Authorization": auth, "X-Backup-Verifier": "v1"})
+	require.Equal(t, 200, response.Code)
+	backup, err = util.UnmarshalJSON[apiKeyBackupResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "ZW5jcnlwdGVk", backup.Data)
+
+	// Wrong verifiers eventually lock the backup
+	for i := 0; i < user.KeyBackupFailureLimit; i++ {
+		response = request(t, s, "GET", "/v1/coop/keys/backup", "", map[string]string{"Authorization": auth, "X-Backup-Verifier": "wrong"})
+		require.Equal(t, 40302, toHTTPError(t, response.Body.String()).Code)
+	}
+	response = request(t, s, "GET", "/v1/coop/keys/backup", "", map[string]string{"Authorization": auth, "X-Backup-Verifier": "v1"})
+	require.Equal(t, 42914, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/v1/coop/keys/backup", "", map[string]string{"Authorization": auth})
+	require.Equal(t, 200, response.Code)
+	backup, err = util.UnmarshalJSON[apiKeyBackupResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, 0, backup.AttemptsLeft)
+
+	// Delete, and the audit trail
+	response = request(t, s, "DELETE", "/v1/coop/keys/backup", "", map[string]string{"Authorization": auth})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/v1/coop/keys/backup", "", map[string]string{"Authorization": auth})
+	require.Equal(t, 404, response.Code)
+	entries, err := s.userManager.AuditEntries(&user.AuditFilter{Action: "keys.backup"})
+	require.Nil(t, err)
+	require.Equal(t, 2+user.KeyBackupFailureLimit+2, len(entries))
+	require.Equal(t, auditActionKeyBackupDelete, entries[0].Action)
+	require.Equal(t, auditActionKeyBackupLocked, entries[1].Action)
+	require.Equal(t, auditActionKeyBackupFailure, entries[2].Action)
+	require.Equal(t, auditActionKeyBackupFetch, entries[len(entries)-2].Action)
+	require.Equal(t, auditActionKeyBackupUpdate, entries[len(entries)-1].Action)
+}
+
+func TestServer_ContactVerification(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("alice", "alice", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddContact("phil", "ben", user.ContactStatusAccepted))
+	require.Nil(t, s.userManager.AddContact("ben", "phil", user.ContactStatusAccepted))
+	require.Nil(t, s.userManager.SetDMTopicMeta("dm-phil-ben", "phil", "ben"))
+	require.Nil(t, s.userManager.SetTopicMeta("grp_friends", "Friends", "", "", "phil"))
+	for _, username := range []string{"phil", "ben"} {
+		require.Nil(t, s.userManager.AllowAccess(username, "dm-phil-ben", user.PermissionReadWrite))
+		require.Nil(t, s.userManager.AllowAccess(username, "grp_friends", user.PermissionReadWrite))
+	}
+
+	// Ben publishes keys for his phone
+	response := request(t, s, "PUT", "/v1/coop/keys/devices/phone", `{"identity_key":"aWRlbnRpdHk=","signed_prekey_id":1,"signed_prekey":"c2lnbmVk","signed_prekey_signature":"c2ln"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	published, err := util.UnmarshalJSON[apiKeysPublishResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+
+	// Only accepted contacts can be verified
+	response = request(t, s, "GET", "/v1/coop/contacts/ben/verification", "", map[string]string{
+		"Authorization": util.BasicAuth("alice", "alice"),
+	})
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "GET", "/v1/coop/contacts/ben/verification", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	verification, err := util.UnmarshalJSON[apiContactVerificationResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.False(t, verification.Verified)
+	require.Equal(t, 1, len(verification.Devices))
+	require.Equal(t, user.VerificationStatusUnverified, verification.Devices[0].Status)
+
+	// Verify with a stale fingerprint, then with the right one
+	response = request(t, s, "PUT", "/v1/coop/contacts/ben/verification", `{"devices":[{"device_id":"phone","fingerprint":"abc"}]}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 40907, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/v1/coop/contacts/ben/verification", `{"devices":[{"device_id":"phone","fingerprint":"`+published.Fingerprint+`"}]}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	verification, err = util.UnmarshalJSON[apiContactVerificationResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.True(t, verification.Verified)
+
+	// Ben replaces his phone's identity key: verification is invalidated, and key change events are emitted
+	response = request(t, s, "PUT", "/v1/coop/keys/devices/phone", `{"identity_key":"bmV3aWRlbnRpdHk=","signed_prekey_id":2,"signed_prekey":"c2lnbmVk","signed_prekey_signature":"c2ln"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	published, err = util.UnmarshalJSON[apiKeysPublishResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.True(t, published.IdentityChanged)
+
+	response = request(t, s, "GET", "/v1/coop/contacts/ben/verification", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	verification, err = util.UnmarshalJSON[apiContactVerificationResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.False(t, verification.Verified)
+	require.Equal(t, user.VerificationStatusChanged, verification.Devices[0].Status)
+
+	keyChangeEvents := func(topic string) []*apiKeyChangeEvent {
+		response := request(t, s, "GET", "/"+topic+"/json?poll=1", "", map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, response.Code)
+		events := make([]*apiKeyChangeEvent, 0)
+		for _, m := range toMessages(t, response.Body.String()) {
+			require.Equal(t, coopKeyChangeEvent, m.Event)
+			require.Equal(t, "ben", m.SenderName)
+			event, err := util.UnmarshalJSON[apiKeyChangeEvent](io.NopCloser(strings.NewReader(m.Message)))
+			require.Nil(t, err)
+			events = append(events, event)
+		}
+		return events
+	}
+	for _, topic := range []string{"dm-phil-ben", "grp_friends"} {
+		events := keyChangeEvents(topic)
+		require.Len(t, events, 2) // The phone was added, then its key was replaced
+		require.Equal(t, "phone", events[1].DeviceID)
+		require.Equal(t, published.Fingerprint, events[1].Fingerprint)
+	}
+
+	// Adding a device, and removing and re-adding one, also changes the set of identity keys
+	response = request(t, s, "PUT", "/v1/coop/keys/devices/tablet", `{"identity_key":"dGFibGV0","signed_prekey_id":1,"signed_prekey":"c2lnbmVk","signed_prekey_signature":"c2ln"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	tablet, err := util.UnmarshalJSON[apiKeysPublishResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.True(t, tablet.IdentityChanged)
+	response = request(t, s, "DELETE", "/v1/coop/keys/devices/phone", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/v1/coop/keys/devices/phone", `{"identity_key":"YXR0YWNrZXI=","signed_prekey_id":1,"signed_prekey":"c2lnbmVk","signed_prekey_signature":"c2ln"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	readded, err := util.UnmarshalJSON[apiKeysPublishResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.True(t, readded.IdentityChanged)
+	events := keyChangeEvents("dm-phil-ben")
+	require.Len(t, events, 5)
+	require.Equal(t, &apiKeyChangeEvent{Username: "ben", DeviceID: "tablet", Fingerprint: tablet.Fingerprint}, events[2])
+	require.Equal(t, &apiKeyChangeEvent{Username: "ben", DeviceID: "phone", Removed: true}, events[3])
+	require.Equal(t, &apiKeyChangeEvent{Username: "ben", DeviceID: "phone", Fingerprint: readded.Fingerprint}, events[4])
+
+	// Refreshing the keys of a device without changing its identity key does not
+	response = request(t, s, "PUT", "/v1/coop/keys/devices/phone", `{"identity_key":"YXR0YWNrZXI=","signed_prekey_id":2,"signed_prekey":"c2lnbmVkMg==","signed_prekey_signature":"c2ln"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Len(t, keyChangeEvents("dm-phil-ben"), 5)
+
+	// Re-verify all devices, and reset
+	response = request(t, s, "PUT", "/v1/coop/contacts/ben/verification", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	verification, err = util.UnmarshalJSON[apiContactVerificationResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.True(t, verification.Verified)
+	response = request(t, s, "DELETE", "/v1/coop/contacts/ben/verification", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	devices, err := s.userManager.ContactDevices("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, user.VerificationStatusUnverified, devices[0].Status)
+}
+
+func TestServer_ContactBlock(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	for _, username := range []string{"phil", "ben", "alice"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess(username, "grp_friends", user.PermissionReadWrite))
+	}
+	require.Nil(t, s.userManager.SetDMTopicMeta("dm_philben", "phil", "ben"))
+	require.Nil(t, s.userManager.AllowAccess("phil", "dm_philben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("ben", "dm_philben", user.PermissionReadWrite))
+	ben, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.UpdateProfileLastSeen(ben.ID, time.Now().Unix()))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	aliceAuth := map[string]string{"Authorization": util.BasicAuth("alice", "alice")}
+
+	// Ben blocks phil
+	response := request(t, s, "POST", "/v1/coop/contacts/phil/block", "", benAuth)
+	require.Equal(t, 200, response.Code)
+
+	// The DM is read-only for phil, but not for ben
+	response = request(t, s, "PUT", "/dm_philben", "hi ben", philAuth)
+	require.Equal(t, 40303, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/dm_philben", "go away", benAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/coop/nudge", `{"topic":"dm_philben"}`, philAuth)
+	require.Equal(t, 40303, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/coop/commands", `{"command":"gurr","topic":"dm_philben"}`, philAuth)
+	require.Equal(t, 40303, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/coop/typing", `{"topic":"dm_philben"}`, philAuth)
+	require.Equal(t, 200, response.Code) // Dropped silently
+
+	// Phil's group messages and typing events are not forwarded to ben, but to alice
+	benRR, aliceRR := httptest.NewRecorder(), httptest.NewRecorder()
+	benCancel := subscribe(t, s, "/grp_friends/json?auth="+base64.RawURLEncoding.EncodeToString([]byte(util.BasicAuth("ben", "ben"))), benRR)
+	aliceCancel := subscribe(t, s, "/grp_friends/json?auth="+base64.RawURLEncoding.EncodeToString([]byte(util.BasicAuth("alice", "alice"))), aliceRR)
+	response = request(t, s, "PUT", "/grp_friends", "hi all", philAuth)
+	require.Equal(t, 200, response.Code)
+	philMessage := toMessage(t, response.Body.String())
+	response = request(t, s, "POST", "/v1/coop/typing", `{"topic":"grp_friends"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/grp_friends", "hi from alice", aliceAuth)
+	require.Equal(t, 200, response.Code)
+	aliceMessage := toMessage(t, response.Body.String())
+	benCancel()
+	aliceCancel()
+	require.NotContains(t, benRR.Body.String(), "hi all")
+	require.NotContains(t, benRR.Body.String(), coopTypingEvent)
+	require.Contains(t, benRR.Body.String(), "hi from alice")
+	require.Contains(t, aliceRR.Body.String(), "hi all")
+	require.Contains(t, aliceRR.Body.String(), coopTypingEvent)
+
+	// History replay hides phil's group messages from ben, but keeps the DM history
+	response = request(t, s, "GET", "/grp_friends/json?poll=1", "", benAuth)
+	require.NotContains(t, response.Body.String(), "hi all")
+	require.Contains(t, response.Body.String(), "hi from alice")
+	response = request(t, s, "GET", "/grp_friends/json?poll=1", "", aliceAuth)
+	require.Contains(t, response.Body.String(), "hi all")
+
+	// Phil cannot react to ben's messages, and his reactions are hidden from ben
+	response = request(t, s, "PUT", "/grp_friends", "ben here", benAuth)
+	require.Equal(t, 200, response.Code)
+	benMessage := toMessage(t, response.Body.String())
+	response = request(t, s, "POST", "/v1/coop/messages/"+benMessage.ID+"/reactions", `{"emoji":"👍"}`, philAuth)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/v1/coop/messages/"+aliceMessage.ID+"/reactions", `{"emoji":"👍"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/coop/messages/"+philMessage.ID+"/reactions", `{"emoji":"🎉"}`, aliceAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/v1/coop/messages/"+aliceMessage.ID+"/reactions", "", benAuth)
+	require.Equal(t, 200, response.Code)
+	reactions, err := util.UnmarshalJSON[[]*apiReactionGroup](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Empty(t, *reactions)
+	response = request(t, s, "GET", "/v1/coop/messages/"+aliceMessage.ID+"/reactions", "", aliceAuth)
+	reactions, err = util.UnmarshalJSON[[]*apiReactionGroup](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, []string{"phil"}, (*reactions)[0].Users)
+	response = request(t, s, "GET", "/v1/coop/reactions?topic=grp_friends", "", benAuth)
+	require.Equal(t, 200, response.Code)
+	require.NotContains(t, response.Body.String(), `"phil"`)
+	require.Contains(t, response.Body.String(), `"alice"`)
+
+	// Ben's presence is hidden from phil, but not from alice
+	response = request(t, s, "GET", "/v1/coop/profiles?topic=grp_friends", "", philAuth)
+	require.Equal(t, 200, response.Code)
+	profiles, err := util.UnmarshalJSON[[]*user.Profile](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	for _, p := range *profiles {
+		if p.Username == "ben" {
+			require.Equal(t, int64(0), p.LastSeen)
+		}
+	}
+	response = request(t, s, "GET", "/v1/coop/profiles?topic=grp_friends", "", aliceAuth)
+	profiles, err = util.UnmarshalJSON[[]*user.Profile](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	for _, p := range *profiles {
+		if p.Username == "ben" {
+			require.True(t, p.LastSeen > 0)
+		}
+	}
+}
+
+func TestServer_ContactPatch(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	for _, username := range []string{"phil", "ben", "alice", "carol"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+	}
+	for _, username := range []string{"ben", "alice", "carol"} {
+		require.Nil(t, s.userManager.AddContact("phil", username, user.ContactStatusAccepted))
+		require.Nil(t, s.userManager.AddContact(username, "phil", user.ContactStatusAccepted))
+	}
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Set nickname, favorite and labels; unset fields are left alone
+	response := request(t, s, "PATCH", "/v1/coop/contacts/ben", `{"nickname":"Benny","favorite":true,"labels":["Work"," Family ","Work",""]}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	contact, err := util.UnmarshalJSON[user.Contact](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "Benny", contact.Nickname)
+	require.True(t, contact.Favorite)
+	require.Equal(t, []string{"Family", "Work"}, contact.Labels)
+	response = request(t, s, "PATCH", "/v1/coop/contacts/ben", `{"favorite":false}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	contact, err = util.UnmarshalJSON[user.Contact](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "Benny", contact.Nickname)
+	require.False(t, contact.Favorite)
+	require.Equal(t, []string{"Family", "Work"}, contact.Labels)
+	response = request(t, s, "PATCH", "/v1/coop/contacts/alice", `{"labels":["Work"]}`, philAuth)
+	require.Equal(t, 200, response.Code)
+
+	// Invalid requests
+	response = request(t, s, "PATCH", "/v1/coop/contacts/nobody", `{"nickname":"x"}`, philAuth)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "PATCH", "/v1/coop/contacts/carol", `{"labels":["`+strings.Repeat("x", 33)+`"]}`, philAuth)
+	require.Equal(t, 400, response.Code)
+
+	// Filter by label
+	response = request(t, s, "GET", "/v1/coop/contacts?label=Work", "", philAuth)
+	require.Equal(t, 200, response.Code)
+	contacts, err := util.UnmarshalJSON[[]*user.Contact](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Len(t, *contacts, 2)
+	response = request(t, s, "GET", "/v1/coop/contacts", "", philAuth)
+	require.Equal(t, 200, response.Code)
+	contacts, err = util.UnmarshalJSON[[]*user.Contact](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Len(t, *contacts, 3)
+
+	// Labels resolve to members when creating a group
+	response = request(t, s, "POST", "/v1/coop/groups", `{"name":"Office","labels":["Work"]}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	group, err := util.UnmarshalJSON[apiGroupCreateResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	for _, username := range []string{"ben", "alice"} {
+		u, err := s.userManager.User(username)
+		require.Nil(t, err)
+		require.Nil(t, s.userManager.Authorize(u, group.Topic, user.PermissionWrite))
+	}
+	carol, err := s.userManager.User("carol")
+	require.Nil(t, err)
+	require.Error(t, s.userManager.Authorize(carol, group.Topic, user.PermissionRead))
+	response = request(t, s, "POST", "/v1/coop/groups", `{"name":"Nobody","labels":["Gym"]}`, philAuth)
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_ContactsVCard(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	for _, username := range []string{"phil", "ben", "alice", "carol", "dave"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+	}
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	require.Nil(t, s.userManager.UpdateProfilePrivacy("carol", user.PrivacyInviteOnly))
+	require.Nil(t, s.userManager.UpdateProfilePrivacy("dave", user.PrivacyOpen))
+	for username, phoneNumber := range map[string]string{"carol": "+15551234567", "dave": "+4930123456"} {
+		u, err := s.userManager.User(username)
+		require.Nil(t, err)
+		require.Nil(t, s.userManager.AddPhoneNumber(u.ID, phoneNumber))
+	}
+
+	// Export, with nickname, labels and a long, folded display name
+	require.Nil(t, s.userManager.AddContact("phil", "alice", user.ContactStatusAccepted))
+	require.Nil(t, s.userManager.AddContact("alice", "phil", user.ContactStatusAccepted))
+	require.Nil(t, s.userManager.UpdateContact("phil", "alice", "Ali; the great", false, []string{"Work", "Family"}))
+	alice, err := s.userManager.User("alice")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.UpdateProfile(alice.ID, "Alice "+strings.Repeat("ä", 40), ""))
+	response := request(t, s, "GET", "/v1/coop/contacts/export.vcf", "", philAuth)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "text/vcard; charset=utf-8", response.Header().Get("Content-Type"))
+	export := response.Body.String()
+	require.True(t, strings.HasPrefix(export, "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Alice "))
+	require.Contains(t, export, "\r\nNICKNAME:Ali\\; the great\r\n")
+	require.Contains(t, export, "\r\nCATEGORIES:Family,Work\r\n")
+	require.Contains(t, export, "\r\nX-COOP-USERNAME:alice\r\n")
+	for _, line := range strings.Split(export, "\r\n") {
+		require.LessOrEqual(t, len(line), 75)
+	}
+	cards, err := parseVCards(export)
+	require.Nil(t, err)
+	require.Len(t, cards, 1)
+	require.Equal(t, []string{"alice"}, cards[0].Usernames)
+
+	// Ben imports phil's export plus cards from his phone: alice and phil are matched by username, dave by
+	// phone number; carol only accepts invites, so her phone number is not revealed
+	vcf := export + strings.Join([]string{
+		"BEGIN:VCARD", "VERSION:3.0", "FN:Phil", "X-COOP-USERNAME:phil", "END:VCARD",
+		"BEGIN:VCARD", "VERSION:3.0", "FN:Carol", "TEL;TYPE=CELL:+1 (555) 123-4567", "END:VCARD",
+		"BEGIN:VCARD", "VERSION:4.0", "FN:Dave", "item1.TEL;VALUE=uri;TYPE=\"voice,cell\":tel:0049-30-", " 123456", "END:VCARD",
+		"BEGIN:VCARD", "VERSION:3.0", "FN:Nobody", "TEL:+1 555 000 0000", "EMAIL:nobody@example.com", "END:VCARD",
+	}, "\n")
+	response = request(t, s, "POST", "/v1/coop/contacts/import", vcf, benAuth)
+	require.Equal(t, 200, response.Code)
+	result, err := util.UnmarshalJSON[apiContactImportResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, 2, result.Unmatched)
+	require.Len(t, result.Matched, 3)
+	require.Equal(t, "alice", result.Matched[0].Username)
+	require.Equal(t, user.ContactStatusPending, result.Matched[0].Status)
+	require.Equal(t, "phil", result.Matched[1].Username)
+	require.Equal(t, user.ContactStatusPending, result.Matched[1].Status)
+	require.Equal(t, "dave", result.Matched[2].Username)
+	require.Equal(t, user.ContactStatusAccepted, result.Matched[2].Status)
+
+	// Importing again reports the existing relationships
+	response = request(t, s, "POST", "/v1/coop/contacts/import", vcf, benAuth)
+	require.Equal(t, 200, response.Code)
+	result, err = util.UnmarshalJSON[apiContactImportResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Len(t, result.Matched, 3)
+	require.Contains(t, result.Matched[0].Error, "already exists")
+
+	// Invalid vCards
+	response = request(t, s, "POST", "/v1/coop/contacts/import", "BEGIN:VCARD\nFN:Phil\n", benAuth)
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_ContactsVCard_Limit(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.ContactLimit = 5
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	for _, username := range []string{"phil", "ben", "alice", "carol", "dave", "eve"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+	}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	vcf := ""
+	for _, username := range []string{"alice", "carol", "dave", "eve"} {
+		vcf += "BEGIN:VCARD\nVERSION:4.0\nFN:" + username + "\nX-COOP-USERNAME:" + username + "\nEND:VCARD\n"
+	}
+
+	// Contact requests and lookups share one daily limit: the request to phil, and a lookup and a
+	// request for alice and carol each; the remaining cards are skipped
+	response := request(t, s, "POST", "/v1/coop/contacts", `{"username":"phil"}`, benAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/coop/contacts/import", vcf, benAuth)
+	require.Equal(t, 200, response.Code)
+	result, err := util.UnmarshalJSON[apiContactImportResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Len(t, result.Matched, 2)
+	require.Equal(t, "alice", result.Matched[0].Username)
+	require.Equal(t, "carol", result.Matched[1].Username)
+	require.Equal(t, 2, result.Skipped)
+	status, err := s.userManager.ContactStatus("ben", "dave")
+	require.Nil(t, err)
+	require.Equal(t, "", status)
+
+	response = request(t, s, "POST", "/v1/coop/contacts", `{"username":"dave"}`, benAuth)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42918, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/coop/contacts/import", vcf, benAuth)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42918, toHTTPError(t, response.Body.String()).Code)
+
+	// The limit is reset daily
+	s.resetStats()
+	response = request(t, s, "POST", "/v1/coop/contacts", `{"username":"dave"}`, benAuth)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_ContactCard(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.CacheDuration = time.Hour
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	for _, username := range []string{"phil", "ben", "alice"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess(username, "grp_friends", user.PermissionReadWrite))
+	}
+	require.Nil(t, s.userManager.AddUser("carol", "carol", user.RoleUser, false))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	carolAuth := map[string]string{"Authorization": util.BasicAuth("carol", "carol")}
+	alice, err := s.userManager.User("alice")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.UpdateProfile(alice.ID, "Alice", ""))
+
+	// Phil shares alice's card in the group
+	response := request(t, s, "POST", "/v1/coop/contacts/card", `{"topic":"grp_friends","username":"alice"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/grp_friends/json?poll=1", "", benAuth)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, coopContactCardEvent, m.Event)
+	require.Equal(t, "phil", m.SenderName)
+	card, err := util.UnmarshalJSON[apiContactCard](io.NopCloser(strings.NewReader(m.Message)))
+	require.Nil(t, err)
+	require.Equal(t, "alice", card.Username)
+	require.Equal(t, "Alice", card.DisplayName)
+
+	// Adding the contact from the card is a regular contact request
+	response = request(t, s, "POST", "/v1/coop/contacts", `{"username":"`+card.Username+`"}`, benAuth)
+	require.Equal(t, 200, response.Code)
+	status, err := s.userManager.ContactStatus("ben", "alice")
+	require.Nil(t, err)
+	require.Equal(t, user.ContactStatusPending, status)
+
+	// No access to the topic, unknown user, or blocked
+	response = request(t, s, "POST", "/v1/coop/contacts/card", `{"topic":"grp_friends","username":"alice"}`, carolAuth)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/v1/coop/contacts/card", `{"topic":"grp_friends","username":"nobody"}`, philAuth)
+	require.Equal(t, 400, response.Code)
+	require.Nil(t, s.userManager.BlockContact("alice", "phil"))
+	response = request(t, s, "POST", "/v1/coop/contacts/card", `{"topic":"grp_friends","username":"alice"}`, philAuth)
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_ContactCard_MessageLimit(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.CacheDuration = time.Hour
+	c.VisitorMessageDailyLimit = 2
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	for _, username := range []string{"phil", "alice"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess(username, "grp_friends", user.PermissionReadWrite))
+	}
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Cards count towards the daily message limit, like regular messages
+	response := request(t, s, "PUT", "/grp_friends", "hi", philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/coop/contacts/card", `{"topic":"grp_friends","username":"alice"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/coop/contacts/card", `{"topic":"grp_friends","username":"alice"}`, philAuth)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/grp_friends", "hi again", philAuth)
+	require.Equal(t, 429, response.Code)
+
+	s.mu.RLock()
+	require.Equal(t, int64(2), s.messages)
+	s.mu.RUnlock()
+}
+
+func TestServer_Reports(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.CacheDuration = time.Hour
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin, false))
+	for _, username := range []string{"ben", "emma"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+		require.Nil(t, s.userManager.AllowAccess(username, "mytopic", user.PermissionReadWrite))
+	}
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	emmaAuth := map[string]string{"Authorization": util.BasicAuth("emma", "emma")}
+
+	// Listen on the sync topics of ben and emma for status updates and warnings
+	syncEvents := func(username string) chan *apiAccountSyncTopicResponse {
+		u, err := s.userManager.User(username)
+		require.Nil(t, err)
+		syncTopic, err := s.topicFromID(u.SyncTopic)
+		require.Nil(t, err)
+		events := make(chan *apiAccountSyncTopicResponse, 10)
+		syncTopic.Subscribe(func(v *visitor, m *message) error {
+			event, err := util.UnmarshalJSON[apiAccountSyncTopicResponse](io.NopCloser(strings.NewReader(m.Message)))
+			require.Nil(t, err)
+			events <- event
+			return nil
+		}, u.ID, func() {})
+		return events
+	}
+	benEvents, emmaEvents := syncEvents("ben"), syncEvents("emma")
+
+	response := request(t, s, "PUT", "/mytopic", "buy my stuff", emmaAuth)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	// Invalid reports
+	response = request(t, s, "POST", "/v1/coop/reports", `{"type":"message","topic":"mytopic","message_id":"`+m.ID+`","category":"nope"}`, benAuth)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "POST", "/v1/coop/reports", `{"type":"nope","category":"spam"}`, benAuth)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "POST", "/v1/coop/reports", `{"type":"message","topic":"othertopic","message_id":"`+m.ID+`","category":"spam"}`, benAuth)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/v1/coop/reports", `{"type":"message","topic":"mytopic","message_id":"doesnotexist","category":"spam"}`, benAuth)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "POST", "/v1/coop/reports", `{"type":"user","username":"ben","category":"spam"}`, benAuth)
+	require.Equal(t, 400, response.Code)
+
+	// Ben reports emma's message, and the whole topic
+	response = request(t, s, "POST", "/v1/coop/reports", `{"type":"message","topic":"mytopic","message_id":"`+m.ID+`","category":"spam","comment":"ads"}`, benAuth)
+	require.Equal(t, 200, response.Code)
+	messageReport, err := util.UnmarshalJSON[apiReportResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "emma", messageReport.Username)
+	require.Equal(t, string(user.ReportStatusOpen), messageReport.Status)
+	response = request(t, s, "POST", "/v1/coop/reports", `{"type":"group","topic":"mytopic","category":"other"}`, benAuth)
+	require.Equal(t, 200, response.Code)
+	groupReport, err := util.UnmarshalJSON[apiReportResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	response = request(t, s, "GET", "/v1/coop/reports", "", benAuth)
+	require.Equal(t, 200, response.Code)
+	ownReports, err := util.UnmarshalJSON[[]*apiReportResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Len(t, *ownReports, 2)
+
+	// Only admins can triage reports
+	response = request(t, s, "GET", "/v1/admin/reports", "", benAuth)
+	require.Equal(t, 401, response.Code)
+	adminReports := func(status string) []*apiAdminReport {
+		response := request(t, s, "GET", "/v1/admin/reports?status="+status, "", philAuth)
+		require.Equal(t, 200, response.Code)
+		reports, err := util.UnmarshalJSON[apiAdminReportsResponse](io.NopCloser(response.Body))
+		require.Nil(t, err)
+		return reports.Reports
+	}
+	require.Len(t, adminReports("open"), 2)
+
+	// Deleting the message keeps the evidence, and notifies the reporter
+	response = request(t, s, "PUT", "/v1/admin/reports/"+messageReport.ID, `{"action":"delete_message"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", benAuth)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, messageDeleteEvent, messages[0].Event)
+	require.Equal(t, m.ID, messages[0].SequenceID)
+	resolved := adminReports("resolved")
+	require.Len(t, resolved, 1)
+	require.Equal(t, "ben", resolved[0].Reporter)
+	require.Contains(t, string(resolved[0].Snapshot), "buy my stuff")
+	require.Len(t, resolved[0].Actions, 1)
+	require.Equal(t, reportActionDeleteMessage, resolved[0].Actions[0].Action)
+	require.Equal(t, "phil", resolved[0].Actions[0].Actor)
+	select {
+	case event := <-benEvents:
+		require.Equal(t, syncTopicReportStatusEvent, event.Event)
+		require.Equal(t, messageReport.ID, event.ReportID)
+		require.Equal(t, string(user.ReportStatusResolved), event.ReportStatus)
+	case <-time.After(time.Second):
+		t.Fatal("expected report status event")
+	}
+
+	// Warning and suspending the reported user are linked to the same report
+	response = request(t, s, "PUT", "/v1/admin/reports/"+messageReport.ID, `{"action":"warn","note":"no ads please"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	select {
+	case event := <-emmaEvents:
+		require.Equal(t, syncTopicAccountWarningEvent, event.Event)
+		require.Equal(t, "no ads please", event.Reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected account warning event")
+	}
+	response = request(t, s, "PUT", "/v1/admin/reports/"+messageReport.ID, `{"action":"suspend_user"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	report, err := util.UnmarshalJSON[apiAdminReport](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Len(t, report.Actions, 3)
+	emma, err := s.userManager.User("emma")
+	require.Nil(t, err)
+	require.True(t, emma.Suspended())
+	require.Equal(t, "reported for spam", emma.Suspension.Reason)
+	response = request(t, s, "GET", "/v1/account", "", emmaAuth)
+	require.Equal(t, 403, response.Code)
+
+	// Group reports are not about a message or user; dismissing notifies the reporter
+	response = request(t, s, "PUT", "/v1/admin/reports/"+groupReport.ID, `{"action":"delete_message"}`, philAuth)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "PUT", "/v1/admin/reports/"+groupReport.ID, `{"action":"warn"}`, philAuth)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "PUT", "/v1/admin/reports/"+groupReport.ID, `{"action":"nope"}`, philAuth)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "PUT", "/v1/admin/reports/"+groupReport.ID, `{"action":"dismiss"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	select {
+	case event := <-benEvents:
+		require.Equal(t, groupReport.ID, event.ReportID)
+		require.Equal(t, string(user.ReportStatusDismissed), event.ReportStatus)
+	case <-time.After(time.Second):
+		t.Fatal("expected report status event")
+	}
+	dismissed := adminReports("dismissed")
+	require.Len(t, dismissed, 1)
+	require.Contains(t, string(dismissed[0].Snapshot), "buy my stuff") // Snapshot was taken before the deletion
+	require.Empty(t, adminReports("open"))
+	response = request(t, s, "PUT", "/v1/admin/reports/re_doesnotexist", `{"action":"dismiss"}`, philAuth)
+	require.Equal(t, 404, response.Code)
+
+	entries, err := s.userManager.AuditEntries(&user.AuditFilter{Action: "admin.report"})
+	require.Nil(t, err)
+	require.Len(t, entries, 4)
+	entries, err = s.userManager.AuditEntries(&user.AuditFilter{Action: auditActionAdminUserSuspend})
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, messageReport.ID, entries[0].Detail["report"])
+}
+
+func TestServer_Reports_Snapshot(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.CacheDuration = time.Hour
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("admin", "admin", user.RoleAdmin, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "dm-phil-ben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("ben", "dm-phil-ben", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.SetDMTopicMeta("dm-phil-ben", "phil", "ben"))
+	phil, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	_, err = s.userManager.PublishDeviceKeys(phil.ID, &user.DeviceKeys{DeviceID: "laptop", IdentityKey: "aWQ=", SignedPrekey: "c3Br", SignedPrekeySignature: "c2ln"}, nil)
+	require.Nil(t, err)
+
+	// Phil sends an encrypted message, which ben reports
+	body := `{"v":1,"sender_device":"laptop","recipients":[{"user":"ben","device":"phone","type":3,"ciphertext":"Zm9yIGJlbg=="}]}`
+	response := request(t, s, "PUT", "/dm-phil-ben", body, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Content-Type":  envelopeContentType,
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	response = request(t, s, "POST", "/v1/coop/reports", `{"type":"message","topic":"dm-phil-ben","message_id":"`+m.ID+`","category":"harassment"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	created, err := util.UnmarshalJSON[apiReportResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+
+	// The snapshot only has the fields moderators need, and expires with the message
+	report, err := s.userManager.Report(created.ID)
+	require.Nil(t, err)
+	require.NotContains(t, report.Snapshot, "Zm9yIGJlbg==")
+	require.NotContains(t, report.Snapshot, `"envelope":`)
+	require.Contains(t, report.Snapshot, `"sender":"phil"`)
+	require.Equal(t, m.Expires, report.SnapshotExpires.Unix())
+
+	// The message expires while the report is still open: the snapshot is kept for the moderators
+	expired := strings.Replace(report.Snapshot, fmt.Sprintf(`"expires":%d`, m.Expires), `"expires":1`, 1)
+	require.Nil(t, s.userManager.SetReportSnapshot(report.ID, expired, time.Unix(1, 0)))
+	s.pruneReportSnapshots()
+	report, err = s.userManager.Report(created.ID)
+	require.Nil(t, err)
+	require.Equal(t, expired, report.Snapshot)
+	response = request(t, s, "GET", "/v1/admin/reports", "", map[string]string{
+		"Authorization": util.BasicAuth("admin", "admin"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Contains(t, response.Body.String(), `"sender":"phil"`)
+
+	// Once the report is dismissed, the expired message is removed from the snapshot, but the report is kept
+	response = request(t, s, "PUT", "/v1/admin/reports/"+created.ID, `{"action":"dismiss"}`, map[string]string{
+		"Authorization": util.BasicAuth("admin", "admin"),
+	})
+	require.Equal(t, 200, response.Code)
+	s.pruneReportSnapshots()
+	report, err = s.userManager.Report(created.ID)
+	require.Nil(t, err)
+	require.Equal(t, "[]", report.Snapshot)
+	require.True(t, report.SnapshotExpires.IsZero())
+}
+
+func TestServer_DMRequest(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.DMRequestMessageLimit = 2
+	c.CacheDuration = time.Hour
+	c.AttachmentFileSizeLimit = 5000
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	for _, username := range []string{"phil", "ben", "alice"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+	}
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	aliceAuth := map[string]string{"Authorization": util.BasicAuth("alice", "alice")}
+	response := request(t, s, "PATCH", "/v1/coop/profile", `{"privacy":"open"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+
+	subscribed := func(username, topic string) bool {
+		u, err := s.userManager.User(username)
+		require.Nil(t, err)
+		return u.Prefs != nil && slices.ContainsFunc(u.Prefs.Subscriptions, func(sub *user.Subscription) bool { return sub.Topic == topic })
+	}
+	dmTopics := func(auth map[string]string) []string {
+		response := request(t, s, "GET", "/v1/coop/dm", "", auth)
+		require.Equal(t, 200, response.Code)
+		entries, err := util.UnmarshalJSON[[]*apiDMListEntry](io.NopCloser(response.Body))
+		require.Nil(t, err)
+		topics := make([]string, 0)
+		for _, entry := range *entries {
+			topics = append(topics, entry.Topic)
+		}
+		return topics
+	}
+	dmRequests := func(auth map[string]string) []*apiDMRequestEntry {
+		response := request(t, s, "GET", "/v1/coop/dm/requests", "", auth)
+		require.Equal(t, 200, response.Code)
+		entries, err := util.UnmarshalJSON[[]*apiDMRequestEntry](io.NopCloser(response.Body))
+		require.Nil(t, err)
+		return *entries
+	}
+
+	// Ben is not a contact of phil, so his DM is a message request
+	response = request(t, s, "POST", "/v1/coop/dm", `{"username":"phil"}`, benAuth)
+	require.Equal(t, 200, response.Code)
+	dm, err := util.UnmarshalJSON[apiDMCreateResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.True(t, subscribed("ben", dm.Topic))
+	require.False(t, subscribed("phil", dm.Topic))
+	require.Equal(t, []string{dm.Topic}, dmTopics(benAuth))
+	require.Empty(t, dmTopics(philAuth))
+
+	// Ben may send two messages until phil accepts, failed messages are not counted
+	response = request(t, s, "PUT", "/"+dm.Topic, strings.Repeat("x", 6000), benAuth)
+	require.Equal(t, 413, response.Code)
+	for _, msg := range []string{"hi phil", "are you there?"} {
+		response = request(t, s, "PUT", "/"+dm.Topic, msg, benAuth)
+		require.Equal(t, 200, response.Code)
+	}
+	response = request(t, s, "PUT", "/"+dm.Topic, "hello??", benAuth)
+	require.Equal(t, 40304, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/coop/nudge", `{"topic":"`+dm.Topic+`"}`, benAuth)
+	require.Equal(t, 40304, toHTTPError(t, response.Body.String()).Code)
+
+	requests := dmRequests(philAuth)
+	require.Len(t, requests, 1)
+	require.Equal(t, dm.Topic, requests[0].Topic)
+	require.Equal(t, "ben", requests[0].Partner)
+	require.Equal(t, 2, requests[0].MessageCount)
+	require.Empty(t, dmRequests(benAuth))
+
+	// Only phil can accept
+	response = request(t, s, "POST", "/v1/coop/dm/requests/"+dm.Topic+"/accept", "", benAuth)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "POST", "/v1/coop/dm/requests/"+dm.Topic+"/accept", "", philAuth)
+	require.Equal(t, 200, response.Code)
+	require.True(t, subscribed("phil", dm.Topic))
+	require.Equal(t, []string{dm.Topic}, dmTopics(philAuth))
+	require.Empty(t, dmRequests(philAuth))
+	response = request(t, s, "PUT", "/"+dm.Topic, "hello??", benAuth)
+	require.Equal(t, 200, response.Code)
+
+	// Alice's request is declined, which deletes the DM
+	response = request(t, s, "POST", "/v1/coop/dm", `{"username":"phil"}`, aliceAuth)
+	require.Equal(t, 200, response.Code)
+	dm, err = util.UnmarshalJSON[apiDMCreateResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	response = request(t, s, "PUT", "/"+dm.Topic, "buy my stuff", aliceAuth)
+	require.Equal(t, 200, response.Code)
+	messages, err := s.messageCache.Messages(dm.Topic, sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+	response = request(t, s, "POST", "/v1/coop/dm/requests/"+dm.Topic+"/decline", "", philAuth)
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, dmRequests(philAuth))
+	require.False(t, subscribed("alice", dm.Topic))
+	topic, err := s.userManager.FindDMTopic("alice", "phil")
+	require.Nil(t, err)
+	require.Equal(t, "", topic)
+	messages, err = s.messageCache.Messages(dm.Topic, sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	response = request(t, s, "PUT", "/"+dm.Topic, "hello?", aliceAuth)
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_DMRequest_ConcurrentMessages(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.DMRequestMessageLimit = 2
+	c.CacheDuration = time.Hour
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser, false))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	response := request(t, s, "PATCH", "/v1/coop/profile", `{"privacy":"open"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/coop/dm", `{"username":"phil"}`, benAuth)
+	require.Equal(t, 200, response.Code)
+	dm, err := util.UnmarshalJSON[apiDMCreateResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+
+	// Concurrent messages cannot exceed the limit
+	var wg sync.WaitGroup
+	var sent atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if request(t, s, "PUT", "/"+dm.Topic, "hi phil", benAuth).Code == 200 {
+				sent.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), sent.Load())
+	messages, err := s.messageCache.Messages(dm.Topic, sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Len(t, messages, 2)
+}
+
+func TestServer_ContactInvite(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.BaseURL = "https://coop.example.com"
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	for _, username := range []string{"phil", "ben", "alice"} {
+		require.Nil(t, s.userManager.AddUser(username, username, user.RoleUser, false))
+	}
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+
+	// Phil only accepts contacts via invite
+	response := request(t, s, "PATCH", "/v1/coop/profile", `{"privacy":"invite_only"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/coop/contacts", `{"username":"phil"}`, benAuth)
+	require.Equal(t, 403, response.Code)
+
+	// Phil creates a single-use invite
+	response = request(t, s, "POST", "/v1/coop/contact-invites", `{"max_uses":1}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	invite, err := util.UnmarshalJSON[apiContactInviteResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "https://coop.example.com/contact/"+invite.Token, invite.URL)
+	require.True(t, invite.Expires > time.Now().Unix())
+
+	// Anyone with the token can see who it is from, and render the QR code
+	response = request(t, s, "GET", "/v1/coop/contact-invites/"+invite.Token, "", nil)
+	require.Equal(t, 200, response.Code)
+	info, err := util.UnmarshalJSON[apiContactInviteInfoResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "phil", info.Username)
+	require.True(t, info.Available)
+	response = request(t, s, "GET", "/v1/coop/contact-invites/"+invite.Token+"/qr.png?size=128", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "image/png", response.Header().Get("Content-Type"))
+	img, err := png.Decode(response.Body)
+	require.Nil(t, err)
+	require.Equal(t, 128, img.Bounds().Dx())
+	response = request(t, s, "GET", "/v1/coop/contact-invites/"+invite.Token+"/qr.svg", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "image/svg+xml", response.Header().Get("Content-Type"))
+	require.True(t, strings.HasPrefix(response.Body.String(), "<svg"))
+
+	// Phil cannot redeem his own invite; ben redeems it and opens a DM
+	response = request(t, s, "POST", "/v1/coop/contact-invites/"+invite.Token+"/redeem", "", philAuth)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "POST", "/v1/coop/contact-invites/"+invite.Token+"/redeem", `{"dm":true}`, benAuth)
+	require.Equal(t, 200, response.Code)
+	redeemed, err := util.UnmarshalJSON[apiContactInviteRedeemResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "phil", redeemed.Username)
+	require.True(t, isDMTopic(redeemed.Topic))
+	for _, pair := range [][]string{{"phil", "ben"}, {"ben", "phil"}} {
+		status, err := s.userManager.ContactStatus(pair[0], pair[1])
+		require.Nil(t, err)
+		require.Equal(t, user.ContactStatusAccepted, status)
+	}
+	response = request(t, s, "PUT", "/"+redeemed.Topic, "hi phil", benAuth)
+	require.Equal(t, 200, response.Code)
+
+	// The invite is used up
+	response = request(t, s, "POST", "/v1/coop/contact-invites/"+invite.Token+"/redeem", "", map[string]string{
+		"Authorization": util.BasicAuth("alice", "alice"),
+	})
+	require.Equal(t, 40052, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/v1/coop/contact-invites/"+invite.Token+"/qr.svg", "", nil)
+	require.Equal(t, 40052, toHTTPError(t, response.Body.String()).Code)
+
+	// List and revoke
+	response = request(t, s, "GET", "/v1/coop/contact-invites", "", philAuth)
+	require.Equal(t, 200, response.Code)
+	invites, err := util.UnmarshalJSON[[]*apiContactInviteResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(*invites))
+	require.Equal(t, 1, (*invites)[0].UsedCount)
+	response = request(t, s, "DELETE", "/v1/coop/contact-invites/"+invite.Token, "", benAuth)
+	require.Equal(t, 40050, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "DELETE", "/v1/coop/contact-invites/"+invite.Token, "", philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/v1/coop/contact-invites/"+invite.Token, "", nil)
+	require.Equal(t, 40050, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_AvatarUpload(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="file"; filename="avatar.png"`)
+		header.Set("Content-Type", "image/png") // Not trusted
+		part, err := mw.CreatePart(header)
+		require.Nil(t, err)
+		_, err = part.Write(data)
+		require.Nil(t, err)
+		require.Nil(t, mw.Close())
+		return request(t, s, "PUT", "/v1/coop/profile/avatar", body.String(), map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+			"Content-Type":  mw.FormDataContentType(),
+		})
+	}
+
+	// Not an image
+	response := upload([]byte("<svg onload=alert(1)>"))
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+
+	// JPEG is detected, cropped and re-encoded
+	response = upload(newTestJPEG(t, 800, 600, 1, "GPS 48.2082N 16.3738E"))
+	require.Equal(t, 200, response.Code)
+	avatar, err := util.UnmarshalJSON[map[string]string](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	avatarURL := (*avatar)["avatar_url"]
+	require.True(t, strings.HasSuffix(avatarURL, ".jpg"))
+
+	for _, size := range []int{256, 64} {
+		response = request(t, s, "GET", fmt.Sprintf("%s?size=%d", avatarURL, size), "", nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, "image/jpeg", response.Header().Get("Content-Type"))
+		require.Equal(t, "public, max-age=31536000, immutable", response.Header().Get("Cache-Control"))
+		require.NotContains(t, response.Body.String(), "GPS 48.2082N")
+		img, err := jpeg.Decode(response.Body)
+		require.Nil(t, err)
+		require.Equal(t, image.Rect(0, 0, size, size), img.Bounds())
+	}
+
+	// Default size, and conditional requests
+	response = request(t, s, "GET", avatarURL, "", nil)
+	require.Equal(t, 200, response.Code)
+	etag := response.Header().Get("ETag")
+	require.Equal(t, strconv.Quote(strings.TrimPrefix(avatarURL, "/v1/coop/profile/avatar/")), etag)
+	response = request(t, s, "GET", avatarURL, "", map[string]string{"If-None-Match": etag})
+	require.Equal(t, 304, response.Code)
+	require.Empty(t, response.Body.String())
+	response = request(t, s, "GET", avatarURL+"?size=64", "", map[string]string{"If-None-Match": etag})
+	require.Equal(t, 200, response.Code)
+	require.NotEqual(t, etag, response.Header().Get("ETag"))
+
+	response = request(t, s, "GET", avatarURL+"?size=100", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40062, toHTTPError(t, response.Body.String()).Code)
+
+	// Replacing the avatar removes all variants
+	avatarID := strings.TrimPrefix(avatarURL, "/v1/coop/profile/avatar/")
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, avatarDirName, avatarVariantID(avatarID, 64)))
+	response = upload(newTestPNG(t, 300, 300))
+	require.Equal(t, 200, response.Code)
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, avatarDirName, avatarID))
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, avatarDirName, avatarVariantID(avatarID, 64)))
+}
+
+func TestServer_EncryptionAtRest(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	c.AttachmentEncryptionKey = bytes.Repeat([]byte{7}, 32)
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+
+	// Attachments are encrypted on disk, and decrypted on download
+	content := "secret document " + util.RandomString(100)
+	response := request(t, s, "PUT", "/mytopic?f=doc.txt", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, int64(len(content)), msg.Attachment.Size)
+	stored, err := os.ReadFile(filepath.Join(c.AttachmentCacheDir, toAttachmentFileID(t, s, msg.ID)))
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(stored), fileCipherMagic))
+	require.NotContains(t, string(stored), "secret document")
+
+	response = request(t, s, "GET", "/file/"+msg.ID+".txt", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, fmt.Sprintf("%d", len(content)), response.Header().Get("Content-Length"))
+	require.Equal(t, content, response.Body.String())
+
+	// Avatars as well
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="avatar.png"`)
+	header.Set("Content-Type", "image/png")
+	part, err := mw.CreatePart(header)
+	require.Nil(t, err)
+	_, err = part.Write(newTestPNG(t, 100, 100))
+	require.Nil(t, err)
+	require.Nil(t, mw.Close())
+	response = request(t, s, "PUT", "/v1/coop/profile/avatar", body.String(), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Content-Type":  mw.FormDataContentType(),
+	})
+	require.Equal(t, 200, response.Code)
+	avatar, err := util.UnmarshalJSON[map[string]string](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	avatarURL := (*avatar)["avatar_url"]
+	stored, err = os.ReadFile(filepath.Join(s.config.AttachmentCacheDir, avatarDirName, strings.TrimPrefix(avatarURL, "/v1/coop/profile/avatar/")))
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(stored), fileCipherMagic))
+	response = request(t, s, "GET", avatarURL, "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	img, err := jpeg.Decode(response.Body)
+	require.Nil(t, err)
+	require.Equal(t, image.Rect(0, 0, 100, 100), img.Bounds())
+}
+
+func TestServer_AttachmentStoreS3(t *testing.T) {
+	s3Server := newTestS3Server(t)
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	c.AttachmentCacheDir = ""
+	c.AttachmentS3URL = s3Server.url()
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+
+	// Attachments are stored in the bucket, and downloads are redirected to a presigned URL
+	content := "stored in s3 " + util.RandomString(100)
+	response := request(t, s, "PUT", "/mytopic?f=doc.txt", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, content, string(s3Server.object("coop/"+toAttachmentFileID(t, s, msg.ID))))
+	response = request(t, s, "GET", "/file/"+msg.ID+".txt", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 302, response.Code)
+	resp, err := http.Get(response.Header().Get("Location"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, content, string(b))
+	require.Equal(t, `attachment; filename="doc.txt"`, resp.Header.Get("Content-Disposition"))
+
+	// Avatars are stored in the bucket as well
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="avatar.png"`)
+	header.Set("Content-Type", "image/png")
+	part, err := mw.CreatePart(header)
+	require.Nil(t, err)
+	_, err = part.Write(newTestPNG(t, 100, 100))
+	require.Nil(t, err)
+	require.Nil(t, mw.Close())
+	response = request(t, s, "PUT", "/v1/coop/profile/avatar", body.String(), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Content-Type":  mw.FormDataContentType(),
+	})
+	require.Equal(t, 200, response.Code)
+	avatar, err := util.UnmarshalJSON[map[string]string](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	avatarID := strings.TrimPrefix((*avatar)["avatar_url"], "/v1/coop/profile/avatar/")
+	stored := s3Server.object("coop/avatars/" + avatarID)
+	require.NotNil(t, s3Server.object("coop/avatars/"+avatarVariantID(avatarID, 64)))
+	response = request(t, s, "GET", (*avatar)["avatar_url"], "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, string(stored), response.Body.String())
+	response = request(t, s, "DELETE", "/v1/coop/profile/avatar", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Nil(t, s3Server.object("coop/avatars/"+avatarID))
+	require.Nil(t, s3Server.object("coop/avatars/"+avatarVariantID(avatarID, 64)))
+}
+
+func TestServer_AttachmentStoreS3_Encrypted(t *testing.T) {
+	s3Server := newTestS3Server(t)
+	c := newTestConfigWithAuthFile(t)
+	c.CacheDuration = time.Hour
+	c.AuthDefault = user.PermissionDenyAll
+	c.AttachmentCacheDir = ""
+	c.AttachmentS3URL = s3Server.url()
+	c.AttachmentEncryptionKey = bytes.Repeat([]byte{7}, 32)
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser, false))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+
+	// Encrypted attachments cannot be downloaded from the bucket directly, so the server decrypts them
+	content := "secret in s3 " + util.RandomString(100)
+	response := request(t, s, "PUT", "/mytopic?f=doc.txt", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.NotContains(t, string(s3Server.object("coop/"+toAttachmentFileID(t, s, msg.ID))), "secret in s3")
+	response = request(t, s, "GET", "/file/"+msg.ID+".txt", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Range":         "bytes=7-12",
+	})
+	require.Equal(t, 206, response.Code)
+	require.Equal(t, fmt.Sprintf("bytes 7-12/%d", len(content)), response.Header().Get("Content-Range"))
+	require.Equal(t, "in s3 ", response.Body.String())
+}
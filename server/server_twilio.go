@@ -92,7 +92,7 @@ func (s *Server) callPhone(v *visitor, r *http.Request, m *message, to string) {
 	templateData := &twilioCallData{
 		Topic:    xmlEscapeText(m.Topic),
 		Title:    xmlEscapeText(m.Title),
-		Message:  xmlEscapeText(m.Message),
+		Message:  xmlEscapeText(messagePlainText(m)),
 		Priority: m.Priority,
 		Tags:     tags,
 		Sender:   xmlEscapeText(sender),
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Resumable uploads let clients upload large attachments in chunks, so that an interrupted upload can be
+// continued instead of restarted:
+//
+//  1. POST /v1/coop/uploads with {"filename": "video.mp4", "size": 15728640} creates an upload
+//  2. PATCH /v1/coop/uploads/{id} with an "Upload-Offset" header appends a chunk; the offset must match the
+//     bytes received so far, which GET /v1/coop/uploads/{id} returns after a connection loss
+//  3. Publishing with an "Upload: {id}" header attaches the completed upload to the message
+//
+// Chunks are stored as separate files in the attachment store, and are concatenated when the upload is
+// attached. A chunk that is interrupted is discarded entirely, so clients should keep chunks small.
+
+const (
+	apiUploadsPath      = "/v1/coop/uploads"
+	apiUploadsPrefix    = "/v1/coop/uploads/"
+	uploadOffsetHeader  = "Upload-Offset"
+	uploadsLimit        = 10   // Incomplete uploads per user
+	uploadChunksLimit   = 1000 // Chunks per upload, since every chunk is a file
+	uploadFilenameLimit = 255
+	tagUpload           = "upload"
+)
+
+// attachmentUpload is a resumable upload, stored in the message cache
+type attachmentUpload struct {
+	ID       string
+	User     string
+	Filename string
+	Size     int64 // Announced size of the file
+	Received int64 // Bytes received so far, i.e. the offset of the next chunk
+	Chunks   int
+	Expires  int64 // Unix time; extended with every chunk
+}
+
+// apiUploadCreateRequest is the request for POST /v1/coop/uploads
+type apiUploadCreateRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+// apiUploadResponse is the response for all /v1/coop/uploads endpoints
+type apiUploadResponse struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	Expires  int64  `json:"expires"`
+}
+
+// handleUploadCreate handles POST /v1/coop/uploads - start a resumable upload. The announced size must fit
+// the attachment limits of the user, minus what other incomplete uploads of the user already reserved.
+func (s *Server) handleUploadCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if s.fileCache == nil || s.config.BaseURL == "" {
+		return errHTTPBadRequestAttachmentsDisallowed
+	}
+	req, err := readJSONWithLimit[apiUploadCreateRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	filename := strings.TrimSpace(req.Filename)
+	if filename == "" || len(filename) > uploadFilenameLimit || strings.ContainsAny(filename, "/\\\r\n") || req.Size <= 0 {
+		return errHTTPBadRequestUploadInvalid
+	}
+	u := v.User()
+	uploads, err := s.messageCache.AttachmentUploadsByUser(u.ID)
+	if err != nil {
+		return err
+	} else if len(uploads) >= uploadsLimit {
+		return errHTTPTooManyRequestsLimitUploads
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	var reserved int64
+	for _, upload := range uploads {
+		reserved += upload.Size
+	}
+	if req.Size > vinfo.Limits.AttachmentFileSizeLimit || req.Size > vinfo.Stats.AttachmentTotalSizeRemaining-reserved {
+		return errHTTPEntityTooLargeAttachment.Fields(log.Context{
+			"upload_size":                     req.Size,
+			"attachment_total_size_remaining": vinfo.Stats.AttachmentTotalSizeRemaining - reserved,
+			"attachment_file_size_limit":      vinfo.Limits.AttachmentFileSizeLimit,
+		})
+	}
+	upload := &attachmentUpload{
+		ID:       util.RandomString(messageIDLength),
+		User:     u.ID,
+		Filename: filename,
+		Size:     req.Size,
+		Expires:  time.Now().Add(s.config.AttachmentUploadExpiry).Unix(),
+	}
+	if err := s.messageCache.AddAttachmentUpload(upload); err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagUpload).Fields(log.Context{"upload_id": upload.ID, "upload_size": upload.Size}).Debug("Created resumable upload")
+	return s.writeUploadResponse(w, upload)
+}
+
+// handleUploadGet handles GET /v1/coop/uploads/{id} - return the offset at which to continue an upload
+func (s *Server) handleUploadGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	upload, err := s.userUpload(v, strings.TrimPrefix(r.URL.Path, apiUploadsPrefix))
+	if err != nil {
+		return err
+	}
+	return s.writeUploadResponse(w, upload)
+}
+
+// handleUploadChunk handles PATCH /v1/coop/uploads/{id} - append the request body to an upload. The
+// bandwidth and attachment size limiters of the visitor apply to every chunk.
+func (s *Server) handleUploadChunk(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	id := strings.TrimPrefix(r.URL.Path, apiUploadsPrefix)
+	if !s.lockUpload(id) {
+		return errHTTPConflictUploadInProgress
+	}
+	defer s.unlockUpload(id)
+	upload, err := s.userUpload(v, id)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		return errHTTPBadRequestUploadOffsetInvalid
+	} else if offset != upload.Received {
+		return errHTTPConflictUploadOffsetMismatch.Fields(log.Context{
+			"upload_id":       upload.ID,
+			"upload_offset":   offset,
+			"upload_received": upload.Received,
+		})
+	} else if upload.Chunks >= uploadChunksLimit {
+		return errHTTPBadRequestUploadInvalid.Wrap("too many chunks, upload larger chunks")
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	uploads, err := s.messageCache.AttachmentUploadsByUser(upload.User)
+	if err != nil {
+		return err
+	}
+	var received int64 // Bytes stored for incomplete uploads, which do not count towards the stats yet
+	for _, u := range uploads {
+		received += u.Received
+	}
+	limiters := []util.Limiter{
+		v.BandwidthLimiter(),
+		util.NewFixedLimiter(upload.Size - upload.Received),
+		util.NewFixedLimiter(vinfo.Limits.AttachmentFileSizeLimit - upload.Received),
+		util.NewFixedLimiter(vinfo.Stats.AttachmentTotalSizeRemaining - received),
+	}
+	chunkID := uploadChunkID(upload.ID, upload.Chunks)
+	s.fileCache.Remove(chunkID) // Left over if the server stopped while receiving the chunk
+	size, err := s.fileCache.Write(chunkID, r.Body, limiters...)
+	if errors.Is(err, util.ErrLimitReached) {
+		return errHTTPEntityTooLargeAttachment.Fields(log.Context{"upload_id": upload.ID})
+	} else if err != nil {
+		return err
+	} else if size == 0 {
+		s.fileCache.Remove(chunkID)
+		return s.writeUploadResponse(w, upload)
+	}
+	upload.Received += size
+	upload.Chunks++
+	upload.Expires = time.Now().Add(s.config.AttachmentUploadExpiry).Unix()
+	if err := s.messageCache.UpdateAttachmentUpload(upload); err != nil {
+		s.fileCache.Remove(chunkID)
+		return err
+	}
+	logvr(v, r).
+		Tag(tagUpload).
+		Fields(log.Context{"upload_id": upload.ID, "upload_received": upload.Received, "upload_size": upload.Size}).
+		Trace("Received upload chunk")
+	return s.writeUploadResponse(w, upload)
+}
+
+// handleUploadDelete handles DELETE /v1/coop/uploads/{id} - abort an upload
+func (s *Server) handleUploadDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	id := strings.TrimPrefix(r.URL.Path, apiUploadsPrefix)
+	if !s.lockUpload(id) {
+		return errHTTPConflictUploadInProgress
+	}
+	defer s.unlockUpload(id)
+	upload, err := s.userUpload(v, id)
+	if err != nil {
+		return err
+	}
+	if err := s.removeUpload(upload); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleBodyAsUpload attaches a completed resumable upload to a message, and uses the body as the message.
+// The chunks were already counted against the bandwidth limit, so only the size limits are checked again.
+func (s *Server) handleBodyAsUpload(v *visitor, m *message, body *util.PeekedReadCloser, id string) error {
+	if s.fileCache == nil || s.config.BaseURL == "" {
+		return errHTTPBadRequestAttachmentsDisallowed.With(m)
+	} else if !s.lockUpload(id) {
+		return errHTTPConflictUploadInProgress.With(m)
+	}
+	defer s.unlockUpload(id)
+	upload, err := s.userUpload(v, id)
+	if err != nil {
+		return err
+	} else if upload.Received < upload.Size {
+		return errHTTPConflictUploadIncomplete.With(m)
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	attachmentExpiry := time.Now().Add(vinfo.Limits.AttachmentExpiryDuration).Unix()
+	if m.Time > attachmentExpiry {
+		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery.With(m)
+	} else if upload.Size > vinfo.Limits.AttachmentFileSizeLimit || upload.Size > vinfo.Stats.AttachmentTotalSizeRemaining {
+		return errHTTPEntityTooLargeAttachment.With(m)
+	}
+	if m.Attachment == nil {
+		m.Attachment = &attachment{}
+	}
+	if m.Attachment.Name == "" {
+		m.Attachment.Name = upload.Filename
+	}
+	if err := s.handleBodyAsTextMessage(m, body); err != nil {
+		return err
+	}
+	reader := newUploadReader(s.fileCache, upload)
+	defer reader.Close()
+	in := bufio.NewReaderSize(reader, s.config.MessageSizeLimit) // Same amount as peeked for regular uploads
+	peeked, err := in.Peek(s.config.MessageSizeLimit)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	var ext string
+	m.Attachment.Expires = attachmentExpiry
+	m.Attachment.Type, ext = util.DetectContentType(peeked, m.Attachment.Name)
+	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", s.config.BaseURL, m.ID, ext)
+	if err := s.writeAttachment(v, m, in, vinfo.Limits.AttachmentFileSizeLimit, util.NewFixedLimiter(vinfo.Limits.AttachmentFileSizeLimit)); err != nil {
+		return err
+	}
+	logvm(v, m).Tag(tagUpload).Field("upload_id", upload.ID).Debug("Attached resumable upload to message")
+	if err := s.removeUpload(upload); err != nil {
+		logvm(v, m).Tag(tagUpload).Err(err).Warn("Cannot remove attached upload")
+	}
+	return nil
+}
+
+// userUpload returns the upload with the given ID, if it belongs to the visitor's user
+func (s *Server) userUpload(v *visitor, id string) (*attachmentUpload, error) {
+	upload, err := s.messageCache.AttachmentUpload(id)
+	if errors.Is(err, errUploadNotFound) {
+		return nil, errHTTPNotFoundUpload
+	} else if err != nil {
+		return nil, err
+	} else if u := v.User(); u == nil || upload.User != u.ID {
+		return nil, errHTTPNotFoundUpload
+	}
+	return upload, nil
+}
+
+// removeUpload deletes the chunks of an upload, and the upload itself
+func (s *Server) removeUpload(upload *attachmentUpload) error {
+	if err := s.fileCache.Remove(uploadChunkIDs(upload)...); err != nil {
+		return err
+	}
+	return s.messageCache.DeleteAttachmentUpload(upload.ID)
+}
+
+// pruneUploads deletes incomplete uploads that did not receive a chunk for AttachmentUploadExpiry
+func (s *Server) pruneUploads() {
+	uploads, err := s.messageCache.AttachmentUploadsExpired()
+	if err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error retrieving expired uploads")
+		return
+	}
+	for _, upload := range uploads {
+		if !s.lockUpload(upload.ID) {
+			continue // Chunk is being received, and will extend the expiry
+		}
+		log.Tag(tagManager).Field("upload_id", upload.ID).Debug("Deleting expired upload")
+		if err := s.removeUpload(upload); err != nil {
+			log.Tag(tagManager).Err(err).Warn("Error deleting expired upload %s", upload.ID)
+		}
+		s.unlockUpload(upload.ID)
+	}
+}
+
+// lockUpload marks an upload as being written to, so that chunks are appended one at a time. It returns
+// false if the upload is already locked.
+func (s *Server) lockUpload(id string) bool {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	if s.uploadsActive[id] {
+		return false
+	}
+	s.uploadsActive[id] = true
+	return true
+}
+
+func (s *Server) unlockUpload(id string) {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	delete(s.uploadsActive, id)
+}
+
+func (s *Server) writeUploadResponse(w http.ResponseWriter, upload *attachmentUpload) error {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(upload.Received, 10))
+	return s.writeJSON(w, &apiUploadResponse{
+		ID:       upload.ID,
+		Filename: upload.Filename,
+		Size:     upload.Size,
+		Offset:   upload.Received,
+		Expires:  upload.Expires,
+	})
+}
+
+// uploadChunkID returns the file ID of the n-th chunk of an upload
+func uploadChunkID(id string, n int) string {
+	return fmt.Sprintf("%s_%d", id, n)
+}
+
+func uploadChunkIDs(upload *attachmentUpload) []string {
+	ids := make([]string, upload.Chunks)
+	for i := range ids {
+		ids[i] = uploadChunkID(upload.ID, i)
+	}
+	return ids
+}
+
+// uploadReader reads the chunks of an upload one after another, opening each chunk only when it is needed
+type uploadReader struct {
+	store   attachmentStore
+	ids     []string
+	current io.ReadCloser
+}
+
+func newUploadReader(store attachmentStore, upload *attachmentUpload) *uploadReader {
+	return &uploadReader{store: store, ids: uploadChunkIDs(upload)}
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.ids) == 0 {
+				return 0, io.EOF
+			}
+			current, err := r.store.Read(r.ids[0], 0, -1)
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.ids = current, r.ids[1:]
+		}
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *uploadReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
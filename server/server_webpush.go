@@ -83,6 +83,7 @@ func (s *Server) handleWebPushDelete(w http.ResponseWriter, r *http.Request, _ *
 }
 
 func (s *Server) publishToWebPushEndpoints(v *visitor, m *message) {
+	m = m.withoutEnvelope() // Previews only show the placeholder of encrypted messages
 	subscriptions, err := s.webPush.SubscriptionsForTopic(m.Topic)
 	if err != nil {
 		logvm(v, m).Err(err).With(v, m).Warn("Unable to publish web push messages")
@@ -94,13 +95,43 @@ func (s *Server) publishToWebPushEndpoints(v *visitor, m *message) {
 		log.Tag(tagWebPush).Err(err).With(v, m).Warn("Unable to marshal expiring payload")
 		return
 	}
+	var blockers map[string]bool
+	if m.User != "" {
+		if blockers, err = s.blockerIDs(m.User); err != nil {
+			log.Tag(tagWebPush).Err(err).With(v, m).Warn("Unable to look up blocking users, notifying all subscribers")
+		}
+	}
 	for _, subscription := range subscriptions {
-		if err := s.sendWebPushNotification(subscription, payload, v, m); err != nil {
+		if subscription.UserID != "" && blockers[subscription.UserID] {
+			continue // Subscriber blocked the publisher
+		}
+		if err := s.sendWebPushNotification(subscription, s.webPushPayloadForSubscription(subscription, m, payload), v, m); err != nil {
 			log.Tag(tagWebPush).Err(err).With(v, m, subscription).Warn("Unable to publish web push message")
 		}
 	}
 }
 
+// webPushPayloadForSubscription returns the payload with an attachment URL signed for the subscription's user,
+// so that the notification can show a preview image, or the shared payload if no signed URL is needed
+func (s *Server) webPushPayloadForSubscription(subscription *webPushSubscription, m *message, payload []byte) []byte {
+	if m.Attachment == nil || subscription.UserID == "" || s.userManager == nil {
+		return payload
+	}
+	u, err := s.userManager.UserByID(subscription.UserID)
+	if err != nil {
+		return payload
+	}
+	signed := s.withSignedAttachmentURL(m, u)
+	if signed == m {
+		return payload
+	}
+	signedPayload, err := json.Marshal(newWebPushPayload(fmt.Sprintf("%s/%s", s.config.BaseURL, m.Topic), signed.forJSON()))
+	if err != nil {
+		return payload
+	}
+	return signedPayload
+}
+
 func (s *Server) pruneAndNotifyWebPushSubscriptions() {
 	if s.config.WebPushPublicKey == "" {
 		return
@@ -78,12 +78,12 @@ func (s *smtpSender) withCount(v *visitor, m *message, fn func() error) error {
 
 func formatMail(baseURL, senderIP, from, to string, m *message) (string, error) {
 	topicURL := baseURL + "/" + m.Topic
+	message := messagePlainText(m) // Coop: No raw markdown in emails
 	subject := m.Title
 	if subject == "" {
-		subject = m.Message
+		subject = message
 	}
 	subject = strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " ")
-	message := m.Message
 	trailer := ""
 	if len(m.Tags) > 0 {
 		emojis, tags, err := toEmojis(m.Tags)
@@ -107,6 +107,12 @@ func formatMail(baseURL, senderIP, from, to string, m *message) (string, error)
 		}
 		trailer += fmt.Sprintf("Priority: %s", priority)
 	}
+	if m.Attachment != nil {
+		if trailer != "" {
+			trailer += "\n"
+		}
+		trailer += fmt.Sprintf("Attachment: %s (%s)", m.Attachment.Name, m.Attachment.URL)
+	}
 	if trailer != "" {
 		message += "\n\n" + trailer
 	}
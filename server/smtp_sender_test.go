@@ -26,6 +26,33 @@ This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://nt
 	require.Equal(t, expected, actual)
 }
 
+func TestFormatMail_Attachment(t *testing.T) {
+	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "You received a file: photo.jpg",
+		Attachment: &attachment{
+			Name: "photo.jpg",
+			URL:  "https://ntfy.sh/file/abc.jpg?exp=1640385804&sig=xyz&u=phil",
+		},
+	})
+	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+To: phil@example.com
+Date: Fri, 24 Dec 2021 21:43:24 +0000
+Subject: You received a file: photo.jpg
+Content-Type: text/plain; charset="utf-8"
+
+You received a file: photo.jpg
+
+Attachment: photo.jpg (https://ntfy.sh/file/abc.jpg?exp=1640385804&sig=xyz&u=phil)
+
+--
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
+	require.Equal(t, expected, actual)
+}
+
 func TestFormatMail_JustEmojis(t *testing.T) {
 	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
 		ID:      "abc",
@@ -145,3 +172,18 @@ Priority: max
 This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
 	require.Equal(t, expected, actual)
 }
+
+func TestFormatMail_Markdown(t *testing.T) {
+	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:          "abc",
+		Time:        1640382204,
+		Event:       "message",
+		Topic:       "alerts",
+		Message:     "**Deploy** <img src=x onerror=alert(1)>done",
+		ContentType: markdownContentType,
+	})
+	require.Contains(t, actual, "Subject: Deploy done\n")
+	require.Contains(t, actual, "\n\nDeploy done\n\n--\n")
+	require.NotContains(t, actual, "**")
+	require.NotContains(t, actual, "onerror")
+}
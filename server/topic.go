@@ -22,6 +22,7 @@ type topic struct {
 	ID          string
 	subscribers map[int]*topicSubscriber
 	rateVisitor *visitor
+	blockers    blockerFunc // Returns the users that blocked a publisher, may be nil
 	lastAccess  time.Time
 	mu          sync.RWMutex
 }
@@ -35,6 +36,9 @@ type topicSubscriber struct {
 // subscriber is a function that is called for every new message on a topic
 type subscriber func(v *visitor, msg *message) error
 
+// blockerFunc returns the IDs of all users that have blocked the given user
+type blockerFunc func(userID string) (map[string]bool, error)
+
 // newTopic creates a new topic
 func newTopic(id string) *topic {
 	return &topic{
@@ -95,6 +99,13 @@ func (t *topic) RateVisitor() *visitor {
 	return t.rateVisitor
 }
 
+// SetBlockers sets the function used to skip subscribers that have blocked the publisher
+func (t *topic) SetBlockers(fn blockerFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blockers = fn
+}
+
 // Unsubscribe removes the subscription from the list of subscribers
 func (t *topic) Unsubscribe(id int) {
 	t.mu.Lock()
@@ -110,7 +121,12 @@ func (t *topic) Publish(v *visitor, m *message) error {
 		subscribers := t.subscribersCopy()
 		if len(subscribers) > 0 {
 			logvm(v, m).Tag(tagPublish).Debug("Forwarding to %d subscriber(s)", len(subscribers))
+			blockers := t.blockersOf(v, m)
 			for _, s := range subscribers {
+				if s.userID != "" && blockers[s.userID] {
+					logvm(v, m).Tag(tagPublish).Trace("Subscriber %s blocked publisher, not forwarding", s.userID)
+					continue
+				}
 				// We call the subscriber functions in their own Go routines because they are blocking, and
 				// we don't want individual slow subscribers to be able to block others.
 				go func(s subscriber) {
@@ -127,6 +143,23 @@ func (t *topic) Publish(v *visitor, m *message) error {
 	return nil
 }
 
+// blockersOf returns the IDs of the users that have blocked the publisher of the message. Lookup
+// errors are logged and treated as "nobody", so a broken contact list never stops delivery.
+func (t *topic) blockersOf(v *visitor, m *message) map[string]bool {
+	t.mu.RLock()
+	blockers := t.blockers
+	t.mu.RUnlock()
+	if blockers == nil || m.User == "" {
+		return nil
+	}
+	ids, err := blockers(m.User)
+	if err != nil {
+		logvm(v, m).Tag(tagPublish).Err(err).Warn("Unable to look up blocking users, forwarding to all subscribers")
+		return nil
+	}
+	return ids
+}
+
 // Stats returns the number of subscribers and last access to this topic
 func (t *topic) Stats() (int, time.Time) {
 	t.mu.RLock()
@@ -46,6 +46,9 @@ type message struct {
 	SenderName  string      `json:"sender,omitempty"`        // Coop: Username of the sender (visible in JSON)
 	ReplyTo     string      `json:"reply_to,omitempty"`      // Coop: Message ID this is a reply to
 	ReplyToText string      `json:"reply_to_text,omitempty"` // Coop: Preview of the replied-to message
+	HTML        string      `json:"-"`                       // Coop: Sanitized HTML rendering of chat messages, see renderMessageHTML
+	Envelope    *envelope   `json:"envelope,omitempty"`      // Coop: Per-device ciphertexts of an encrypted message, see envelopeContentType
+	Coop        bool        `json:"-"`                       // Coop: True if the topic is a Coop chat topic, resolved once per publish (not stored)
 	Sender      netip.Addr  `json:"-"`                       // IP address of uploader, used for rate limiting
 	User        string      `json:"-"`                       // UserID of the uploader, used to associated attachments
 }
@@ -80,11 +83,15 @@ func (m *message) forJSON() *message {
 }
 
 type attachment struct {
-	Name    string `json:"name"`
-	Type    string `json:"type,omitempty"`
-	Size    int64  `json:"size,omitempty"`
-	Expires int64  `json:"expires,omitempty"`
-	URL     string `json:"url"`
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Expires  int64  `json:"expires,omitempty"`
+	URL      string `json:"url"`
+	Width    int    `json:"width,omitempty"`    // Coop: Image width in pixels (after applying the EXIF orientation)
+	Height   int    `json:"height,omitempty"`   // Coop: Image height in pixels
+	BlurHash string `json:"blurhash,omitempty"` // Coop: Placeholder to show while the image loads, see https://blurha.sh
+	Hash     string `json:"-"`                  // Coop: SHA-256 of the contents, ID of the stored blob (empty for old attachments, stored by message ID)
 }
 
 type action struct {
@@ -128,6 +135,7 @@ type publishMessage struct {
 	Firebase   string   `json:"firebase"` // use string as it defaults to true (or use &bool instead)
 	Delay      string   `json:"delay"`
 	ReplyTo    string   `json:"reply_to"` // Coop: Message ID this is a reply to
+	Upload     string   `json:"upload"`   // Coop: ID of a completed resumable upload to attach
 }
 
 // messageEncoder is a function that knows how to encode a message
@@ -487,6 +495,7 @@ type apiConfigResponse struct {
 	EnableLogin        bool     `json:"enable_login"`
 	RequireLogin       bool     `json:"require_login"`
 	EnableSignup       bool     `json:"enable_signup"`
+	EnableOIDC         bool     `json:"enable_oidc"`
 	EnablePayments     bool     `json:"enable_payments"`
 	EnableCalls        bool     `json:"enable_calls"`
 	EnableEmails       bool     `json:"enable_emails"`
@@ -524,7 +533,11 @@ type apiAccountBillingPortalRedirectResponse struct {
 }
 
 type apiAccountSyncTopicResponse struct {
-	Event string `json:"event"`
+	Event        string `json:"event"`
+	LockedUntil  int64  `json:"locked_until,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	ReportID     string `json:"report_id,omitempty"`
+	ReportStatus string `json:"report_status,omitempty"`
 }
 
 type apiSuccessResponse struct {
@@ -577,14 +590,19 @@ type webPushPayload struct {
 	Event          string   `json:"event"`
 	SubscriptionID string   `json:"subscription_id"`
 	Message        *message `json:"message"`
+	Preview        string   `json:"preview,omitempty"` // Coop: Plain text notification body, if it differs from the message
 }
 
 func newWebPushPayload(subscriptionID string, message *message) *webPushPayload {
-	return &webPushPayload{
+	payload := &webPushPayload{
 		Event:          webPushMessageEvent,
 		SubscriptionID: subscriptionID,
 		Message:        message,
 	}
+	if preview := messagePlainText(message); preview != message.Message {
+		payload.Preview = preview
+	}
+	return payload
 }
 
 type webPushControlMessagePayload struct {
@@ -61,6 +61,7 @@ type visitor struct {
 	messagesLimiter     *util.FixedLimiter // Rate limiter for messages
 	emailsLimiter       *util.RateLimiter  // Rate limiter for emails
 	callsLimiter        *util.FixedLimiter // Rate limiter for calls
+	contactsLimiter     *util.FixedLimiter // Fixed limiter for contact lookups and requests, reset daily
 	subscriptionLimiter *util.FixedLimiter // Fixed limiter for active subscriptions (ongoing connections)
 	bandwidthLimiter    *util.RateLimiter  // Limiter for attachment bandwidth downloads
 	accountLimiter      *rate.Limiter      // Rate limiter for account creation, may be nil
@@ -130,6 +131,7 @@ func newVisitor(conf *Config, messageCache *messageCache, userManager *user.Mana
 		firebase:            time.Unix(0, 0),
 		seen:                time.Now(),
 		subscriptionLimiter: util.NewFixedLimiter(int64(conf.VisitorSubscriptionLimit)),
+		contactsLimiter:     util.NewFixedLimiter(int64(conf.ContactLimit)),
 		requestLimiter:      nil, // Set in resetLimiters
 		messagesLimiter:     nil, // Set in resetLimiters, may be nil
 		emailsLimiter:       nil, // Set in resetLimiters
@@ -239,6 +241,12 @@ func (v *visitor) CallAllowed() bool {
 	return v.callsLimiter.Allow()
 }
 
+func (v *visitor) ContactAllowed() bool {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.contactsLimiter.Allow()
+}
+
 func (v *visitor) SubscriptionAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
@@ -329,6 +337,7 @@ func (v *visitor) ResetStats() {
 	v.emailsLimiter.Reset()
 	v.messagesLimiter.Reset()
 	v.callsLimiter.Reset()
+	v.contactsLimiter.Reset()
 }
 
 // User returns the visitor user, or nil if there is none
@@ -466,8 +475,13 @@ func (v *visitor) Info() (*visitorInfo, error) {
 	var attachmentsBytesUsed int64
 	var err error
 	u := v.User()
-	if u != nil {
+	unique := v.config.AttachmentQuotaPolicy == AttachmentQuotaPolicyUnique
+	if u != nil && unique {
+		attachmentsBytesUsed, err = v.messageCache.UniqueAttachmentBytesUsedByUser(u.ID)
+	} else if u != nil {
 		attachmentsBytesUsed, err = v.messageCache.AttachmentBytesUsedByUser(u.ID)
+	} else if unique {
+		attachmentsBytesUsed, err = v.messageCache.UniqueAttachmentBytesUsedBySender(v.IP().String())
 	} else {
 		attachmentsBytesUsed, err = v.messageCache.AttachmentBytesUsedBySender(v.IP().String())
 	}
@@ -0,0 +1,367 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"heckel.io/ntfy/v2/log"
+)
+
+const (
+	tagLDAP = "ldap"
+)
+
+// Default values for the LDAP configuration
+const (
+	DefaultLDAPUserFilter           = "(uid=%s)"
+	DefaultLDAPGroupAttribute       = "memberOf"
+	DefaultLDAPDisplayNameAttribute = "displayName"
+	DefaultLDAPAvatarAttribute      = "jpegPhoto"
+	DefaultLDAPTimeout              = 10 * time.Second
+)
+
+// LDAPConfig is the configuration for the LDAP authenticator
+type LDAPConfig struct {
+	URL                  string        // LDAP server URL, e.g. ldaps://ldap.example.com:636
+	StartTLS             bool          // Upgrade a plain ldap:// connection via StartTLS
+	BindDN               string        // Service account used to search for users; empty for anonymous search
+	BindPassword         string        // Password of the service account
+	BaseDN               string        // Search base for users, e.g. ou=people,dc=example,dc=com
+	UserFilter           string        // Search filter, %s is replaced with the (escaped) username
+	GroupAttribute       string        // Attribute listing the user's groups, e.g. memberOf
+	DisplayNameAttribute string        // Attribute synced into the profile display name; empty to disable
+	AvatarAttribute      string        // Attribute containing the user's photo; empty to disable
+	AdminGroups          []string      // Members of these groups are admins; if empty, the role is not managed
+	TierGroups           []TierGroup   // Group -> tier code, in order of precedence
+	Timeout              time.Duration // Connection and request timeout
+
+	// SyncAvatar is called with the contents of the avatar attribute after a successful login, if the
+	// attribute is set. Storing the image is left to the caller. May be nil.
+	SyncAvatar func(u *User, avatar []byte) error
+}
+
+// LDAPAuther is an Auther that authenticates users against an LDAP directory by searching for
+// the user's DN and binding as that user. Users are created (or updated) in the local user database on
+// successful login, so that tokens, ACLs and profiles work as usual. Users that cannot be found in the
+// directory (e.g. a local admin), or all users if the directory is unreachable, are authenticated
+// against the local user database.
+type LDAPAuther struct {
+	manager *Manager
+	config  *LDAPConfig
+}
+
+var _ Auther = (*LDAPAuther)(nil)
+
+// ldapEntry is the result of a user search in the directory
+type ldapEntry struct {
+	dn          string
+	groups      []string
+	displayName string
+	avatar      []byte
+}
+
+// errLDAPUserNotFound is returned by search if the user does not exist in the directory
+var errLDAPUserNotFound = errors.New("user not found in directory")
+
+// NewLDAPAuther creates a new LDAPAuther, backed by the given manager
+func NewLDAPAuther(manager *Manager, config *LDAPConfig) *LDAPAuther {
+	if config.UserFilter == "" {
+		config.UserFilter = DefaultLDAPUserFilter
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = DefaultLDAPGroupAttribute
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultLDAPTimeout
+	}
+	return &LDAPAuther{
+		manager: manager,
+		config:  config,
+	}
+}
+
+// Authenticate checks the username and password against the directory, and falls back to the local
+// user database if the user is not found in the directory, or if the directory cannot be reached.
+func (a *LDAPAuther) Authenticate(username, password string) (*User, error) {
+	if username == Everyone || !AllowedUsername(username) {
+		return nil, ErrUnauthenticated
+	}
+	conn, err := a.dial()
+	if err != nil {
+		log.Tag(tagLDAP).Err(err).Warn("Cannot connect to LDAP server, falling back to local authentication")
+		return a.manager.Authenticate(username, password)
+	}
+	defer conn.Close()
+	entry, err := a.search(conn, username)
+	if errors.Is(err, errLDAPUserNotFound) {
+		log.Tag(tagLDAP).Field("user_name", username).Trace("User not found in directory, falling back to local authentication")
+		return a.manager.Authenticate(username, password)
+	} else if err != nil {
+		log.Tag(tagLDAP).Field("user_name", username).Err(err).Warn("LDAP search failed, falling back to local authentication")
+		return a.manager.Authenticate(username, password)
+	} else if local, err := a.localUser(username); err != nil {
+		return nil, err
+	} else if local {
+		log.Tag(tagLDAP).Field("user_name", username).Info("User %s exists locally and was not created from the LDAP directory, falling back to local authentication", username)
+		return a.manager.Authenticate(username, password)
+	}
+	failure, err := a.loginFailure(username)
+	if err != nil {
+		return nil, err
+	}
+	// An empty password would result in an unauthenticated bind, which most servers accept (RFC 4513, 5.1.2)
+	if password == "" {
+		return nil, a.authFailed(username)
+	} else if err := conn.Bind(entry.dn, password); err != nil {
+		log.Tag(tagLDAP).Field("user_name", username).Err(err).Trace("Authentication of user failed (LDAP bind)")
+		return nil, a.authFailed(username)
+	}
+	// Suspended users are rejected before syncing, so that their role, tier and profile stay as they are
+	if u, err := a.manager.User(username); err == nil && u.Suspended() {
+		log.Tag(tagLDAP).Field("user_name", username).Trace("Authentication of user failed: user suspended")
+		return nil, ErrUserSuspended
+	} else if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+	return a.sync(username, entry, failure)
+}
+
+// Authorize delegates to the local user database, since ACLs are always managed locally
+func (a *LDAPAuther) Authorize(user *User, topic string, perm Permission) error {
+	return a.manager.Authorize(user, topic, perm)
+}
+
+func (a *LDAPAuther) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: a.config.Timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.config.Timeout)
+	if a.config.StartTLS {
+		u, err := url.Parse(a.config.URL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("service account bind failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuther) search(conn *ldap.Conn, username string) (*ldapEntry, error) {
+	attributes := []string{a.config.GroupAttribute}
+	if a.config.DisplayNameAttribute != "" {
+		attributes = append(attributes, a.config.DisplayNameAttribute)
+	}
+	if a.config.AvatarAttribute != "" {
+		attributes = append(attributes, a.config.AvatarAttribute)
+	}
+	req := ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2, // We only need to know if there is more than one
+		int(a.config.Timeout.Seconds()),
+		false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		attributes,
+		nil,
+	)
+	result, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, errLDAPUserNotFound
+	} else if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || (err == nil && len(result.Entries) > 1) {
+		return nil, fmt.Errorf("search for user %s returned more than one entry", username)
+	} else if err != nil {
+		return nil, err
+	} else if len(result.Entries) == 0 {
+		return nil, errLDAPUserNotFound
+	}
+	entry := result.Entries[0]
+	ldapUser := &ldapEntry{
+		dn:     entry.DN,
+		groups: entry.GetAttributeValues(a.config.GroupAttribute),
+	}
+	if a.config.DisplayNameAttribute != "" {
+		ldapUser.displayName = entry.GetAttributeValue(a.config.DisplayNameAttribute)
+	}
+	if a.config.AvatarAttribute != "" {
+		ldapUser.avatar = entry.GetRawAttributeValue(a.config.AvatarAttribute)
+	}
+	return ldapUser, nil
+}
+
+// localUser returns true if a local user with the given name exists that was not created from the directory.
+// The directory must not take over such accounts, so they can only log in with their local password.
+func (a *LDAPAuther) localUser(username string) (bool, error) {
+	u, err := a.manager.User(username)
+	if errors.Is(err, ErrUserNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	linked, err := a.manager.LDAPUserLinked(u.ID)
+	if err != nil {
+		return false, err
+	}
+	return !linked, nil
+}
+
+// loginFailure returns the failed login attempts of the local user, so that the login lockout applies to
+// directory users as well. It returns ErrUserLocked if the user is locked, and ErrUnauthenticated if the
+// local user was deleted.
+func (a *LDAPAuther) loginFailure(username string) (*LoginFailure, error) {
+	u, err := a.manager.User(username)
+	if errors.Is(err, ErrUserNotFound) {
+		return &LoginFailure{}, nil
+	} else if err != nil {
+		return nil, err
+	} else if u.Deleted {
+		return nil, ErrUnauthenticated
+	}
+	failure, err := a.manager.LoginFailure(u.ID)
+	if err != nil {
+		return nil, err
+	} else if failure.Locked() {
+		log.Tag(tagLDAP).Field("user_name", username).Trace("Authentication of user failed: user locked until %s", failure.LockedUntil.String())
+		return nil, ErrUserLocked
+	}
+	return failure, nil
+}
+
+// authFailed records a failed login attempt for the local user, so that it counts towards the login lockout,
+// and returns ErrUnauthenticated. Directory users that have never logged in have no local user yet; for them,
+// only the directory's own password policy applies.
+func (a *LDAPAuther) authFailed(username string) error {
+	u, err := a.manager.User(username)
+	if errors.Is(err, ErrUserNotFound) {
+		return ErrUnauthenticated
+	} else if err != nil {
+		return err
+	}
+	if _, err := a.manager.AuthFailed(u.ID); err != nil {
+		return err
+	}
+	return ErrUnauthenticated
+}
+
+// sync creates the local user if it does not exist, and updates role, tier and profile from the directory
+func (a *LDAPAuther) sync(username string, entry *ldapEntry, failure *LoginFailure) (*User, error) {
+	u, err := a.manager.User(username)
+	if errors.Is(err, ErrUserNotFound) {
+		log.Tag(tagLDAP).Field("user_name", username).Info("Creating user %s from LDAP directory", username)
+		if err := a.manager.AddUser(username, randomLDAPPassword(), a.role(entry.groups, RoleUser), false); err != nil {
+			return nil, err
+		}
+		u, err = a.manager.User(username)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.manager.LinkLDAPUser(u.ID, entry.dn); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if role := a.role(entry.groups, u.Role); role != u.Role {
+		log.Tag(tagLDAP).Field("user_name", username).Info("Changing role of user %s to %s based on LDAP groups", username, role)
+		if err := a.manager.ChangeRole(username, role); err != nil {
+			return nil, err
+		}
+	}
+	if tierCode := a.tier(entry.groups); tierCode != "" && (u.Tier == nil || u.Tier.Code != tierCode) {
+		log.Tag(tagLDAP).Field("user_name", username).Info("Changing tier of user %s to %s based on LDAP groups", username, tierCode)
+		if err := a.manager.ChangeTier(username, tierCode); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.syncProfile(u, entry); err != nil {
+		log.Tag(tagLDAP).Field("user_name", username).Err(err).Warn("Cannot sync profile from LDAP directory")
+	}
+	if failure.Failures > 0 {
+		if err := a.manager.ResetLoginFailures(u.ID); err != nil {
+			return nil, err
+		}
+	}
+	return a.manager.User(username)
+}
+
+func (a *LDAPAuther) syncProfile(u *User, entry *ldapEntry) error {
+	if entry.displayName != "" {
+		if err := a.manager.UpdateProfileDisplayName(u.ID, entry.displayName); err != nil {
+			return err
+		}
+	}
+	if len(entry.avatar) > 0 && a.config.SyncAvatar != nil {
+		return a.config.SyncAvatar(u, entry.avatar)
+	}
+	return nil
+}
+
+// role returns RoleAdmin if the user is a member of one of the admin groups, and RoleUser if not.
+// If no admin groups are configured, the role is not managed by the directory.
+func (a *LDAPAuther) role(groups []string, current Role) Role {
+	if len(a.config.AdminGroups) == 0 {
+		return current
+	}
+	for _, group := range groups {
+		for _, adminGroup := range a.config.AdminGroups {
+			if ldapGroupMatches(group, adminGroup) {
+				return RoleAdmin
+			}
+		}
+	}
+	return RoleUser
+}
+
+// tier returns the tier code of the first configured tier group the user is a member of, if any
+func (a *LDAPAuther) tier(groups []string) string {
+	for _, tierGroup := range a.config.TierGroups {
+		for _, group := range groups {
+			if ldapGroupMatches(group, tierGroup.Group) {
+				return tierGroup.Tier
+			}
+		}
+	}
+	return ""
+}
+
+// ldapGroupMatches compares a group DN (e.g. cn=admins,ou=groups,dc=example,dc=com) from the directory
+// with a configured group, which may either be a full DN or just the group name (e.g. admins)
+func ldapGroupMatches(groupDN, configured string) bool {
+	if strings.EqualFold(groupDN, configured) {
+		return true
+	}
+	dn, err := ldap.ParseDN(groupDN)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return false
+	}
+	return strings.EqualFold(dn.RDNs[0].Attributes[0].Value, configured)
+}
+
+// randomLDAPPassword returns a random password for users created from the directory. It is never
+// handed out, so these users can only log in via the directory (or via tokens).
+func randomLDAPPassword() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // Cannot happen, see crypto/rand docs
+	}
+	return hex.EncodeToString(b)
+}
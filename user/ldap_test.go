@@ -0,0 +1,234 @@
+package user
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLDAPEntry(name, password, displayName string, groups ...string) *gldap.Entry {
+	memberOf := make([]string, 0, len(groups))
+	for _, group := range groups {
+		memberOf = append(memberOf, fmt.Sprintf("cn=%s,%s", group, testdirectory.DefaultGroupDN))
+	}
+	return gldap.NewEntry(fmt.Sprintf("cn=%s,%s", name, testdirectory.DefaultUserDN), map[string][]string{
+		"cn":          {name},
+		"password":    {password},
+		"displayName": {displayName},
+		"memberOf":    memberOf,
+		"jpegPhoto":   {"\xff\xd8\xff\xe0fakejpeg-" + name},
+	})
+}
+
+func newTestLDAPAuther(t *testing.T, url string) (*LDAPAuther, *Manager, map[string][]byte) {
+	a := newTestManager(t, PermissionDenyAll)
+	avatars := make(map[string][]byte)
+	auther := NewLDAPAuther(a, &LDAPConfig{
+		URL:                  url,
+		BindDN:               "cn=coop-service," + testdirectory.DefaultUserDN,
+		BindPassword:         "service-pass",
+		BaseDN:               testdirectory.DefaultUserDN,
+		UserFilter:           "(cn=%s)",
+		DisplayNameAttribute: DefaultLDAPDisplayNameAttribute,
+		AvatarAttribute:      DefaultLDAPAvatarAttribute,
+		AdminGroups:          []string{"coop-admins"},
+		TierGroups:           []TierGroup{{Group: "cn=staff," + testdirectory.DefaultGroupDN, Tier: "pro"}},
+		SyncAvatar: func(u *User, avatar []byte) error {
+			avatars[u.Name] = avatar
+			return nil
+		},
+	})
+	return auther, a, avatars
+}
+
+func startTestLDAPDirectory(t *testing.T, entries ...*gldap.Entry) (*testdirectory.Directory, string) {
+	d := testdirectory.Start(t, testdirectory.WithNoTLS(t))
+	service := gldap.NewEntry("cn=coop-service,"+testdirectory.DefaultUserDN, map[string][]string{
+		"password": {"service-pass"},
+	})
+	d.SetUsers(append(entries, service)...)
+	return d, fmt.Sprintf("ldap://%s:%d", d.Host(), d.Port())
+}
+
+func testLDAPProfile(t *testing.T, a *Manager, userID string) (displayName, bio string) {
+	require.Nil(t, a.db.QueryRow("SELECT display_name, bio FROM user_profile WHERE user_id = ?", userID).Scan(&displayName, &bio))
+	return displayName, bio
+}
+
+func TestLDAPAuther_Authenticate_ProvisionAndSync(t *testing.T) {
+	d, url := startTestLDAPDirectory(t, newTestLDAPEntry("alice", "alice-pass", "Alice Liddell", "coop-admins", "staff"))
+	auther, a, avatars := newTestLDAPAuther(t, url)
+	require.Nil(t, a.AddTier(&Tier{Code: "pro", Name: "Pro"}))
+
+	// First login creates the user, with role and tier from the groups
+	u, err := auther.Authenticate("alice", "alice-pass")
+	require.Nil(t, err)
+	require.Equal(t, "alice", u.Name)
+	require.Equal(t, RoleAdmin, u.Role)
+	require.Equal(t, "pro", u.Tier.Code)
+
+	displayName, _ := testLDAPProfile(t, a, u.ID)
+	require.Equal(t, "Alice Liddell", displayName)
+	require.Equal(t, []byte("\xff\xd8\xff\xe0fakejpeg-alice"), avatars["alice"])
+	linked, err := a.LDAPUserLinked(u.ID)
+	require.Nil(t, err)
+	require.True(t, linked)
+
+	// The local (random) password cannot be used
+	_, err = a.Authenticate("alice", "alice-pass")
+	require.Equal(t, ErrUnauthenticated, err)
+
+	// Wrong and empty passwords are rejected
+	_, err = auther.Authenticate("alice", "wrong-pass")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = auther.Authenticate("alice", "")
+	require.Equal(t, ErrUnauthenticated, err)
+
+	// Groups and display name changed in the directory, synced on next login; the bio is kept
+	require.Nil(t, a.UpdateProfile(u.ID, "Alice Liddell", "Down the rabbit hole"))
+	d.SetUsers(
+		newTestLDAPEntry("alice", "alice-pass", "Alice L.", "staff"),
+		gldap.NewEntry("cn=coop-service,"+testdirectory.DefaultUserDN, map[string][]string{"password": {"service-pass"}}),
+	)
+	u, err = auther.Authenticate("alice", "alice-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleUser, u.Role)
+	displayName, bio := testLDAPProfile(t, a, u.ID)
+	require.Equal(t, "Alice L.", displayName)
+	require.Equal(t, "Down the rabbit hole", bio)
+}
+
+func TestLDAPAuther_Authenticate_Suspended(t *testing.T) {
+	d, url := startTestLDAPDirectory(t, newTestLDAPEntry("alice", "alice-pass", "Alice Liddell", "coop-admins"))
+	auther, a, _ := newTestLDAPAuther(t, url)
+	u, err := auther.Authenticate("alice", "alice-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, u.Role)
+	require.Nil(t, a.SuspendUser(u.ID, "spam", "phil", time.Time{}))
+
+	// Directory changes are not synced while the user is suspended
+	d.SetUsers(
+		newTestLDAPEntry("alice", "alice-pass", "Alice L."),
+		gldap.NewEntry("cn=coop-service,"+testdirectory.DefaultUserDN, map[string][]string{"password": {"service-pass"}}),
+	)
+	_, err = auther.Authenticate("alice", "alice-pass")
+	require.Equal(t, ErrUserSuspended, err)
+	u, err = a.User("alice")
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, u.Role)
+	displayName, _ := testLDAPProfile(t, a, u.ID)
+	require.Equal(t, "Alice Liddell", displayName)
+}
+
+func TestLDAPAuther_Authenticate_LocalFallback(t *testing.T) {
+	_, url := startTestLDAPDirectory(t, newTestLDAPEntry("alice", "alice-pass", "Alice"))
+	auther, a, _ := newTestLDAPAuther(t, url)
+	require.Nil(t, a.AddUser("phil", "phil-pass", RoleAdmin, false))
+
+	// Local user not in the directory
+	u, err := auther.Authenticate("phil", "phil-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, u.Role)
+	_, err = auther.Authenticate("phil", "wrong-pass")
+	require.Equal(t, ErrUnauthenticated, err)
+
+	// Unknown everywhere
+	_, err = auther.Authenticate("nobody", "nobody-pass")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestLDAPAuther_Authenticate_ExistingUserNotLinked(t *testing.T) {
+	_, url := startTestLDAPDirectory(t, newTestLDAPEntry("admin", "directory-pass", "Mallory", "staff"))
+	auther, a, avatars := newTestLDAPAuther(t, url)
+	require.Nil(t, a.AddTier(&Tier{Code: "pro", Name: "Pro"}))
+	require.Nil(t, a.AddUser("admin", "admin-pass", RoleAdmin, false))
+
+	// Directory claims to be "admin", but the local admin was not created from the directory
+	_, err := auther.Authenticate("admin", "directory-pass")
+	require.Equal(t, ErrUnauthenticated, err)
+	u, err := auther.Authenticate("admin", "admin-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, u.Role)
+	require.Nil(t, u.Tier)
+	displayName, _ := testLDAPProfile(t, a, u.ID)
+	require.Equal(t, "", displayName)
+	require.Empty(t, avatars)
+	linked, err := a.LDAPUserLinked(u.ID)
+	require.Nil(t, err)
+	require.False(t, linked)
+}
+
+func TestLDAPAuther_Authenticate_DirectoryUnreachable(t *testing.T) {
+	auther, a, _ := newTestLDAPAuther(t, fmt.Sprintf("ldap://127.0.0.1:%d", testdirectory.FreePort(t)))
+	require.Nil(t, a.AddUser("phil", "phil-pass", RoleAdmin, false))
+
+	u, err := auther.Authenticate("phil", "phil-pass")
+	require.Nil(t, err)
+	require.Equal(t, "phil", u.Name)
+	_, err = auther.Authenticate("alice", "alice-pass")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestLDAPAuther_Authenticate_Locked(t *testing.T) {
+	_, url := startTestLDAPDirectory(t, newTestLDAPEntry("alice", "alice-pass", "Alice"))
+	auther, a, _ := newTestLDAPAuther(t, url)
+	_, err := auther.Authenticate("alice", "alice-pass")
+	require.Nil(t, err)
+	u, err := a.User("alice")
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := a.AuthFailed(u.ID)
+		require.Nil(t, err)
+	}
+	_, err = auther.Authenticate("alice", "alice-pass")
+	require.Equal(t, ErrUserLocked, err)
+}
+
+func TestLDAPAuther_Authenticate_BindFailureLocks(t *testing.T) {
+	_, url := startTestLDAPDirectory(t, newTestLDAPEntry("alice", "alice-pass", "Alice"))
+	auther, a, _ := newTestLDAPAuther(t, url)
+	a.config.LoginFailureLimit = 3
+	_, err := auther.Authenticate("alice", "alice-pass")
+	require.Nil(t, err)
+
+	// Failed binds count towards the lockout, until the correct password is rejected as well
+	for i := 0; i < 3; i++ {
+		_, err := auther.Authenticate("alice", "wrong-pass")
+		require.Equal(t, ErrUnauthenticated, err)
+	}
+	u, err := a.User("alice")
+	require.Nil(t, err)
+	failure, err := a.LoginFailure(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, 3, failure.Failures)
+	_, err = auther.Authenticate("alice", "alice-pass")
+	require.Equal(t, ErrUserLocked, err)
+}
+
+func TestLDAPAuther_Tier_Precedence(t *testing.T) {
+	auther, _, _ := newTestLDAPAuther(t, "ldap://127.0.0.1:1")
+	auther.config.TierGroups = []TierGroup{
+		{Group: "staff", Tier: "pro"},
+		{Group: "students", Tier: "basic"},
+	}
+	staff := "cn=staff," + testdirectory.DefaultGroupDN
+	students := "cn=students," + testdirectory.DefaultGroupDN
+	for i := 0; i < 20; i++ {
+		require.Equal(t, "pro", auther.tier([]string{students, staff}))
+		require.Equal(t, "pro", auther.tier([]string{staff, students}))
+	}
+	require.Equal(t, "basic", auther.tier([]string{students}))
+	require.Equal(t, "", auther.tier([]string{"cn=others," + testdirectory.DefaultGroupDN}))
+}
+
+func TestLDAPGroupMatches(t *testing.T) {
+	require.True(t, ldapGroupMatches("cn=admins,ou=groups,dc=example,dc=com", "admins"))
+	require.True(t, ldapGroupMatches("cn=admins,ou=groups,dc=example,dc=com", "CN=Admins,ou=groups,dc=example,dc=com"))
+	require.False(t, ldapGroupMatches("cn=admins,ou=groups,dc=example,dc=com", "groups"))
+	require.False(t, ldapGroupMatches("cn=admins-old,ou=groups,dc=example,dc=com", "admins"))
+	require.False(t, ldapGroupMatches("not a dn", "admins"))
+}
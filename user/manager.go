@@ -2,7 +2,11 @@
 package user
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,7 +34,17 @@ const (
 	userHardDeleteAfterDuration     = 7 * 24 * time.Hour
 	tokenPrefix                     = "tk_"
 	tokenLength                     = 32
-	tokenMaxCount                   = 60 // Only keep this many tokens in the table per user
+	tokenMaxCount                   = 60   // Only keep this many tokens in the table per user
+	deviceKeysMaxDevices            = 10   // Max number of E2E devices per user in the key directory
+	deviceKeysMaxOneTimePrekeys     = 100  // Max number of unclaimed one-time prekeys per device
+	deviceKeyMaxLength              = 1024 // Max length of a base64-encoded public key or signature
+	keyBackupKDFMaxLength           = 1024 // Max length of the key derivation parameters of a key backup
+	contactInvitePrefix             = "ci_"
+	contactInviteLength             = 24
+	contactInvitesMaxCount          = 20 // Max number of active contact invites per user
+	reportIDPrefix                  = "re_"
+	reportIDLength                  = 12
+	reportsMaxOpenCount             = 20 // Max number of open reports per reporter
 	tag                             = "user_manager"
 )
 
@@ -38,6 +52,16 @@ const (
 const (
 	DefaultUserStatsQueueWriterInterval = 33 * time.Second
 	DefaultUserPasswordBcryptCost       = 10
+	DefaultLoginFailureLimit            = 10
+	DefaultLoginLockDuration            = time.Minute
+	DefaultLoginLockMaxDuration         = time.Hour
+)
+
+// Key backup limits: after KeyBackupFailureLimit failed fetch attempts, the backup is locked
+// until KeyBackupLockDuration has passed since the last failure
+const (
+	KeyBackupFailureLimit = 10
+	KeyBackupLockDuration = 24 * time.Hour
 )
 
 var (
@@ -129,8 +153,175 @@ const (
 			bio TEXT NOT NULL DEFAULT '',
 			avatar_id TEXT NOT NULL DEFAULT '',
 			last_seen INTEGER NOT NULL DEFAULT 0,
+			privacy TEXT NOT NULL DEFAULT 'request',
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_contact (
+			user_id TEXT NOT NULL,
+			contact_user_id TEXT NOT NULL,
+			nickname TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'pending',
+			created_at INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+			updated_at INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+			favorite INT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, contact_user_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
+			FOREIGN KEY (contact_user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_contact_user ON user_contact(user_id, status);
+		CREATE INDEX IF NOT EXISTS idx_contact_reverse ON user_contact(contact_user_id, status);
+		CREATE TABLE IF NOT EXISTS user_contact_label (
+			user_id TEXT NOT NULL,
+			contact_user_id TEXT NOT NULL,
+			label TEXT NOT NULL,
+			PRIMARY KEY (user_id, contact_user_id, label),
+			FOREIGN KEY (user_id, contact_user_id) REFERENCES user_contact (user_id, contact_user_id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_contact_label ON user_contact_label(user_id, label);
+		CREATE TABLE IF NOT EXISTS topic_meta (
+			topic TEXT PRIMARY KEY,
+			display_name TEXT NOT NULL DEFAULT '',
+			description TEXT NOT NULL DEFAULT '',
+			avatar_id TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+			dm_user_a TEXT NOT NULL DEFAULT '',
+			dm_user_b TEXT NOT NULL DEFAULT '',
+			dm_request_to TEXT NOT NULL DEFAULT '',
+			dm_request_count INT NOT NULL DEFAULT 0
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_topic_meta_dm ON topic_meta(dm_user_a, dm_user_b) WHERE dm_user_a != '';
+		CREATE TABLE IF NOT EXISTS user_login_failure (
+			user_id TEXT PRIMARY KEY,
+			failures INT NOT NULL,
+			last_failure INT NOT NULL,
+			locked_until INT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_suspension (
+			user_id TEXT PRIMARY KEY,
+			reason TEXT NOT NULL,
+			suspended_by TEXT NOT NULL,
+			suspended_at INT NOT NULL,
+			suspended_until INT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_oidc (
+			user_id TEXT PRIMARY KEY,
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_user_oidc_subject ON user_oidc (issuer, subject);
+		CREATE TABLE IF NOT EXISTS user_ldap (
+			user_id TEXT PRIMARY KEY,
+			dn TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS report (
+			id TEXT PRIMARY KEY,
+			reporter TEXT NOT NULL,
+			type TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			reported_user TEXT NOT NULL,
+			category TEXT NOT NULL,
+			comment TEXT NOT NULL,
+			snapshot TEXT NOT NULL,
+			snapshot_expires INT NOT NULL DEFAULT 0,
+			status TEXT NOT NULL,
+			created INT NOT NULL,
+			updated INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_report_status ON report (status, created);
+		CREATE INDEX IF NOT EXISTS idx_report_reporter ON report (reporter, status);
+		CREATE INDEX IF NOT EXISTS idx_report_snapshot_expires ON report (snapshot_expires);
+		CREATE TABLE IF NOT EXISTS report_action (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			report_id TEXT NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			note TEXT NOT NULL,
+			time INT NOT NULL,
+			FOREIGN KEY (report_id) REFERENCES report (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_report_action_report_id ON report_action (report_id);
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INT NOT NULL,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			detail TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log (time);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log (actor);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log (target);
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit log is append-only');
+		END;
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit log is append-only');
+		END;
+		CREATE TABLE IF NOT EXISTS user_device_key (
+			user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			identity_key TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			signed_prekey_id INT NOT NULL,
+			signed_prekey TEXT NOT NULL,
+			signed_prekey_signature TEXT NOT NULL,
+			created_at INT NOT NULL,
+			updated_at INT NOT NULL,
+			PRIMARY KEY (user_id, device_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_device_prekey (
+			user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			key_id INT NOT NULL,
+			public_key TEXT NOT NULL,
+			PRIMARY KEY (user_id, device_id, key_id),
+			FOREIGN KEY (user_id, device_id) REFERENCES user_device_key (user_id, device_id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_key_backup (
+			user_id TEXT PRIMARY KEY,
+			version INT NOT NULL,
+			kdf TEXT NOT NULL,
+			verifier_hash TEXT NOT NULL,
+			data TEXT NOT NULL,
+			size INT NOT NULL,
+			revision INT NOT NULL,
+			created_at INT NOT NULL,
+			updated_at INT NOT NULL,
+			failures INT NOT NULL DEFAULT 0,
+			last_failure INT NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_contact_verification (
+			user_id TEXT NOT NULL,
+			contact_user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			verified_at INT NOT NULL,
+			PRIMARY KEY (user_id, contact_user_id, device_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
+			FOREIGN KEY (contact_user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_contact_invite (
+			token TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			max_uses INT NOT NULL,
+			used_count INT NOT NULL,
+			expires INT NOT NULL,
+			created INT NOT NULL,
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
 		);
+		CREATE INDEX IF NOT EXISTS idx_user_contact_invite_user_id ON user_contact_invite (user_id);
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
 			version INT NOT NULL
@@ -146,28 +337,32 @@ const (
 	`
 
 	selectUserByIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id, s.reason, s.suspended_by, s.suspended_at, s.suspended_until
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
+		LEFT JOIN user_suspension s on s.user_id = u.id
 		WHERE u.id = ?
 	`
 	selectUserByNameQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id, s.reason, s.suspended_by, s.suspended_at, s.suspended_until
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
+		LEFT JOIN user_suspension s on s.user_id = u.id
 		WHERE user = ?
 	`
 	selectUserByTokenQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id, s.reason, s.suspended_by, s.suspended_at, s.suspended_until
 		FROM user u
 		JOIN user_token tk on u.id = tk.user_id
 		LEFT JOIN tier t on t.id = u.tier_id
+		LEFT JOIN user_suspension s on s.user_id = u.id
 		WHERE tk.token = ? AND (tk.expires = 0 OR tk.expires >= ?)
 	`
 	selectUserByStripeCustomerIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.provisioned, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id, s.reason, s.suspended_by, s.suspended_at, s.suspended_until
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
+		LEFT JOIN user_suspension s on s.user_id = u.id
 		WHERE u.stripe_customer_id = ?
 	`
 	selectTopicPermsQuery = `
@@ -296,10 +491,58 @@ const (
 		)
 	`
 
+	selectLoginFailureQuery = `SELECT failures, last_failure, locked_until FROM user_login_failure WHERE user_id = ?`
+	upsertLoginFailureQuery = `
+		INSERT INTO user_login_failure (user_id, failures, last_failure, locked_until)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id)
+		DO UPDATE SET failures = excluded.failures, last_failure = excluded.last_failure, locked_until = excluded.locked_until
+	`
+	deleteLoginFailureQuery        = `DELETE FROM user_login_failure WHERE user_id = ?`
+	selectLockedUsersCountQuery    = `SELECT COUNT(*) FROM user_login_failure WHERE locked_until > ?`
+	deleteExpiredLoginFailureQuery = `DELETE FROM user_login_failure WHERE locked_until < ? AND last_failure < ?`
+
+	upsertSuspensionQuery = `
+		INSERT INTO user_suspension (user_id, reason, suspended_by, suspended_at, suspended_until)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id)
+		DO UPDATE SET reason = excluded.reason, suspended_by = excluded.suspended_by, suspended_at = excluded.suspended_at, suspended_until = excluded.suspended_until
+	`
+	deleteSuspensionQuery         = `DELETE FROM user_suspension WHERE user_id = ?`
+	deleteExpiredSuspensionsQuery = `DELETE FROM user_suspension WHERE suspended_until > 0 AND suspended_until <= ?`
+
+	selectUserIDByOIDCSubjectQuery = `SELECT user_id FROM user_oidc WHERE issuer = ? AND subject = ?`
+	upsertOIDCSubjectQuery         = `
+		INSERT INTO user_oidc (user_id, issuer, subject)
+		VALUES (?, ?, ?)
+		ON CONFLICT (user_id)
+		DO UPDATE SET issuer = excluded.issuer, subject = excluded.subject
+	`
+	deleteOIDCSubjectQuery = `DELETE FROM user_oidc WHERE user_id = ?`
+
+	selectLDAPUserCountQuery = `SELECT COUNT(*) FROM user_ldap WHERE user_id = ?`
+	upsertLDAPUserQuery      = `
+		INSERT INTO user_ldap (user_id, dn)
+		VALUES (?, ?)
+		ON CONFLICT (user_id)
+		DO UPDATE SET dn = excluded.dn
+	`
+
+	insertAuditEntryQuery   = `INSERT INTO audit_log (time, actor, action, target, ip, user_agent, detail) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	selectAuditEntriesQuery = `SELECT id, time, actor, action, target, ip, user_agent, detail FROM audit_log`
+
 	selectPhoneNumbersQuery = `SELECT phone_number FROM user_phone WHERE user_id = ?`
 	insertPhoneNumberQuery  = `INSERT INTO user_phone (user_id, phone_number) VALUES (?, ?)`
 	deletePhoneNumberQuery  = `DELETE FROM user_phone WHERE user_id = ? AND phone_number = ?`
 
+	selectUsernamesByPhoneNumberQuery = `
+		SELECT u.user
+		FROM user_phone p
+		JOIN user u ON u.id = p.user_id
+		WHERE p.phone_number = ? AND u.deleted IS NULL
+		ORDER BY u.user
+	`
+
 	insertTierQuery = `
 		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
@@ -336,7 +579,7 @@ const (
 
 // Schema management queries
 const (
-	currentSchemaVersion     = 9
+	currentSchemaVersion     = 22
 	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
 	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
 	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
@@ -593,6 +836,202 @@ const (
 		CREATE UNIQUE INDEX IF NOT EXISTS idx_topic_meta_dm ON topic_meta(dm_user_a, dm_user_b) WHERE dm_user_a != '';
 	`
 
+	// 9 -> 10: Per-user login failure counters
+	migrate9To10UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_login_failure (
+			user_id TEXT PRIMARY KEY,
+			failures INT NOT NULL,
+			last_failure INT NOT NULL,
+			locked_until INT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
+	// 10 -> 11: Append-only audit log
+	migrate10To11UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INT NOT NULL,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			detail TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log (time);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log (actor);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log (target);
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit log is append-only');
+		END;
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit log is append-only');
+		END;
+	`
+
+	// 11 -> 12: E2E key directory (device identity keys, signed prekeys, one-time prekeys)
+	migrate11To12UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_device_key (
+			user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			identity_key TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			signed_prekey_id INT NOT NULL,
+			signed_prekey TEXT NOT NULL,
+			signed_prekey_signature TEXT NOT NULL,
+			created_at INT NOT NULL,
+			updated_at INT NOT NULL,
+			PRIMARY KEY (user_id, device_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_device_prekey (
+			user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			key_id INT NOT NULL,
+			public_key TEXT NOT NULL,
+			PRIMARY KEY (user_id, device_id, key_id),
+			FOREIGN KEY (user_id, device_id) REFERENCES user_device_key (user_id, device_id) ON DELETE CASCADE
+		);
+	`
+
+	// 12 -> 13: Encrypted key backups
+	migrate12To13UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_key_backup (
+			user_id TEXT PRIMARY KEY,
+			version INT NOT NULL,
+			kdf TEXT NOT NULL,
+			verifier_hash TEXT NOT NULL,
+			data TEXT NOT NULL,
+			size INT NOT NULL,
+			revision INT NOT NULL,
+			created_at INT NOT NULL,
+			updated_at INT NOT NULL,
+			failures INT NOT NULL DEFAULT 0,
+			last_failure INT NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
+	// 13 -> 14: Contact device verification (safety numbers)
+	migrate13To14UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_contact_verification (
+			user_id TEXT NOT NULL,
+			contact_user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			verified_at INT NOT NULL,
+			PRIMARY KEY (user_id, contact_user_id, device_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
+			FOREIGN KEY (contact_user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
+	// 14 -> 15: Personal contact invites
+	migrate14To15UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_contact_invite (
+			token TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			max_uses INT NOT NULL,
+			used_count INT NOT NULL,
+			expires INT NOT NULL,
+			created INT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_user_contact_invite_user_id ON user_contact_invite (user_id);
+	`
+
+	// 15 -> 16: DM message requests
+	migrate15To16UpdateQueries = `
+		ALTER TABLE topic_meta ADD COLUMN dm_request_to TEXT NOT NULL DEFAULT '';
+		ALTER TABLE topic_meta ADD COLUMN dm_request_count INT NOT NULL DEFAULT 0;
+	`
+
+	// 16 -> 17: Contact favorites and labels
+	migrate16To17UpdateQueries = `
+		ALTER TABLE user_contact ADD COLUMN favorite INT NOT NULL DEFAULT 0;
+		CREATE TABLE IF NOT EXISTS user_contact_label (
+			user_id TEXT NOT NULL,
+			contact_user_id TEXT NOT NULL,
+			label TEXT NOT NULL,
+			PRIMARY KEY (user_id, contact_user_id, label),
+			FOREIGN KEY (user_id, contact_user_id) REFERENCES user_contact (user_id, contact_user_id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_contact_label ON user_contact_label(user_id, label);
+	`
+
+	// 17 -> 18: User suspensions
+	migrate17To18UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_suspension (
+			user_id TEXT PRIMARY KEY,
+			reason TEXT NOT NULL,
+			suspended_by TEXT NOT NULL,
+			suspended_at INT NOT NULL,
+			suspended_until INT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
+	// 18 -> 19: Abuse reports
+	migrate18To19UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS report (
+			id TEXT PRIMARY KEY,
+			reporter TEXT NOT NULL,
+			type TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			reported_user TEXT NOT NULL,
+			category TEXT NOT NULL,
+			comment TEXT NOT NULL,
+			snapshot TEXT NOT NULL,
+			status TEXT NOT NULL,
+			created INT NOT NULL,
+			updated INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_report_status ON report (status, created);
+		CREATE INDEX IF NOT EXISTS idx_report_reporter ON report (reporter, status);
+		CREATE TABLE IF NOT EXISTS report_action (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			report_id TEXT NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			note TEXT NOT NULL,
+			time INT NOT NULL,
+			FOREIGN KEY (report_id) REFERENCES report (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_report_action_report_id ON report_action (report_id);
+	`
+
+	// 19 -> 20: OpenID Connect subjects
+	migrate19To20UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_oidc (
+			user_id TEXT PRIMARY KEY,
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_user_oidc_subject ON user_oidc (issuer, subject);
+	`
+
+	// 20 -> 21: Expiry of report snapshots. Existing snapshots are marked as expired, so that they are
+	// reduced to the fields moderators need on the next prune run (they used to contain full messages).
+	migrate20To21UpdateQueries = `
+		ALTER TABLE report ADD COLUMN snapshot_expires INT NOT NULL DEFAULT 0;
+		UPDATE report SET snapshot_expires = 1 WHERE snapshot != '[]';
+		CREATE INDEX IF NOT EXISTS idx_report_snapshot_expires ON report (snapshot_expires);
+	`
+
+	// 21 -> 22: Users created from the LDAP directory
+	migrate21To22UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_ldap (
+			user_id TEXT PRIMARY KEY,
+			dn TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
 	// Contact CRUD queries
 	insertContactQuery = `
 		INSERT INTO user_contact (user_id, contact_user_id, status, created_at, updated_at)
@@ -603,13 +1042,21 @@ const (
 		)
 	`
 	selectContactsQuery = `
-		SELECT u2.user, COALESCE(p.display_name, ''), COALESCE(p.bio, ''), COALESCE(p.avatar_id, ''), COALESCE(p.last_seen, 0), c.status, c.nickname, c.created_at
+		SELECT u2.user, COALESCE(p.display_name, ''), COALESCE(p.bio, ''), COALESCE(p.avatar_id, ''), COALESCE(p.last_seen, 0), c.status, c.nickname, c.favorite, c.created_at
 		FROM user_contact c
 		JOIN user u1 ON u1.id = c.user_id
 		JOIN user u2 ON u2.id = c.contact_user_id
 		LEFT JOIN user_profile p ON p.user_id = c.contact_user_id
 		WHERE u1.user = ? AND c.status = ?
-		ORDER BY COALESCE(p.display_name, u2.user)
+		ORDER BY c.favorite DESC, COALESCE(p.display_name, u2.user)
+	`
+	selectContactQuery = `
+		SELECT u2.user, COALESCE(p.display_name, ''), COALESCE(p.bio, ''), COALESCE(p.avatar_id, ''), COALESCE(p.last_seen, 0), c.status, c.nickname, c.favorite, c.created_at
+		FROM user_contact c
+		JOIN user u1 ON u1.id = c.user_id
+		JOIN user u2 ON u2.id = c.contact_user_id
+		LEFT JOIN user_profile p ON p.user_id = c.contact_user_id
+		WHERE u1.user = ? AND u2.user = ?
 	`
 	selectContactRequestsQuery = `
 		SELECT u1.user, COALESCE(p.display_name, ''), COALESCE(p.bio, ''), COALESCE(p.avatar_id, ''), COALESCE(p.last_seen, 0), c.status, c.nickname, c.created_at
@@ -644,6 +1091,101 @@ const (
 		WHERE ((u1.user = ? AND u2.user = ?) OR (u1.user = ? AND u2.user = ?))
 		AND c.status = 'blocked'
 	`
+	upsertContactAcceptedQuery = `
+		INSERT INTO user_contact (user_id, contact_user_id, status, created_at, updated_at)
+		VALUES (?, ?, 'accepted', strftime('%s','now'), strftime('%s','now'))
+		ON CONFLICT (user_id, contact_user_id) DO UPDATE SET status = 'accepted', updated_at = excluded.updated_at
+	`
+	selectContactAcceptedCountQuery = `
+		SELECT COUNT(*) FROM user_contact
+		WHERE ((user_id = ? AND contact_user_id = ?) OR (user_id = ? AND contact_user_id = ?))
+		AND status = 'accepted'
+	`
+	updateContactQuery = `
+		UPDATE user_contact SET nickname = ?, favorite = ?, updated_at = strftime('%s','now')
+		WHERE user_id = (SELECT id FROM user WHERE user = ?)
+		AND contact_user_id = (SELECT id FROM user WHERE user = ?)
+	`
+	selectContactLabelsQuery = `
+		SELECT u2.user, l.label
+		FROM user_contact_label l
+		JOIN user u1 ON u1.id = l.user_id
+		JOIN user u2 ON u2.id = l.contact_user_id
+		WHERE u1.user = ?
+		ORDER BY l.label
+	`
+	deleteContactLabelsQuery = `
+		DELETE FROM user_contact_label
+		WHERE user_id = (SELECT id FROM user WHERE user = ?)
+		AND contact_user_id = (SELECT id FROM user WHERE user = ?)
+	`
+	insertContactLabelQuery = `
+		INSERT INTO user_contact_label (user_id, contact_user_id, label)
+		VALUES ((SELECT id FROM user WHERE user = ?), (SELECT id FROM user WHERE user = ?), ?)
+	`
+	selectContactUsernamesByLabelQuery = `
+		SELECT u2.user
+		FROM user_contact_label l
+		JOIN user_contact c ON c.user_id = l.user_id AND c.contact_user_id = l.contact_user_id
+		JOIN user u1 ON u1.id = l.user_id
+		JOIN user u2 ON u2.id = l.contact_user_id
+		WHERE u1.user = ? AND l.label = ? AND c.status = 'accepted'
+		ORDER BY u2.user
+	`
+	selectBlockerIDsQuery   = `SELECT user_id FROM user_contact WHERE contact_user_id = ? AND status = 'blocked'`
+	selectBlockedIDsQuery   = `SELECT contact_user_id FROM user_contact WHERE user_id = ? AND status = 'blocked'`
+	selectBlockerNamesQuery = `
+		SELECT u.user
+		FROM user_contact c
+		JOIN user u ON u.id = c.user_id
+		WHERE c.contact_user_id = ? AND c.status = 'blocked'
+	`
+
+	// Contact invite queries
+	insertContactInviteQuery = `
+		INSERT INTO user_contact_invite (token, user_id, max_uses, used_count, expires, created)
+		VALUES (?, ?, ?, 0, ?, ?)
+	`
+	selectContactInviteQuery = `
+		SELECT i.token, u.id, u.user, i.max_uses, i.used_count, i.expires, i.created
+		FROM user_contact_invite i
+		JOIN user u ON u.id = i.user_id
+		WHERE i.token = ?
+	`
+	selectContactInvitesQuery = `
+		SELECT i.token, u.id, u.user, i.max_uses, i.used_count, i.expires, i.created
+		FROM user_contact_invite i
+		JOIN user u ON u.id = i.user_id
+		WHERE i.user_id = ? AND (i.expires = 0 OR i.expires >= ?)
+		ORDER BY i.created DESC
+	`
+	selectContactInviteCountQuery = `SELECT COUNT(*) FROM user_contact_invite WHERE user_id = ? AND (expires = 0 OR expires >= ?)`
+	updateContactInviteUsedQuery  = `UPDATE user_contact_invite SET used_count = used_count + 1 WHERE token = ? AND used_count < max_uses`
+	deleteContactInviteQuery      = `DELETE FROM user_contact_invite WHERE user_id = ? AND token = ?`
+	deleteExpiredContactInvites   = `DELETE FROM user_contact_invite WHERE expires > 0 AND expires < ?`
+
+	// Contact verification queries
+	selectContactDevicesQuery = `
+		SELECT k.device_id, k.fingerprint, COALESCE(v.fingerprint, ''), COALESCE(v.verified_at, 0)
+		FROM user_device_key k
+		JOIN user c ON c.id = k.user_id
+		LEFT JOIN user_contact_verification v
+			ON v.user_id = (SELECT id FROM user WHERE user = ?) AND v.contact_user_id = k.user_id AND v.device_id = k.device_id
+		WHERE c.user = ?
+		ORDER BY k.created_at, k.device_id
+	`
+	upsertContactVerificationQuery = `
+		INSERT INTO user_contact_verification (user_id, contact_user_id, device_id, fingerprint, verified_at)
+		VALUES ((SELECT id FROM user WHERE user = ?), (SELECT id FROM user WHERE user = ?), ?, ?, ?)
+		ON CONFLICT (user_id, contact_user_id, device_id) DO UPDATE SET
+			fingerprint = excluded.fingerprint,
+			verified_at = excluded.verified_at
+	`
+	deleteContactVerificationsQuery = `
+		DELETE FROM user_contact_verification
+		WHERE user_id = (SELECT id FROM user WHERE user = ?)
+		AND contact_user_id = (SELECT id FROM user WHERE user = ?)
+	`
 
 	// User search query
 	searchUsersQuery = `
@@ -670,7 +1212,7 @@ const (
 
 	// Topic meta queries
 	selectTopicMetaQuery = `
-		SELECT topic, display_name, description, avatar_id, created_by, created_at, dm_user_a, dm_user_b
+		SELECT topic, display_name, description, avatar_id, created_by, created_at, dm_user_a, dm_user_b, dm_request_to, dm_request_count
 		FROM topic_meta WHERE topic = ?
 	`
 	upsertTopicMetaQuery = `
@@ -693,13 +1235,118 @@ const (
 		WHERE (dm_user_a = ? AND dm_user_b = ?) OR (dm_user_a = ? AND dm_user_b = ?)
 		LIMIT 1
 	`
+	updateDMRequestQuery        = `UPDATE topic_meta SET dm_request_to = ?, dm_request_count = 0 WHERE topic = ? AND dm_user_a != ''`
+	updateDMRequestCountQuery   = `UPDATE topic_meta SET dm_request_count = dm_request_count + 1 WHERE topic = ? AND dm_request_to != '' AND dm_request_count < ?`
+	updateDMRequestReleaseQuery = `UPDATE topic_meta SET dm_request_count = dm_request_count - 1 WHERE topic = ? AND dm_request_count > 0`
+	deleteDMTopicMetaQuery      = `DELETE FROM topic_meta WHERE topic = ? AND dm_user_a != ''`
 
 	// DM-related: list DM topics for a user via topic_meta
 	selectDMTopicsQuery = `
-		SELECT topic, dm_user_a, dm_user_b
+		SELECT topic, dm_user_a, dm_user_b, dm_request_to, created_at
 		FROM topic_meta
 		WHERE dm_user_a = ? OR dm_user_b = ?
 	`
+	selectChatTopicsQuery = `
+		SELECT topic FROM topic_meta WHERE dm_user_a = ? OR dm_user_b = ?
+		UNION
+		SELECT m.topic
+		FROM topic_meta m
+		JOIN user_access a ON m.topic LIKE a.topic ESCAPE '\'
+		JOIN user u ON u.id = a.user_id
+		WHERE u.user = ? AND m.dm_user_a = '' AND a.read = 1
+		ORDER BY 1
+	`
+
+	// E2E key directory queries
+	selectDeviceKeysCountQuery   = `SELECT COUNT(*) FROM user_device_key WHERE user_id = ?`
+	selectDeviceIdentityKeyQuery = `SELECT identity_key FROM user_device_key WHERE user_id = ? AND device_id = ?`
+	upsertDeviceKeysQuery        = `
+		INSERT INTO user_device_key (user_id, device_id, identity_key, fingerprint, signed_prekey_id, signed_prekey, signed_prekey_signature, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET
+			identity_key = excluded.identity_key,
+			fingerprint = excluded.fingerprint,
+			signed_prekey_id = excluded.signed_prekey_id,
+			signed_prekey = excluded.signed_prekey,
+			signed_prekey_signature = excluded.signed_prekey_signature,
+			updated_at = excluded.updated_at
+	`
+	deleteDeviceKeysQuery = `DELETE FROM user_device_key WHERE user_id = ? AND device_id = ?`
+	selectDeviceKeysQuery = `
+		SELECT k.device_id, k.identity_key, k.fingerprint, k.signed_prekey_id, k.signed_prekey, k.signed_prekey_signature, k.created_at, k.updated_at,
+			(SELECT COUNT(*) FROM user_device_prekey p WHERE p.user_id = k.user_id AND p.device_id = k.device_id)
+		FROM user_device_key k
+		JOIN user u ON u.id = k.user_id
+		WHERE u.user = ?
+		ORDER BY k.created_at, k.device_id
+	`
+	selectDeviceFingerprintsQuery = `
+		SELECT u.user, k.device_id, k.fingerprint
+		FROM user_device_key k
+		JOIN user u ON u.id = k.user_id
+		WHERE u.user IN (%s)
+		ORDER BY u.user, k.created_at, k.device_id
+	`
+	selectOneTimePrekeysCountQuery = `SELECT COUNT(*) FROM user_device_prekey WHERE user_id = ? AND device_id = ?`
+	insertOneTimePrekeyQuery       = `
+		INSERT INTO user_device_prekey (user_id, device_id, key_id, public_key)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, device_id, key_id) DO UPDATE SET public_key = excluded.public_key
+	`
+	deleteOneTimePrekeysQuery = `DELETE FROM user_device_prekey WHERE user_id = ? AND device_id = ?`
+	claimOneTimePrekeyQuery   = `
+		DELETE FROM user_device_prekey
+		WHERE rowid = (
+			SELECT p.rowid
+			FROM user_device_prekey p
+			JOIN user u ON u.id = p.user_id
+			WHERE u.user = ? AND p.device_id = ?
+			ORDER BY p.key_id
+			LIMIT 1
+		)
+		RETURNING key_id, public_key
+	`
+
+	// Key backup queries
+	selectKeyBackupQuery = `
+		SELECT version, kdf, verifier_hash, data, size, revision, created_at, updated_at, failures, last_failure
+		FROM user_key_backup
+		WHERE user_id = ?
+	`
+	upsertKeyBackupQuery = `
+		INSERT INTO user_key_backup (user_id, version, kdf, verifier_hash, data, size, revision, created_at, updated_at, failures, last_failure)
+		VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?, 0, 0)
+		ON CONFLICT (user_id) DO UPDATE SET
+			version = excluded.version,
+			kdf = excluded.kdf,
+			verifier_hash = excluded.verifier_hash,
+			data = excluded.data,
+			size = excluded.size,
+			revision = revision + 1,
+			updated_at = excluded.updated_at,
+			failures = 0,
+			last_failure = 0
+	`
+	updateKeyBackupAttemptQuery = `
+		UPDATE user_key_backup
+		SET failures = CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END, last_failure = ?
+		WHERE user_id = ? AND (last_failure < ? OR failures < ?)
+		RETURNING failures, last_failure
+	`
+	updateKeyBackupResetFailuresQuery = `UPDATE user_key_backup SET failures = 0, last_failure = 0 WHERE user_id = ?`
+	deleteKeyBackupQuery              = `DELETE FROM user_key_backup WHERE user_id = ?`
+
+	// Report queries
+	insertReportQuery = `
+		INSERT INTO report (id, reporter, type, topic, message_id, reported_user, category, comment, snapshot, snapshot_expires, status, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	selectReportsQuery         = `SELECT id, reporter, type, topic, message_id, reported_user, category, comment, snapshot, snapshot_expires, status, created, updated FROM report`
+	selectReportOpenCountQuery = `SELECT COUNT(*) FROM report WHERE reporter = ? AND status = 'open'`
+	updateReportStatusQuery    = `UPDATE report SET status = ?, updated = ? WHERE id = ?`
+	updateReportSnapshotQuery  = `UPDATE report SET snapshot = ?, snapshot_expires = ? WHERE id = ?`
+	insertReportActionQuery    = `INSERT INTO report_action (report_id, action, actor, note, time) VALUES (?, ?, ?, ?, ?)`
+	selectReportActionsQuery   = `SELECT id, action, actor, note, time FROM report_action WHERE report_id = ? ORDER BY id`
 
 	// Profile CRUD queries
 	selectProfileByUserIDQuery = `
@@ -708,16 +1355,18 @@ const (
 		WHERE p.user_id = ?
 	`
 	selectProfileByUsernameQuery = `
-		SELECT u.user, p.display_name, p.bio, p.avatar_id, p.last_seen, p.privacy
+		SELECT u.user, p.display_name, p.bio, p.avatar_id, p.last_seen, p.privacy, s.suspended_until
 		FROM user_profile p
 		JOIN user u ON u.id = p.user_id
+		LEFT JOIN user_suspension s ON s.user_id = u.id
 		WHERE u.user = ?
 	`
 	selectProfilesByTopicQuery = `
-		SELECT u.user, p.display_name, p.bio, p.avatar_id, p.last_seen
+		SELECT u.user, p.display_name, p.bio, p.avatar_id, p.last_seen, s.suspended_until
 		FROM user_access a
 		JOIN user u ON u.id = a.user_id
 		LEFT JOIN user_profile p ON p.user_id = u.id
+		LEFT JOIN user_suspension s ON s.user_id = u.id
 		WHERE a.topic = ? AND u.role != 'anonymous'
 	`
 	upsertProfileQuery = `
@@ -732,6 +1381,9 @@ const (
 	updateProfileDisplayNameBioQuery = `
 		UPDATE user_profile SET display_name = ?, bio = ? WHERE user_id = ?
 	`
+	updateProfileDisplayNameQuery = `
+		UPDATE user_profile SET display_name = ? WHERE user_id = ?
+	`
 	updateProfileAvatarQuery = `
 		UPDATE user_profile SET avatar_id = ? WHERE user_id = ?
 	`
@@ -745,14 +1397,27 @@ const (
 
 var (
 	migrations = map[int]func(db *sql.DB) error{
-		1: migrateFrom1,
-		2: migrateFrom2,
-		3: migrateFrom3,
-		4: migrateFrom4,
-		5: migrateFrom5,
-		6: migrateFrom6,
-		7: migrateFrom7,
-		8: migrateFrom8,
+		1:  migrateFrom1,
+		2:  migrateFrom2,
+		3:  migrateFrom3,
+		4:  migrateFrom4,
+		5:  migrateFrom5,
+		6:  migrateFrom6,
+		7:  migrateFrom7,
+		8:  migrateFrom8,
+		9:  migrateFrom9,
+		10: migrateFrom10,
+		11: migrateFrom11,
+		12: migrateFrom12,
+		13: migrateFrom13,
+		14: migrateFrom14,
+		15: migrateFrom15,
+		16: migrateFrom16,
+		17: migrateFrom17,
+		18: migrateFrom18,
+		19: migrateFrom19,
+		20: migrateFrom20,
+		21: migrateFrom21,
 	}
 )
 
@@ -769,15 +1434,18 @@ type Manager struct {
 
 // Config holds the configuration for the user Manager
 type Config struct {
-	Filename            string              // Database filename, e.g. "/var/lib/ntfy/user.db"
-	StartupQueries      string              // Queries to run on startup, e.g. to create initial users or tiers
-	DefaultAccess       Permission          // Default permission if no ACL matches
-	ProvisionEnabled    bool                // Hack: Enable auto-provisioning of users and access grants, disabled for "ntfy user" commands
-	Users               []*User             // Predefined users to create on startup
-	Access              map[string][]*Grant // Predefined access grants to create on startup (username -> []*Grant)
-	Tokens              map[string][]*Token // Predefined users to create on startup (username -> []*Token)
-	QueueWriterInterval time.Duration       // Interval for the async queue writer to flush stats and token updates to the database
-	BcryptCost          int                 // Cost of generated passwords; lowering makes testing faster
+	Filename             string              // Database filename, e.g. "/var/lib/ntfy/user.db"
+	StartupQueries       string              // Queries to run on startup, e.g. to create initial users or tiers
+	DefaultAccess        Permission          // Default permission if no ACL matches
+	ProvisionEnabled     bool                // Hack: Enable auto-provisioning of users and access grants, disabled for "ntfy user" commands
+	Users                []*User             // Predefined users to create on startup
+	Access               map[string][]*Grant // Predefined access grants to create on startup (username -> []*Grant)
+	Tokens               map[string][]*Token // Predefined users to create on startup (username -> []*Token)
+	QueueWriterInterval  time.Duration       // Interval for the async queue writer to flush stats and token updates to the database
+	BcryptCost           int                 // Cost of generated passwords; lowering makes testing faster
+	LoginFailureLimit    int                 // Number of consecutive failed logins after which a user is temporarily locked
+	LoginLockDuration    time.Duration       // Duration of the first lock; doubled for every further failed login
+	LoginLockMaxDuration time.Duration       // Upper bound for the lock duration; failures older than this are forgotten
 }
 
 var _ Auther = (*Manager)(nil)
@@ -791,6 +1459,15 @@ func NewManager(config *Config) (*Manager, error) {
 	if config.QueueWriterInterval.Seconds() <= 0 {
 		config.QueueWriterInterval = DefaultUserStatsQueueWriterInterval
 	}
+	if config.LoginFailureLimit <= 0 {
+		config.LoginFailureLimit = DefaultLoginFailureLimit
+	}
+	if config.LoginLockDuration <= 0 {
+		config.LoginLockDuration = DefaultLoginLockDuration
+	}
+	if config.LoginLockMaxDuration <= 0 {
+		config.LoginLockMaxDuration = DefaultLoginLockMaxDuration
+	}
 	// Check the parent directory of the database file (makes for friendly error messages)
 	parentDir := filepath.Dir(config.Filename)
 	if !util.FileExists(parentDir) {
@@ -823,7 +1500,10 @@ func NewManager(config *Config) (*Manager, error) {
 
 // Authenticate checks username and password and returns a User if correct, and the user has not been
 // marked as deleted. The method returns in constant-ish time, regardless of whether the user exists or
-// the password is correct or incorrect.
+// the password is correct or incorrect. An incorrect password is recorded as a failed login attempt (see
+// AuthFailed). If the user is temporarily locked due to too many failed login attempts, ErrUserLocked is
+// returned without checking the password. If the password is correct but the user is suspended (see
+// SuspendUser), ErrUserSuspended is returned.
 func (a *Manager) Authenticate(username, password string) (*User, error) {
 	if username == Everyone {
 		return nil, ErrUnauthenticated
@@ -837,77 +1517,384 @@ func (a *Manager) Authenticate(username, password string) (*User, error) {
 		log.Tag(tag).Field("user_name", username).Trace("Authentication of user failed (2): user marked deleted")
 		bcrypt.CompareHashAndPassword([]byte(userAuthIntentionalSlowDownHash), []byte("intentional slow-down to avoid timing attacks"))
 		return nil, ErrUnauthenticated
+	}
+	failure, err := a.LoginFailure(user.ID)
+	if err != nil {
+		return nil, err
+	} else if failure.Locked() {
+		log.Tag(tag).Field("user_name", username).Trace("Authentication of user failed (4): user locked until %s", failure.LockedUntil.String())
+		bcrypt.CompareHashAndPassword([]byte(userAuthIntentionalSlowDownHash), []byte("intentional slow-down to avoid timing attacks"))
+		return nil, ErrUserLocked
 	} else if err := bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password)); err != nil {
 		log.Tag(tag).Field("user_name", username).Err(err).Trace("Authentication of user failed (3)")
+		if _, err := a.AuthFailed(user.ID); err != nil {
+			return nil, err
+		}
 		return nil, ErrUnauthenticated
 	}
-	return user, nil
-}
-
-// AuthenticateToken checks if the token exists and returns the associated User if it does.
-// The method sets the User.Token value to the token that was used for authentication.
-func (a *Manager) AuthenticateToken(token string) (*User, error) {
-	if len(token) != tokenLength {
-		return nil, ErrUnauthenticated
+	if user.Suspended() {
+		log.Tag(tag).Field("user_name", username).Trace("Authentication of user failed (5): user suspended")
+		return nil, ErrUserSuspended
 	}
-	user, err := a.userByToken(token)
-	if err != nil {
-		log.Tag(tag).Field("token", token).Err(err).Trace("Authentication of token failed")
-		return nil, ErrUnauthenticated
+	if failure.Failures > 0 {
+		if err := a.ResetLoginFailures(user.ID); err != nil {
+			return nil, err
+		}
 	}
-	user.Token = token
 	return user, nil
 }
 
-// CreateToken generates a random token for the given user and returns it. The token expires
-// after a fixed duration unless ChangeToken is called. This function also prunes tokens for the
-// given user, if there are too many of them.
-func (a *Manager) CreateToken(userID, label string, expires time.Time, origin netip.Addr, provisioned bool) (*Token, error) {
-	return queryTx(a.db, func(tx *sql.Tx) (*Token, error) {
-		return a.createTokenTx(tx, userID, GenerateToken(), label, expires, origin, provisioned)
+// LoginFailure returns the failed login attempts for the user with the given user ID. If there are
+// no failed attempts, an empty LoginFailure is returned.
+func (a *Manager) LoginFailure(userID string) (*LoginFailure, error) {
+	return queryTx(a.db, func(tx *sql.Tx) (*LoginFailure, error) {
+		return a.loginFailureTx(tx, userID)
 	})
 }
 
-func (a *Manager) createTokenTx(tx *sql.Tx, userID, token, label string, expires time.Time, origin netip.Addr, provisioned bool) (*Token, error) {
-	access := time.Now()
-	if _, err := tx.Exec(upsertTokenQuery, userID, token, label, access.Unix(), origin.String(), expires.Unix(), provisioned); err != nil {
+func (a *Manager) loginFailureTx(tx *sql.Tx, userID string) (*LoginFailure, error) {
+	var failures int
+	var lastFailure, lockedUntil int64
+	if err := tx.QueryRow(selectLoginFailureQuery, userID).Scan(&failures, &lastFailure, &lockedUntil); errors.Is(err, sql.ErrNoRows) {
+		return &LoginFailure{}, nil
+	} else if err != nil {
 		return nil, err
 	}
-	rows, err := tx.Query(selectTokenCountQuery, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return nil, errNoRows
-	}
-	var tokenCount int
-	if err := rows.Scan(&tokenCount); err != nil {
-		return nil, err
-	}
-	if tokenCount >= tokenMaxCount {
-		// This pruning logic is done in two queries for efficiency. The SELECT above is a lookup
-		// on two indices, whereas the query below is a full table scan.
-		if _, err := tx.Exec(deleteExcessTokensQuery, userID, userID, tokenMaxCount); err != nil {
-			return nil, err
-		}
-	}
-	return &Token{
-		Value:       token,
-		Label:       label,
-		LastAccess:  access,
-		LastOrigin:  origin,
-		Expires:     expires,
-		Provisioned: provisioned,
+	return &LoginFailure{
+		Failures:    failures,
+		LastFailure: time.Unix(lastFailure, 0),
+		LockedUntil: time.Unix(lockedUntil, 0),
 	}, nil
 }
 
-// Tokens returns all existing tokens for the user with the given user ID
-func (a *Manager) Tokens(userID string) ([]*Token, error) {
-	rows, err := a.db.Query(selectTokensQuery, userID)
-	if err != nil {
-		return nil, err
-	}
+// AuthFailed records a failed login attempt for the user with the given user ID, and returns the updated
+// state. Once LoginFailureLimit consecutive attempts have failed, the user is locked for LoginLockDuration,
+// and the lock duration doubles with every further failed attempt, up to LoginLockMaxDuration. Failures
+// that are older than LoginLockMaxDuration are forgotten.
+func (a *Manager) AuthFailed(userID string) (*LoginFailure, error) {
+	return queryTx(a.db, func(tx *sql.Tx) (*LoginFailure, error) {
+		failure, err := a.loginFailureTx(tx, userID)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		if failure.LastFailure.Before(now.Add(-a.config.LoginLockMaxDuration)) {
+			failure.Failures = 0
+		}
+		failure.Failures++
+		failure.LastFailure = now
+		if failure.Failures >= a.config.LoginFailureLimit {
+			failure.LockedUntil = now.Add(a.loginLockDuration(failure.Failures))
+		}
+		if _, err := tx.Exec(upsertLoginFailureQuery, userID, failure.Failures, failure.LastFailure.Unix(), failure.LockedUntil.Unix()); err != nil {
+			return nil, err
+		}
+		return failure, nil
+	})
+}
+
+// loginLockDuration returns the exponentially increasing lock duration for the given number of failures
+func (a *Manager) loginLockDuration(failures int) time.Duration {
+	duration := a.config.LoginLockDuration
+	for i := a.config.LoginFailureLimit; i < failures && duration < a.config.LoginLockMaxDuration; i++ {
+		duration *= 2
+	}
+	return min(duration, a.config.LoginLockMaxDuration)
+}
+
+// ResetLoginFailures removes all failed login attempts for the user with the given user ID, and
+// thereby also unlocks the user. It is called after a successful login, or by an admin.
+func (a *Manager) ResetLoginFailures(userID string) error {
+	if _, err := a.db.Exec(deleteLoginFailureQuery, userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LockedUsersCount returns the number of users that are currently locked due to failed login attempts
+func (a *Manager) LockedUsersCount() (int64, error) {
+	var count int64
+	if err := a.db.QueryRow(selectLockedUsersCountQuery, time.Now().Unix()).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// RemoveExpiredLoginFailures deletes failed login attempts that are no longer relevant, i.e.
+// the user is not locked anymore, and the last failure is older than LoginLockMaxDuration
+func (a *Manager) RemoveExpiredLoginFailures() error {
+	now := time.Now()
+	if _, err := a.db.Exec(deleteExpiredLoginFailureQuery, now.Unix(), now.Add(-a.config.LoginLockMaxDuration).Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SuspendUser suspends the user with the given user ID until the given time, or indefinitely if until
+// is zero. Suspending an already suspended user replaces the suspension. All access tokens of the user
+// are deleted, and Authenticate and AuthenticateToken fail with ErrUserSuspended while it is active.
+func (a *Manager) SuspendUser(userID, reason, suspendedBy string, until time.Time) error {
+	var suspendedUntil int64
+	if !until.IsZero() {
+		suspendedUntil = until.Unix()
+	}
+	return execTx(a.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(upsertSuspensionQuery, userID, reason, suspendedBy, time.Now().Unix(), suspendedUntil); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(deleteAllTokenQuery, userID); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// UnsuspendUser lifts the suspension of the user with the given user ID, if any
+func (a *Manager) UnsuspendUser(userID string) error {
+	if _, err := a.db.Exec(deleteSuspensionQuery, userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RemoveExpiredSuspensions lifts all suspensions that have reached their expiry time
+func (a *Manager) RemoveExpiredSuspensions() error {
+	if _, err := a.db.Exec(deleteExpiredSuspensionsQuery, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UserByOIDCSubject returns the user that is linked to the given OpenID Connect issuer and subject
+// (see LinkOIDCSubject), or ErrUserNotFound if no user is linked
+func (a *Manager) UserByOIDCSubject(issuer, subject string) (*User, error) {
+	var userID string
+	if err := a.db.QueryRow(selectUserIDByOIDCSubjectQuery, issuer, subject).Scan(&userID); errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return a.UserByID(userID)
+}
+
+// LinkOIDCSubject links the user with the given user ID to an OpenID Connect issuer and subject, so that
+// single sign-on logins with that identity log in as this user. An existing link of the user is replaced.
+// If the identity is already linked to another user, ErrOIDCSubjectLinked is returned.
+func (a *Manager) LinkOIDCSubject(userID, issuer, subject string) error {
+	return execTx(a.db, func(tx *sql.Tx) error {
+		var linkedUserID string
+		if err := tx.QueryRow(selectUserIDByOIDCSubjectQuery, issuer, subject).Scan(&linkedUserID); err == nil && linkedUserID != userID {
+			return ErrOIDCSubjectLinked
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if _, err := tx.Exec(upsertOIDCSubjectQuery, userID, issuer, subject); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// UnlinkOIDCSubject removes the OpenID Connect link of the user with the given user ID, if any
+func (a *Manager) UnlinkOIDCSubject(userID string) error {
+	if _, err := a.db.Exec(deleteOIDCSubjectQuery, userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LinkLDAPUser marks the user with the given user ID as created from the LDAP directory entry with
+// the given DN. Only linked users can be logged in (and synced) by the directory.
+func (a *Manager) LinkLDAPUser(userID, dn string) error {
+	if _, err := a.db.Exec(upsertLDAPUserQuery, userID, dn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LDAPUserLinked returns true if the user with the given user ID was created from the LDAP directory
+// (see LinkLDAPUser), and false if it is a local user
+func (a *Manager) LDAPUserLinked(userID string) (bool, error) {
+	var count int
+	if err := a.db.QueryRow(selectLDAPUserCountQuery, userID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// AddAuditEntry appends an entry to the audit log. If the entry's time is not set, the current time is used.
+func (a *Manager) AddAuditEntry(entry *AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	detail := "{}"
+	if len(entry.Detail) > 0 {
+		b, err := json.Marshal(entry.Detail)
+		if err != nil {
+			return err
+		}
+		detail = string(b)
+	}
+	ip := ""
+	if entry.IP.IsValid() {
+		ip = entry.IP.String()
+	}
+	if _, err := a.db.Exec(insertAuditEntryQuery, entry.Time.Unix(), entry.Actor, entry.Action, entry.Target, ip, entry.UserAgent, detail); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AuditEntries returns the entries from the audit log matching the given filter, newest first
+func (a *Manager) AuditEntries(filter *AuditFilter) ([]*AuditEntry, error) {
+	entries := make([]*AuditEntry, 0)
+	if err := a.ForEachAuditEntry(filter, func(entry *AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ForEachAuditEntry calls f for each entry from the audit log matching the given filter, newest first,
+// without loading all entries into memory. If f returns an error, the iteration stops and the error
+// is returned.
+func (a *Manager) ForEachAuditEntry(filter *AuditFilter, f func(entry *AuditEntry) error) error {
+	var where []string
+	var args []any
+	if filter.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		where = append(where, `(action = ? OR action LIKE ? ESCAPE '\')`)
+		args = append(args, filter.Action, escapeLike(filter.Action)+".%")
+	}
+	if filter.Target != "" {
+		where = append(where, "target = ?")
+		args = append(args, filter.Target)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "time <= ?")
+		args = append(args, filter.Until.Unix())
+	}
+	if filter.Before > 0 {
+		where = append(where, "id < ?")
+		args = append(args, filter.Before)
+	}
+	query := selectAuditEntriesQuery
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, timestamp int64
+		var actor, action, target, ip, userAgent, detail string
+		if err := rows.Scan(&id, &timestamp, &actor, &action, &target, &ip, &userAgent, &detail); err != nil {
+			return err
+		}
+		entry := &AuditEntry{
+			ID:        id,
+			Time:      time.Unix(timestamp, 0),
+			Actor:     actor,
+			Action:    action,
+			Target:    target,
+			UserAgent: userAgent,
+		}
+		if ip != "" {
+			entry.IP, _ = netip.ParseAddr(ip)
+		}
+		if err := json.Unmarshal([]byte(detail), &entry.Detail); err != nil {
+			return err
+		}
+		if err := f(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// AuthenticateToken checks if the token exists and returns the associated User if it does.
+// The method sets the User.Token value to the token that was used for authentication.
+func (a *Manager) AuthenticateToken(token string) (*User, error) {
+	if len(token) != tokenLength {
+		return nil, ErrUnauthenticated
+	}
+	user, err := a.userByToken(token)
+	if err != nil {
+		log.Tag(tag).Field("token", token).Err(err).Trace("Authentication of token failed")
+		return nil, ErrUnauthenticated
+	} else if user.Suspended() {
+		log.Tag(tag).Field("token", token).Trace("Authentication of token failed: user suspended")
+		return nil, ErrUserSuspended
+	}
+	user.Token = token
+	return user, nil
+}
+
+// CreateToken generates a random token for the given user and returns it. The token expires
+// after a fixed duration unless ChangeToken is called. This function also prunes tokens for the
+// given user, if there are too many of them.
+func (a *Manager) CreateToken(userID, label string, expires time.Time, origin netip.Addr, provisioned bool) (*Token, error) {
+	return queryTx(a.db, func(tx *sql.Tx) (*Token, error) {
+		return a.createTokenTx(tx, userID, GenerateToken(), label, expires, origin, provisioned)
+	})
+}
+
+func (a *Manager) createTokenTx(tx *sql.Tx, userID, token, label string, expires time.Time, origin netip.Addr, provisioned bool) (*Token, error) {
+	access := time.Now()
+	if _, err := tx.Exec(upsertTokenQuery, userID, token, label, access.Unix(), origin.String(), expires.Unix(), provisioned); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(selectTokenCountQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, errNoRows
+	}
+	var tokenCount int
+	if err := rows.Scan(&tokenCount); err != nil {
+		return nil, err
+	}
+	if tokenCount >= tokenMaxCount {
+		// This pruning logic is done in two queries for efficiency. The SELECT above is a lookup
+		// on two indices, whereas the query below is a full table scan.
+		if _, err := tx.Exec(deleteExcessTokensQuery, userID, userID, tokenMaxCount); err != nil {
+			return nil, err
+		}
+	}
+	return &Token{
+		Value:       token,
+		Label:       label,
+		LastAccess:  access,
+		LastOrigin:  origin,
+		Expires:     expires,
+		Provisioned: provisioned,
+	}, nil
+}
+
+// Tokens returns all existing tokens for the user with the given user ID
+func (a *Manager) Tokens(userID string) ([]*Token, error) {
+	rows, err := a.db.Query(selectTokensQuery, userID)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 	tokens := make([]*Token, 0)
 	for {
@@ -1065,6 +2052,25 @@ func (a *Manager) PhoneNumbers(userID string) ([]string, error) {
 	return phoneNumbers, nil
 }
 
+// UsernamesByPhoneNumber returns the users that verified the given phone number. The same number
+// may be verified by more than one user.
+func (a *Manager) UsernamesByPhoneNumber(phoneNumber string) ([]string, error) {
+	rows, err := a.db.Query(selectUsernamesByPhoneNumberQuery, phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usernames := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
 func (a *Manager) readPhoneNumber(rows *sql.Rows) (string, error) {
 	var phoneNumber string
 	if !rows.Next() {
@@ -1467,10 +2473,12 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, tierID, tierCode, tierName sql.NullString
 	var messages, emails, calls int64
 	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
+	var suspensionReason, suspendedBy sql.NullString
+	var suspendedAt, suspendedUntil sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrUserNotFound
 	}
-	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &provisioned, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &provisioned, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID, &suspensionReason, &suspendedBy, &suspendedAt, &suspendedUntil); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -1520,6 +2528,16 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 			StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
 		}
 	}
+	if suspendedAt.Valid {
+		user.Suspension = &Suspension{
+			Reason:      suspensionReason.String,
+			SuspendedBy: suspendedBy.String,
+			SuspendedAt: time.Unix(suspendedAt.Int64, 0),
+		}
+		if suspendedUntil.Int64 > 0 {
+			user.Suspension.Until = time.Unix(suspendedUntil.Int64, 0)
+		}
+	}
 	return user, nil
 }
 
@@ -2391,71 +3409,305 @@ func migrateFrom8(db *sql.DB) error {
 	return tx.Commit()
 }
 
-// Profile returns the profile for a given username
-func (a *Manager) Profile(username string) (*Profile, error) {
-	row := a.db.QueryRow(selectProfileByUsernameQuery, username)
-	profile := &Profile{}
-	var avatarID string
-	if err := row.Scan(&profile.Username, &profile.DisplayName, &profile.Bio, &avatarID, &profile.LastSeen, &profile.Privacy); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrUserNotFound
-		}
-		return nil, err
+func migrateFrom9(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 9 to 10")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
-	if avatarID != "" {
-		profile.AvatarURL = "/v1/coop/profile/avatar/" + avatarID
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate9To10UpdateQueries); err != nil {
+		return err
 	}
-	return profile, nil
+	if _, err := tx.Exec(updateSchemaVersion, 10); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// ProfileByUserID returns the profile for a given user ID
-func (a *Manager) ProfileByUserID(userID string) (*Profile, error) {
-	row := a.db.QueryRow(selectProfileByUserIDQuery, userID)
-	profile := &Profile{}
-	var avatarID string
-	if err := row.Scan(&profile.DisplayName, &profile.Bio, &avatarID, &profile.LastSeen, &profile.Privacy); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrUserNotFound
-		}
-		return nil, err
+func migrateFrom10(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 10 to 11")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
-	if avatarID != "" {
-		profile.AvatarURL = "/v1/coop/profile/avatar/" + avatarID
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate10To11UpdateQueries); err != nil {
+		return err
 	}
-	return profile, nil
+	if _, err := tx.Exec(updateSchemaVersion, 11); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// ProfilesByTopic returns all profiles for users with access to a topic
-func (a *Manager) ProfilesByTopic(topic string) ([]*Profile, error) {
-	rows, err := a.db.Query(selectProfilesByTopicQuery, topic)
+func migrateFrom11(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 11 to 12")
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	profiles := make([]*Profile, 0)
-	for rows.Next() {
-		profile := &Profile{}
-		var avatarID sql.NullString
-		var displayName, bio sql.NullString
-		var lastSeen sql.NullInt64
-		if err := rows.Scan(&profile.Username, &displayName, &bio, &avatarID, &lastSeen); err != nil {
-			return nil, err
-		}
-		if displayName.Valid {
-			profile.DisplayName = displayName.String
-		}
-		if bio.Valid {
-			profile.Bio = bio.String
-		}
-		if avatarID.Valid && avatarID.String != "" {
-			profile.AvatarURL = "/v1/coop/profile/avatar/" + avatarID.String
-		}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate11To12UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 12); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom12(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 12 to 13")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate12To13UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 13); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom13(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 13 to 14")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate13To14UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 14); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom14(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 14 to 15")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate14To15UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 15); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom15(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 15 to 16")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate15To16UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 16); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom16(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 16 to 17")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate16To17UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 17); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom17(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 17 to 18")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate17To18UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 18); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom18(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 18 to 19")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate18To19UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 19); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom19(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 19 to 20")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate19To20UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 20); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom20(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 20 to 21")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate20To21UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 21); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom21(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 21 to 22")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate21To22UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 22); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Profile returns the profile for a given username
+func (a *Manager) Profile(username string) (*Profile, error) {
+	row := a.db.QueryRow(selectProfileByUsernameQuery, username)
+	profile := &Profile{}
+	var avatarID string
+	var suspendedUntil sql.NullInt64
+	if err := row.Scan(&profile.Username, &profile.DisplayName, &profile.Bio, &avatarID, &profile.LastSeen, &profile.Privacy, &suspendedUntil); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if avatarID != "" {
+		profile.AvatarURL = "/v1/coop/profile/avatar/" + avatarID
+	}
+	setProfileDeactivated(profile, suspendedUntil)
+	return profile, nil
+}
+
+// setProfileDeactivated marks the profile as deactivated if the user has a suspension that has not
+// expired (see Suspension.Active), and hides the presence of the user while it does
+func setProfileDeactivated(profile *Profile, suspendedUntil sql.NullInt64) {
+	if suspendedUntil.Valid && (suspendedUntil.Int64 == 0 || suspendedUntil.Int64 > time.Now().Unix()) {
+		profile.Deactivated = true
+		profile.LastSeen = 0
+	}
+}
+
+// ProfileByUserID returns the profile for a given user ID
+func (a *Manager) ProfileByUserID(userID string) (*Profile, error) {
+	row := a.db.QueryRow(selectProfileByUserIDQuery, userID)
+	profile := &Profile{}
+	var avatarID string
+	if err := row.Scan(&profile.DisplayName, &profile.Bio, &avatarID, &profile.LastSeen, &profile.Privacy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if avatarID != "" {
+		profile.AvatarURL = "/v1/coop/profile/avatar/" + avatarID
+	}
+	return profile, nil
+}
+
+// ProfilesByTopic returns all profiles for users with access to a topic
+func (a *Manager) ProfilesByTopic(topic string) ([]*Profile, error) {
+	rows, err := a.db.Query(selectProfilesByTopicQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	profiles := make([]*Profile, 0)
+	for rows.Next() {
+		profile := &Profile{}
+		var avatarID sql.NullString
+		var displayName, bio sql.NullString
+		var lastSeen, suspendedUntil sql.NullInt64
+		if err := rows.Scan(&profile.Username, &displayName, &bio, &avatarID, &lastSeen, &suspendedUntil); err != nil {
+			return nil, err
+		}
+		if displayName.Valid {
+			profile.DisplayName = displayName.String
+		}
+		if bio.Valid {
+			profile.Bio = bio.String
+		}
+		if avatarID.Valid && avatarID.String != "" {
+			profile.AvatarURL = "/v1/coop/profile/avatar/" + avatarID.String
+		}
 		if lastSeen.Valid {
 			profile.LastSeen = lastSeen.Int64
 		}
+		setProfileDeactivated(profile, suspendedUntil)
 		profiles = append(profiles, profile)
 	}
-	return profiles, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	usernames := make([]string, len(profiles))
+	for i, profile := range profiles {
+		usernames[i] = profile.Username
+	}
+	fingerprints, err := a.DeviceFingerprints(usernames...)
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		profile.Devices = fingerprints[profile.Username]
+	}
+	return profiles, nil
 }
 
 // UpdateProfile updates display_name and bio for a user
@@ -2464,6 +3716,12 @@ func (a *Manager) UpdateProfile(userID, displayName, bio string) error {
 	return err
 }
 
+// UpdateProfileDisplayName updates only the display_name for a user, e.g. when it is synced from a directory
+func (a *Manager) UpdateProfileDisplayName(userID, displayName string) error {
+	_, err := a.db.Exec(updateProfileDisplayNameQuery, displayName, userID)
+	return err
+}
+
 // UpdateProfileAvatar updates the avatar_id for a user
 func (a *Manager) UpdateProfileAvatar(userID, avatarID string) error {
 	_, err := a.db.Exec(updateProfileAvatarQuery, avatarID, userID)
@@ -2517,7 +3775,7 @@ func (a *Manager) AddContact(fromUsername, toUsername, status string) error {
 	return err
 }
 
-// Contacts returns the contact list for a user with a given status
+// Contacts returns the contact list for a user with a given status, favorites first
 func (a *Manager) Contacts(username, status string) ([]*Contact, error) {
 	rows, err := a.db.Query(selectContactsQuery, username, status)
 	if err != nil {
@@ -2526,17 +3784,117 @@ func (a *Manager) Contacts(username, status string) ([]*Contact, error) {
 	defer rows.Close()
 	contacts := make([]*Contact, 0)
 	for rows.Next() {
-		c := &Contact{}
-		var avatarID string
-		if err := rows.Scan(&c.Username, &c.DisplayName, &c.Bio, &avatarID, &c.LastSeen, &c.Status, &c.Nickname, &c.CreatedAt); err != nil {
+		c, err := a.readContact(rows)
+		if err != nil {
 			return nil, err
 		}
-		if avatarID != "" {
-			c.AvatarURL = "/v1/coop/profile/avatar/" + avatarID
-		}
 		contacts = append(contacts, c)
 	}
-	return contacts, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	labels, err := a.contactLabels(username)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range contacts {
+		c.Labels = labels[c.Username]
+	}
+	return contacts, nil
+}
+
+// Contact returns a single contact of a user (with any status), or ErrContactNotFound
+func (a *Manager) Contact(username, contactUsername string) (*Contact, error) {
+	rows, err := a.db.Query(selectContactQuery, username, contactUsername)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, ErrContactNotFound
+	}
+	c, err := a.readContact(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+	labels, err := a.contactLabels(username)
+	if err != nil {
+		return nil, err
+	}
+	c.Labels = labels[c.Username]
+	return c, nil
+}
+
+// UpdateContact sets the nickname, favorite flag and labels a user has given one of their contacts.
+// The labels replace any existing labels.
+func (a *Manager) UpdateContact(username, contactUsername, nickname string, favorite bool, labels []string) error {
+	return execTx(a.db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(updateContactQuery, nickname, favorite, username, contactUsername)
+		if err != nil {
+			return err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return ErrContactNotFound
+		}
+		if _, err := tx.Exec(deleteContactLabelsQuery, username, contactUsername); err != nil {
+			return err
+		}
+		for _, label := range labels {
+			if _, err := tx.Exec(insertContactLabelQuery, username, contactUsername, label); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ContactUsernamesByLabel returns the usernames of the accepted contacts a user has given a label
+func (a *Manager) ContactUsernamesByLabel(username, label string) ([]string, error) {
+	rows, err := a.db.Query(selectContactUsernamesByLabelQuery, username, label)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usernames := make([]string, 0)
+	for rows.Next() {
+		var contactUsername string
+		if err := rows.Scan(&contactUsername); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, contactUsername)
+	}
+	return usernames, rows.Err()
+}
+
+func (a *Manager) readContact(rows *sql.Rows) (*Contact, error) {
+	c := &Contact{}
+	var avatarID string
+	if err := rows.Scan(&c.Username, &c.DisplayName, &c.Bio, &avatarID, &c.LastSeen, &c.Status, &c.Nickname, &c.Favorite, &c.CreatedAt); err != nil {
+		return nil, err
+	}
+	if avatarID != "" {
+		c.AvatarURL = "/v1/coop/profile/avatar/" + avatarID
+	}
+	return c, nil
+}
+
+// contactLabels returns the labels a user has given their contacts, keyed by contact username
+func (a *Manager) contactLabels(username string) (map[string][]string, error) {
+	rows, err := a.db.Query(selectContactLabelsQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	labels := make(map[string][]string)
+	for rows.Next() {
+		var contactUsername, label string
+		if err := rows.Scan(&contactUsername, &label); err != nil {
+			return nil, err
+		}
+		labels[contactUsername] = append(labels[contactUsername], label)
+	}
+	return labels, rows.Err()
 }
 
 // ContactRequests returns pending incoming contact requests for a user
@@ -2601,14 +3959,183 @@ func (a *Manager) BlockContact(fromUsername, toUsername string) error {
 	return a.AddContact(fromUsername, toUsername, ContactStatusBlocked)
 }
 
-// IsBlocked checks if either user has blocked the other
-func (a *Manager) IsBlocked(userA, userB string) (bool, error) {
-	row := a.db.QueryRow(selectIsBlockedQuery, userA, userB, userB, userA)
-	var count int
-	if err := row.Scan(&count); err != nil {
-		return false, err
+// IsBlocked checks if either user has blocked the other
+func (a *Manager) IsBlocked(userA, userB string) (bool, error) {
+	row := a.db.QueryRow(selectIsBlockedQuery, userA, userB, userB, userA)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// BlockerIDs returns the IDs of all users that have blocked the given user
+func (a *Manager) BlockerIDs(userID string) (map[string]bool, error) {
+	return a.contactIDs(selectBlockerIDsQuery, userID)
+}
+
+// BlockedIDs returns the IDs of all users the given user has blocked
+func (a *Manager) BlockedIDs(userID string) (map[string]bool, error) {
+	return a.contactIDs(selectBlockedIDsQuery, userID)
+}
+
+// BlockerNames returns the usernames of all users that have blocked the given user
+func (a *Manager) BlockerNames(userID string) (map[string]bool, error) {
+	return a.contactIDs(selectBlockerNamesQuery, userID)
+}
+
+func (a *Manager) contactIDs(query, userID string) (map[string]bool, error) {
+	rows, err := a.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// AddContactInvite creates a personal contact invite for a user. Redeeming the invite makes the redeeming
+// user and the owner contacts, without a contact request. If expires is zero, the invite does not expire.
+func (a *Manager) AddContactInvite(userID string, maxUses int, expires time.Time) (*ContactInvite, error) {
+	if maxUses <= 0 {
+		return nil, ErrInvalidArgument
+	}
+	now := time.Now()
+	var count int
+	if err := a.db.QueryRow(selectContactInviteCountQuery, userID, now.Unix()).Scan(&count); err != nil {
+		return nil, err
+	} else if count >= contactInvitesMaxCount {
+		return nil, ErrTooManyContactInvites
+	}
+	var expiresUnix int64
+	if !expires.IsZero() {
+		expiresUnix = expires.Unix()
+	}
+	token := util.RandomStringPrefix(contactInvitePrefix, contactInviteLength)
+	if _, err := a.db.Exec(insertContactInviteQuery, token, userID, maxUses, expiresUnix, now.Unix()); err != nil {
+		return nil, err
+	}
+	return a.ContactInvite(token)
+}
+
+// ContactInvite returns the contact invite with the given token, regardless of whether it is still usable
+func (a *Manager) ContactInvite(token string) (*ContactInvite, error) {
+	rows, err := a.db.Query(selectContactInviteQuery, token)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invites, err := readContactInvites(rows)
+	if err != nil {
+		return nil, err
+	} else if len(invites) == 0 {
+		return nil, ErrContactInviteNotFound
+	}
+	return invites[0], nil
+}
+
+// ContactInvites returns all contact invites of a user that have not expired
+func (a *Manager) ContactInvites(userID string) ([]*ContactInvite, error) {
+	rows, err := a.db.Query(selectContactInvitesQuery, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return readContactInvites(rows)
+}
+
+// RemoveContactInvite deletes a contact invite of a user
+func (a *Manager) RemoveContactInvite(userID, token string) error {
+	result, err := a.db.Exec(deleteContactInviteQuery, userID, token)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrContactInviteNotFound
+	}
+	return nil
+}
+
+// RemoveExpiredContactInvites deletes all expired contact invites from the database
+func (a *Manager) RemoveExpiredContactInvites() error {
+	_, err := a.db.Exec(deleteExpiredContactInvites, time.Now().Unix())
+	return err
+}
+
+// RedeemContactInvite redeems a contact invite on behalf of a user, and makes the user and the invite owner
+// accepted contacts in both directions. Any existing request between the two is accepted. If the two are
+// already contacts, the invite is not used up. Blocks must be checked by the caller.
+func (a *Manager) RedeemContactInvite(token, username string) (*ContactInvite, error) {
+	return queryTx(a.db, func(tx *sql.Tx) (*ContactInvite, error) {
+		rows, err := tx.Query(selectContactInviteQuery, token)
+		if err != nil {
+			return nil, err
+		}
+		invites, err := readContactInvites(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		} else if len(invites) == 0 {
+			return nil, ErrContactInviteNotFound
+		}
+		invite := invites[0]
+		if invite.Expired() {
+			return nil, ErrContactInviteExpired
+		} else if invite.Username == username {
+			return nil, ErrInvalidArgument
+		}
+		var userID string
+		if err := tx.QueryRow(selectUserIDFromUsernameQuery, username).Scan(&userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, ErrUserNotFound
+			}
+			return nil, err
+		}
+		var accepted int
+		if err := tx.QueryRow(selectContactAcceptedCountQuery, invite.UserID, userID, userID, invite.UserID).Scan(&accepted); err != nil {
+			return nil, err
+		} else if accepted == 2 {
+			return invite, nil // Already contacts
+		}
+		result, err := tx.Exec(updateContactInviteUsedQuery, token)
+		if err != nil {
+			return nil, err
+		} else if n, _ := result.RowsAffected(); n == 0 {
+			return nil, ErrContactInviteMaxUsed
+		}
+		if _, err := tx.Exec(upsertContactAcceptedQuery, invite.UserID, userID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(upsertContactAcceptedQuery, userID, invite.UserID); err != nil {
+			return nil, err
+		}
+		invite.UsedCount++
+		return invite, nil
+	})
+}
+
+func readContactInvites(rows *sql.Rows) ([]*ContactInvite, error) {
+	invites := make([]*ContactInvite, 0)
+	for rows.Next() {
+		var expires, created int64
+		invite := &ContactInvite{}
+		if err := rows.Scan(&invite.Token, &invite.UserID, &invite.Username, &invite.MaxUses, &invite.UsedCount, &expires, &created); err != nil {
+			return nil, err
+		}
+		if expires > 0 {
+			invite.Expires = time.Unix(expires, 0)
+		}
+		invite.Created = time.Unix(created, 0)
+		invites = append(invites, invite)
 	}
-	return count > 0, nil
+	return invites, rows.Err()
 }
 
 func escapeLike(s string) string {
@@ -2645,7 +4172,7 @@ func (a *Manager) SearchUsers(query, excludeUser string) ([]*UserSearchResult, e
 func (a *Manager) TopicMeta(topic string) (*TopicMeta, error) {
 	row := a.db.QueryRow(selectTopicMetaQuery, topic)
 	meta := &TopicMeta{}
-	if err := row.Scan(&meta.Topic, &meta.DisplayName, &meta.Description, &meta.AvatarID, &meta.CreatedBy, &meta.CreatedAt, &meta.DMUserA, &meta.DMUserB); err != nil {
+	if err := row.Scan(&meta.Topic, &meta.DisplayName, &meta.Description, &meta.AvatarID, &meta.CreatedBy, &meta.CreatedAt, &meta.DMUserA, &meta.DMUserB, &meta.DMRequestTo, &meta.DMRequestCount); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
@@ -2666,6 +4193,48 @@ func (a *Manager) SetDMTopicMeta(topic, userA, userB string) error {
 	return err
 }
 
+// SetDMRequest marks a DM topic as a message request to the given recipient, i.e. the DM was started by
+// someone who is not a contact of the recipient. An empty recipient accepts the request.
+func (a *Manager) SetDMRequest(topic, recipient string) error {
+	result, err := a.db.Exec(updateDMRequestQuery, recipient, topic)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrDMTopicNotFound
+	}
+	return nil
+}
+
+// CountDMRequestMessage counts a message sent in a DM that is a message request, and returns false if the
+// sender already sent limit messages. It returns true if the DM is not a message request.
+func (a *Manager) CountDMRequestMessage(topic string, limit int) (bool, error) {
+	meta, err := a.TopicMeta(topic)
+	if err != nil {
+		return false, err
+	} else if meta == nil || meta.DMRequestTo == "" {
+		return true, nil
+	}
+	result, err := a.db.Exec(updateDMRequestCountQuery, topic, limit)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// ReleaseDMRequestMessage gives back a message counted with CountDMRequestMessage, e.g. because it could not be stored
+func (a *Manager) ReleaseDMRequestMessage(topic string) error {
+	_, err := a.db.Exec(updateDMRequestReleaseQuery, topic)
+	return err
+}
+
+// RemoveDMTopicMeta deletes the metadata of a DM topic, so that a new DM can be started between the two users
+func (a *Manager) RemoveDMTopicMeta(topic string) error {
+	_, err := a.db.Exec(deleteDMTopicMetaQuery, topic)
+	return err
+}
+
 // FindDMTopic finds an existing DM topic between two users, returns "" if none exists
 func (a *Manager) FindDMTopic(userA, userB string) (string, error) {
 	row := a.db.QueryRow(findDMTopicQuery, userA, userB, userB, userA)
@@ -2681,8 +4250,11 @@ func (a *Manager) FindDMTopic(userA, userB string) (string, error) {
 
 // DMTopicEntry represents a DM topic with partner info
 type DMTopicEntry struct {
-	Topic   string
-	Partner string
+	Topic     string
+	Partner   string
+	RequestTo string // Recipient of the message request, empty if the DM was accepted
+	CreatedAt int64
+	Devices   []*DeviceFingerprint // E2E devices of the partner
 }
 
 // DMTopics returns all DM topics for a user with partner usernames
@@ -2694,17 +4266,529 @@ func (a *Manager) DMTopics(username string) ([]*DMTopicEntry, error) {
 	defer rows.Close()
 	entries := make([]*DMTopicEntry, 0)
 	for rows.Next() {
-		var topic, dmUserA, dmUserB string
-		if err := rows.Scan(&topic, &dmUserA, &dmUserB); err != nil {
+		var topic, dmUserA, dmUserB, requestTo string
+		var createdAt int64
+		if err := rows.Scan(&topic, &dmUserA, &dmUserB, &requestTo, &createdAt); err != nil {
 			return nil, err
 		}
 		partner := dmUserA
 		if dmUserA == username {
 			partner = dmUserB
 		}
-		entries = append(entries, &DMTopicEntry{Topic: topic, Partner: partner})
+		entries = append(entries, &DMTopicEntry{Topic: topic, Partner: partner, RequestTo: requestTo, CreatedAt: createdAt})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	partners := make([]string, len(entries))
+	for i, entry := range entries {
+		partners[i] = entry.Partner
+	}
+	fingerprints, err := a.DeviceFingerprints(partners...)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		entry.Devices = fingerprints[entry.Partner]
+	}
+	return entries, nil
+}
+
+// ChatTopics returns all DM and group topics a user takes part in
+func (a *Manager) ChatTopics(username string) ([]string, error) {
+	rows, err := a.db.Query(selectChatTopicsQuery, username, username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make([]string, 0)
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	return topics, rows.Err()
+}
+
+// PublishDeviceKeys adds or updates the public keys of one of the user's devices in the key directory,
+// and adds the given one-time prekeys to the device's pool. identityChanged is true if the user's set of
+// identity keys changed, i.e. if the device is new or its identity key was replaced. In the latter case,
+// all previously published one-time prekeys are discarded.
+func (a *Manager) PublishDeviceKeys(userID string, keys *DeviceKeys, prekeys []*OneTimePrekey) (identityChanged bool, err error) {
+	if !AllowedDeviceID(keys.DeviceID) {
+		return false, ErrInvalidArgument
+	}
+	fingerprint, err := KeyFingerprint(keys.IdentityKey)
+	if err != nil {
+		return false, err
+	}
+	if !validDeviceKey(keys.IdentityKey) || !validDeviceKey(keys.SignedPrekey) || !validDeviceKey(keys.SignedPrekeySignature) {
+		return false, ErrInvalidArgument
+	}
+	for _, prekey := range prekeys {
+		if !validDeviceKey(prekey.PublicKey) {
+			return false, ErrInvalidArgument
+		}
+	}
+	return queryTx(a.db, func(tx *sql.Tx) (bool, error) {
+		var existingIdentityKey string
+		if err := tx.QueryRow(selectDeviceIdentityKeyQuery, userID, keys.DeviceID).Scan(&existingIdentityKey); errors.Is(err, sql.ErrNoRows) {
+			var devices int
+			if err := tx.QueryRow(selectDeviceKeysCountQuery, userID).Scan(&devices); err != nil {
+				return false, err
+			} else if devices >= deviceKeysMaxDevices {
+				return false, ErrTooManyDevices
+			}
+		} else if err != nil {
+			return false, err
+		}
+		if existingIdentityKey != "" && existingIdentityKey != keys.IdentityKey {
+			if _, err := tx.Exec(deleteOneTimePrekeysQuery, userID, keys.DeviceID); err != nil {
+				return false, err
+			}
+		}
+		changed := existingIdentityKey != keys.IdentityKey
+		now := time.Now().Unix()
+		if _, err := tx.Exec(upsertDeviceKeysQuery, userID, keys.DeviceID, keys.IdentityKey, fingerprint, keys.SignedPrekeyID, keys.SignedPrekey, keys.SignedPrekeySignature, now, now); err != nil {
+			return false, err
+		}
+		for _, prekey := range prekeys {
+			if _, err := tx.Exec(insertOneTimePrekeyQuery, userID, keys.DeviceID, prekey.KeyID, prekey.PublicKey); err != nil {
+				return false, err
+			}
+		}
+		var count int
+		if err := tx.QueryRow(selectOneTimePrekeysCountQuery, userID, keys.DeviceID).Scan(&count); err != nil {
+			return false, err
+		} else if count > deviceKeysMaxOneTimePrekeys {
+			return false, ErrTooManyPrekeys
+		}
+		return changed, nil
+	})
+}
+
+// RemoveDeviceKeys removes a device and its one-time prekeys from the key directory
+func (a *Manager) RemoveDeviceKeys(userID, deviceID string) error {
+	return execTx(a.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(deleteOneTimePrekeysQuery, userID, deviceID); err != nil {
+			return err
+		}
+		result, err := tx.Exec(deleteDeviceKeysQuery, userID, deviceID)
+		if err != nil {
+			return err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return ErrDeviceNotFound
+		}
+		return nil
+	})
+}
+
+// DeviceKeys returns the public keys of all of a user's devices, without claiming any one-time prekeys
+func (a *Manager) DeviceKeys(username string) ([]*DeviceKeys, error) {
+	rows, err := a.db.Query(selectDeviceKeysQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]*DeviceKeys, 0)
+	for rows.Next() {
+		d := &DeviceKeys{}
+		if err := rows.Scan(&d.DeviceID, &d.IdentityKey, &d.Fingerprint, &d.SignedPrekeyID, &d.SignedPrekey, &d.SignedPrekeySignature, &d.CreatedAt, &d.UpdatedAt, &d.OneTimePrekeys); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// ClaimPrekeyBundles returns a prekey bundle for each of the user's devices (or only for the given device,
+// if deviceID is not empty). Each bundle atomically claims (removes) one one-time prekey from the device's pool.
+func (a *Manager) ClaimPrekeyBundles(username, deviceID string) ([]*PrekeyBundle, error) {
+	devices, err := a.DeviceKeys(username)
+	if err != nil {
+		return nil, err
+	}
+	if deviceID != "" {
+		devices = slices.DeleteFunc(devices, func(d *DeviceKeys) bool { return d.DeviceID != deviceID })
+		if len(devices) == 0 {
+			return nil, ErrDeviceNotFound
+		}
+	}
+	return queryTx(a.db, func(tx *sql.Tx) ([]*PrekeyBundle, error) {
+		bundles := make([]*PrekeyBundle, 0, len(devices))
+		for _, d := range devices {
+			bundle := &PrekeyBundle{
+				DeviceID:              d.DeviceID,
+				IdentityKey:           d.IdentityKey,
+				Fingerprint:           d.Fingerprint,
+				SignedPrekeyID:        d.SignedPrekeyID,
+				SignedPrekey:          d.SignedPrekey,
+				SignedPrekeySignature: d.SignedPrekeySignature,
+			}
+			prekey := &OneTimePrekey{}
+			if err := tx.QueryRow(claimOneTimePrekeyQuery, username, d.DeviceID).Scan(&prekey.KeyID, &prekey.PublicKey); err == nil {
+				bundle.OneTimePrekey = prekey
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return nil, err
+			}
+			bundles = append(bundles, bundle)
+		}
+		return bundles, nil
+	})
+}
+
+// DeviceFingerprints returns the identity key fingerprints of all devices of the given users, keyed by username
+func (a *Manager) DeviceFingerprints(usernames ...string) (map[string][]*DeviceFingerprint, error) {
+	fingerprints := make(map[string][]*DeviceFingerprint)
+	if len(usernames) == 0 {
+		return fingerprints, nil
+	}
+	args := make([]any, len(usernames))
+	for i, username := range usernames {
+		args[i] = username
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(usernames)), ",")
+	rows, err := a.db.Query(fmt.Sprintf(selectDeviceFingerprintsQuery, placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		d := &DeviceFingerprint{}
+		if err := rows.Scan(&username, &d.DeviceID, &d.Fingerprint); err != nil {
+			return nil, err
+		}
+		fingerprints[username] = append(fingerprints[username], d)
+	}
+	return fingerprints, rows.Err()
+}
+
+// SetKeyBackup stores or replaces the encrypted key backup of a user. Only a hash of the verifier is stored.
+// Replacing a backup resets its failed fetch attempts.
+func (a *Manager) SetKeyBackup(userID string, version int, kdf, data, verifier string) (*KeyBackup, error) {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(decoded) == 0 || verifier == "" || version <= 0 || len(kdf) > keyBackupKDFMaxLength {
+		return nil, ErrInvalidArgument
+	}
+	now := time.Now().Unix()
+	if _, err := a.db.Exec(upsertKeyBackupQuery, userID, version, kdf, hashKeyBackupVerifier(verifier), data, len(decoded), now, now); err != nil {
+		return nil, err
+	}
+	backup, _, err := a.keyBackup(userID)
+	if err != nil {
+		return nil, err
+	}
+	backup.Data = ""
+	return backup, nil
+}
+
+// KeyBackup returns the metadata of a user's key backup, without the encrypted data
+func (a *Manager) KeyBackup(userID string) (*KeyBackup, error) {
+	backup, _, err := a.keyBackup(userID)
+	if err != nil {
+		return nil, err
+	}
+	backup.Data = ""
+	return backup, nil
+}
+
+// VerifyKeyBackup returns a user's key backup including the encrypted data, if the given verifier matches.
+// Failed attempts are counted, and after KeyBackupFailureLimit failures the backup is locked (ErrKeyBackupLocked)
+// for KeyBackupLockDuration. If the verifier does not match, ErrKeyBackupInvalid and the backup's metadata is returned.
+func (a *Manager) VerifyKeyBackup(userID, verifier string) (*KeyBackup, error) {
+	backup, verifierHash, err := a.keyBackup(userID)
+	if err != nil {
+		return nil, err
+	}
+	data := backup.Data
+	backup.Data = ""
+
+	// Every attempt is counted as a failure before the verifier is checked, in a single conditional update,
+	// so that concurrent attempts cannot get past the limit. Successful attempts reset the counter below.
+	now := time.Now()
+	lockStart := now.Add(-KeyBackupLockDuration).Unix()
+	var lastFailure int64
+	err = a.db.QueryRow(updateKeyBackupAttemptQuery, lockStart, now.Unix(), userID, lockStart, KeyBackupFailureLimit).Scan(&backup.Failures, &lastFailure)
+	if errors.Is(err, sql.ErrNoRows) {
+		return backup, ErrKeyBackupLocked
+	} else if err != nil {
+		return nil, err
+	}
+	backup.LastFailure = time.Unix(lastFailure, 0)
+	if subtle.ConstantTimeCompare([]byte(hashKeyBackupVerifier(verifier)), []byte(verifierHash)) != 1 {
+		return backup, ErrKeyBackupInvalid
+	}
+	if _, err := a.db.Exec(updateKeyBackupResetFailuresQuery, userID); err != nil {
+		return nil, err
+	}
+	backup.Failures, backup.LastFailure = 0, time.Unix(0, 0)
+	backup.Data = data
+	return backup, nil
+}
+
+// RemoveKeyBackup deletes a user's key backup
+func (a *Manager) RemoveKeyBackup(userID string) error {
+	result, err := a.db.Exec(deleteKeyBackupQuery, userID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrKeyBackupNotFound
+	}
+	return nil
+}
+
+func (a *Manager) keyBackup(userID string) (backup *KeyBackup, verifierHash string, err error) {
+	var createdAt, updatedAt, lastFailure int64
+	backup = &KeyBackup{}
+	err = a.db.QueryRow(selectKeyBackupQuery, userID).Scan(&backup.Version, &backup.KDF, &verifierHash, &backup.Data, &backup.Size, &backup.Revision, &createdAt, &updatedAt, &backup.Failures, &lastFailure)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrKeyBackupNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+	backup.CreatedAt, backup.UpdatedAt, backup.LastFailure = time.Unix(createdAt, 0), time.Unix(updatedAt, 0), time.Unix(lastFailure, 0)
+	return backup, verifierHash, nil
+}
+
+func hashKeyBackupVerifier(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return hex.EncodeToString(sum[:])
+}
+
+// ContactDevices returns the devices of a contact, along with their verification status as seen by the given user.
+// A device is verified if the user compared its safety number, and the identity key has not changed since.
+func (a *Manager) ContactDevices(username, contactUsername string) ([]*ContactDevice, error) {
+	rows, err := a.db.Query(selectContactDevicesQuery, username, contactUsername)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]*ContactDevice, 0)
+	for rows.Next() {
+		var verifiedFingerprint string
+		var verifiedAt int64
+		device := &ContactDevice{}
+		if err := rows.Scan(&device.DeviceID, &device.Fingerprint, &verifiedFingerprint, &verifiedAt); err != nil {
+			return nil, err
+		}
+		switch verifiedFingerprint {
+		case "":
+			device.Status = VerificationStatusUnverified
+		case device.Fingerprint:
+			device.Status = VerificationStatusVerified
+			device.VerifiedAt = verifiedAt
+		default:
+			device.Status = VerificationStatusChanged
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// VerifyContactDevices marks the given devices of a contact as verified by the user. The fingerprints must match
+// the devices' current identity keys, so that a key change in the meantime is not verified by accident.
+func (a *Manager) VerifyContactDevices(username, contactUsername string, devices []*DeviceFingerprint) error {
+	current, err := a.ContactDevices(username, contactUsername)
+	if err != nil {
+		return err
+	}
+	fingerprints := make(map[string]string)
+	for _, d := range current {
+		fingerprints[d.DeviceID] = d.Fingerprint
+	}
+	for _, d := range devices {
+		fingerprint, ok := fingerprints[d.DeviceID]
+		if !ok {
+			return ErrDeviceNotFound
+		} else if fingerprint != d.Fingerprint {
+			return ErrFingerprintMismatch
+		}
+	}
+	return execTx(a.db, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+		for _, d := range devices {
+			if _, err := tx.Exec(upsertContactVerificationQuery, username, contactUsername, d.DeviceID, d.Fingerprint, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UnverifyContact removes all verification records the user has for a contact's devices
+func (a *Manager) UnverifyContact(username, contactUsername string) error {
+	_, err := a.db.Exec(deleteContactVerificationsQuery, username, contactUsername)
+	return err
+}
+
+func validDeviceKey(key string) bool {
+	if key == "" || len(key) > deviceKeyMaxLength {
+		return false
+	}
+	_, err := base64.StdEncoding.DecodeString(key)
+	return err == nil
+}
+
+// AddReport stores a new abuse report, and sets its ID, status and timestamps. Each reporter can only
+// have a limited number of open reports, see ErrTooManyReports.
+func (a *Manager) AddReport(report *Report) error {
+	var count int
+	if err := a.db.QueryRow(selectReportOpenCountQuery, report.Reporter).Scan(&count); err != nil {
+		return err
+	} else if count >= reportsMaxOpenCount {
+		return ErrTooManyReports
+	}
+	now := time.Now()
+	report.ID = util.RandomStringPrefix(reportIDPrefix, reportIDLength)
+	report.Status = ReportStatusOpen
+	report.Created, report.Updated = now, now
+	report.Actions = make([]*ReportAction, 0)
+	var snapshotExpires int64
+	if !report.SnapshotExpires.IsZero() {
+		snapshotExpires = report.SnapshotExpires.Unix()
+	}
+	if _, err := a.db.Exec(insertReportQuery, report.ID, report.Reporter, string(report.Type), report.Topic, report.MessageID, report.ReportedUser, report.Category, report.Comment, report.Snapshot, snapshotExpires, string(report.Status), now.Unix(), now.Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Report returns the report with the given ID, including the actions taken on it
+func (a *Manager) Report(id string) (*Report, error) {
+	reports, err := a.queryReports(selectReportsQuery+" WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	} else if len(reports) == 0 {
+		return nil, ErrReportNotFound
+	}
+	return reports[0], nil
+}
+
+// Reports returns the reports matching the given filter, newest first, including the actions taken on them
+func (a *Manager) Reports(filter *ReportFilter) ([]*Report, error) {
+	var where []string
+	var args []any
+	if filter.Reporter != "" {
+		where = append(where, "reporter = ?")
+		args = append(args, filter.Reporter)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, string(filter.Status))
+	}
+	query := selectReportsQuery
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created DESC, id"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	return a.queryReports(query, args...)
+}
+
+// ReportsWithExpiredSnapshots returns the resolved or dismissed reports in which at least one message of the
+// snapshot has expired, see SetReportSnapshot. Snapshots of open reports are kept until a moderator gets to them.
+func (a *Manager) ReportsWithExpiredSnapshots() ([]*Report, error) {
+	return a.queryReports(selectReportsQuery+" WHERE status != ? AND snapshot_expires > 0 AND snapshot_expires <= ?", string(ReportStatusOpen), time.Now().Unix())
+}
+
+// SetReportSnapshot replaces the snapshot of a report, and the time at which its first message expires
+// (zero if none of the messages expire)
+func (a *Manager) SetReportSnapshot(reportID, snapshot string, expires time.Time) error {
+	var expiresUnix int64
+	if !expires.IsZero() {
+		expiresUnix = expires.Unix()
+	}
+	result, err := a.db.Exec(updateReportSnapshotQuery, snapshot, expiresUnix, reportID)
+	if err != nil {
+		return err
+	} else if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrReportNotFound
+	}
+	return nil
+}
+
+// AddReportAction records an action taken by an admin on a report, and changes the status of the report.
+// It returns the updated report.
+func (a *Manager) AddReportAction(reportID, action, actor, note string, status ReportStatus) (*Report, error) {
+	err := execTx(a.db, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+		result, err := tx.Exec(updateReportStatusQuery, string(status), now, reportID)
+		if err != nil {
+			return err
+		} else if rows, _ := result.RowsAffected(); rows == 0 {
+			return ErrReportNotFound
+		}
+		if _, err := tx.Exec(insertReportActionQuery, reportID, action, actor, note, now); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.Report(reportID)
+}
+
+func (a *Manager) queryReports(query string, args ...any) ([]*Report, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reports := make([]*Report, 0)
+	for rows.Next() {
+		var reportType, status string
+		var snapshotExpires, created, updated int64
+		report := &Report{}
+		if err := rows.Scan(&report.ID, &report.Reporter, &reportType, &report.Topic, &report.MessageID, &report.ReportedUser, &report.Category, &report.Comment, &report.Snapshot, &snapshotExpires, &status, &created, &updated); err != nil {
+			return nil, err
+		}
+		if snapshotExpires > 0 {
+			report.SnapshotExpires = time.Unix(snapshotExpires, 0)
+		}
+		report.Type = ReportType(reportType)
+		report.Status = ReportStatus(status)
+		report.Created = time.Unix(created, 0)
+		report.Updated = time.Unix(updated, 0)
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	for _, report := range reports {
+		if report.Actions, err = a.reportActions(report.ID); err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+func (a *Manager) reportActions(reportID string) ([]*ReportAction, error) {
+	rows, err := a.db.Query(selectReportActionsQuery, reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	actions := make([]*ReportAction, 0)
+	for rows.Next() {
+		var timestamp int64
+		action := &ReportAction{}
+		if err := rows.Scan(&action.ID, &action.Action, &action.Actor, &action.Note, &timestamp); err != nil {
+			return nil, err
+		}
+		action.Time = time.Unix(timestamp, 0)
+		actions = append(actions, action)
 	}
-	return entries, rows.Err()
+	return actions, rows.Err()
 }
 
 func nullString(s string) sql.NullString {
@@ -2,6 +2,7 @@ package user
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
@@ -9,6 +10,7 @@ import (
 	"net/netip"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -360,6 +362,816 @@ func TestManager_ChangePassword(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestManager_AuthFailed_LockAndReset(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	a.config.LoginFailureLimit = 3
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	u, err := a.User("phil")
+	require.Nil(t, err)
+
+	// Below the limit, the user is not locked
+	for i := 1; i < 3; i++ {
+		failure, err := a.AuthFailed(u.ID)
+		require.Nil(t, err)
+		require.Equal(t, i, failure.Failures)
+		require.False(t, failure.Locked())
+	}
+
+	// Reaching the limit locks the user, even with the correct password
+	failure, err := a.AuthFailed(u.ID)
+	require.Nil(t, err)
+	require.True(t, failure.Locked())
+	require.InDelta(t, time.Now().Add(time.Minute).Unix(), failure.LockedUntil.Unix(), 2)
+	_, err = a.Authenticate("phil", "phil")
+	require.Equal(t, ErrUserLocked, err)
+	_, err = a.Authenticate("phil", "wrong")
+	require.Equal(t, ErrUserLocked, err)
+
+	lockedCount, err := a.LockedUsersCount()
+	require.Nil(t, err)
+	require.Equal(t, int64(1), lockedCount)
+
+	// Resetting unlocks the user
+	require.Nil(t, a.ResetLoginFailures(u.ID))
+	failure, err = a.LoginFailure(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, 0, failure.Failures)
+	require.False(t, failure.Locked())
+	_, err = a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+}
+
+func TestManager_Authenticate_ResetsLoginFailures(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	u, err := a.User("phil")
+	require.Nil(t, err)
+
+	_, err = a.AuthFailed(u.ID)
+	require.Nil(t, err)
+	_, err = a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+
+	failure, err := a.LoginFailure(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, 0, failure.Failures)
+}
+
+func TestManager_Authenticate_RecordsLoginFailures(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	a.config.LoginFailureLimit = 2
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = a.Authenticate("ben", "wrong")
+		require.Equal(t, ErrUnauthenticated, err)
+	}
+	failure, err := a.LoginFailure(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, 2, failure.Failures)
+	_, err = a.Authenticate("ben", "ben")
+	require.Equal(t, ErrUserLocked, err)
+}
+
+func TestManager_AuthFailed_ExponentialLockDuration(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	a.config.LoginFailureLimit = 2
+	a.config.LoginLockDuration = time.Minute
+	a.config.LoginLockMaxDuration = 5 * time.Minute
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	u, err := a.User("phil")
+	require.Nil(t, err)
+
+	expected := []time.Duration{0, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for _, duration := range expected {
+		failure, err := a.AuthFailed(u.ID)
+		require.Nil(t, err)
+		if duration == 0 {
+			require.False(t, failure.Locked())
+		} else {
+			require.InDelta(t, time.Now().Add(duration).Unix(), failure.LockedUntil.Unix(), 2)
+		}
+	}
+}
+
+func TestManager_RemoveExpiredLoginFailures(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	u, err := a.User("phil")
+	require.Nil(t, err)
+
+	_, err = a.AuthFailed(u.ID)
+	require.Nil(t, err)
+	_, err = a.db.Exec("UPDATE user_login_failure SET last_failure = ?", time.Now().Add(-2*time.Hour).Unix())
+	require.Nil(t, err)
+	require.Nil(t, a.RemoveExpiredLoginFailures())
+
+	failure, err := a.LoginFailure(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, 0, failure.Failures)
+}
+
+func TestManager_SuspendUser(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin, false))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+	require.False(t, u.Suspended())
+	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), false)
+	require.Nil(t, err)
+
+	// Suspending deletes all tokens, and rejects logins with the correct password only
+	until := time.Now().Add(time.Hour)
+	require.Nil(t, a.SuspendUser(u.ID, "spam", "phil", until))
+	u, err = a.User("ben")
+	require.Nil(t, err)
+	require.True(t, u.Suspended())
+	require.Equal(t, "spam", u.Suspension.Reason)
+	require.Equal(t, "phil", u.Suspension.SuspendedBy)
+	require.Equal(t, until.Unix(), u.Suspension.Until.Unix())
+	require.InDelta(t, time.Now().Unix(), u.Suspension.SuspendedAt.Unix(), 2)
+	_, err = a.Authenticate("ben", "ben")
+	require.Equal(t, ErrUserSuspended, err)
+	_, err = a.Authenticate("ben", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.AuthenticateToken(token.Value)
+	require.Equal(t, ErrUnauthenticated, err)
+	tokens, err := a.Tokens(u.ID)
+	require.Nil(t, err)
+	require.Empty(t, tokens)
+
+	// The profile shows the user as deactivated
+	require.Nil(t, a.UpdateProfileLastSeen(u.ID, time.Now().Unix()))
+	profile, err := a.Profile("ben")
+	require.Nil(t, err)
+	require.True(t, profile.Deactivated)
+	require.Zero(t, profile.LastSeen)
+	profiles, err := a.ProfilesByTopic("mytopic")
+	require.Nil(t, err)
+	require.Len(t, profiles, 1)
+	require.True(t, profiles[0].Deactivated)
+
+	// Suspending indefinitely replaces the suspension
+	require.Nil(t, a.SuspendUser(u.ID, "more spam", "phil", time.Time{}))
+	u, err = a.User("ben")
+	require.Nil(t, err)
+	require.True(t, u.Suspended())
+	require.Equal(t, "more spam", u.Suspension.Reason)
+	require.True(t, u.Suspension.Until.IsZero())
+
+	// Lifting the suspension allows logins again
+	require.Nil(t, a.UnsuspendUser(u.ID))
+	u, err = a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Nil(t, u.Suspension)
+	profile, err = a.Profile("ben")
+	require.Nil(t, err)
+	require.False(t, profile.Deactivated)
+}
+
+func TestManager_RemoveExpiredSuspensions(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	require.Nil(t, a.AddUser("emma", "emma", RoleUser, false))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	emma, err := a.User("emma")
+	require.Nil(t, err)
+
+	// An expired suspension is not active anymore, even before it is removed
+	require.Nil(t, a.SuspendUser(ben.ID, "spam", "phil", time.Now().Add(-time.Second)))
+	require.Nil(t, a.SuspendUser(emma.ID, "spam", "phil", time.Time{}))
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.NotNil(t, ben.Suspension)
+	require.False(t, ben.Suspended())
+	_, err = a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+
+	// Expired suspensions are removed, indefinite ones are kept
+	require.Nil(t, a.RemoveExpiredSuspensions())
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, ben.Suspension)
+	emma, err = a.User("emma")
+	require.Nil(t, err)
+	require.True(t, emma.Suspended())
+}
+
+func TestManager_Reports(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	require.Nil(t, a.AddUser("emma", "emma", RoleUser, false))
+
+	report := &Report{
+		Reporter:     "ben",
+		Type:         ReportTypeMessage,
+		Topic:        "mytopic",
+		MessageID:    "msg123",
+		ReportedUser: "emma",
+		Category:     "spam",
+		Comment:      "buy my stuff",
+		Snapshot:     `[{"id":"msg123","message":"buy my stuff"}]`,
+	}
+	require.Nil(t, a.AddReport(report))
+	require.NotEmpty(t, report.ID)
+	require.Equal(t, ReportStatusOpen, report.Status)
+	require.Nil(t, a.AddReport(&Report{Reporter: "emma", Type: ReportTypeGroup, Topic: "othertopic", Category: "other", Snapshot: "[]"}))
+
+	// Filter by reporter and status
+	reports, err := a.Reports(&ReportFilter{Reporter: "ben"})
+	require.Nil(t, err)
+	require.Len(t, reports, 1)
+	require.Equal(t, report.ID, reports[0].ID)
+	require.Equal(t, "msg123", reports[0].MessageID)
+	require.Equal(t, "emma", reports[0].ReportedUser)
+	require.Equal(t, report.Snapshot, reports[0].Snapshot)
+	require.Empty(t, reports[0].Actions)
+	reports, err = a.Reports(&ReportFilter{Status: ReportStatusOpen})
+	require.Nil(t, err)
+	require.Len(t, reports, 2)
+
+	// Actions are linked to the report and change its status
+	updated, err := a.AddReportAction(report.ID, "warn", "phil", "first warning", ReportStatusResolved)
+	require.Nil(t, err)
+	require.Equal(t, ReportStatusResolved, updated.Status)
+	require.Len(t, updated.Actions, 1)
+	require.Equal(t, "warn", updated.Actions[0].Action)
+	require.Equal(t, "phil", updated.Actions[0].Actor)
+	require.Equal(t, "first warning", updated.Actions[0].Note)
+	_, err = a.AddReportAction(report.ID, "suspend_user", "phil", "", ReportStatusResolved)
+	require.Nil(t, err)
+	reports, err = a.Reports(&ReportFilter{Status: ReportStatusOpen})
+	require.Nil(t, err)
+	require.Len(t, reports, 1)
+	_, err = a.AddReportAction("re_doesnotexist", "dismiss", "phil", "", ReportStatusDismissed)
+	require.Equal(t, ErrReportNotFound, err)
+
+	// Reports survive the deletion of the reporter and the reported user
+	require.Nil(t, a.RemoveUser("ben"))
+	require.Nil(t, a.RemoveUser("emma"))
+	report, err = a.Report(report.ID)
+	require.Nil(t, err)
+	require.Equal(t, "ben", report.Reporter)
+	require.Len(t, report.Actions, 2)
+	_, err = a.Report("re_doesnotexist")
+	require.Equal(t, ErrReportNotFound, err)
+}
+
+func TestManager_Reports_SnapshotExpiry(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	expiring := &Report{Reporter: "ben", Type: ReportTypeGroup, Topic: "mytopic", Category: "spam", Snapshot: `[{"id":"msg1"}]`, SnapshotExpires: time.Now().Add(-time.Minute)}
+	require.Nil(t, a.AddReport(expiring))
+	require.Nil(t, a.AddReport(&Report{Reporter: "ben", Type: ReportTypeGroup, Topic: "mytopic", Category: "spam", Snapshot: `[{"id":"msg2"}]`, SnapshotExpires: time.Now().Add(time.Hour)}))
+	require.Nil(t, a.AddReport(&Report{Reporter: "ben", Type: ReportTypeGroup, Topic: "mytopic", Category: "spam", Snapshot: "[]"}))
+
+	// Snapshots of open reports are kept
+	reports, err := a.ReportsWithExpiredSnapshots()
+	require.Nil(t, err)
+	require.Empty(t, reports)
+
+	// Only resolved or dismissed reports with an expired snapshot message are returned
+	_, err = a.AddReportAction(expiring.ID, "dismiss", "phil", "", ReportStatusDismissed)
+	require.Nil(t, err)
+	reports, err = a.ReportsWithExpiredSnapshots()
+	require.Nil(t, err)
+	require.Len(t, reports, 1)
+	require.Equal(t, expiring.ID, reports[0].ID)
+	require.Equal(t, expiring.SnapshotExpires.Unix(), reports[0].SnapshotExpires.Unix())
+
+	// Replacing the snapshot resets the expiry
+	require.Nil(t, a.SetReportSnapshot(expiring.ID, "[]", time.Time{}))
+	reports, err = a.ReportsWithExpiredSnapshots()
+	require.Nil(t, err)
+	require.Empty(t, reports)
+	report, err := a.Report(expiring.ID)
+	require.Nil(t, err)
+	require.Equal(t, "[]", report.Snapshot)
+	require.True(t, report.SnapshotExpires.IsZero())
+	require.Equal(t, ErrReportNotFound, a.SetReportSnapshot("re_doesnotexist", "[]", time.Time{}))
+}
+
+func TestManager_Reports_TooManyOpen(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	var first *Report
+	for i := 0; i < reportsMaxOpenCount; i++ {
+		report := &Report{Reporter: "ben", Type: ReportTypeUser, ReportedUser: "emma", Category: "spam", Snapshot: "[]"}
+		require.Nil(t, a.AddReport(report))
+		if first == nil {
+			first = report
+		}
+	}
+	require.Equal(t, ErrTooManyReports, a.AddReport(&Report{Reporter: "ben", Type: ReportTypeUser, ReportedUser: "emma", Category: "spam", Snapshot: "[]"}))
+
+	// Handled reports do not count towards the limit
+	_, err := a.AddReportAction(first.ID, "dismiss", "phil", "", ReportStatusDismissed)
+	require.Nil(t, err)
+	require.Nil(t, a.AddReport(&Report{Reporter: "ben", Type: ReportTypeUser, ReportedUser: "emma", Category: "spam", Snapshot: "[]"}))
+}
+
+func TestManager_AuditEntries(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	ip := netip.MustParseAddr("1.2.3.4")
+	require.Nil(t, a.AddAuditEntry(&AuditEntry{Time: time.Unix(1000, 0), Actor: "phil", Action: "admin.user.create", Target: "ben", IP: ip, UserAgent: "curl/8.0"}))
+	require.Nil(t, a.AddAuditEntry(&AuditEntry{Time: time.Unix(2000, 0), Actor: "phil", Action: "admin.user.delete", Target: "ben", Detail: map[string]any{"reason": "spam"}}))
+	require.Nil(t, a.AddAuditEntry(&AuditEntry{Time: time.Unix(3000, 0), Actor: "", Action: "login.failure", Target: "phil", IP: ip}))
+	require.Nil(t, a.AddAuditEntry(&AuditEntry{Time: time.Unix(4000, 0), Actor: "ben", Action: "administrator", Target: "x"}))
+
+	// All entries, newest first
+	entries, err := a.AuditEntries(&AuditFilter{})
+	require.Nil(t, err)
+	require.Equal(t, 4, len(entries))
+	require.Equal(t, "administrator", entries[0].Action)
+	require.Equal(t, "login.failure", entries[1].Action)
+	require.Equal(t, ip, entries[1].IP)
+	require.Equal(t, "spam", entries[2].Detail["reason"])
+	require.Equal(t, "curl/8.0", entries[3].UserAgent)
+	require.Equal(t, int64(1000), entries[3].Time.Unix())
+
+	// Filters
+	entries, err = a.AuditEntries(&AuditFilter{Action: "admin"})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	entries, err = a.AuditEntries(&AuditFilter{Actor: "phil", Action: "admin.user.delete"})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+	entries, err = a.AuditEntries(&AuditFilter{Target: "ben", Since: time.Unix(1500, 0)})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+	entries, err = a.AuditEntries(&AuditFilter{Until: time.Unix(2000, 0)})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+
+	// Pagination
+	page1, err := a.AuditEntries(&AuditFilter{Limit: 3})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(page1))
+	page2, err := a.AuditEntries(&AuditFilter{Limit: 3, Before: page1[2].ID})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(page2))
+	require.Equal(t, "admin.user.create", page2[0].Action)
+
+	// Append-only
+	_, err = a.db.Exec("UPDATE audit_log SET actor = 'someone-else'")
+	require.Error(t, err)
+	_, err = a.db.Exec("DELETE FROM audit_log")
+	require.Error(t, err)
+	entries, err = a.AuditEntries(&AuditFilter{})
+	require.Nil(t, err)
+	require.Equal(t, 4, len(entries))
+}
+
+func TestManager_DeviceKeys(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+
+	keys := &DeviceKeys{
+		DeviceID:              "laptop",
+		IdentityKey:           "aWRlbnRpdHkx",
+		SignedPrekeyID:        1,
+		SignedPrekey:          "c2lnbmVkMQ==",
+		SignedPrekeySignature: "c2lnMQ==",
+	}
+	prekeys := []*OneTimePrekey{{KeyID: 1, PublicKey: "b3RrMQ=="}, {KeyID: 2, PublicKey: "b3RrMg=="}}
+	changed, err := a.PublishDeviceKeys(phil.ID, keys, prekeys)
+	require.Nil(t, err)
+	require.True(t, changed) // New device
+
+	devices, err := a.DeviceKeys("phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(devices))
+	require.Equal(t, "laptop", devices[0].DeviceID)
+	require.Equal(t, 2, devices[0].OneTimePrekeys)
+	fingerprint, err := KeyFingerprint("aWRlbnRpdHkx")
+	require.Nil(t, err)
+	require.Equal(t, fingerprint, devices[0].Fingerprint)
+	require.Equal(t, 64, len(fingerprint))
+
+	// Each claim consumes one one-time prekey, the last claim has none left
+	bundles, err := a.ClaimPrekeyBundles("phil", "")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(bundles))
+	require.Equal(t, int64(1), bundles[0].OneTimePrekey.KeyID)
+	require.Equal(t, "b3RrMQ==", bundles[0].OneTimePrekey.PublicKey)
+	bundles, err = a.ClaimPrekeyBundles("phil", "laptop")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), bundles[0].OneTimePrekey.KeyID)
+	bundles, err = a.ClaimPrekeyBundles("phil", "laptop")
+	require.Nil(t, err)
+	require.Nil(t, bundles[0].OneTimePrekey)
+	require.Equal(t, "c2lnbmVkMQ==", bundles[0].SignedPrekey)
+	_, err = a.ClaimPrekeyBundles("phil", "phone")
+	require.Equal(t, ErrDeviceNotFound, err)
+
+	// Changing the identity key discards the old one-time prekeys
+	changed, err = a.PublishDeviceKeys(phil.ID, keys, []*OneTimePrekey{{KeyID: 3, PublicKey: "b3RrMw=="}})
+	require.Nil(t, err)
+	require.False(t, changed)
+	keys.IdentityKey = "aWRlbnRpdHky"
+	changed, err = a.PublishDeviceKeys(phil.ID, keys, []*OneTimePrekey{{KeyID: 4, PublicKey: "b3RrNA=="}})
+	require.Nil(t, err)
+	require.True(t, changed)
+	devices, err = a.DeviceKeys("phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, devices[0].OneTimePrekeys)
+	require.NotEqual(t, fingerprint, devices[0].Fingerprint)
+
+	// Invalid keys
+	_, err = a.PublishDeviceKeys(phil.ID, &DeviceKeys{DeviceID: "phone", IdentityKey: "not base64!", SignedPrekey: "eA==", SignedPrekeySignature: "eA=="}, nil)
+	require.Equal(t, ErrInvalidArgument, err)
+	_, err = a.PublishDeviceKeys(phil.ID, &DeviceKeys{DeviceID: "bad/device", IdentityKey: "eA==", SignedPrekey: "eA==", SignedPrekeySignature: "eA=="}, nil)
+	require.Equal(t, ErrInvalidArgument, err)
+
+	// Fingerprints show up in DM and group member lists
+	require.Nil(t, a.SetDMTopicMeta("dm_philben", "ben", "phil"))
+	require.Nil(t, a.AllowAccess("phil", "group1", PermissionReadWrite))
+	require.Nil(t, a.AllowAccess("ben", "group1", PermissionReadWrite))
+	dms, err := a.DMTopics("ben")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(dms))
+	require.Equal(t, "phil", dms[0].Partner)
+	require.Equal(t, []*DeviceFingerprint{{DeviceID: "laptop", Fingerprint: devices[0].Fingerprint}}, dms[0].Devices)
+	profiles, err := a.ProfilesByTopic("group1")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(profiles))
+	for _, profile := range profiles {
+		if profile.Username == "phil" {
+			require.Equal(t, 1, len(profile.Devices))
+		} else {
+			require.Nil(t, profile.Devices)
+		}
+	}
+
+	// Remove device
+	require.Nil(t, a.RemoveDeviceKeys(phil.ID, "laptop"))
+	require.Equal(t, ErrDeviceNotFound, a.RemoveDeviceKeys(phil.ID, "laptop"))
+	devices, err = a.DeviceKeys("phil")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(devices))
+	var count int
+	require.Nil(t, a.db.QueryRow("SELECT COUNT(*) FROM user_device_prekey").Scan(&count))
+	require.Equal(t, 0, count)
+}
+
+func TestManager_DeviceKeys_Limits(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+
+	for i := 0; i < deviceKeysMaxDevices; i++ {
+		_, err := a.PublishDeviceKeys(phil.ID, &DeviceKeys{DeviceID: fmt.Sprintf("device%d", i), IdentityKey: "eA==", SignedPrekey: "eA==", SignedPrekeySignature: "eA=="}, nil)
+		require.Nil(t, err)
+	}
+	_, err = a.PublishDeviceKeys(phil.ID, &DeviceKeys{DeviceID: "onetoomany", IdentityKey: "eA==", SignedPrekey: "eA==", SignedPrekeySignature: "eA=="}, nil)
+	require.Equal(t, ErrTooManyDevices, err)
+
+	prekeys := make([]*OneTimePrekey, deviceKeysMaxOneTimePrekeys+1)
+	for i := range prekeys {
+		prekeys[i] = &OneTimePrekey{KeyID: int64(i), PublicKey: "eA=="}
+	}
+	_, err = a.PublishDeviceKeys(phil.ID, &DeviceKeys{DeviceID: "device0", IdentityKey: "eA==", SignedPrekey: "eA==", SignedPrekeySignature: "eA=="}, prekeys)
+	require.Equal(t, ErrTooManyPrekeys, err)
+	devices, err := a.DeviceKeys("phil")
+	require.Nil(t, err)
+	require.Equal(t, 0, devices[0].OneTimePrekeys) // Rolled back
+}
+
+func TestManager_KeyBackup(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+
+	_, err = a.KeyBackup(phil.ID)
+	require.Equal(t, ErrKeyBackupNotFound, err)
+	_, err = a.SetKeyBackup(phil.ID, 1, "salt", "not base64!", "verifier")
+	require.Equal(t, ErrInvalidArgument, err)
+
+	backup, err := a.SetKeyBackup(phil.ID, 1, `{"salt":"abc"}`, "ZW5jcnlwdGVk", "verifier1")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), backup.Revision)
+	require.Equal(t, int64(9), backup.Size)
+	require.Equal(t, "", backup.Data)
+
+	// Metadata only, and verified fetch with data
+	backup, err = a.KeyBackup(phil.ID)
+	require.Nil(t, err)
+	require.Equal(t, `{"salt":"abc"}`, backup.KDF)
+	require.Equal(t, "", backup.Data)
+	backup, err = a.VerifyKeyBackup(phil.ID, "verifier1")
+	require.Nil(t, err)
+	require.Equal(t, "ZW5jcnlwdGVk", backup.Data)
+
+	// Failed attempts lock the backup, even for the correct verifier
+	for i := 1; i <= KeyBackupFailureLimit; i++ {
+		backup, err = a.VerifyKeyBackup(phil.ID, "wrong")
+		require.Equal(t, ErrKeyBackupInvalid, err)
+		require.Equal(t, "", backup.Data)
+		require.Equal(t, KeyBackupFailureLimit-i, backup.AttemptsLeft())
+	}
+	_, err = a.VerifyKeyBackup(phil.ID, "verifier1")
+	require.Equal(t, ErrKeyBackupLocked, err)
+
+	// Lock expires
+	_, err = a.db.Exec("UPDATE user_key_backup SET last_failure = ?", time.Now().Add(-KeyBackupLockDuration-time.Minute).Unix())
+	require.Nil(t, err)
+	backup, err = a.VerifyKeyBackup(phil.ID, "verifier1")
+	require.Nil(t, err)
+	require.Equal(t, 0, backup.Failures)
+
+	// Replace and remove
+	backup, err = a.SetKeyBackup(phil.ID, 2, "", "bmV3", "verifier2")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), backup.Revision)
+	require.Equal(t, 2, backup.Version)
+	_, err = a.VerifyKeyBackup(phil.ID, "verifier1")
+	require.Equal(t, ErrKeyBackupInvalid, err)
+	require.Nil(t, a.RemoveKeyBackup(phil.ID))
+	require.Equal(t, ErrKeyBackupNotFound, a.RemoveKeyBackup(phil.ID))
+}
+
+func TestManager_KeyBackup_ConcurrentAttempts(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	_, err = a.SetKeyBackup(phil.ID, 1, "", "ZW5jcnlwdGVk", "verifier1")
+	require.Nil(t, err)
+
+	// Concurrent attempts cannot get past the limit
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var invalid, locked int
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.VerifyKeyBackup(phil.ID, "wrong")
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, ErrKeyBackupInvalid) {
+				invalid++
+			} else if errors.Is(err, ErrKeyBackupLocked) {
+				locked++
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, KeyBackupFailureLimit, invalid)
+	require.Equal(t, 50-KeyBackupFailureLimit, locked)
+	_, err = a.VerifyKeyBackup(phil.ID, "verifier1")
+	require.Equal(t, ErrKeyBackupLocked, err)
+}
+
+func TestManager_ContactVerification(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	_, err = a.PublishDeviceKeys(ben.ID, &DeviceKeys{DeviceID: "phone", IdentityKey: "aWQx", SignedPrekey: "c3Br", SignedPrekeySignature: "c2ln"}, nil)
+	require.Nil(t, err)
+	_, err = a.PublishDeviceKeys(ben.ID, &DeviceKeys{DeviceID: "tablet", IdentityKey: "aWQy", SignedPrekey: "c3Br", SignedPrekeySignature: "c2ln"}, nil)
+	require.Nil(t, err)
+
+	devices, err := a.ContactDevices("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(devices))
+	require.Equal(t, VerificationStatusUnverified, devices[0].Status)
+	phone := devices[0]
+	require.Equal(t, "phone", phone.DeviceID)
+
+	// Verify with wrong fingerprint or unknown device fails
+	require.Equal(t, ErrFingerprintMismatch, a.VerifyContactDevices("phil", "ben", []*DeviceFingerprint{{DeviceID: "phone", Fingerprint: "abc"}}))
+	require.Equal(t, ErrDeviceNotFound, a.VerifyContactDevices("phil", "ben", []*DeviceFingerprint{{DeviceID: "watch", Fingerprint: phone.Fingerprint}}))
+
+	// Verify phone; verification is per viewer
+	require.Nil(t, a.VerifyContactDevices("phil", "ben", []*DeviceFingerprint{{DeviceID: "phone", Fingerprint: phone.Fingerprint}}))
+	devices, err = a.ContactDevices("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, VerificationStatusVerified, devices[0].Status)
+	require.True(t, devices[0].VerifiedAt > 0)
+	require.Equal(t, VerificationStatusUnverified, devices[1].Status)
+
+	// Key change turns verified into changed
+	changed, err := a.PublishDeviceKeys(ben.ID, &DeviceKeys{DeviceID: "phone", IdentityKey: "aWQz", SignedPrekey: "c3Br", SignedPrekeySignature: "c2ln"}, nil)
+	require.Nil(t, err)
+	require.True(t, changed)
+	devices, err = a.ContactDevices("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, VerificationStatusChanged, devices[0].Status)
+	require.Equal(t, int64(0), devices[0].VerifiedAt)
+
+	// Unverify
+	require.Nil(t, a.UnverifyContact("phil", "ben"))
+	devices, err = a.ContactDevices("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, VerificationStatusUnverified, devices[0].Status)
+}
+
+func TestManager_BlockerIDs(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	require.Nil(t, a.AddUser("emma", "emma", RoleUser, false))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.AddContact("emma", "ben", ContactStatusAccepted))
+	require.Nil(t, a.BlockContact("phil", "ben"))
+
+	blockers, err := a.BlockerIDs(ben.ID)
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{phil.ID: true}, blockers)
+	blocked, err := a.BlockedIDs(phil.ID)
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{ben.ID: true}, blocked)
+	blockers, err = a.BlockerIDs(phil.ID)
+	require.Nil(t, err)
+	require.Empty(t, blockers)
+	names, err := a.BlockerNames(ben.ID)
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{"phil": true}, names)
+}
+
+func TestManager_ContactInvites(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	require.Nil(t, a.AddUser("emma", "emma", RoleUser, false))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+
+	invite, err := a.AddContactInvite(phil.ID, 1, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(invite.Token, "ci_"))
+	require.Equal(t, "phil", invite.Username)
+	require.True(t, invite.Available())
+
+	// Redeeming makes both users accepted contacts, even if a request was pending
+	require.Nil(t, a.AddContact("ben", "phil", ContactStatusPending))
+	_, err = a.RedeemContactInvite(invite.Token, "phil")
+	require.Equal(t, ErrInvalidArgument, err)
+	redeemed, err := a.RedeemContactInvite(invite.Token, "ben")
+	require.Nil(t, err)
+	require.Equal(t, 1, redeemed.UsedCount)
+	status, err := a.ContactStatus("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, ContactStatusAccepted, status)
+	status, err = a.ContactStatus("ben", "phil")
+	require.Nil(t, err)
+	require.Equal(t, ContactStatusAccepted, status)
+
+	// Redeeming again as an existing contact does not use up the invite, but others cannot redeem it anymore
+	_, err = a.RedeemContactInvite(invite.Token, "ben")
+	require.Nil(t, err)
+	_, err = a.RedeemContactInvite(invite.Token, "emma")
+	require.Equal(t, ErrContactInviteMaxUsed, err)
+
+	// Expired invites cannot be redeemed, and are removed
+	expired, err := a.AddContactInvite(phil.ID, 5, time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+	_, err = a.RedeemContactInvite(expired.Token, "emma")
+	require.Equal(t, ErrContactInviteExpired, err)
+	invites, err := a.ContactInvites(phil.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(invites))
+	require.Nil(t, a.RemoveExpiredContactInvites())
+	_, err = a.ContactInvite(expired.Token)
+	require.Equal(t, ErrContactInviteNotFound, err)
+
+	// Remove
+	require.Nil(t, a.RemoveContactInvite(phil.ID, invite.Token))
+	require.Equal(t, ErrContactInviteNotFound, a.RemoveContactInvite(phil.ID, invite.Token))
+}
+
+func TestManager_ContactLabels(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	for _, username := range []string{"phil", "ben", "alice"} {
+		require.Nil(t, a.AddUser(username, username, RoleUser, false))
+	}
+	require.Nil(t, a.AddContact("phil", "ben", ContactStatusAccepted))
+	require.Nil(t, a.AddContact("phil", "alice", ContactStatusAccepted))
+	require.Equal(t, ErrContactNotFound, a.UpdateContact("ben", "alice", "Al", false, nil))
+
+	// Nickname, favorite and labels
+	require.Nil(t, a.UpdateContact("phil", "ben", "Benny", true, []string{"Work", "Family"}))
+	require.Nil(t, a.UpdateContact("phil", "alice", "", false, []string{"Work"}))
+	contact, err := a.Contact("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, "Benny", contact.Nickname)
+	require.True(t, contact.Favorite)
+	require.Equal(t, []string{"Family", "Work"}, contact.Labels)
+	_, err = a.Contact("ben", "phil")
+	require.Equal(t, ErrContactNotFound, err)
+
+	contacts, err := a.Contacts("phil", ContactStatusAccepted)
+	require.Nil(t, err)
+	require.Len(t, contacts, 2)
+	require.Equal(t, "ben", contacts[0].Username) // Favorites first
+	require.Equal(t, []string{"Work"}, contacts[1].Labels)
+
+	usernames, err := a.ContactUsernamesByLabel("phil", "Work")
+	require.Nil(t, err)
+	require.Equal(t, []string{"alice", "ben"}, usernames)
+
+	// Labels are replaced, and removed with the contact
+	require.Nil(t, a.UpdateContact("phil", "ben", "Benny", true, []string{"Family"}))
+	usernames, err = a.ContactUsernamesByLabel("phil", "Work")
+	require.Nil(t, err)
+	require.Equal(t, []string{"alice"}, usernames)
+	require.Nil(t, a.DeleteContact("phil", "alice"))
+	usernames, err = a.ContactUsernamesByLabel("phil", "Work")
+	require.Nil(t, err)
+	require.Empty(t, usernames)
+	require.Nil(t, a.AddContact("phil", "alice", ContactStatusAccepted))
+	contact, err = a.Contact("phil", "alice")
+	require.Nil(t, err)
+	require.Empty(t, contact.Labels)
+}
+
+func TestManager_DMRequest(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	require.Nil(t, a.SetDMTopicMeta("dm_philben", "ben", "phil"))
+	require.Equal(t, ErrDMTopicNotFound, a.SetDMRequest("grp_friends", "phil"))
+
+	// Not a request: messages are not counted
+	allowed, err := a.CountDMRequestMessage("dm_philben", 2)
+	require.Nil(t, err)
+	require.True(t, allowed)
+
+	// Ben requests a DM with phil, and may send two messages
+	require.Nil(t, a.SetDMRequest("dm_philben", "phil"))
+	entries, err := a.DMTopics("phil")
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "ben", entries[0].Partner)
+	require.Equal(t, "phil", entries[0].RequestTo)
+	for i := 0; i < 2; i++ {
+		allowed, err = a.CountDMRequestMessage("dm_philben", 2)
+		require.Nil(t, err)
+		require.True(t, allowed)
+	}
+	allowed, err = a.CountDMRequestMessage("dm_philben", 2)
+	require.Nil(t, err)
+	require.False(t, allowed)
+	meta, err := a.TopicMeta("dm_philben")
+	require.Nil(t, err)
+	require.Equal(t, 2, meta.DMRequestCount)
+
+	// A message that is not stored is given back
+	require.Nil(t, a.ReleaseDMRequestMessage("dm_philben"))
+	meta, err = a.TopicMeta("dm_philben")
+	require.Nil(t, err)
+	require.Equal(t, 1, meta.DMRequestCount)
+	allowed, err = a.CountDMRequestMessage("dm_philben", 2)
+	require.Nil(t, err)
+	require.True(t, allowed)
+
+	// Accept
+	require.Nil(t, a.SetDMRequest("dm_philben", ""))
+	allowed, err = a.CountDMRequestMessage("dm_philben", 2)
+	require.Nil(t, err)
+	require.True(t, allowed)
+
+	// Remove
+	require.Nil(t, a.RemoveDMTopicMeta("dm_philben"))
+	topic, err := a.FindDMTopic("phil", "ben")
+	require.Nil(t, err)
+	require.Equal(t, "", topic)
+}
+
+func TestManager_ChatTopics(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser, false))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	require.Nil(t, a.SetDMTopicMeta("dm_philben", "ben", "phil"))
+	require.Nil(t, a.SetTopicMeta("grp_friends", "Friends", "", "", "phil"))
+	require.Nil(t, a.SetTopicMeta("grp_other", "Other", "", "", "ben"))
+	require.Nil(t, a.AllowAccess("phil", "grp_friends", PermissionReadWrite))
+	require.Nil(t, a.AllowAccess("ben", "grp_other", PermissionReadWrite))
+	require.Nil(t, a.AllowAccess("phil", "sometopic", PermissionReadWrite))
+
+	topics, err := a.ChatTopics("phil")
+	require.Nil(t, err)
+	require.Equal(t, []string{"dm_philben", "grp_friends"}, topics)
+	topics, err = a.ChatTopics("ben")
+	require.Nil(t, err)
+	require.Equal(t, []string{"dm_philben", "grp_other"}, topics)
+}
+
 func TestManager_ChangeRole(t *testing.T) {
 	a := newTestManager(t, PermissionDenyAll)
 	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
@@ -1070,6 +1882,13 @@ func TestUser_PhoneNumberAdd_Multiple_Users_Same_Number(t *testing.T) {
 	require.Nil(t, err)
 	require.Nil(t, a.AddPhoneNumber(phil.ID, "+1234567890"))
 	require.Nil(t, a.AddPhoneNumber(ben.ID, "+1234567890"))
+
+	usernames, err := a.UsernamesByPhoneNumber("+1234567890")
+	require.Nil(t, err)
+	require.Equal(t, []string{"ben", "phil"}, usernames)
+	usernames, err = a.UsernamesByPhoneNumber("+1999")
+	require.Nil(t, err)
+	require.Empty(t, usernames)
 }
 
 func TestManager_Topic_Wildcard_With_Asterisk_Underscore(t *testing.T) {
@@ -1598,3 +2417,56 @@ func newTestManagerFromFile(t *testing.T, filename, startupQueries string, defau
 	require.Nil(t, err)
 	return a
 }
+
+func TestManager_OIDCSubject(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin, false))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser, false))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+
+	_, err = a.UserByOIDCSubject("https://idp.example.com", "sub-phil")
+	require.Equal(t, ErrUserNotFound, err)
+
+	require.Nil(t, a.LinkOIDCSubject(phil.ID, "https://idp.example.com", "sub-phil"))
+	u, err := a.UserByOIDCSubject("https://idp.example.com", "sub-phil")
+	require.Nil(t, err)
+	require.Equal(t, "phil", u.Name)
+	_, err = a.UserByOIDCSubject("https://other.example.com", "sub-phil")
+	require.Equal(t, ErrUserNotFound, err)
+
+	// Same identity cannot be linked twice, but a user's link can be replaced
+	require.Equal(t, ErrOIDCSubjectLinked, a.LinkOIDCSubject(ben.ID, "https://idp.example.com", "sub-phil"))
+	require.Nil(t, a.LinkOIDCSubject(phil.ID, "https://idp.example.com", "sub-phil2"))
+	_, err = a.UserByOIDCSubject("https://idp.example.com", "sub-phil")
+	require.Equal(t, ErrUserNotFound, err)
+
+	require.Nil(t, a.UnlinkOIDCSubject(phil.ID))
+	_, err = a.UserByOIDCSubject("https://idp.example.com", "sub-phil2")
+	require.Equal(t, ErrUserNotFound, err)
+}
+
+func TestManager_ForEachAuditEntry(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, a.AddAuditEntry(&AuditEntry{Actor: "phil", Action: "login", Target: fmt.Sprintf("t%d", i)}))
+	}
+
+	var targets []string
+	require.Nil(t, a.ForEachAuditEntry(&AuditFilter{Limit: 3}, func(entry *AuditEntry) error {
+		targets = append(targets, entry.Target)
+		return nil
+	}))
+	require.Equal(t, []string{"t4", "t3", "t2"}, targets)
+
+	// Iteration stops at the first error
+	errStop := errors.New("stop")
+	count := 0
+	require.Equal(t, errStop, a.ForEachAuditEntry(&AuditFilter{}, func(entry *AuditEntry) error {
+		count++
+		return errStop
+	}))
+	require.Equal(t, 1, count)
+}
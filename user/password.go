@@ -0,0 +1,101 @@
+package user
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Default password policy values
+const (
+	DefaultPasswordMinLength = 8
+)
+
+// Errors returned by PasswordPolicy.Validate
+var (
+	ErrPasswordTooShort         = errors.New("password too short")
+	ErrPasswordTooSimple        = errors.New("password does not contain enough character classes")
+	ErrPasswordContainsUsername = errors.New("password must not contain the username")
+	ErrPasswordBreached         = errors.New("password appears in a list of breached passwords")
+)
+
+// PasswordPolicy defines the requirements for new passwords. The zero value accepts any password.
+type PasswordPolicy struct {
+	MinLength        int    // Minimum number of characters (0 = no minimum)
+	MinClasses       int    // Minimum number of character classes (lowercase, uppercase, digits, other), 0-4
+	DisallowUsername bool   // Reject passwords that contain the username (case-insensitive)
+	BreachedDir      string // Directory of HIBP range files (<PREFIX>.txt, "SUFFIX:COUNT" lines), optional
+}
+
+// Validate checks the password against the policy, and returns one of the ErrPassword* errors
+// if it does not match. If the breached password directory cannot be read, the error is returned as is.
+func (p *PasswordPolicy) Validate(username, password string) error {
+	if p == nil {
+		return nil
+	}
+	if len([]rune(password)) < p.MinLength {
+		return ErrPasswordTooShort
+	} else if passwordClasses(password) < p.MinClasses {
+		return ErrPasswordTooSimple
+	} else if p.DisallowUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return ErrPasswordContainsUsername
+	}
+	if p.BreachedDir != "" {
+		breached, err := passwordBreached(p.BreachedDir, password)
+		if err != nil {
+			return err
+		} else if breached {
+			return ErrPasswordBreached
+		}
+	}
+	return nil
+}
+
+// passwordClasses returns the number of character classes (lowercase, uppercase, digits, other)
+// that are used in the password
+func passwordClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// passwordBreached checks if the password is contained in the local copy of the "Have I Been Pwned"
+// password list. The list is expected in the k-anonymity range format, i.e. one file per 5-character
+// SHA-1 hash prefix (e.g. 21BD1.txt), with each line containing the remaining hash suffix and the
+// number of occurrences, separated by a colon. Missing prefix files are treated as "not breached".
+func passwordBreached(dir, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+	f, err := os.Open(filepath.Join(dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineSuffix, count, found := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if found && strings.EqualFold(lineSuffix, suffix) {
+			return count != "0", nil // Padding entries have a count of zero
+		}
+	}
+	return false, scanner.Err()
+}
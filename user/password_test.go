@@ -0,0 +1,41 @@
+package user
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	p := &PasswordPolicy{
+		MinLength:        8,
+		MinClasses:       3,
+		DisallowUsername: true,
+	}
+	require.Equal(t, ErrPasswordTooShort, p.Validate("phil", "Ab1!"))
+	require.Equal(t, ErrPasswordTooSimple, p.Validate("phil", "abcdefgh"))
+	require.Equal(t, ErrPasswordTooSimple, p.Validate("phil", "abcdEFGH"))
+	require.Equal(t, ErrPasswordContainsUsername, p.Validate("phil", "xxPHIL123x"))
+	require.Nil(t, p.Validate("phil", "abcdEFGH1"))
+	require.Nil(t, p.Validate("phil", "äöüÄÖÜ-x"))
+}
+
+func TestPasswordPolicy_Validate_Empty(t *testing.T) {
+	var p *PasswordPolicy
+	require.Nil(t, p.Validate("phil", "phil"))
+	require.Nil(t, (&PasswordPolicy{}).Validate("phil", "phil"))
+}
+
+func TestPasswordPolicy_Validate_Breached(t *testing.T) {
+	dir := t.TempDir()
+	// SHA-1("password") = 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	// SHA-1("letmein")  = B7A875FC1EA228B9061041B7CEC4BD3C52AB3CE3
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte("003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\r\n"), 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "B7A87.txt"), []byte("5FC1EA228B9061041B7CEC4BD3C52AB3CE3:0\n"), 0600))
+
+	p := &PasswordPolicy{BreachedDir: dir}
+	require.Equal(t, ErrPasswordBreached, p.Validate("phil", "password"))
+	require.Nil(t, p.Validate("phil", "letmein"))                // Padding entry
+	require.Nil(t, p.Validate("phil", "not-in-any-breach-list")) // Prefix file does not exist
+}
@@ -21,8 +21,14 @@ type User struct {
 	Stats       *Stats
 	Billing     *Billing
 	SyncTopic   string
-	Provisioned bool // Whether the user was provisioned by the config file
-	Deleted     bool // Whether the user was soft-deleted
+	Provisioned bool        // Whether the user was provisioned by the config file
+	Deleted     bool        // Whether the user was soft-deleted
+	Suspension  *Suspension // Set if the user was suspended by an admin, see Suspended
+}
+
+// Suspended returns true if the user has a suspension that has not yet expired
+func (u *User) Suspended() bool {
+	return u != nil && u.Suspension.Active()
 }
 
 // TierID returns the ID of the User.Tier, or an empty string if the user has no tier,
@@ -48,7 +54,8 @@ func (u *User) IsUser() bool {
 type Auther interface {
 	// Authenticate checks username and password and returns a user if correct. The method
 	// returns in constant-ish time, regardless of whether the user exists or the password is
-	// correct or incorrect.
+	// correct or incorrect. Incorrect passwords of existing users are recorded as failed login
+	// attempts (see Manager.AuthFailed).
 	Authenticate(username, password string) (*User, error)
 
 	// Authorize returns nil if the given user has access to the given topic using the desired
@@ -58,36 +65,64 @@ type Auther interface {
 
 // Profile represents a user's public profile (Coop)
 type Profile struct {
-	Username    string `json:"username"`
-	DisplayName string `json:"display_name"`
-	Bio         string `json:"bio"`
-	AvatarURL   string `json:"avatar_url,omitempty"`
-	LastSeen    int64  `json:"last_seen"`
-	Privacy     string `json:"privacy,omitempty"`
+	Username    string               `json:"username"`
+	DisplayName string               `json:"display_name"`
+	Bio         string               `json:"bio"`
+	AvatarURL   string               `json:"avatar_url,omitempty"`
+	LastSeen    int64                `json:"last_seen"`
+	Privacy     string               `json:"privacy,omitempty"`
+	Devices     []*DeviceFingerprint `json:"devices,omitempty"`
+	Deactivated bool                 `json:"deactivated,omitempty"` // Set while the user is suspended
+}
+
+// ContactInvite is a personal invite link of a user (Coop). Redeeming it makes the redeeming user
+// a contact of the owner, even if the owner only accepts contacts via invite.
+type ContactInvite struct {
+	Token     string
+	UserID    string // ID of the owner
+	Username  string // Username of the owner
+	MaxUses   int
+	UsedCount int
+	Expires   time.Time // Zero if the invite does not expire
+	Created   time.Time
+}
+
+// Expired returns true if the invite has an expiry date, and it has passed
+func (i *ContactInvite) Expired() bool {
+	return !i.Expires.IsZero() && i.Expires.Before(time.Now())
+}
+
+// Available returns true if the invite can still be redeemed
+func (i *ContactInvite) Available() bool {
+	return !i.Expired() && i.UsedCount < i.MaxUses
 }
 
 // Contact represents a contact relationship between two users (Coop)
 type Contact struct {
-	Username    string `json:"username"`
-	DisplayName string `json:"display_name,omitempty"`
-	Bio         string `json:"bio,omitempty"`
-	AvatarURL   string `json:"avatar_url,omitempty"`
-	LastSeen    int64  `json:"last_seen,omitempty"`
-	Status      string `json:"status"`
-	Nickname    string `json:"nickname,omitempty"`
-	CreatedAt   int64  `json:"created_at,omitempty"`
+	Username    string   `json:"username"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Bio         string   `json:"bio,omitempty"`
+	AvatarURL   string   `json:"avatar_url,omitempty"`
+	LastSeen    int64    `json:"last_seen,omitempty"`
+	Status      string   `json:"status"`
+	Nickname    string   `json:"nickname,omitempty"`
+	Favorite    bool     `json:"favorite,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	CreatedAt   int64    `json:"created_at,omitempty"`
 }
 
 // TopicMeta represents metadata for a topic/group (Coop)
 type TopicMeta struct {
-	Topic       string `json:"topic"`
-	DisplayName string `json:"display_name"`
-	Description string `json:"description,omitempty"`
-	AvatarID    string `json:"avatar_id,omitempty"`
-	CreatedBy   string `json:"created_by,omitempty"`
-	CreatedAt   int64  `json:"created_at,omitempty"`
-	DMUserA     string `json:"dm_user_a,omitempty"`
-	DMUserB     string `json:"dm_user_b,omitempty"`
+	Topic          string `json:"topic"`
+	DisplayName    string `json:"display_name"`
+	Description    string `json:"description,omitempty"`
+	AvatarID       string `json:"avatar_id,omitempty"`
+	CreatedBy      string `json:"created_by,omitempty"`
+	CreatedAt      int64  `json:"created_at,omitempty"`
+	DMUserA        string `json:"dm_user_a,omitempty"`
+	DMUserB        string `json:"dm_user_b,omitempty"`
+	DMRequestTo    string `json:"dm_request_to,omitempty"`    // Recipient of a pending message request
+	DMRequestCount int    `json:"dm_request_count,omitempty"` // Messages sent while the request is pending
 }
 
 // UserSearchResult represents a user search result (Coop)
@@ -98,6 +133,59 @@ type UserSearchResult struct {
 	AvatarURL   string `json:"avatar_url,omitempty"`
 }
 
+// DeviceKeys is the public key material a device has published to the key directory (Coop).
+// Keys are opaque, base64-encoded blobs; the server stores them but never interprets them.
+type DeviceKeys struct {
+	DeviceID              string `json:"device_id"`
+	IdentityKey           string `json:"identity_key"`
+	Fingerprint           string `json:"fingerprint"`
+	SignedPrekeyID        int64  `json:"signed_prekey_id"`
+	SignedPrekey          string `json:"signed_prekey"`
+	SignedPrekeySignature string `json:"signed_prekey_signature"`
+	OneTimePrekeys        int    `json:"one_time_prekeys"` // Number of unclaimed one-time prekeys
+	CreatedAt             int64  `json:"created_at"`
+	UpdatedAt             int64  `json:"updated_at"`
+}
+
+// OneTimePrekey is a single-use prekey, handed out at most once as part of a PrekeyBundle (Coop)
+type OneTimePrekey struct {
+	KeyID     int64  `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// PrekeyBundle is what a sender needs to start an encrypted session with one of a user's devices (Coop).
+// OneTimePrekey is nil if the device has run out of one-time prekeys.
+type PrekeyBundle struct {
+	DeviceID              string         `json:"device_id"`
+	IdentityKey           string         `json:"identity_key"`
+	Fingerprint           string         `json:"fingerprint"`
+	SignedPrekeyID        int64          `json:"signed_prekey_id"`
+	SignedPrekey          string         `json:"signed_prekey"`
+	SignedPrekeySignature string         `json:"signed_prekey_signature"`
+	OneTimePrekey         *OneTimePrekey `json:"one_time_prekey,omitempty"`
+}
+
+// DeviceFingerprint identifies a device and the fingerprint of its identity key (Coop)
+type DeviceFingerprint struct {
+	DeviceID    string `json:"device_id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ContactDevice is a contact's device, and whether the user verified its identity key (Coop)
+type ContactDevice struct {
+	DeviceID    string `json:"device_id"`
+	Fingerprint string `json:"fingerprint"`
+	Status      string `json:"status"`
+	VerifiedAt  int64  `json:"verified_at,omitempty"`
+}
+
+// Verification status constants for contact devices
+const (
+	VerificationStatusUnverified = "unverified"
+	VerificationStatusVerified   = "verified"
+	VerificationStatusChanged    = "changed" // Verified before, but the identity key changed since
+)
+
 // Contact status constants
 const (
 	ContactStatusPending  = "pending"
@@ -122,6 +210,136 @@ type Token struct {
 	Provisioned bool
 }
 
+// LoginFailure holds the failed login attempts of a user, and until when the user is locked
+type LoginFailure struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Locked returns true if the user is currently locked due to too many failed login attempts
+func (f *LoginFailure) Locked() bool {
+	return f != nil && f.LockedUntil.After(time.Now())
+}
+
+// Suspension holds why, by whom and until when a user was suspended by an admin
+type Suspension struct {
+	Reason      string
+	SuspendedBy string
+	SuspendedAt time.Time
+	Until       time.Time // Zero if the suspension does not expire
+}
+
+// Active returns true if the suspension has not expired yet
+func (s *Suspension) Active() bool {
+	return s != nil && (s.Until.IsZero() || s.Until.After(time.Now()))
+}
+
+// ReportType is the kind of content an abuse report is about
+type ReportType string
+
+// Report types
+const (
+	ReportTypeMessage = ReportType("message")
+	ReportTypeUser    = ReportType("user")
+	ReportTypeGroup   = ReportType("group")
+)
+
+// ReportStatus is the moderation state of an abuse report
+type ReportStatus string
+
+// Report states
+const (
+	ReportStatusOpen      = ReportStatus("open")
+	ReportStatusResolved  = ReportStatus("resolved")
+	ReportStatusDismissed = ReportStatus("dismissed")
+)
+
+// Report is an abuse report filed by a user about a message, a user or a group (Coop). Reporter and
+// ReportedUser are usernames rather than IDs, so that reports survive the deletion of either account.
+type Report struct {
+	ID              string
+	Reporter        string
+	Type            ReportType
+	Topic           string // Empty for user reports without a topic
+	MessageID       string // Only set for message reports
+	ReportedUser    string // Empty if the report is not about a specific user
+	Category        string
+	Comment         string
+	Snapshot        string    // JSON array of the reported messages at the time of the report
+	SnapshotExpires time.Time // Time at which the first message in the snapshot expires, or zero if none expire
+	Status          ReportStatus
+	Created         time.Time
+	Updated         time.Time
+	Actions         []*ReportAction
+}
+
+// ReportAction is an action an admin took on a report, e.g. deleting the reported message
+type ReportAction struct {
+	ID     int64
+	Action string
+	Actor  string
+	Note   string
+	Time   time.Time
+}
+
+// ReportFilter restricts the reports returned by Manager.Reports. Empty fields match all reports.
+type ReportFilter struct {
+	Reporter string
+	Status   ReportStatus
+	Limit    int
+}
+
+// AuditEntry is a single record in the append-only audit log
+type AuditEntry struct {
+	ID        int64
+	Time      time.Time
+	Actor     string // Username of the user performing the action, empty if anonymous
+	Action    string // Dot-separated action, e.g. admin.user.delete
+	Target    string // Affected user, topic, token, etc.
+	IP        netip.Addr
+	UserAgent string
+	Detail    map[string]any
+}
+
+// AuditFilter restricts the entries returned from the audit log. Empty fields are ignored.
+type AuditFilter struct {
+	Actor  string
+	Action string // Matches the action itself and all sub-actions, e.g. "admin" matches "admin.user.delete"
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Before int64 // Only return entries with an ID lower than this, used for pagination
+	Limit  int
+}
+
+// KeyBackup is a user's encrypted E2E key backup (Coop). The data is encrypted on the client with a key derived
+// from a recovery passphrase, and is only handed out to clients that present the verifier derived from the same passphrase.
+type KeyBackup struct {
+	Version     int    // Backup format version, chosen by the client
+	KDF         string // Opaque key derivation parameters (e.g. salt), needed by the client to derive the verifier
+	Data        string // Base64-encoded encrypted backup, only set after the verifier was checked
+	Size        int64  // Size of the decoded data in bytes
+	Revision    int64  // Incremented with every update
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Failures    int // Failed fetch attempts since the last successful fetch
+	LastFailure time.Time
+}
+
+// AttemptsLeft returns the number of fetch attempts left before the backup is locked
+func (b *KeyBackup) AttemptsLeft() int {
+	if b.LastFailure.Before(time.Now().Add(-KeyBackupLockDuration)) {
+		return KeyBackupFailureLimit
+	}
+	return max(0, KeyBackupFailureLimit-b.Failures)
+}
+
+// Locked returns true if the backup is currently locked due to too many failed fetch attempts
+func (b *KeyBackup) Locked() bool {
+	return b.AttemptsLeft() == 0
+}
+
 // TokenUpdate holds information about the last access time and origin IP address of a token
 type TokenUpdate struct {
 	LastAccess time.Time
@@ -153,6 +371,13 @@ type Tier struct {
 	StripeYearlyPriceID      string        // Yearly price ID for paid tiers (price_...)
 }
 
+// TierGroup maps a group of an external identity provider (LDAP directory or OpenID provider) to a tier.
+// Tier groups are matched in the configured order, so the first mapping that matches wins.
+type TierGroup struct {
+	Group string // Group name (or DN, for LDAP)
+	Tier  string // Tier code
+}
+
 // Context returns fields for the log
 func (t *Tier) Context() log.Context {
 	return log.Context{
@@ -314,4 +539,22 @@ var (
 	ErrPhoneNumberExists      = errors.New("phone number already exists")
 	ErrProvisionedUserChange  = errors.New("cannot change or delete provisioned user")
 	ErrProvisionedTokenChange = errors.New("cannot change or delete provisioned token")
+	ErrUserLocked             = errors.New("user temporarily locked due to too many failed login attempts")
+	ErrUserSuspended          = errors.New("user suspended")
+	ErrOIDCSubjectLinked      = errors.New("single sign-on identity is already linked to another user")
+	ErrDeviceNotFound         = errors.New("device not found")
+	ErrTooManyDevices         = errors.New("too many devices")
+	ErrTooManyPrekeys         = errors.New("too many one-time prekeys")
+	ErrKeyBackupNotFound      = errors.New("key backup not found")
+	ErrKeyBackupLocked        = errors.New("key backup temporarily locked due to too many failed attempts")
+	ErrKeyBackupInvalid       = errors.New("incorrect key backup verifier")
+	ErrFingerprintMismatch    = errors.New("fingerprint does not match the current identity key")
+	ErrTooManyContactInvites  = errors.New("too many contact invites")
+	ErrContactInviteNotFound  = errors.New("contact invite not found")
+	ErrContactInviteExpired   = errors.New("contact invite has expired")
+	ErrContactInviteMaxUsed   = errors.New("contact invite has reached maximum uses")
+	ErrDMTopicNotFound        = errors.New("DM topic not found")
+	ErrContactNotFound        = errors.New("contact not found")
+	ErrReportNotFound         = errors.New("report not found")
+	ErrTooManyReports         = errors.New("too many open reports")
 )
@@ -1,6 +1,9 @@
 package user
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/util"
 	"regexp"
@@ -13,6 +16,7 @@ var (
 	allowedTopicPatternRegex = regexp.MustCompile(`^[-_*A-Za-z0-9]{1,64}$`) // Adds '*' for wildcards!
 	allowedTierRegex         = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
 	allowedTokenRegex        = regexp.MustCompile(`^tk_[-_A-Za-z0-9]{29}$`) // Must be tokenLength-len(tokenPrefix)
+	allowedDeviceIDRegex     = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
 )
 
 // AllowedRole returns true if the given role can be used for new users
@@ -40,6 +44,22 @@ func AllowedTier(tier string) bool {
 	return allowedTierRegex.MatchString(tier)
 }
 
+// AllowedDeviceID returns true if the given E2E device ID is valid
+func AllowedDeviceID(deviceID string) bool {
+	return allowedDeviceIDRegex.MatchString(deviceID)
+}
+
+// KeyFingerprint returns the fingerprint of a base64-encoded public key, which is the
+// hex-encoded SHA-256 of the raw key bytes. It returns ErrInvalidArgument if the key cannot be decoded.
+func KeyFingerprint(key string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) == 0 {
+		return "", ErrInvalidArgument
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 // ValidPasswordHash checks if the given password hash is a valid bcrypt hash
 func ValidPasswordHash(hash string, minCost int) error {
 	if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
@@ -11,6 +11,7 @@ var config = {
   enable_login: true,
   require_login: false,
   enable_signup: true,
+  enable_oidc: false,
   enable_payments: false,
   enable_reservations: true,
   enable_emails: true,
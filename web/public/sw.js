@@ -34,7 +34,7 @@ const broadcastChannel = new BroadcastChannel("web-push-broadcast");
  * receives the broadcast and plays a sound (see web/src/app/WebPush.js).
  */
 const handlePushMessage = async (data) => {
-  const { subscription_id: subscriptionId, message } = data;
+  const { subscription_id: subscriptionId, message, preview } = data;
   const db = await dbAsync();
 
   console.log("[ServiceWorker] Message received", data);
@@ -71,9 +71,10 @@ const handlePushMessage = async (data) => {
   // Broadcast the message to potentially play a sound
   broadcastChannel.postMessage(message);
 
+  // Show the plain text preview (e.g. of a markdown message) if the server sent one
   await self.registration.showNotification(
     ...toNotificationParams({
-      message,
+      message: preview ? { ...message, message: preview } : message,
       defaultTitle: message.topic,
       topicRoute: new URL(message.topic, self.location.origin).toString(),
       baseUrl: subscription.baseUrl,
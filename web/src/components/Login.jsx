@@ -1,4 +1,4 @@
-import { useState } from "react";
+import { useEffect, useState } from "react";
 import { Typography, TextField, Button, Box, IconButton, InputAdornment } from "@mui/material";
 import WarningAmberIcon from "@mui/icons-material/WarningAmber";
 import { NavLink } from "react-router-dom";
@@ -36,6 +36,22 @@ const Login = () => {
   const [password, setPassword] = useState("");
   const [showPassword, setShowPassword] = useState(false);
 
+  // Single sign-on: the server redirects back to the login page with the token in the URL fragment
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.hash.substring(1));
+    const oidcToken = params.get("oidc_token");
+    const oidcUsername = params.get("username");
+    if (!oidcToken || !oidcUsername) {
+      return;
+    }
+    window.history.replaceState(null, "", window.location.pathname);
+    (async () => {
+      console.log(`[Login] Single sign-on successful`);
+      await session.store(oidcUsername, oidcToken);
+      window.location.href = routes.app;
+    })();
+  }, []);
+
   const handleSubmit = async (event) => {
     event.preventDefault();
     const user = { username, password };
@@ -140,6 +156,28 @@ const Login = () => {
         >
           {t("login_form_button_submit")}
         </Button>
+        {config.enable_oidc && (
+          <Button
+            fullWidth
+            variant="outlined"
+            href={`${config.base_url}/v1/auth/oidc/login`}
+            sx={{
+              mb: 2,
+              borderRadius: 0,
+              border: "3px solid var(--coop-black)",
+              boxShadow: "var(--coop-shadow)",
+              color: "var(--coop-black)",
+              fontWeight: 700,
+              fontFamily: "'Space Grotesk', sans-serif",
+              "&:hover": {
+                border: "3px solid var(--coop-black)",
+                boxShadow: "var(--coop-shadow-hover)",
+              },
+            }}
+          >
+            {t("login_form_button_sso")}
+          </Button>
+        )}
         {error && (
           <Box
             sx={{